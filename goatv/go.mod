@@ -2,12 +2,17 @@ module github.com/alexjsteffen/goatv
 
 go 1.24.11
 
-require github.com/hashicorp/mdns v1.0.6
+require (
+	filippo.io/bigmod v0.1.0
+	github.com/miekg/dns v1.1.55
+	golang.org/x/crypto v0.32.0
+	golang.org/x/net v0.34.0
+	google.golang.org/protobuf v1.36.5
+	howett.net/plist v1.0.1
+)
 
 require (
-	github.com/miekg/dns v1.1.55 // indirect
 	golang.org/x/mod v0.17.0 // indirect
-	golang.org/x/net v0.34.0 // indirect
 	golang.org/x/sync v0.10.0 // indirect
 	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
@@ -0,0 +1,214 @@
+package pyatv
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"howett.net/plist"
+)
+
+// Legacy AirPlay pairing is used by devices without HAP support, like the
+// Apple TV 3. Pair-setup runs SRP with binary plists on /pair-setup-pin and
+// hands the device our Ed25519 key. Pair-verify proves we still hold that
+// key, but does not give any keys to encrypt the connection with.
+
+// legacyClientIDSize is the length of the identifier we pair with.
+const legacyClientIDSize = 8
+
+// legacyAirPlay returns true if an AirPlay or RAOP service only supports legacy
+// pairing, i.e. it is not an AirPlay 2 receiver. Services that do not say
+// they play video or audio have unknown features and are not assumed to be
+// legacy.
+func legacyAirPlay(service *Service) bool {
+	if service.Protocol != ProtocolAirPlay && service.Protocol != ProtocolRAOP {
+		return false
+	}
+	features := service.Capabilities.Features
+	if !features.Has(AirPlayFeatureVideoV1) && !features.Has(AirPlayFeatureAudio) {
+		return false
+	}
+	return !features.Has(AirPlayFeatureUnifiedMediaControl) && !features.Has(AirPlayFeatureCoreUtilsPairingAndEncryption)
+}
+
+// legacyPairingMessage is the plist sent to and received from
+// /pair-setup-pin. Every step uses a different set of keys.
+type legacyPairingMessage struct {
+	Method  string `plist:"method,omitempty"`
+	User    string `plist:"user,omitempty"`
+	PK      []byte `plist:"pk,omitempty"`
+	Salt    []byte `plist:"salt,omitempty"`
+	Proof   []byte `plist:"proof,omitempty"`
+	EPK     []byte `plist:"epk,omitempty"`
+	AuthTag []byte `plist:"authTag,omitempty"`
+}
+
+// postPlist sends a message as binary plist and decodes the response.
+func (t *airPlayPairingTransport) postPlist(ctx context.Context, path string, message *legacyPairingMessage) (*legacyPairingMessage, error) {
+	body, err := plist.Marshal(message, plist.BinaryFormat)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Content-Type": {"application/x-apple-binary-plist"}}
+	data, err := t.post(ctx, path, header, body)
+	if err != nil {
+		return nil, legacyAuthError(err)
+	}
+
+	resp := &legacyPairingMessage{}
+	if len(data) > 0 {
+		if _, err := plist.Unmarshal(data, resp); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+		}
+	}
+	return resp, nil
+}
+
+// legacyAuthError reports a request rejected by the device as failed
+// authentication, which is how wrong PINs and unknown keys show up.
+func legacyAuthError(err error) error {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return fmt.Errorf("%w: %w", ErrAuthentication, err)
+	}
+	return err
+}
+
+// legacyAESKey derives a 128 bit AES key or IV from a secret.
+func legacyAESKey(label string, secret []byte) []byte {
+	sum := sha512.Sum512(concat([]byte(label), secret))
+	return sum[:16]
+}
+
+// legacyPairSetup runs legacy pair-setup. The Ed25519 seed in the new
+// credentials doubles as SRP private key, like in pyatv.
+type legacyPairSetup struct {
+	transport   *airPlayPairingTransport
+	credentials *Credentials
+}
+
+func newLegacyPairSetup(transport *airPlayPairingTransport) (*legacyPairSetup, error) {
+	clientID := make([]byte, legacyClientIDSize)
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(clientID); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	return &legacyPairSetup{
+		transport:   transport,
+		credentials: &Credentials{Type: CredentialsLegacy, ClientID: clientID, LTSK: seed},
+	}, nil
+}
+
+// start makes the device show the PIN.
+func (p *legacyPairSetup) start(ctx context.Context) error {
+	_, err := p.transport.post(ctx, "/pair-pin-start", nil, nil)
+	return err
+}
+
+// finish authenticates with the PIN and registers our public key.
+func (p *legacyPairSetup) finish(ctx context.Context, pin string) (*Credentials, error) {
+	user := strings.ToUpper(hex.EncodeToString(p.credentials.ClientID))
+	resp, err := p.transport.postPlist(ctx, "/pair-setup-pin", &legacyPairingMessage{Method: "pin", User: user})
+	if err != nil {
+		return nil, err
+	}
+	if resp.PK == nil || resp.Salt == nil {
+		return nil, fmt.Errorf("%w: missing public key or salt", ErrInvalidResponse)
+	}
+
+	srp := newSRPClient(srpGroupLegacy, user, pin, p.credentials.LTSK)
+	proof, err := srp.Process(resp.Salt, resp.PK)
+	if err != nil {
+		return nil, err
+	}
+	resp, err = p.transport.postPlist(ctx, "/pair-setup-pin", &legacyPairingMessage{PK: srp.PublicKey(), Proof: proof})
+	if err != nil {
+		return nil, err
+	}
+	if err := srp.Verify(resp.Proof); err != nil {
+		return nil, err
+	}
+
+	// The IV is increased by one for some reason
+	sessionKey := srp.SessionKey()
+	iv := legacyAESKey("Pair-Setup-AES-IV", sessionKey)
+	iv[len(iv)-1]++
+	block, err := aes.NewCipher(legacyAESKey("Pair-Setup-AES-Key", sessionKey))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+
+	public := ed25519.NewKeyFromSeed(p.credentials.LTSK).Public().(ed25519.PublicKey)
+	sealed := gcm.Seal(nil, iv, public, nil)
+	tagStart := len(sealed) - gcm.Overhead()
+	if _, err := p.transport.postPlist(ctx, "/pair-setup-pin", &legacyPairingMessage{
+		EPK:     sealed[:tagStart],
+		AuthTag: sealed[tagStart:],
+	}); err != nil {
+		return nil, err
+	}
+	return p.credentials, nil
+}
+
+// legacyPairVerify proves to the device that we hold the key registered by
+// legacy pair-setup. The seed is used both as Ed25519 and X25519 key.
+func legacyPairVerify(ctx context.Context, transport *airPlayPairingTransport, credentials *Credentials) error {
+	signer := ed25519.NewKeyFromSeed(credentials.LTSK)
+	private, err := ecdh.X25519().NewPrivateKey(credentials.LTSK)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	public := private.PublicKey().Bytes()
+
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err := transport.post(ctx, "/pair-verify", header,
+		concat([]byte{1, 0, 0, 0}, public, signer.Public().(ed25519.PublicKey)))
+	if err != nil {
+		return legacyAuthError(err)
+	}
+	if len(resp) < 32 {
+		return fmt.Errorf("%w: pair-verify response of %d bytes", ErrInvalidResponse, len(resp))
+	}
+
+	devicePublic, deviceData := resp[:32], resp[32:]
+	peer, err := ecdh.X25519().NewPublicKey(devicePublic)
+	if err != nil {
+		return fmt.Errorf("%w: invalid device public key", ErrAuthentication)
+	}
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrAuthentication, err)
+	}
+
+	// The signature is encrypted with the key stream that follows the data
+	// from the device
+	block, err := aes.NewCipher(legacyAESKey("Pair-Verify-AES-Key", shared))
+	if err != nil {
+		return err
+	}
+	stream := cipher.NewCTR(block, legacyAESKey("Pair-Verify-AES-IV", shared))
+	stream.XORKeyStream(make([]byte, len(deviceData)), deviceData)
+	signature := ed25519.Sign(signer, concat(public, devicePublic))
+	stream.XORKeyStream(signature, signature)
+
+	if _, err := transport.post(ctx, "/pair-verify", header, concat([]byte{0, 0, 0, 0}, signature)); err != nil {
+		return legacyAuthError(err)
+	}
+	return nil
+}
@@ -0,0 +1,380 @@
+package pyatv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"howett.net/plist"
+)
+
+// Recorded exchange with an Apple TV 3, from the fake AirPlay device in the
+// pyatv tests.
+const (
+	legacyTestCredentials = "75FBEEC773CFC563:8F06696F2542D70DF59286C761695C485F815BE3D152849E1361282D46AB1493"
+	legacyTestPIN         = "2271"
+
+	legacyAuthStep1     = "62706c6973743030d201020304566d6574686f6454757365725370696e5f101037354642454543373733434643353633080d14191d0000000000000101000000000000000500000000000000000000000000000030"
+	legacyAuthStep1Resp = "62706c6973743030d20102030452706b5473616c744f1101008817e16146c7d12b45e810b0bf190a4ccb25d9a20a8d0504d874daa8db5574c51c8b33703a95c00bdbe99c8c3745d1ef1b38e538edfd98e09ec029effe6f28b3b54a1bd41c28d8f33da6f5ac9327bfce9a66869dae645b5cbd2c6b8fbe14a30ad4f8598154f2ef7f4f52cee3e3042a69780463c26bbb764870eb1995b26a2a4ade05564836d788baf07469a143c410ea9d07a068eb790b2b0aa5b86c990636814e3fa1a899ceba1af45b211ca4bd3b5b66ffaf16051a4f851e120476054258f257b8521a068907ad5e9c7220d5cef9aa072dec9edb7ebf633cad4d52d105cf58440f17e236332b0b26539851a879e9ac8d3c2da4c590785468e590296d39d7374f1010fca6dcb6b83a7c716a692f806e9159540008000d001000150119000000000000020100000000000000050000000000000000000000000000012c"
+	legacyAuthStep2     = "62706c6973743030d20102030452706b5570726f6f664f1101000819b6ba7feead4753809314e2b4c5db9109f737a0fc70b758342b6bbf536fae4e40cf94607588abb17c2076030cc00c2c1fa5fc3b3dfe8aa1ec2f23f74d917c0792fbf02f131377dfb8ae2a1656ceaa0a36bb3ab752586e1af17e1d5ef24ce083f3f9298d0be761f26c0d48af86510bf9aac7940cf90bff6bd214cf34b5536856c80f076cfbe06fd69af9d6a07a6d3ac580dfffc8a40b9730575a16c5046cd73321a944880dcf9fac952afc7ffd2d135e57ec208b11cef22b734f331ad4d8c9a737b588f7b30bd5210c65cae2ba0226f69ce7b505771faa63af89ed2f9e8325d7d5f3a2da7412f9d837860632d7f81b7fa5e09dd85e1539184070c0fa8433c24f1014fc6286910833d3e7ae0631d47ddbb0f492ef85b80008000d00100016011a0000000000000201000000000000000500000000000000000000000000000131"
+	legacyAuthStep2Resp = "62706c6973743030d101025570726f6f664f101484a88548b12bce122ad1cea6caff312630edcf27080b110000000000000101000000000000000300000000000000000000000000000028"
+	legacyAuthStep3     = "62706c6973743030d20102030457617574685461675365706b4f101052a92f8712c6ea417f3adb3d03d8e5634f1020ff07fc8520d10728e6f2ab0a0245dfa20709b5d1ae5f9a19328b0663ba9414f2080d15192c000000000000010100000000000000050000000000000000000000000000004f"
+	legacyAuthStep3Resp = "62706c6973743030d2010203045365706b57617574685461674f10206285b20afad4cefe1fce40cee685ab072c75240cb47fb71bc3b3d03dca52dc5d4f1010893eb8e5ae418b245e9b1bf7cba9116b080d11193c000000000000010100000000000000050000000000000000000000000000004f"
+
+	legacyVerifyStep1     = "01000000891bae9f581f68f9c9933c4f713fbb5b9de639ec7df5d0a4fd4f342f1c21aa6a5e9d1e843302d6265b8c48dd169e273460e567916b0b36280ac071001118f6b2"
+	legacyVerifyStep1Resp = "3221371da9f00d035955caa912455fd2acee68117b557f25e39168746af4b631cfab7b2c6d0b58e96cc10af884f5a4cdef8063858a9d9c04e866743cf4b77b4be50de1352ab4ff2691a1a7afd8c1341475b4170ac50455973b7fcf3c24324fa9"
+	legacyVerifyStep2     = "00000000a1f91acf64aacb185684080b817103b423816ad63b7f5e001f62337b4cc4b3b92c1474959930b7c2a59d0004814300580459d06fc6cc6441bd82bac72a5c5cc7"
+)
+
+func mustDecodeHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// legacyTestDevice replays the recorded exchange. Requests that differ from
+// the recording are rejected like an Apple TV does.
+type legacyTestDevice struct {
+	mu       sync.Mutex
+	requests []string // Path of every request
+
+	playStatus []int            // Answers to /play before 200 OK
+	play       []byte           // Body of the last /play
+	playback   []map[string]any // Answers to /playback-info, then nothing
+}
+
+// pairSetupResponse returns the recorded response to a /pair-setup-pin step,
+// or nil if the request does not match the recording.
+func (d *legacyTestDevice) pairSetupResponse(data []byte) []byte {
+	var request legacyPairingMessage
+	if _, err := plist.Unmarshal(data, &request); err != nil {
+		return nil
+	}
+	for _, step := range [][2]string{
+		{legacyAuthStep1, legacyAuthStep1Resp},
+		{legacyAuthStep2, legacyAuthStep2Resp},
+		{legacyAuthStep3, legacyAuthStep3Resp},
+	} {
+		var expected legacyPairingMessage
+		plist.Unmarshal(mustDecodeHex(step[0]), &expected)
+		if reflect.DeepEqual(request, expected) {
+			return mustDecodeHex(step[1])
+		}
+	}
+	return nil
+}
+
+func (d *legacyTestDevice) pairVerifyResponse(data []byte) []byte {
+	switch {
+	case bytes.Equal(data, mustDecodeHex(legacyVerifyStep1)):
+		return mustDecodeHex(legacyVerifyStep1Resp)
+	case bytes.Equal(data, mustDecodeHex(legacyVerifyStep2)):
+		return []byte{}
+	}
+	return nil
+}
+
+func (d *legacyTestDevice) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(req.Body)
+		d.mu.Lock()
+		d.requests = append(d.requests, req.URL.Path)
+
+		var body []byte
+		status := http.StatusOK
+		switch req.URL.Path {
+		case "/pair-pin-start":
+			body = []byte{}
+		case "/pair-setup-pin":
+			body = d.pairSetupResponse(data)
+		case "/pair-verify":
+			body = d.pairVerifyResponse(data)
+		case "/play":
+			body, d.play = []byte{}, data
+			if len(d.playStatus) > 0 {
+				status, d.playStatus = d.playStatus[0], d.playStatus[1:]
+			}
+		case "/playback-info":
+			body = []byte{}
+			if len(d.playback) > 0 {
+				body, _ = plist.Marshal(d.playback[0], plist.BinaryFormat)
+				d.playback = d.playback[1:]
+			}
+		}
+		d.mu.Unlock()
+
+		if body == nil {
+			status = 470 // Connection Authorization Required
+		}
+		resp := &http.Response{
+			StatusCode:    status,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			ContentLength: int64(len(body)),
+			Body:          io.NopCloser(bytes.NewReader(body)),
+		}
+		if resp.Write(conn) != nil {
+			return
+		}
+	}
+}
+
+// startLegacyTestDevice returns a config with an AirPlay service that only
+// supports legacy pairing.
+func startLegacyTestDevice(t *testing.T, device *legacyTestDevice) *Config {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				device.serve(conn)
+			}()
+		}
+	}()
+
+	return &Config{
+		Address: net.ParseIP("127.0.0.1"),
+		Name:    "Apple TV 3",
+		Services: []*Service{{
+			Identifier: "75FBEEC773CFC563",
+			Protocol:   ProtocolAirPlay,
+			Port:       listener.Addr().(*net.TCPAddr).Port,
+			Enabled:    true,
+			Capabilities: Capabilities{
+				Features: 0x1E5A7FFFF7,
+			},
+		}},
+	}
+}
+
+// pairLegacyTestDevice pairs with the keys of the recording instead of new
+// ones, so that the device recognizes the requests.
+func pairLegacyTestDevice(ctx context.Context, t *testing.T, config *Config, pin string) (*DefaultPairingHandler, error) {
+	t.Helper()
+	handler := NewPairingHandler(config, config.GetService(ProtocolAirPlay), ProtocolAirPlay, PairOptions{})
+	if err := handler.Begin(ctx); err != nil {
+		t.Fatalf("Begin() error = %v", err)
+	}
+	defer handler.Close()
+
+	setup, ok := handler.setup.(*legacyPairSetup)
+	if !ok {
+		t.Fatalf("Expected legacy pair-setup, got %T", handler.setup)
+	}
+	setup.credentials, _ = ParseCredentials(legacyTestCredentials)
+
+	handler.Pin(pin)
+	return handler, handler.Finish(ctx)
+}
+
+func TestLegacyPairSetup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	device := &legacyTestDevice{}
+	config := startLegacyTestDevice(t, device)
+
+	handler, err := pairLegacyTestDevice(ctx, t, config, legacyTestPIN)
+	if err != nil {
+		t.Fatalf("Finish() error = %v", err)
+	}
+	if !handler.HasPaired() {
+		t.Error("Expected handler to have paired")
+	}
+
+	expected := "75fbeec773cfc563:8f06696f2542d70df59286c761695c485f815be3d152849e1361282d46ab1493"
+	if got := config.GetService(ProtocolAirPlay).Credentials; got != expected {
+		t.Errorf("Expected credentials %q, got %q", expected, got)
+	}
+
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	paths := []string{"/pair-pin-start", "/pair-setup-pin", "/pair-setup-pin", "/pair-setup-pin"}
+	if !reflect.DeepEqual(device.requests, paths) {
+		t.Errorf("Expected requests %v, got %v", paths, device.requests)
+	}
+}
+
+func TestLegacyPairSetupWrongPin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	config := startLegacyTestDevice(t, &legacyTestDevice{})
+	if _, err := pairLegacyTestDevice(ctx, t, config, "0000"); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Expected ErrAuthentication, got %v", err)
+	}
+	if got := config.GetService(ProtocolAirPlay).Credentials; got != "" {
+		t.Errorf("Expected no credentials, got %q", got)
+	}
+}
+
+func TestConnectLegacy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	device := &legacyTestDevice{}
+	config := startLegacyTestDevice(t, device)
+	config.GetService(ProtocolAirPlay).Credentials = legacyTestCredentials
+
+	atv := NewAppleTVConnection(config, ConnectOptions{})
+	if err := atv.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer atv.Close()
+
+	session := atv.sessions[ProtocolAirPlay]
+	if session == nil {
+		t.Fatal("Expected a session from legacy pair-verify")
+	}
+	if _, err := session.secure(airPlaySessionKeys); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Expected ErrNotSupported, got %v", err)
+	}
+
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	paths := []string{"/pair-verify", "/pair-verify"}
+	if !reflect.DeepEqual(device.requests, paths) {
+		t.Errorf("Expected requests %v, got %v", paths, device.requests)
+	}
+}
+
+func TestConnectLegacyUnknownKey(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	config := startLegacyTestDevice(t, &legacyTestDevice{})
+	config.GetService(ProtocolAirPlay).Credentials = "75fbeec773cfc563:" + hex.EncodeToString(bytes.Repeat([]byte{1}, 32))
+
+	atv := NewAppleTVConnection(config, ConnectOptions{})
+	if err := atv.Connect(ctx); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Expected ErrAuthentication, got %v", err)
+	}
+}
+
+// connectLegacyTestDevice connects to a device that was paired with the keys
+// of the recording.
+func connectLegacyTestDevice(ctx context.Context, t *testing.T, device *legacyTestDevice) *AppleTVConnection {
+	t.Helper()
+	config := startLegacyTestDevice(t, device)
+	config.GetService(ProtocolAirPlay).Credentials = legacyTestCredentials
+
+	atv := NewAppleTVConnection(config, ConnectOptions{})
+	if err := atv.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	t.Cleanup(func() { atv.Close() })
+	return atv
+}
+
+func TestLegacyPlayURL(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	device := &legacyTestDevice{
+		playStatus: []int{http.StatusInternalServerError},
+		playback:   []map[string]any{{}, {"duration": 60.0, "position": 1.0}},
+	}
+	atv := connectLegacyTestDevice(ctx, t, device)
+
+	url := "http://example.com/video.mp4"
+	if err := atv.Stream().PlayURL(ctx, url, map[string]interface{}{"position": 12}); err != nil {
+		t.Fatalf("PlayURL() error = %v", err)
+	}
+
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	paths := []string{"/pair-verify", "/pair-verify", "/play", "/play", "/playback-info", "/playback-info", "/playback-info"}
+	if !reflect.DeepEqual(device.requests, paths) {
+		t.Errorf("Expected requests %v, got %v", paths, device.requests)
+	}
+	var request airPlayPlayRequest
+	if _, err := plist.Unmarshal(device.play, &request); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if request.ContentLocation != url || request.StartPosition != 12 || request.SessionID == "" {
+		t.Errorf("Unexpected play request %+v", request)
+	}
+}
+
+func TestLegacyPlayURLErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		device   *legacyTestDevice
+		expected error
+	}{
+		{"not authenticated", &legacyTestDevice{playStatus: []int{470}}, ErrAuthentication},
+		{"retries exceeded", &legacyTestDevice{playStatus: []int{500, 500, 500}}, ErrPlayback},
+		{"playback", &legacyTestDevice{playback: []map[string]any{
+			{"error": map[string]any{"code": -11800, "domain": "AVFoundationErrorDomain"}},
+		}}, ErrPlayback},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			atv := connectLegacyTestDevice(ctx, t, tt.device)
+			if err := atv.Stream().PlayURL(ctx, "http://example.com/video.mp4", nil); !errors.Is(err, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestLegacyAirPlay(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol Protocol
+		features AirPlayFeatures
+		expected bool
+	}{
+		{"no features", ProtocolAirPlay, 0, false},
+		{"video only", ProtocolAirPlay, AirPlayFeatureVideoV1, true},
+		{"audio only", ProtocolAirPlay, AirPlayFeatureAudio, true},
+		{"photo only", ProtocolAirPlay, AirPlayFeaturePhoto, false},
+		{"Apple TV 3", ProtocolAirPlay, 0x1E5A7FFFF7, true},
+		{"core utils", ProtocolAirPlay, AirPlayFeatureVideoV1 | AirPlayFeatureCoreUtilsPairingAndEncryption, false},
+		{"unified media control", ProtocolAirPlay, AirPlayFeatureVideoV1 | AirPlayFeatureUnifiedMediaControl, false},
+		{"RAOP", ProtocolRAOP, AirPlayFeatureAudio, true},
+		{"RAOP without features", ProtocolRAOP, 0, false},
+		{"RAOP core utils", ProtocolRAOP, AirPlayFeatureAudio | AirPlayFeatureCoreUtilsPairingAndEncryption, false},
+		{"not AirPlay", ProtocolCompanion, AirPlayFeatureVideoV1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &Service{Protocol: tt.protocol}
+			service.Capabilities.Features = tt.features
+			if got := legacyAirPlay(service); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
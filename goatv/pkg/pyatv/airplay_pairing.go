@@ -0,0 +1,190 @@
+package pyatv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/tlv8"
+)
+
+// airPlayUserAgent is sent with every AirPlay request.
+const airPlayUserAgent = "AirPlay/320.20"
+
+// airPlayPairingsPaths are the endpoints for managing pairings by method.
+var airPlayPairingsPaths = map[tlv8.Method]string{
+	tlv8.MethodAddPairing:    "/pair-add",
+	tlv8.MethodRemovePairing: "/pair-remove",
+	tlv8.MethodListPairings:  "/pair-list",
+}
+
+// airPlayPairingTransport sends pairing messages as HTTP requests over a
+// single AirPlay connection, which must stay open for encryption to be
+// enabled on it after pair-verify.
+type airPlayPairingTransport struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newAirPlayPairingTransport(conn net.Conn) *airPlayPairingTransport {
+	return &airPlayPairingTransport{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// post sends a POST request and returns the response body.
+func (t *airPlayPairingTransport) post(ctx context.Context, path string, header http.Header, body []byte) ([]byte, error) {
+	return t.request(ctx, http.MethodPost, path, header, body)
+}
+
+// request sends a request and returns the response body. Anything but 200 OK
+// is returned as HTTPError.
+func (t *airPlayPairingTransport) request(ctx context.Context, method, path string, header http.Header, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, "http://"+t.conn.RemoteAddr().String()+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", airPlayUserAgent)
+	req.Header.Set("Connection", "keep-alive")
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	stop := bindContext(ctx, t.conn)
+	defer stop()
+
+	if err := req.Write(t.conn); err != nil {
+		return nil, connectionError(ctx, err)
+	}
+	resp, err := http.ReadResponse(t.reader, req)
+	if err != nil {
+		return nil, connectionError(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, connectionError(ctx, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidResponse, path, NewHTTPError(resp.Status, resp.StatusCode))
+	}
+	return data, nil
+}
+
+// exchange sends a message to /pair-setup or /pair-verify. Pair-setup with a
+// PIN is preceded by /pair-pin-start, which makes the device show it. Requests
+// managing pairings go to /pair-list, /pair-add or /pair-remove.
+func (t *airPlayPairingTransport) exchange(ctx context.Context, kind hapExchange, items tlv8.Items) (tlv8.Items, error) {
+	header := http.Header{
+		"Content-Type": {"application/octet-stream"},
+		"X-Apple-Hkp":  {"3"},
+	}
+	if kind == exchangeTransientPairSetup {
+		header.Set("X-Apple-Hkp", "4")
+	}
+
+	path := "/pair-verify"
+	if kind == exchangePairings {
+		method, _ := items.Uint(tlv8.TagMethod)
+		path = airPlayPairingsPaths[tlv8.Method(method)]
+	} else if kind.setup() {
+		path = "/pair-setup"
+		if state, _ := items.Uint(tlv8.TagState); kind == exchangePairSetup && state == uint64(tlv8.M1) {
+			if _, err := t.post(ctx, "/pair-pin-start", header, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	data, err := t.post(ctx, path, header, items.Encode())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := tlv8.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	return resp, nil
+}
+
+func (t *airPlayPairingTransport) stream() net.Conn {
+	return &bufferedConn{Conn: t.conn, reader: t.reader}
+}
+
+func (t *airPlayPairingTransport) Close() error {
+	return t.conn.Close()
+}
+
+// airPlayPairingServerTransport receives pairing requests from an AirPlay
+// client and answers everything else that comes before pair-verify.
+type airPlayPairingServerTransport struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newAirPlayPairingServerTransport(conn net.Conn) *airPlayPairingServerTransport {
+	return &airPlayPairingServerTransport{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (t *airPlayPairingServerTransport) receive() (hapExchange, tlv8.Items, error) {
+	for {
+		req, err := http.ReadRequest(t.reader)
+		if err != nil {
+			return 0, nil, err
+		}
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		var kind hapExchange
+		switch req.URL.Path {
+		case "/pair-pin-start":
+			if err := t.respond(http.StatusOK, nil); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case "/pair-setup":
+			kind = exchangePairSetup
+			if req.Header.Get("X-Apple-Hkp") == "4" {
+				kind = exchangeTransientPairSetup
+			}
+		case "/pair-verify":
+			kind = exchangePairVerify
+		default:
+			if err := t.respond(http.StatusNotFound, nil); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		items, err := tlv8.Decode(data)
+		if err != nil {
+			return 0, nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+		}
+		return kind, items, nil
+	}
+}
+
+func (t *airPlayPairingServerTransport) send(kind hapExchange, items tlv8.Items) error {
+	return t.respond(http.StatusOK, items.Encode())
+}
+
+func (t *airPlayPairingServerTransport) respond(status int, body []byte) error {
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/octet-stream"}},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+	}
+	return resp.Write(t.conn)
+}
+
+func (t *airPlayPairingServerTransport) stream() net.Conn {
+	return &bufferedConn{Conn: t.conn, reader: t.reader}
+}
@@ -0,0 +1,147 @@
+package pyatv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"howett.net/plist"
+)
+
+// Devices with legacy pairing play URLs with AirPlay 1: after pair-verify,
+// /play is sent on the same connection, which is then used to follow the
+// playback until the media ends.
+
+const (
+	airPlayPlayUserAgent = "AirPlay/550.10"
+
+	// airPlayPlayAttempts is how many times /play is sent, as devices
+	// sometimes answer with 500 Internal Server Error at first. Other errors
+	// mean that the device did not accept our credentials.
+	airPlayPlayAttempts   = 3
+	airPlayPlayRetryDelay = time.Second
+
+	// airPlayPlaybackInfoInterval is the time between /playback-info
+	// requests and airPlayPlaybackStartAttempts how many of them it may
+	// take before the media is playing.
+	airPlayPlaybackInfoInterval  = time.Second
+	airPlayPlaybackStartAttempts = 5
+)
+
+// airPlayPlayRequest is the plist sent to /play.
+type airPlayPlayRequest struct {
+	ContentLocation string  `plist:"Content-Location"`
+	StartPosition   float64 `plist:"Start-Position"`
+	SessionID       string  `plist:"X-Apple-Session-ID"`
+}
+
+// airPlayPlaybackInfo is the part of the /playback-info plist that tells
+// whether the media is playing.
+type airPlayPlaybackInfo struct {
+	Duration *float64      `plist:"duration"`
+	Error    *airPlayError `plist:"error"`
+}
+
+type airPlayError struct {
+	Code   int    `plist:"code"`
+	Domain string `plist:"domain"`
+}
+
+// connectAirPlay lets a session from legacy pair-verify play URLs. HAP
+// sessions would need an encrypted connection, which is not supported.
+func (a *AppleTVConnection) connectAirPlay(session *hapSession) {
+	transport, ok := session.transport.(*airPlayPairingTransport)
+	if !ok || session.secret != nil {
+		return
+	}
+	a.stream = &airPlayStream{defaultStream: defaultStream{atv: a}, transport: transport}
+}
+
+// airPlayStream plays URLs over a connection that passed legacy pair-verify.
+type airPlayStream struct {
+	defaultStream
+	mu        sync.Mutex // Held while a URL is playing
+	transport *airPlayPairingTransport
+}
+
+// PlayURL tells the device to play a URL and returns when playback ends. The
+// start position in seconds can be set with the "position" option.
+func (s *airPlayStream) PlayURL(ctx context.Context, url string, options map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request := &airPlayPlayRequest{ContentLocation: url, SessionID: newPairingID()}
+	switch position := options["position"].(type) {
+	case int:
+		request.StartPosition = float64(position)
+	case float64:
+		request.StartPosition = position
+	}
+	body, err := plist.Marshal(request, plist.BinaryFormat)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("User-Agent", airPlayPlayUserAgent)
+	header.Set("Content-Type", "application/x-apple-binary-plist")
+	header.Set("X-Apple-ProtocolVersion", "1")
+	header.Set("X-Apple-Stream-ID", "1")
+	for attempt := 1; ; attempt++ {
+		_, err = s.transport.post(ctx, "/play", header, body)
+		var httpErr *HTTPError
+		if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusInternalServerError {
+			break
+		}
+		if attempt == airPlayPlayAttempts {
+			return fmt.Errorf("%w: /play failed %d times: %w", ErrPlayback, attempt, httpErr)
+		}
+		if err := sleep(ctx, airPlayPlayRetryDelay); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return legacyAuthError(err)
+	}
+	return s.waitForPlayback(ctx)
+}
+
+// waitForPlayback polls /playback-info until the media has played, never
+// started or the device closed the connection.
+func (s *airPlayStream) waitForPlayback(ctx context.Context) error {
+	started, attempts := false, airPlayPlaybackStartAttempts
+	for {
+		data, err := s.transport.request(ctx, http.MethodGet, "/playback-info", nil, nil)
+		if errors.Is(err, ErrConnectionLost) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		info := &airPlayPlaybackInfo{}
+		if len(data) > 0 {
+			if _, err := plist.Unmarshal(data, info); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+			}
+		}
+		switch {
+		case info.Error != nil:
+			return fmt.Errorf("%w: %s error %d", ErrPlayback, info.Error.Domain, info.Error.Code)
+		case info.Duration != nil:
+			started = true
+		case started:
+			return nil
+		default:
+			if attempts--; attempts == 0 {
+				return nil
+			}
+		}
+
+		if err := sleep(ctx, airPlayPlaybackInfoInterval); err != nil {
+			return err
+		}
+	}
+}
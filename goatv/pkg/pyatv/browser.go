@@ -0,0 +1,302 @@
+package pyatv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	mdnsGroupV4 = &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: mdnsPort}
+	mdnsGroupV6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: mdnsPort}
+)
+
+// mdnsBrowser queries the mDNS multicast group for services and picks up both
+// answers and unsolicited announcements, including goodbye packets.
+type mdnsBrowser struct {
+	services    []string
+	maxInterval time.Duration
+	ifaces      []net.Interface
+	sockets     []*mdnsSocket
+
+	mu     sync.Mutex
+	parser *serviceParser
+}
+
+// newMDNSBrowser joins the mDNS multicast groups of the allowed address
+// families on every interface in ifaces. Queries are repeated with a doubling
+// interval, starting at one second and capped at maxInterval.
+func newMDNSBrowser(services []string, ifaces []net.Interface, family AddressFamily, maxInterval time.Duration) (*mdnsBrowser, error) {
+	b := &mdnsBrowser{
+		services:    services,
+		maxInterval: maxInterval,
+		ifaces:      ifaces,
+		parser:      newServiceParser(),
+	}
+
+	var errs []error
+	if family != AddressFamilyIPv6 {
+		socket, err := listenMDNSv4(ifaces)
+		if err == nil {
+			b.sockets = append(b.sockets, socket)
+		}
+		errs = append(errs, err)
+	}
+	if family != AddressFamilyIPv4 {
+		// Many hosts have no IPv6 configured, so it only matters if nothing else works
+		socket, err := listenMDNSv6(ifaces)
+		if err == nil {
+			b.sockets = append(b.sockets, socket)
+		}
+		errs = append(errs, err)
+	}
+
+	if len(b.sockets) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return b, nil
+}
+
+// run browses until ctx is done, calling found for every entry that is
+// announced, updated or removed. Removed entries have a zero TTL.
+func (b *mdnsBrowser) run(ctx context.Context, found func(*ServiceEntry)) error {
+	query, err := newServiceQuery(b.services).Pack()
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, socket := range b.sockets {
+		wg.Add(1)
+		go func(socket *mdnsSocket) {
+			defer wg.Done()
+			b.receive(socket, found)
+		}(socket)
+	}
+
+	defer func() {
+		for _, socket := range b.sockets {
+			socket.conn.Close()
+		}
+		wg.Wait()
+	}()
+
+	interval := time.Second
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		}
+
+		for _, socket := range b.sockets {
+			if len(b.ifaces) == 0 {
+				socket.send(query, nil)
+			}
+			for i := range b.ifaces {
+				socket.send(query, &b.ifaces[i])
+			}
+		}
+
+		timer.Reset(interval)
+		if interval *= 2; interval > b.maxInterval {
+			interval = b.maxInterval
+		}
+	}
+}
+
+func (b *mdnsBrowser) receive(socket *mdnsSocket, found func(*ServiceEntry)) {
+	buf := make([]byte, 65536)
+	for {
+		n, ifIndex, src, err := socket.read(buf)
+		if err != nil {
+			return
+		}
+
+		iface, ok := b.lookupInterface(ifIndex)
+		if !ok {
+			continue
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Response {
+			continue
+		}
+
+		for _, entry := range b.handle(msg, src, iface) {
+			found(entry)
+		}
+	}
+}
+
+// lookupInterface returns the name of the interface with the given index and
+// whether packets from it should be handled. A zero index means the platform
+// did not say, in which case the packet is accepted.
+func (b *mdnsBrowser) lookupInterface(index int) (string, bool) {
+	if index == 0 {
+		return "", true
+	}
+	for _, iface := range b.ifaces {
+		if iface.Index == index {
+			return iface.Name, true
+		}
+	}
+	return "", len(b.ifaces) == 0
+}
+
+// handle adds a message received from src on iface to the record cache and
+// returns the entries of the browsed services that it affected.
+func (b *mdnsBrowser) handle(msg *dns.Msg, src net.IP, iface string) []*ServiceEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var entries []*ServiceEntry
+	for _, key := range b.parser.add(msg) {
+		entry := b.parser.entry(key)
+		if entry == nil || !isQueriedService(entry.Name, b.services) {
+			continue
+		}
+		if entry.TTL == 0 {
+			b.parser.remove(key)
+		}
+
+		// Link-local addresses are only reachable through the interface they were seen on
+		entry.Interface = iface
+		for i, addr := range entry.Addresses {
+			if addr.IP.To4() == nil && addr.IP.IsLinkLocalUnicast() {
+				entry.Addresses[i].Zone = iface
+			}
+		}
+
+		entry.DeepSleep = answeredByProxy(entry, src)
+		entries = append(entries, entry)
+	}
+	markDeepSleep(append(append([]dns.RR{}, msg.Answer...), msg.Extra...), entries)
+	return entries
+}
+
+// answeredByProxy returns true if an entry was announced by another host than
+// the device itself. A Bonjour sleep proxy does this for devices in deep sleep.
+func answeredByProxy(entry *ServiceEntry, src net.IP) bool {
+	if src.To4() == nil {
+		// IPv6 sources are often link-local and not listed in records
+		return false
+	}
+
+	hasV4 := false
+	for _, addr := range entry.Addresses {
+		if addr.IP.To4() == nil {
+			continue
+		}
+		if addr.IP.Equal(src) {
+			return false
+		}
+		hasV4 = true
+	}
+	return hasV4
+}
+
+// mdnsSocket is a socket bound to the mDNS port that has joined the multicast
+// group on a set of interfaces and reports which interface a packet came in on.
+type mdnsSocket struct {
+	conn *net.UDPConn
+	read func(b []byte) (n int, ifIndex int, src net.IP, err error)
+	send func(b []byte, iface *net.Interface) error
+}
+
+func listenMDNSv4(ifaces []net.Interface) (*mdnsSocket, error) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroupV4)
+	if err != nil {
+		return nil, err
+	}
+
+	p := ipv4.NewPacketConn(conn)
+	for i := range ifaces {
+		// Fails for interfaces without IPv4 or that already joined, both are fine
+		p.JoinGroup(&ifaces[i], mdnsGroupV4)
+	}
+	p.SetControlMessage(ipv4.FlagInterface, true)
+
+	return &mdnsSocket{
+		conn: conn,
+		read: func(b []byte) (int, int, net.IP, error) {
+			n, cm, src, err := p.ReadFrom(b)
+			if err != nil {
+				return 0, 0, nil, err
+			}
+			return n, ipv4IfIndex(cm), udpIP(src), nil
+		},
+		send: func(b []byte, iface *net.Interface) error {
+			if iface != nil {
+				if err := p.SetMulticastInterface(iface); err != nil {
+					return err
+				}
+			}
+			_, err := p.WriteTo(b, nil, mdnsGroupV4)
+			return err
+		},
+	}, nil
+}
+
+func listenMDNSv6(ifaces []net.Interface) (*mdnsSocket, error) {
+	conn, err := net.ListenMulticastUDP("udp6", nil, mdnsGroupV6)
+	if err != nil {
+		return nil, err
+	}
+
+	p := ipv6.NewPacketConn(conn)
+	for i := range ifaces {
+		p.JoinGroup(&ifaces[i], mdnsGroupV6)
+	}
+	p.SetControlMessage(ipv6.FlagInterface, true)
+
+	return &mdnsSocket{
+		conn: conn,
+		read: func(b []byte) (int, int, net.IP, error) {
+			n, cm, src, err := p.ReadFrom(b)
+			if err != nil {
+				return 0, 0, nil, err
+			}
+			return n, ipv6IfIndex(cm), udpIP(src), nil
+		},
+		send: func(b []byte, iface *net.Interface) error {
+			if iface != nil {
+				if err := p.SetMulticastInterface(iface); err != nil {
+					return err
+				}
+			}
+			_, err := p.WriteTo(b, nil, mdnsGroupV6)
+			return err
+		},
+	}, nil
+}
+
+func ipv4IfIndex(cm *ipv4.ControlMessage) int {
+	if cm == nil {
+		return 0
+	}
+	return cm.IfIndex
+}
+
+func ipv6IfIndex(cm *ipv6.ControlMessage) int {
+	if cm == nil {
+		return 0
+	}
+	return cm.IfIndex
+}
+
+func udpIP(addr net.Addr) net.IP {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return udp.IP
+	}
+	return nil
+}
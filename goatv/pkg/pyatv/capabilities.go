@@ -0,0 +1,286 @@
+package pyatv
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// AirPlayFeatures is the 64-bit feature mask announced by AirPlay and RAOP
+// services in the "features" or "ft" TXT key.
+type AirPlayFeatures uint64
+
+// AirPlay feature bits.
+const (
+	AirPlayFeatureVideoV1                       AirPlayFeatures = 1 << 0
+	AirPlayFeaturePhoto                         AirPlayFeatures = 1 << 1
+	AirPlayFeatureSlideShow                     AirPlayFeatures = 1 << 5
+	AirPlayFeatureScreen                        AirPlayFeatures = 1 << 7
+	AirPlayFeatureAudio                         AirPlayFeatures = 1 << 9
+	AirPlayFeatureAudioRedundant                AirPlayFeatures = 1 << 11
+	AirPlayFeatureAuthentication4               AirPlayFeatures = 1 << 14
+	AirPlayFeatureMetadataFeatures0             AirPlayFeatures = 1 << 15
+	AirPlayFeatureMetadataFeatures1             AirPlayFeatures = 1 << 16
+	AirPlayFeatureMetadataFeatures2             AirPlayFeatures = 1 << 17
+	AirPlayFeatureAudioFormats0                 AirPlayFeatures = 1 << 18
+	AirPlayFeatureAudioFormats1                 AirPlayFeatures = 1 << 19
+	AirPlayFeatureAudioFormats2                 AirPlayFeatures = 1 << 20
+	AirPlayFeatureAudioFormats3                 AirPlayFeatures = 1 << 21
+	AirPlayFeatureAuthentication1               AirPlayFeatures = 1 << 23
+	AirPlayFeatureAuthentication8               AirPlayFeatures = 1 << 26
+	AirPlayFeatureLegacyPairing                 AirPlayFeatures = 1 << 27
+	AirPlayFeatureUnifiedAdvertiserInfo         AirPlayFeatures = 1 << 30
+	AirPlayFeatureCarPlay                       AirPlayFeatures = 1 << 32
+	AirPlayFeatureVideoPlayQueue                AirPlayFeatures = 1 << 33
+	AirPlayFeatureFromCloud                     AirPlayFeatures = 1 << 34
+	AirPlayFeatureTLSPSK                        AirPlayFeatures = 1 << 35
+	AirPlayFeatureUnifiedMediaControl           AirPlayFeatures = 1 << 38
+	AirPlayFeatureBufferedAudio                 AirPlayFeatures = 1 << 40
+	AirPlayFeaturePTP                           AirPlayFeatures = 1 << 41
+	AirPlayFeatureScreenMultiCodec              AirPlayFeatures = 1 << 42
+	AirPlayFeatureSystemPairing                 AirPlayFeatures = 1 << 43
+	AirPlayFeatureValeriaScreenSender           AirPlayFeatures = 1 << 44
+	AirPlayFeatureHKPairingAndAccessControl     AirPlayFeatures = 1 << 46
+	AirPlayFeatureCoreUtilsPairingAndEncryption AirPlayFeatures = 1 << 48
+	AirPlayFeatureVideoV2                       AirPlayFeatures = 1 << 49
+	AirPlayFeatureMetadataFeatures3             AirPlayFeatures = 1 << 50
+	AirPlayFeatureUnifiedPairSetupAndMFi        AirPlayFeatures = 1 << 51
+	AirPlayFeatureSetPeersExtendedMessage       AirPlayFeatures = 1 << 52
+	AirPlayFeatureAPSync                        AirPlayFeatures = 1 << 54
+	AirPlayFeatureWoL                           AirPlayFeatures = 1 << 55
+	AirPlayFeatureWoL2                          AirPlayFeatures = 1 << 56
+	AirPlayFeatureHangdogRemoteControl          AirPlayFeatures = 1 << 58
+	AirPlayFeatureAudioStreamConnectionSetup    AirPlayFeatures = 1 << 59
+	AirPlayFeatureAudioMetadataControl          AirPlayFeatures = 1 << 60
+	AirPlayFeatureRFC2198Redundancy             AirPlayFeatures = 1 << 61
+)
+
+// Has returns true if all bits in feature are set.
+func (f AirPlayFeatures) Has(feature AirPlayFeatures) bool {
+	return f&feature == feature
+}
+
+// String formats the mask the way it is announced, "0xLOW,0xHIGH".
+func (f AirPlayFeatures) String() string {
+	return fmt.Sprintf("0x%X,0x%X", uint32(f), uint32(f>>32))
+}
+
+var featuresFormat = regexp.MustCompile(`^0x([0-9A-Fa-f]{1,8})(?:,0x([0-9A-Fa-f]{1,8}))?$`)
+
+// ParseAirPlayFeatures parses a feature mask in the format "0xLOW" or
+// "0xLOW,0xHIGH", where the second part holds the upper 32 bits.
+func ParseAirPlayFeatures(features string) (AirPlayFeatures, error) {
+	match := featuresFormat.FindStringSubmatch(features)
+	if match == nil {
+		return 0, fmt.Errorf("%w: invalid feature string %q", ErrInvalidConfig, features)
+	}
+
+	low, _ := strconv.ParseUint(match[1], 16, 32)
+	var high uint64
+	if match[2] != "" {
+		high, _ = strconv.ParseUint(match[2], 16, 32)
+	}
+	return AirPlayFeatures(high<<32 | low), nil
+}
+
+// AirPlayStatusFlags are the status bits announced by AirPlay and RAOP
+// services in the "sf" or "flags" TXT key.
+type AirPlayStatusFlags uint32
+
+// AirPlay status bits.
+const (
+	// AirPlayStatusPINRequired means a PIN must be entered to pair.
+	AirPlayStatusPINRequired AirPlayStatusFlags = 0x8
+	// AirPlayStatusPasswordRequired means a password is needed to stream.
+	AirPlayStatusPasswordRequired AirPlayStatusFlags = 0x80
+	// AirPlayStatusOneTimePairingRequired means the device must be paired once.
+	AirPlayStatusOneTimePairingRequired AirPlayStatusFlags = 0x200
+)
+
+// CompanionFlags are the flags announced by Companion services in the "rpFl"
+// TXT key. Only the bits with known meaning have constants.
+type CompanionFlags uint32
+
+// Companion flag bits, deduced from values observed on real devices.
+const (
+	// CompanionFlagPairingDisabled means only devices in the same home may pair.
+	CompanionFlagPairingDisabled CompanionFlags = 0x4
+	// CompanionFlagPINPairing means pairing with a PIN is supported.
+	CompanionFlagPINPairing CompanionFlags = 0x4000
+)
+
+// Capabilities is what a service announces about itself in its TXT records.
+// Fields that do not apply to the protocol of a service are left empty.
+type Capabilities struct {
+	// AirPlay and RAOP
+	Features          AirPlayFeatures
+	StatusFlags       AirPlayStatusFlags
+	PasswordRequired  bool // "pw" is true or the password status bit is set
+	AccessControl     int  // "acl", 1 limits access to the same home
+	AccessControlType int  // "act", 2 limits access to the current user
+
+	// RAOP
+	EncryptionTypes []int    // "et"
+	Codecs          []int    // "cn"
+	Transports      []string // "tp", e.g. UDP or TCP
+
+	// Companion
+	CompanionFlags CompanionFlags
+
+	// MRP
+	AllowPairing bool   // "AllowPairing" is YES
+	BuildVersion string // "SystemBuildVersion"
+}
+
+// parseCapabilities decodes the TXT records of a service. Values that cannot
+// be parsed are treated as absent.
+func parseCapabilities(protocol Protocol, txtRecords map[string]string) Capabilities {
+	var caps Capabilities
+	switch protocol {
+	case ProtocolAirPlay, ProtocolRAOP:
+		features, ok := txtValue(txtRecords, "features")
+		if !ok {
+			features, _ = txtValue(txtRecords, "ft")
+		}
+		caps.Features, _ = ParseAirPlayFeatures(features)
+
+		flags, ok := txtValue(txtRecords, "sf")
+		if !ok {
+			flags, _ = txtValue(txtRecords, "flags")
+		}
+		caps.StatusFlags = AirPlayStatusFlags(parseHex(flags))
+
+		pw, _ := txtValue(txtRecords, "pw")
+		caps.PasswordRequired = strings.EqualFold(pw, "true") || caps.StatusFlags&AirPlayStatusPasswordRequired != 0
+
+		caps.AccessControl = parseInt(txtRecords, "acl")
+		caps.AccessControlType = parseInt(txtRecords, "act")
+
+		if protocol == ProtocolRAOP {
+			caps.EncryptionTypes = parseIntList(txtRecords, "et")
+			caps.Codecs = parseIntList(txtRecords, "cn")
+			if tp, ok := txtValue(txtRecords, "tp"); ok && tp != "" {
+				caps.Transports = strings.Split(tp, ",")
+			}
+		}
+	case ProtocolCompanion:
+		flags, _ := txtValue(txtRecords, "rpFl")
+		caps.CompanionFlags = CompanionFlags(parseHex(flags))
+	case ProtocolMRP:
+		allow, _ := txtValue(txtRecords, "AllowPairing")
+		caps.AllowPairing = strings.EqualFold(allow, "YES")
+		caps.BuildVersion, _ = txtValue(txtRecords, "SystemBuildVersion")
+	}
+	return caps
+}
+
+func parseHex(value string) uint64 {
+	n, _ := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(value), "0x"), 16, 64)
+	return n
+}
+
+func parseInt(txtRecords map[string]string, key string) int {
+	value, _ := txtValue(txtRecords, key)
+	n, _ := strconv.Atoi(value)
+	return n
+}
+
+func parseIntList(txtRecords map[string]string, key string) []int {
+	value, ok := txtValue(txtRecords, key)
+	if !ok || value == "" {
+		return nil
+	}
+
+	var result []int
+	for _, part := range strings.Split(value, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// updateServiceDetails derives pairing requirement, password requirement and
+// whether a service is usable from the capabilities of all services of a
+// device. RAOP depends on what AirPlay announces, so the whole device is
+// updated at once.
+func updateServiceDetails(config *Config) {
+	var airplay *Capabilities
+	if service := config.GetService(ProtocolAirPlay); service != nil {
+		airplay = &service.Capabilities
+	}
+
+	for _, service := range config.Services {
+		caps := service.Capabilities
+		switch service.Protocol {
+		case ProtocolAirPlay:
+			service.RequiresPassword = caps.PasswordRequired
+			model, _ := txtValue(service.Properties, "model")
+			switch {
+			case caps.AccessControl == 1:
+				// Only devices in the same home may pair
+				service.Pairing = PairingRequirementDisabled
+			case macIdentifier.MatchString(model):
+				service.Pairing = PairingRequirementUnsupported
+			default:
+				service.Pairing = airPlayPairing(caps)
+			}
+		case ProtocolRAOP:
+			service.RequiresPassword = caps.PasswordRequired
+			switch {
+			case airplay != nil && airplay.AccessControl == 1:
+				service.Pairing = PairingRequirementDisabled
+			case airplay != nil && airplay.AccessControlType == 2:
+				service.Pairing = PairingRequirementUnsupported
+			default:
+				service.Pairing = airPlayPairing(caps)
+			}
+		case ProtocolCompanion:
+			switch {
+			case caps.CompanionFlags&CompanionFlagPairingDisabled != 0:
+				service.Pairing = PairingRequirementDisabled
+			case caps.CompanionFlags&CompanionFlagPINPairing != 0:
+				service.Pairing = PairingRequirementMandatory
+			default:
+				service.Pairing = PairingRequirementUnsupported
+			}
+		case ProtocolMRP:
+			// MRP stopped working with tvOS 15
+			if match := buildMajor.FindStringSubmatch(caps.BuildVersion); match != nil {
+				if major, _ := strconv.Atoi(match[1]); major >= 19 {
+					service.Enabled = false
+				}
+			}
+			switch {
+			case !service.Enabled:
+				service.Pairing = PairingRequirementNotNeeded
+			case caps.AllowPairing:
+				service.Pairing = PairingRequirementOptional
+			default:
+				service.Pairing = PairingRequirementDisabled
+			}
+		case ProtocolDMAP:
+			// With Home Sharing enabled, the announced "hG" works as credentials
+			if _, ok := txtValue(service.Properties, "hG"); ok {
+				service.Pairing = PairingRequirementOptional
+			} else {
+				service.Pairing = PairingRequirementMandatory
+			}
+		}
+	}
+}
+
+// airPlayPairing returns the pairing requirement announced in AirPlay status
+// flags.
+func airPlayPairing(caps Capabilities) PairingRequirement {
+	switch {
+	case caps.StatusFlags&(AirPlayStatusOneTimePairingRequired|AirPlayStatusPINRequired) != 0:
+		return PairingRequirementMandatory
+	case caps.AccessControlType == 2:
+		// Access limited to the current user is not supported
+		return PairingRequirementUnsupported
+	default:
+		return PairingRequirementNotNeeded
+	}
+}
@@ -0,0 +1,119 @@
+package pyatv
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseAirPlayFeatures(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected AirPlayFeatures
+		valid    bool
+	}{
+		{"0x5A7FFFF7,0x1E", 0x1E5A7FFFF7, true},
+		{"0x77", 0x77, true},
+		{"0xabcdef12,0x12345678", 0x12345678ABCDEF12, true},
+		{"0x123456789", 0, false},
+		{"12345", 0, false},
+		{"", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseAirPlayFeatures(tt.input)
+		if tt.valid && (err != nil || got != tt.expected) {
+			t.Errorf("ParseAirPlayFeatures(%q) = %X, %v, want %X", tt.input, uint64(got), err, uint64(tt.expected))
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("ParseAirPlayFeatures(%q) expected ErrInvalidConfig, got %v", tt.input, err)
+		}
+	}
+
+	features, _ := ParseAirPlayFeatures("0x5A7FFFF7,0x1E")
+	if features.String() != "0x5A7FFFF7,0x1E" {
+		t.Errorf("Expected round trip, got %s", features)
+	}
+	if !features.Has(AirPlayFeatureAudio) || features.Has(AirPlayFeatureCoreUtilsPairingAndEncryption) {
+		t.Errorf("Unexpected feature bits in %s", features)
+	}
+}
+
+func TestParseCapabilitiesRAOP(t *testing.T) {
+	caps := parseCapabilities(ProtocolRAOP, map[string]string{
+		"et": "0,3,5", "cn": "0,1,2,3", "tp": "UDP", "pw": "true", "ft": "0x4A7FDFD5,0xBC157FDE", "sf": "0x204",
+	})
+
+	if len(caps.EncryptionTypes) != 3 || caps.EncryptionTypes[2] != 5 {
+		t.Errorf("Unexpected encryption types %v", caps.EncryptionTypes)
+	}
+	if len(caps.Codecs) != 4 {
+		t.Errorf("Unexpected codecs %v", caps.Codecs)
+	}
+	if len(caps.Transports) != 1 || caps.Transports[0] != "UDP" {
+		t.Errorf("Unexpected transports %v", caps.Transports)
+	}
+	if !caps.PasswordRequired {
+		t.Error("Expected password to be required")
+	}
+	if caps.StatusFlags != 0x204 || caps.Features != 0xBC157FDE4A7FDFD5 {
+		t.Errorf("Unexpected flags %X and features %s", uint32(caps.StatusFlags), caps.Features)
+	}
+}
+
+func TestUpdateServiceDetails(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol Protocol
+		txt      map[string]string
+		pairing  PairingRequirement
+		password bool
+		enabled  bool
+	}{
+		{"AirPlay PIN", ProtocolAirPlay, map[string]string{"sf": "0x8"}, PairingRequirementMandatory, false, true},
+		{"AirPlay one-time pairing", ProtocolAirPlay, map[string]string{"flags": "0x200"}, PairingRequirementMandatory, false, true},
+		{"AirPlay password", ProtocolAirPlay, map[string]string{"sf": "0x80"}, PairingRequirementNotNeeded, true, true},
+		{"AirPlay same home", ProtocolAirPlay, map[string]string{"acl": "1", "sf": "0x8"}, PairingRequirementDisabled, false, true},
+		{"AirPlay current user", ProtocolAirPlay, map[string]string{"act": "2"}, PairingRequirementUnsupported, false, true},
+		{"AirPlay Mac", ProtocolAirPlay, map[string]string{"model": "Mac14,3"}, PairingRequirementUnsupported, false, true},
+		{"RAOP password", ProtocolRAOP, map[string]string{"pw": "true"}, PairingRequirementNotNeeded, true, true},
+		{"Companion PIN", ProtocolCompanion, map[string]string{"rpFl": "0x36782"}, PairingRequirementMandatory, false, true},
+		{"Companion same home", ProtocolCompanion, map[string]string{"rpFl": "0x627B6"}, PairingRequirementDisabled, false, true},
+		{"Companion HomePod", ProtocolCompanion, map[string]string{"rpFl": "0x62792"}, PairingRequirementUnsupported, false, true},
+		{"MRP allowed", ProtocolMRP, map[string]string{"AllowPairing": "YES", "SystemBuildVersion": "17K499"}, PairingRequirementOptional, false, true},
+		{"MRP allowed without build", ProtocolMRP, map[string]string{"AllowPairing": "YES"}, PairingRequirementOptional, false, true},
+		{"MRP not allowed", ProtocolMRP, map[string]string{"AllowPairing": "NO"}, PairingRequirementDisabled, false, true},
+		{"MRP tvOS 15", ProtocolMRP, map[string]string{"AllowPairing": "YES", "SystemBuildVersion": "19J346"}, PairingRequirementNotNeeded, false, false},
+		{"DMAP Home Sharing", ProtocolDMAP, map[string]string{"hG": "00000000-1111"}, PairingRequirementOptional, false, true},
+		{"DMAP", ProtocolDMAP, map[string]string{}, PairingRequirementMandatory, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &Service{Protocol: tt.protocol, Properties: tt.txt, Enabled: true}
+			service.Capabilities = parseCapabilities(tt.protocol, tt.txt)
+			updateServiceDetails(&Config{Services: []*Service{service}})
+
+			if service.Pairing != tt.pairing {
+				t.Errorf("Expected pairing %s, got %s", tt.pairing, service.Pairing)
+			}
+			if service.RequiresPassword != tt.password {
+				t.Errorf("Expected RequiresPassword %v, got %v", tt.password, service.RequiresPassword)
+			}
+			if service.Enabled != tt.enabled {
+				t.Errorf("Expected Enabled %v, got %v", tt.enabled, service.Enabled)
+			}
+		})
+	}
+}
+
+func TestUpdateServiceDetailsRAOPFollowsAirPlay(t *testing.T) {
+	airplay := &Service{Protocol: ProtocolAirPlay, Properties: map[string]string{"acl": "1"}, Enabled: true}
+	airplay.Capabilities = parseCapabilities(ProtocolAirPlay, airplay.Properties)
+	raop := &Service{Protocol: ProtocolRAOP, Properties: map[string]string{"sf": "0x8"}, Enabled: true}
+	raop.Capabilities = parseCapabilities(ProtocolRAOP, raop.Properties)
+
+	updateServiceDetails(&Config{Services: []*Service{airplay, raop}})
+	if raop.Pairing != PairingRequirementDisabled {
+		t.Errorf("Expected RAOP pairing to follow AirPlay access control, got %s", raop.Pairing)
+	}
+}
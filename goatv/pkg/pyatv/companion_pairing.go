@@ -0,0 +1,204 @@
+package pyatv
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/opack"
+	"github.com/alexjsteffen/goatv/pkg/pyatv/tlv8"
+)
+
+// companionFrameType is the first byte of a Companion frame.
+type companionFrameType byte
+
+// Frame types used for pairing.
+const (
+	companionPairSetupStart  companionFrameType = 3
+	companionPairSetupNext   companionFrameType = 4
+	companionPairVerifyStart companionFrameType = 5
+	companionPairVerifyNext  companionFrameType = 6
+)
+
+// companionHeaderSize is the frame type followed by a 24 bit payload length.
+const companionHeaderSize = 4
+
+// writeCompanionFrame writes a frame with a payload.
+func writeCompanionFrame(w io.Writer, frameType companionFrameType, payload []byte) error {
+	if len(payload) > 0xFFFFFF {
+		return fmt.Errorf("%w: payload of %d bytes does not fit in a frame", ErrInvalidState, len(payload))
+	}
+	size := len(payload)
+	header := []byte{byte(frameType), byte(size >> 16), byte(size >> 8), byte(size)}
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// readCompanionFrame reads a frame and returns its type and payload.
+func readCompanionFrame(r io.Reader) (companionFrameType, []byte, error) {
+	var header [companionHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return companionFrameType(header[0]), payload, nil
+}
+
+// companionFraming is the messageFraming of Companion. Frames with a payload
+// are encrypted with the header as additional authenticated data.
+type companionFraming struct{}
+
+func (companionFraming) parse(data []byte) (int, int, error) {
+	if len(data) < companionHeaderSize {
+		return 0, 0, nil
+	}
+	return companionHeaderSize, int(data[1])<<16 | int(data[2])<<8 | int(data[3]), nil
+}
+
+func (companionFraming) resize(header []byte, payloadSize int) []byte {
+	return []byte{header[0], byte(payloadSize >> 16), byte(payloadSize >> 8), byte(payloadSize)}
+}
+
+func (companionFraming) encrypted(header []byte, payloadSize int) ([]byte, bool) {
+	return header, payloadSize > 0
+}
+
+// companionPairingTransport sends pairing messages over a Companion
+// connection. They are OPACK dictionaries with the TLV8 data in "_pd".
+type companionPairingTransport struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	xid    int64
+}
+
+func newCompanionPairingTransport(conn net.Conn) *companionPairingTransport {
+	return &companionPairingTransport{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (t *companionPairingTransport) exchange(ctx context.Context, kind hapExchange, items tlv8.Items) (tlv8.Items, error) {
+	state, _ := items.Uint(tlv8.TagState)
+	first := state == uint64(tlv8.M1)
+
+	// The first message uses a start frame, all others and every response
+	// use next frames
+	message := map[string]any{"_pd": items.Encode(), "_x": t.xid}
+	var frameType, responseType companionFrameType
+	if kind.setup() {
+		frameType, responseType = companionPairSetupNext, companionPairSetupNext
+		if first {
+			frameType = companionPairSetupStart
+		}
+		message["_pwTy"] = 1
+	} else {
+		frameType, responseType = companionPairVerifyNext, companionPairVerifyNext
+		if first {
+			frameType = companionPairVerifyStart
+			message["_auTy"] = 4
+		}
+	}
+	t.xid++
+
+	payload, err := opack.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := bindContext(ctx, t.conn)
+	defer stop()
+
+	if err := writeCompanionFrame(t.conn, frameType, payload); err != nil {
+		return nil, connectionError(ctx, err)
+	}
+	for {
+		gotType, data, err := readCompanionFrame(t.reader)
+		if err != nil {
+			return nil, connectionError(ctx, err)
+		}
+		if gotType != responseType {
+			continue
+		}
+		return companionPairingData(data)
+	}
+}
+
+// companionPairingData decodes the TLV8 data in a response.
+func companionPairingData(payload []byte) (tlv8.Items, error) {
+	resp, err := opack.UnmarshalMap(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	if message, ok := resp["_em"]; ok {
+		return nil, fmt.Errorf("%w: %v", ErrProtocol, message)
+	}
+
+	data, ok := resp["_pd"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("%w: no pairing data in response", ErrAuthentication)
+	}
+	items, err := tlv8.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	return items, nil
+}
+
+func (t *companionPairingTransport) stream() net.Conn {
+	return &bufferedConn{Conn: t.conn, reader: t.reader}
+}
+
+func (t *companionPairingTransport) Close() error {
+	return t.conn.Close()
+}
+
+// companionPairingServerTransport receives pairing frames from a Companion
+// client.
+type companionPairingServerTransport struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newCompanionPairingServerTransport(conn net.Conn) *companionPairingServerTransport {
+	return &companionPairingServerTransport{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (t *companionPairingServerTransport) receive() (hapExchange, tlv8.Items, error) {
+	for {
+		frameType, payload, err := readCompanionFrame(t.reader)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		var kind hapExchange
+		switch frameType {
+		case companionPairSetupStart, companionPairSetupNext:
+			kind = exchangePairSetup
+		case companionPairVerifyStart, companionPairVerifyNext:
+			kind = exchangePairVerify
+		default:
+			continue
+		}
+		items, err := companionPairingData(payload)
+		return kind, items, err
+	}
+}
+
+func (t *companionPairingServerTransport) send(kind hapExchange, items tlv8.Items) error {
+	payload, err := opack.Marshal(map[string]any{"_pd": items.Encode()})
+	if err != nil {
+		return err
+	}
+	if kind.setup() {
+		return writeCompanionFrame(t.conn, companionPairSetupNext, payload)
+	}
+	return writeCompanionFrame(t.conn, companionPairVerifyNext, payload)
+}
+
+func (t *companionPairingServerTransport) stream() net.Conn {
+	return &bufferedConn{Conn: t.conn, reader: t.reader}
+}
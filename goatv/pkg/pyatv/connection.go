@@ -2,7 +2,9 @@ package pyatv
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"net"
 	"sync"
 )
 
@@ -26,6 +28,12 @@ type AppleTVConnection struct {
 	audio    Audio
 	keyboard Keyboard
 	touch    TouchGestures
+
+	// Services that passed pair-verify, by protocol
+	sessions map[Protocol]*hapSession
+
+	// MRP connection that handlers use, if the device has MRP
+	mrp *mrpProtocol
 }
 
 // NewAppleTVConnection creates a new AppleTV connection.
@@ -60,13 +68,95 @@ func (a *AppleTVConnection) Connect(ctx context.Context) error {
 		return nil
 	}
 
-	// TODO: Implement actual protocol connections
-	// For now, just mark as connected
+	// Devices in deep sleep must be woken up before anything can connect
+	if addresses := a.config.connectAddresses(); a.config.DeepSleep && len(addresses) > 0 {
+		wakeCtx, cancel := context.WithTimeout(ctx, wakeTimeout)
+		defer cancel()
+
+		hosts := make([]string, len(addresses))
+		for i, addr := range addresses {
+			hosts[i] = addr.String()
+		}
+		if err := wakeDevice(wakeCtx, hosts, wakePorts(a.config)); err != nil {
+			return fmt.Errorf("%w: device did not wake up: %v", ErrConnectionFailed, err)
+		}
+		a.config.DeepSleep = false
+	}
+
+	// Verify the services whose sessions get used
+	sessions := make(map[Protocol]*hapSession)
+	name := controllerName(ctx, a.config, "", a.opts.Storage)
+	for _, service := range a.config.Services {
+		if !a.verifiable(service) {
+			continue
+		}
+		session, err := verifyService(ctx, a.config, service, name)
+		if err != nil {
+			closeSessions(sessions)
+			return err
+		}
+		if session != nil {
+			sessions[service.Protocol] = session
+		}
+	}
+
+	// Otherwise make sure the device answers on one of its addresses
+	if service := a.Service(); len(sessions) == 0 && service != nil && service.Port != 0 {
+		conn, err := a.dial(ctx, service.Port)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+
+	// MRP takes over its session for remote control, metadata and more
+	if session := sessions[ProtocolMRP]; session != nil {
+		if err := a.connectMRP(ctx, session); err != nil {
+			closeSessions(sessions)
+			return err
+		}
+	}
+	if session := sessions[ProtocolAirPlay]; session != nil {
+		a.connectAirPlay(session)
+	}
+
+	a.sessions = sessions
 	a.connected = true
 
 	return nil
 }
 
+// verifiable returns true if Connect should verify a service. Without a
+// selected protocol only services whose sessions are used get verified, so
+// that other protocols cannot break the connection.
+func (a *AppleTVConnection) verifiable(service *Service) bool {
+	if !service.Enabled {
+		return false
+	}
+	selected := a.opts.Protocol != nil
+	if selected && *a.opts.Protocol != service.Protocol {
+		return false
+	}
+	switch service.Protocol {
+	case ProtocolMRP:
+		return true
+	case ProtocolAirPlay:
+		// Only sessions from legacy pair-verify can play URLs
+		credentials, err := ParseCredentials(service.Credentials)
+		return selected || (err == nil && credentials.Type == CredentialsLegacy)
+	case ProtocolCompanion:
+		return selected
+	default:
+		return false
+	}
+}
+
+// dial opens a TCP connection to a port on the device, falling back to the
+// other addresses if the preferred one does not answer.
+func (a *AppleTVConnection) dial(ctx context.Context, port int) (net.Conn, error) {
+	return a.config.dial(ctx, port)
+}
+
 // Close closes the connection.
 func (a *AppleTVConnection) Close() error {
 	a.mu.Lock()
@@ -77,6 +167,12 @@ func (a *AppleTVConnection) Close() error {
 	}
 
 	a.connected = false
+	if a.mrp != nil {
+		a.mrp.close()
+		a.mrp = nil
+	}
+	closeSessions(a.sessions)
+	a.sessions = nil
 
 	if a.deviceListener != nil {
 		a.deviceListener.ConnectionClosed()
@@ -155,6 +251,8 @@ func (a *AppleTVConnection) Touch() TouchGestures {
 
 // SetDeviceListener sets the device listener.
 func (a *AppleTVConnection) SetDeviceListener(listener DeviceListener) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	a.deviceListener = listener
 }
 
@@ -588,3 +588,63 @@ func (t TouchAction) String() string {
 		return "Unknown"
 	}
 }
+
+// WatchEventType represents the kind of change reported by Scanner.Watch.
+type WatchEventType int
+
+const (
+	// WatchEventDeviceAdded means a new device was found.
+	WatchEventDeviceAdded WatchEventType = iota + 1
+	// WatchEventServicesUpdated means services were added, removed or changed.
+	WatchEventServicesUpdated
+	// WatchEventAddressChanged means the device moved to a new address.
+	WatchEventAddressChanged
+	// WatchEventDeviceGone means all services of a device disappeared.
+	WatchEventDeviceGone
+)
+
+// String returns a string representation of the WatchEventType.
+func (w WatchEventType) String() string {
+	switch w {
+	case WatchEventDeviceAdded:
+		return "DeviceAdded"
+	case WatchEventServicesUpdated:
+		return "ServicesUpdated"
+	case WatchEventAddressChanged:
+		return "AddressChanged"
+	case WatchEventDeviceGone:
+		return "DeviceGone"
+	default:
+		return "Unknown"
+	}
+}
+
+// AddressFamily selects the IP versions used for scanning and connecting.
+type AddressFamily int
+
+const (
+	// AddressFamilyAny uses both IPv4 and IPv6 and prefers IPv4.
+	AddressFamilyAny AddressFamily = iota
+	// AddressFamilyPreferIPv6 uses both IPv4 and IPv6 and prefers IPv6.
+	AddressFamilyPreferIPv6
+	// AddressFamilyIPv4 only uses IPv4.
+	AddressFamilyIPv4
+	// AddressFamilyIPv6 only uses IPv6.
+	AddressFamilyIPv6
+)
+
+// String returns a string representation of the AddressFamily.
+func (a AddressFamily) String() string {
+	switch a {
+	case AddressFamilyAny:
+		return "Any"
+	case AddressFamilyPreferIPv6:
+		return "PreferIPv6"
+	case AddressFamilyIPv4:
+		return "IPv4"
+	case AddressFamilyIPv6:
+		return "IPv6"
+	default:
+		return "Unknown"
+	}
+}
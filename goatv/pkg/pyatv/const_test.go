@@ -247,3 +247,45 @@ func TestTouchActionString(t *testing.T) {
 		})
 	}
 }
+
+func TestWatchEventTypeString(t *testing.T) {
+	tests := []struct {
+		eventType WatchEventType
+		expected  string
+	}{
+		{WatchEventDeviceAdded, "DeviceAdded"},
+		{WatchEventServicesUpdated, "ServicesUpdated"},
+		{WatchEventAddressChanged, "AddressChanged"},
+		{WatchEventDeviceGone, "DeviceGone"},
+		{WatchEventType(0), "Unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			if got := tt.eventType.String(); got != tt.expected {
+				t.Errorf("WatchEventType.String() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAddressFamilyString(t *testing.T) {
+	tests := []struct {
+		family   AddressFamily
+		expected string
+	}{
+		{AddressFamilyAny, "Any"},
+		{AddressFamilyPreferIPv6, "PreferIPv6"},
+		{AddressFamilyIPv4, "IPv4"},
+		{AddressFamilyIPv6, "IPv6"},
+		{AddressFamily(99), "Unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			if got := tt.family.String(); got != tt.expected {
+				t.Errorf("AddressFamily.String() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
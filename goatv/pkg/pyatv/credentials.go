@@ -0,0 +1,149 @@
+package pyatv
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CredentialsType tells which kind of authentication credentials are for.
+type CredentialsType int
+
+const (
+	// CredentialsNone means there are no credentials.
+	CredentialsNone CredentialsType = iota
+	// CredentialsHAP are long-term keys from HAP pair-setup, used by MRP,
+	// AirPlay 2 and Companion.
+	CredentialsHAP
+	// CredentialsTransient means pairing is done with a fixed PIN every time
+	// a connection is made, nothing is stored.
+	CredentialsTransient
+	// CredentialsLegacy are the identifier and seed used by legacy AirPlay
+	// pairing.
+	CredentialsLegacy
+	// CredentialsDMAP is a pairing GUID or home sharing ID for DMAP.
+	CredentialsDMAP
+)
+
+// String returns a string representation of the CredentialsType.
+func (t CredentialsType) String() string {
+	switch t {
+	case CredentialsNone:
+		return "None"
+	case CredentialsHAP:
+		return "HAP"
+	case CredentialsTransient:
+		return "Transient"
+	case CredentialsLegacy:
+		return "Legacy"
+	case CredentialsDMAP:
+		return "DMAP"
+	default:
+		return "Unknown"
+	}
+}
+
+// transientLTPK is what pyatv stores as device key of transient credentials.
+var transientLTPK = []byte("transient")
+
+// Credentials are what is stored in Service.Credentials after pairing. The
+// string format is the same as pyatv uses, so credentials can be moved
+// between the two:
+//
+//   - HAP: ltpk:ltsk:atv_id:client_id, every field in hex
+//   - Legacy AirPlay: client_id:ltsk in hex, or :ltsk::client_id
+//   - DMAP: a pairing GUID ("0x" and 16 hex digits) or a home sharing ID
+type Credentials struct {
+	Type CredentialsType
+
+	LTPK     []byte // Long-term public key of the device
+	LTSK     []byte // Our long-term secret key (Ed25519 seed)
+	DeviceID []byte // Pairing identifier of the device
+	ClientID []byte // Our pairing identifier
+
+	LoginID string // DMAP pairing GUID or home sharing ID
+}
+
+var (
+	dmapPairingGUID = regexp.MustCompile(`^0x[0-9A-Fa-f]{16}$`)
+	dmapHomeSharing = regexp.MustCompile(`^[0-9A-Fa-f]{8}-([0-9A-Fa-f]{4}-){3}[0-9A-Fa-f]{12}$`)
+)
+
+// ParseCredentials parses credentials in any of the formats described by
+// Credentials. An empty string gives credentials of type CredentialsNone.
+func ParseCredentials(credentials string) (*Credentials, error) {
+	if credentials == "" {
+		return &Credentials{Type: CredentialsNone}, nil
+	}
+	if dmapPairingGUID.MatchString(credentials) || dmapHomeSharing.MatchString(credentials) {
+		return &Credentials{Type: CredentialsDMAP, LoginID: credentials}, nil
+	}
+
+	parts := strings.Split(credentials, ":")
+	fields := make([][]byte, len(parts))
+	for i, part := range parts {
+		value, err := hex.DecodeString(part)
+		if err != nil {
+			return nil, fmt.Errorf("%w: field %d: %v", ErrInvalidCredentials, i+1, err)
+		}
+		fields[i] = value
+	}
+
+	switch len(fields) {
+	case 2:
+		c := &Credentials{Type: CredentialsLegacy, ClientID: fields[0], LTSK: fields[1]}
+		if len(c.ClientID) == 0 || len(c.LTSK) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%w: expected identifier and %d byte seed", ErrInvalidCredentials, ed25519.SeedSize)
+		}
+		return c, nil
+	case 4:
+		return hapCredentials(fields[0], fields[1], fields[2], fields[3])
+	default:
+		return nil, fmt.Errorf("%w: expected two or four fields, got %d", ErrInvalidCredentials, len(fields))
+	}
+}
+
+// hapCredentials validates the four fields of HAP credentials.
+func hapCredentials(ltpk, ltsk, deviceID, clientID []byte) (*Credentials, error) {
+	c := &Credentials{LTPK: ltpk, LTSK: ltsk, DeviceID: deviceID, ClientID: clientID}
+	switch {
+	case len(ltpk) == 0 && len(ltsk) == 0 && len(deviceID) == 0 && len(clientID) == 0:
+		c.Type = CredentialsNone
+	case bytes.Equal(ltpk, transientLTPK):
+		c.Type = CredentialsTransient
+	case len(ltpk) == 0 && len(ltsk) == ed25519.SeedSize && len(deviceID) == 0 && len(clientID) != 0:
+		// How pyatv stores legacy AirPlay credentials
+		c.Type = CredentialsLegacy
+	case len(ltpk) != ed25519.PublicKeySize:
+		return nil, fmt.Errorf("%w: expected %d byte device key, got %d", ErrInvalidCredentials, ed25519.PublicKeySize, len(ltpk))
+	case len(ltsk) != ed25519.SeedSize:
+		return nil, fmt.Errorf("%w: expected %d byte client key, got %d", ErrInvalidCredentials, ed25519.SeedSize, len(ltsk))
+	case len(deviceID) == 0 || len(clientID) == 0:
+		return nil, fmt.Errorf("%w: missing pairing identifier", ErrInvalidCredentials)
+	default:
+		c.Type = CredentialsHAP
+	}
+	return c, nil
+}
+
+// String formats credentials so that ParseCredentials can read them back.
+func (c *Credentials) String() string {
+	switch c.Type {
+	case CredentialsNone:
+		return ""
+	case CredentialsLegacy:
+		return hex.EncodeToString(c.ClientID) + ":" + hex.EncodeToString(c.LTSK)
+	case CredentialsDMAP:
+		return c.LoginID
+	default:
+		return strings.Join([]string{
+			hex.EncodeToString(c.LTPK),
+			hex.EncodeToString(c.LTSK),
+			hex.EncodeToString(c.DeviceID),
+			hex.EncodeToString(c.ClientID),
+		}, ":")
+	}
+}
@@ -0,0 +1,106 @@
+package pyatv
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseCredentials(t *testing.T) {
+	ltpk := strings.Repeat("ab", 32)
+	ltsk := strings.Repeat("cd", 32)
+
+	tests := []struct {
+		name        string
+		credentials string
+		wantType    CredentialsType
+		wantString  string
+	}{
+		{"empty", "", CredentialsNone, ""},
+		{"empty fields", ":::", CredentialsNone, ""},
+		{"hap", ltpk + ":" + ltsk + ":01:02", CredentialsHAP, ltpk + ":" + ltsk + ":01:02"},
+		{"hap uppercase", strings.ToUpper(ltpk+":"+ltsk) + ":0A:0B", CredentialsHAP, ltpk + ":" + ltsk + ":0a:0b"},
+		{"transient", "7472616e7369656e74:::", CredentialsTransient, "7472616e7369656e74:::"},
+		// From the fake AirPlay device in the pyatv tests
+		{
+			"legacy",
+			"75FBEEC773CFC563:8F06696F2542D70DF59286C761695C485F815BE3D152849E1361282D46AB1493",
+			CredentialsLegacy,
+			"75fbeec773cfc563:8f06696f2542d70df59286c761695c485f815be3d152849e1361282d46ab1493",
+		},
+		{
+			"legacy from pyatv",
+			":8F06696F2542D70DF59286C761695C485F815BE3D152849E1361282D46AB1493::75FBEEC773CFC563",
+			CredentialsLegacy,
+			"75fbeec773cfc563:8f06696f2542d70df59286c761695c485f815be3d152849e1361282d46ab1493",
+		},
+		{"dmap pairing guid", "0x0000000000000001", CredentialsDMAP, "0x0000000000000001"},
+		{"dmap home sharing", "12345678-90AB-CDEF-0123-4567890ABCDE", CredentialsDMAP, "12345678-90AB-CDEF-0123-4567890ABCDE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			credentials, err := ParseCredentials(tt.credentials)
+			if err != nil {
+				t.Fatalf("ParseCredentials() error = %v", err)
+			}
+			if credentials.Type != tt.wantType {
+				t.Errorf("Expected type %s, got %s", tt.wantType, credentials.Type)
+			}
+			if got := credentials.String(); got != tt.wantString {
+				t.Errorf("Expected %q, got %q", tt.wantString, got)
+			}
+		})
+	}
+}
+
+func TestParseCredentialsFields(t *testing.T) {
+	credentials, err := ParseCredentials(strings.Repeat("ab", 32) + ":" + strings.Repeat("cd", 32) + ":6174765f6964:636c69656e74")
+	if err != nil {
+		t.Fatalf("ParseCredentials() error = %v", err)
+	}
+	if !bytes.Equal(credentials.LTPK, bytes.Repeat([]byte{0xAB}, 32)) {
+		t.Errorf("Unexpected LTPK %x", credentials.LTPK)
+	}
+	if !bytes.Equal(credentials.LTSK, bytes.Repeat([]byte{0xCD}, 32)) {
+		t.Errorf("Unexpected LTSK %x", credentials.LTSK)
+	}
+	if string(credentials.DeviceID) != "atv_id" {
+		t.Errorf("Expected device ID %q, got %q", "atv_id", credentials.DeviceID)
+	}
+	if string(credentials.ClientID) != "client" {
+		t.Errorf("Expected client ID %q, got %q", "client", credentials.ClientID)
+	}
+}
+
+func TestParseCredentialsInvalid(t *testing.T) {
+	ltpk := strings.Repeat("ab", 32)
+	ltsk := strings.Repeat("cd", 32)
+
+	tests := []struct {
+		name        string
+		credentials string
+	}{
+		{"garbage", "invalid"},
+		{"three fields", "01:02:03"},
+		{"five fields", "01:02:03:04:05"},
+		{"not hex", ltpk + ":" + ltsk + ":01:zz"},
+		{"short ltpk", "abcd:" + ltsk + ":01:02"},
+		{"short ltsk", ltpk + ":abcd:01:02"},
+		{"missing device id", ltpk + ":" + ltsk + "::02"},
+		{"missing client id", ltpk + ":" + ltsk + ":01:"},
+		{"legacy short seed", "75FBEEC773CFC563:8F06"},
+		{"legacy missing identifier", ":" + ltsk},
+		{"legacy from pyatv short seed", ":8F06::75FBEEC773CFC563"},
+		{"dmap short guid", "0x00001"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseCredentials(tt.credentials); !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("Expected ErrInvalidCredentials, got %v", err)
+			}
+		})
+	}
+}
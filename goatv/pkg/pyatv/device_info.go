@@ -0,0 +1,152 @@
+package pyatv
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// modelList maps raw model identifiers to device models.
+var modelList = map[string]DeviceModel{
+	"AirPort4,107":            DeviceModelAirPortExpress,
+	"AirPort10,115":           DeviceModelAirPortExpressGen2,
+	"AppleTV1,1":              DeviceModelAppleTVGen1,
+	"AppleTV2,1":              DeviceModelGen2,
+	"AppleTV3,1":              DeviceModelGen3,
+	"AppleTV3,2":              DeviceModelGen3,
+	"AppleTV5,3":              DeviceModelGen4,
+	"AppleTV6,2":              DeviceModelGen4K,
+	"AppleTV11,1":             DeviceModelAppleTV4KGen2,
+	"AppleTV14,1":             DeviceModelAppleTV4KGen3,
+	"AudioAccessory1,1":       DeviceModelHomePod,
+	"AudioAccessory1,2":       DeviceModelHomePod,
+	"AudioAccessory5,1":       DeviceModelHomePodMini,
+	"AudioAccessorySingle5,1": DeviceModelHomePodMini,
+	"AudioAccessory6,1":       DeviceModelHomePodGen2,
+}
+
+// internalNameList maps internal Apple board names to device models.
+var internalNameList = map[string]DeviceModel{
+	"K66AP":   DeviceModelGen2,
+	"J33AP":   DeviceModelGen3,
+	"J33IAP":  DeviceModelGen3,
+	"J42dAP":  DeviceModelGen4,
+	"J105aAP": DeviceModelGen4K,
+	"J305AP":  DeviceModelAppleTV4KGen2,
+	"J255AP":  DeviceModelAppleTV4KGen3,
+}
+
+// versionList maps tvOS build numbers to versions.
+var versionList = map[string]string{
+	"17J586": "13.0",
+	"17K82":  "13.2",
+	"17K449": "13.3",
+	"17K795": "13.3.1",
+	"17L256": "13.4",
+	"17L562": "13.4.5",
+	"17L570": "13.4.6",
+	"17M61":  "13.4.8",
+	"18J386": "14.0",
+	"18J400": "14.0.1",
+	"18J411": "14.0.2",
+	"18K57":  "14.2",
+	"18K561": "14.3",
+	"18K802": "14.4",
+	"18L204": "14.5",
+	"18L569": "14.6",
+	"18M60":  "14.7",
+	"19J346": "15.0",
+	"19J572": "15.1",
+	"19J581": "15.1.1",
+	"19K53":  "15.2",
+	"19K547": "15.3",
+	"19L440": "15.4",
+	"19L452": "15.4.1",
+	"19L570": "15.5",
+	"19L580": "15.5.1",
+	"19M65":  "15.6",
+	"20J373": "16.0",
+	"20K71":  "16.1",
+	"20K80":  "16.1.1",
+	"20K362": "16.2",
+	"20K650": "16.3",
+	"20K661": "16.3.1",
+	"20K672": "16.3.2",
+	"20K680": "16.3.3",
+	"20L497": "16.4",
+	"20L498": "16.4.1",
+	"20L563": "16.5",
+	"20M73":  "16.6",
+	"21J354": "17.0",
+	"21K69":  "17.1",
+	"21K365": "17.2",
+	"21K646": "17.3",
+	"21L227": "17.4",
+	"21L569": "17.5",
+	"21L580": "17.5.1",
+	"21M71":  "17.6",
+	"21M80":  "17.6.1",
+	"22J357": "18.0",
+	"22J580": "18.1",
+}
+
+var (
+	// macIdentifier matches model identifiers of Macs, e.g. "MacBookAir10,1".
+	macIdentifier = regexp.MustCompile(`^(MacBookAir|MacBookPro|iMac|Macmini|MacPro|Mac)\d+,\d+$`)
+
+	// buildMajor matches the major part of a build number, e.g. "17" in "17K795".
+	buildMajor = regexp.MustCompile(`^(\d+)[A-Z]`)
+)
+
+// lookupModel returns the device model for a raw model identifier.
+func lookupModel(identifier string) DeviceModel {
+	if model, ok := modelList[identifier]; ok {
+		return model
+	}
+	if model, ok := internalNameList[identifier]; ok {
+		return model
+	}
+	if macIdentifier.MatchString(identifier) {
+		return DeviceModelMusic
+	}
+	return DeviceModelUnknown
+}
+
+// lookupVersion returns the OS version for a build number. Unknown builds
+// only give the major version, e.g. "13.x" for "17A123".
+func lookupVersion(build string) string {
+	if version, ok := versionList[build]; ok {
+		return version
+	}
+
+	if match := buildMajor.FindStringSubmatch(build); match != nil {
+		major, _ := strconv.Atoi(match[1])
+		return strconv.Itoa(major-4) + ".x"
+	}
+
+	return ""
+}
+
+// lookupOS returns the operating system running on a raw model identifier.
+func lookupOS(identifier string) OperatingSystem {
+	if macIdentifier.MatchString(identifier) {
+		return OperatingSystemMacOS
+	}
+	return modelOS(lookupModel(identifier))
+}
+
+// modelOS returns the operating system a device model runs.
+func modelOS(model DeviceModel) OperatingSystem {
+	switch model {
+	case DeviceModelAirPortExpress, DeviceModelAirPortExpressGen2:
+		return OperatingSystemAirPortOS
+	case DeviceModelAppleTVGen1, DeviceModelGen2, DeviceModelGen3:
+		return OperatingSystemLegacy
+	case DeviceModelGen4, DeviceModelGen4K, DeviceModelAppleTV4KGen2, DeviceModelAppleTV4KGen3,
+		DeviceModelHomePod, DeviceModelHomePodMini, DeviceModelHomePodGen2:
+		return OperatingSystemTvOS
+	case DeviceModelMusic:
+		return OperatingSystemMacOS
+	default:
+		return OperatingSystemUnknown
+	}
+}
@@ -0,0 +1,103 @@
+package pyatv
+
+import "testing"
+
+func TestLookupModel(t *testing.T) {
+	tests := []struct {
+		identifier string
+		expected   DeviceModel
+	}{
+		{"AppleTV1,1", DeviceModelAppleTVGen1},
+		{"AppleTV2,1", DeviceModelGen2},
+		{"AppleTV3,2", DeviceModelGen3},
+		{"AppleTV5,3", DeviceModelGen4},
+		{"AppleTV6,2", DeviceModelGen4K},
+		{"AppleTV11,1", DeviceModelAppleTV4KGen2},
+		{"AppleTV14,1", DeviceModelAppleTV4KGen3},
+		{"AudioAccessory1,1", DeviceModelHomePod},
+		{"AudioAccessory5,1", DeviceModelHomePodMini},
+		{"AudioAccessorySingle5,1", DeviceModelHomePodMini},
+		{"AudioAccessory6,1", DeviceModelHomePodGen2},
+		{"AirPort4,107", DeviceModelAirPortExpress},
+		{"AirPort10,115", DeviceModelAirPortExpressGen2},
+		{"J105aAP", DeviceModelGen4K},
+		{"MacBookPro16,1", DeviceModelMusic},
+		{"iPhone10,1", DeviceModelUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.identifier, func(t *testing.T) {
+			if got := lookupModel(tt.identifier); got != tt.expected {
+				t.Errorf("lookupModel(%q) = %v, want %v", tt.identifier, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLookupVersion(t *testing.T) {
+	tests := []struct {
+		build    string
+		expected string
+	}{
+		{"17K795", "13.3.1"},
+		{"20K362", "16.2"},
+		{"16A123", "12.x"},
+		{"", ""},
+		{"invalid", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.build, func(t *testing.T) {
+			if got := lookupVersion(tt.build); got != tt.expected {
+				t.Errorf("lookupVersion(%q) = %q, want %q", tt.build, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLookupOS(t *testing.T) {
+	tests := []struct {
+		identifier string
+		expected   OperatingSystem
+	}{
+		{"AppleTV3,1", OperatingSystemLegacy},
+		{"AppleTV6,2", OperatingSystemTvOS},
+		{"AudioAccessory6,1", OperatingSystemTvOS},
+		{"AirPort10,115", OperatingSystemAirPortOS},
+		{"Macmini9,1", OperatingSystemMacOS},
+		{"Unknown1,1", OperatingSystemUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.identifier, func(t *testing.T) {
+			if got := lookupOS(tt.identifier); got != tt.expected {
+				t.Errorf("lookupOS(%q) = %v, want %v", tt.identifier, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestScannerUpdateDeviceInfo(t *testing.T) {
+	scanner := NewScanner(ScanOptions{})
+	config := &Config{DeviceInfo: &DeviceInfo{}}
+
+	scanner.updateDeviceInfo(config, map[string]string{
+		"SystemBuildVersion": "17K795",
+		"macAddress":         "AA:BB:CC:DD:EE:FF",
+	}, ProtocolMRP)
+	scanner.updateDeviceInfo(config, map[string]string{"am": "AppleTV6,2"}, ProtocolRAOP)
+
+	info := config.DeviceInfo
+	if info.Model != DeviceModelGen4K {
+		t.Errorf("Expected model %v, got %v", DeviceModelGen4K, info.Model)
+	}
+	if info.OperatingSystem != OperatingSystemTvOS {
+		t.Errorf("Expected OS %v, got %v", OperatingSystemTvOS, info.OperatingSystem)
+	}
+	if info.Version != "13.3.1" {
+		t.Errorf("Expected version 13.3.1 from build number, got %q", info.Version)
+	}
+	if info.MAC != "AA:BB:CC:DD:EE:FF" {
+		t.Errorf("Expected MAC from MRP, got %q", info.MAC)
+	}
+}
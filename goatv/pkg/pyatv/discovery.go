@@ -0,0 +1,110 @@
+package pyatv
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DiscoveryBackend finds DNS-SD service instances on behalf of a Scanner.
+type DiscoveryBackend interface {
+	// Browse looks for instances of services, e.g. "_airplay._tcp", and calls
+	// found for every entry that is found, updated or removed. Removed entries
+	// have a zero TTL. found may be called from several goroutines at once.
+	// Browse returns when ctx is done or when there is nothing more to find.
+	// An error means browsing was not possible at all; problems that only
+	// affect part of the result are reported by other means.
+	Browse(ctx context.Context, services []string, found func(*ServiceEntry)) error
+}
+
+// MulticastBackend browses with mDNS on the local network.
+type MulticastBackend struct {
+	Interfaces       []string      // Names of interfaces to use, all multicast capable ones if empty
+	AddressFamily    AddressFamily // IP versions to use
+	MaxQueryInterval time.Duration // Cap for the doubling query interval, one second if zero
+}
+
+// Browse implements DiscoveryBackend. It only returns once ctx is done.
+func (b *MulticastBackend) Browse(ctx context.Context, services []string, found func(*ServiceEntry)) error {
+	ifaces, err := selectInterfaces(b.Interfaces)
+	if err != nil {
+		return err
+	}
+
+	maxInterval := b.MaxQueryInterval
+	if maxInterval == 0 {
+		maxInterval = time.Second
+	}
+
+	browser, err := newMDNSBrowser(services, ifaces, b.AddressFamily, maxInterval)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrConnectionFailed, err)
+	}
+	return browser.run(ctx, found)
+}
+
+// UnicastBackend sends DNS-SD queries straight to a list of hosts, which also
+// works across subnets where multicast does not reach. Hosts are knocked on
+// while waiting, which wakes devices sleeping behind a sleep proxy.
+type UnicastBackend struct {
+	Hosts   []string
+	Port    int             // Port to send queries to, the mDNS port if zero
+	Timeout time.Duration   // Time to wait for each host, only limited by ctx if zero
+	OnError func(err error) // Called for hosts that could not be queried
+}
+
+// Browse implements DiscoveryBackend. It returns once every host has answered
+// or timed out.
+func (b *UnicastBackend) Browse(ctx context.Context, services []string, found func(*ServiceEntry)) error {
+	port := b.Port
+	if port == 0 {
+		port = mdnsPort
+	}
+
+	var wg sync.WaitGroup
+	for _, host := range b.Hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+
+			queryCtx := ctx
+			if b.Timeout > 0 {
+				var cancel context.CancelFunc
+				queryCtx, cancel = context.WithTimeout(ctx, b.Timeout)
+				defer cancel()
+			}
+
+			knockCtx, stopKnocking := context.WithCancel(queryCtx)
+			defer stopKnocking()
+			go knocker(knockCtx, host, knockPorts)
+
+			if err := unicastQuery(queryCtx, host, port, services, found); err != nil && b.OnError != nil {
+				b.OnError(fmt.Errorf("%w: failed to query %s: %v", ErrConnectionFailed, host, err))
+			}
+		}(host)
+	}
+	wg.Wait()
+	return nil
+}
+
+// StaticBackend reports a fixed list of entries without touching the network.
+// It is useful for devices with known addresses and for testing.
+type StaticBackend struct {
+	Entries []*ServiceEntry
+}
+
+// Browse implements DiscoveryBackend. It reports every entry of a requested
+// service once and returns.
+func (b *StaticBackend) Browse(ctx context.Context, services []string, found func(*ServiceEntry)) error {
+	for _, entry := range b.Entries {
+		if ctx.Err() != nil {
+			break
+		}
+		if isQueriedService(entry.Name, services) {
+			copied := *entry
+			found(&copied)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package pyatv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type failingBackend struct{}
+
+func (failingBackend) Browse(ctx context.Context, services []string, found func(*ServiceEntry)) error {
+	return ErrConnectionFailed
+}
+
+// blockingBackend reports its entries and then keeps browsing until ctx is
+// done, like MulticastBackend.
+type blockingBackend struct {
+	StaticBackend
+}
+
+func (b *blockingBackend) Browse(ctx context.Context, services []string, found func(*ServiceEntry)) error {
+	b.StaticBackend.Browse(ctx, services, found)
+	<-ctx.Done()
+	return nil
+}
+
+func staticTestBackend() *StaticBackend {
+	return &StaticBackend{Entries: []*ServiceEntry{
+		testEntry("Living Room._airplay._tcp.local.", "10.0.0.2", "deviceid=AA:BB:CC:DD:EE:FF", "model=AppleTV6,2"),
+		testEntry("AABBCCDDEEFF@Living Room._raop._tcp.local.", "10.0.0.2", "am=AppleTV6,2"),
+		testEntry("Kitchen._airplay._tcp.local.", "10.0.0.3", "deviceid=11:22:33:44:55:66"),
+		testEntry("Printer._ipp._tcp.local.", "10.0.0.4"),
+	}}
+}
+
+func TestDiscoverWithStaticBackend(t *testing.T) {
+	scanner := NewScanner(ScanOptions{Backend: staticTestBackend(), Timeout: time.Second})
+
+	devices, err := scanner.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Discover() error = %v", err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("Expected 2 devices, got %d", len(devices))
+	}
+}
+
+func TestDiscoverIdentifierStopsEarly(t *testing.T) {
+	backend := &blockingBackend{*staticTestBackend()}
+	scanner := NewScanner(ScanOptions{Backend: backend, Identifier: "11:22:33:44:55:66", Timeout: time.Minute})
+
+	start := time.Now()
+	devices, err := scanner.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Discover() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected Discover to stop once the device was found, took %s", elapsed)
+	}
+	if len(devices) != 1 || devices[0].Name != "Kitchen" {
+		t.Errorf("Expected only Kitchen, got %v", devices)
+	}
+}
+
+func TestDiscoverQueriesAllServices(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+
+	sent := make(chan []byte, 16)
+	socket := &mdnsSocket{
+		conn: conn,
+		read: func(b []byte) (int, int, net.IP, error) {
+			n, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return 0, 0, nil, err
+			}
+			return n, 0, addr.IP, nil
+		},
+		send: func(b []byte, iface *net.Interface) error {
+			sent <- append([]byte(nil), b...)
+			return nil
+		},
+	}
+	services := NewScanner(ScanOptions{}).serviceTypes()
+	browser := &mdnsBrowser{
+		services:    services,
+		maxInterval: time.Second,
+		sockets:     []*mdnsSocket{socket},
+		parser:      newServiceParser(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- browser.run(ctx, func(*ServiceEntry) {}) }()
+
+	var packet []byte
+	select {
+	case packet = <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a query to be sent")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("run() error = %v", err)
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(packet); err != nil {
+		t.Fatalf("Unpack() error = %v", err)
+	}
+	if len(msg.Question) != len(services) {
+		t.Fatalf("Expected %d questions in one query, got %v", len(services), msg.Question)
+	}
+	for i, service := range services {
+		question := msg.Question[i]
+		if question.Name != service+".local." || question.Qtype != dns.TypePTR {
+			t.Errorf("Expected PTR question for %s, got %v", service, question)
+		}
+	}
+}
+
+func TestDiscoverBackendError(t *testing.T) {
+	scanner := NewScanner(ScanOptions{Backend: failingBackend{}})
+
+	if _, err := scanner.Discover(context.Background()); !errors.Is(err, ErrConnectionFailed) {
+		t.Errorf("Expected ErrConnectionFailed, got %v", err)
+	}
+}
+
+func TestWatchReportsBackendErrors(t *testing.T) {
+	errs := make(chan error, 1)
+	scanner := NewScanner(ScanOptions{
+		Backend: failingBackend{},
+		OnError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := scanner.Watch(ctx); err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrConnectionFailed) {
+			t.Errorf("Expected ErrConnectionFailed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected error to be reported")
+	}
+}
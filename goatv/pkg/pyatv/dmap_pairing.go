@@ -0,0 +1,251 @@
+package pyatv
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DMAP pairing works the other way around compared to HAP: we announce
+// ourselves as a remote with _touch-remote._tcp, the user picks it in the
+// settings of the device and enters the PIN there. The device then calls
+// /pair on our server with an MD5 of the pairing GUID and PIN.
+
+// dmapRemoteServiceType is the service type remotes announce.
+const dmapRemoteServiceType = "_touch-remote._tcp"
+
+// dmapPublishFunc publishes the pairing service of a remote listening on port
+// and returns something that stops publishing it when closed.
+type dmapPublishFunc func(name string, port int, properties map[string]string) (io.Closer, error)
+
+// dmapPairingHandler implements PairingHandler for DMAP by running the server
+// the device connects to.
+type dmapPairingHandler struct {
+	config  *Config
+	service *Service
+	opts    PairOptions
+	name    string
+	guid    string // Pairing GUID as 16 hex digits, without 0x
+	publish dmapPublishFunc
+
+	mu     sync.Mutex
+	pin    string
+	paired bool
+
+	server    *http.Server
+	publisher io.Closer
+}
+
+func newDMAPPairingHandler(ctx context.Context, config *Config, service *Service, opts PairOptions) (*dmapPairingHandler, error) {
+	guid := make([]byte, 8)
+	if _, err := rand.Read(guid); err != nil {
+		return nil, err
+	}
+	return &dmapPairingHandler{
+		config:  config,
+		service: service,
+		opts:    opts,
+		name:    controllerName(ctx, config, opts.Name, opts.Storage),
+		guid:    strings.ToUpper(hex.EncodeToString(guid)),
+		publish: publishDMAPRemote,
+	}, nil
+}
+
+// Service returns the service being paired.
+func (h *dmapPairingHandler) Service() *Service {
+	return h.service
+}
+
+// Close stops the pairing server and removes the published service.
+func (h *dmapPairingHandler) Close() error {
+	var errs []error
+	if h.publisher != nil {
+		errs = append(errs, h.publisher.Close())
+		h.publisher = nil
+	}
+	if h.server != nil {
+		errs = append(errs, h.server.Close())
+		h.server = nil
+	}
+	return errors.Join(errs...)
+}
+
+// Pin sets the PIN the user enters on the device. Any PIN is accepted if none
+// is set.
+func (h *dmapPairingHandler) Pin(pin string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pin = pin
+}
+
+// DeviceProvidesPin returns false, the PIN is entered on the device.
+func (h *dmapPairingHandler) DeviceProvidesPin() bool {
+	return false
+}
+
+// HasPaired returns true once the device has called back with the right PIN.
+func (h *dmapPairingHandler) HasPaired() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.paired
+}
+
+// Begin starts the pairing server and publishes it, after which the remote
+// shows up in the settings of the device.
+func (h *dmapPairingHandler) Begin(ctx context.Context) error {
+	if h.server != nil {
+		return fmt.Errorf("%w: pairing already started", ErrInvalidState)
+	}
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrConnectionFailed, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pair", h.handlePair)
+	h.server = &http.Server{Handler: mux}
+	go h.server.Serve(listener)
+
+	publisher, err := h.publish(h.name, listener.Addr().(*net.TCPAddr).Port, map[string]string{
+		"DvNm":    h.name,
+		"RemV":    "10000",
+		"DvTy":    "iPod",
+		"RemN":    "Remote",
+		"txtvers": "1",
+		"Pair":    h.guid,
+	})
+	if err != nil {
+		h.Close()
+		return err
+	}
+	h.publisher = publisher
+	return nil
+}
+
+// Finish stops the pairing server. The pairing GUID is stored as credentials
+// if the device has paired.
+func (h *dmapPairingHandler) Finish(ctx context.Context) error {
+	if h.server == nil {
+		return fmt.Errorf("%w: pairing not started", ErrInvalidState)
+	}
+	h.Close()
+
+	if !h.HasPaired() {
+		return fmt.Errorf("%w: no pairing request from device", ErrPairing)
+	}
+	credentials := &Credentials{Type: CredentialsDMAP, LoginID: "0x" + h.guid}
+	return saveCredentials(ctx, h.config, h.service, credentials, h.opts.Storage)
+}
+
+// handlePair answers the device, which sends the pairing code and its name.
+func (h *dmapPairingHandler) handlePair(w http.ResponseWriter, r *http.Request) {
+	code := strings.ToLower(r.URL.Query().Get("pairingcode"))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pin != "" && code != dmapPairingCode(h.guid, h.pin) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.paired = true
+
+	guid, _ := strconv.ParseUint(h.guid, 16, 64)
+	w.Write(dmapContainer("cmpa",
+		dmapUint64("cmpg", guid),
+		dmapString("cmnm", h.name),
+		dmapString("cmty", "iPhone"),
+	))
+}
+
+// dmapPairingCode is what the device sends for a PIN: the MD5 of the pairing
+// GUID followed by every PIN digit as UTF-16LE.
+func dmapPairingCode(guid, pin string) string {
+	if len(pin) < 4 {
+		pin = strings.Repeat("0", 4-len(pin)) + pin
+	}
+	data := []byte(guid)
+	for _, c := range []byte(pin) {
+		data = append(data, c, 0)
+	}
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// dmapTag encodes a DMAP tag: its name, the data length as 32 bit big
+// endian and the data.
+func dmapTag(name string, data []byte) []byte {
+	tag := binary.BigEndian.AppendUint32([]byte(name), uint32(len(data)))
+	return append(tag, data...)
+}
+
+func dmapContainer(name string, tags ...[]byte) []byte {
+	return dmapTag(name, concat(tags...))
+}
+
+func dmapUint64(name string, value uint64) []byte {
+	return dmapTag(name, binary.BigEndian.AppendUint64(nil, value))
+}
+
+func dmapString(name, value string) []byte {
+	return dmapTag(name, []byte(value))
+}
+
+// publishDMAPRemote publishes the remote on every private IPv4 address, with
+// the address as instance name like iTunes does.
+func publishDMAPRemote(name string, port int, properties map[string]string) (io.Closer, error) {
+	ifaces, err := selectInterfaces(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var services []*mdnsService
+	for _, ip := range privateIPv4Addresses(ifaces) {
+		services = append(services, &mdnsService{
+			Type:       dmapRemoteServiceType,
+			Name:       fmt.Sprintf("%040d", binary.BigEndian.Uint32(ip)),
+			Address:    ip,
+			Port:       port,
+			Properties: properties,
+		})
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("%w: no private IPv4 address to publish %s on", ErrConnectionFailed, name)
+	}
+
+	publisher, err := publishMDNS(services, ifaces)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConnectionFailed, err)
+	}
+	return publisher, nil
+}
+
+// privateIPv4Addresses returns the private IPv4 addresses of interfaces.
+func privateIPv4Addresses(ifaces []net.Interface) []net.IP {
+	var result []net.IP
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip := ipnet.IP.To4(); ip != nil && ip.IsPrivate() {
+				result = append(result, ip)
+			}
+		}
+	}
+	return result
+}
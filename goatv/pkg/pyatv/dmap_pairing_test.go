@@ -0,0 +1,208 @@
+package pyatv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDMAPPairingCode(t *testing.T) {
+	// From the pyatv DMAP pairing tests
+	tests := []struct {
+		guid     string
+		pin      string
+		expected string
+	}{
+		{"0000000000000001", "1234", "690e6ff61e0d7c747654a42aed17047d"},
+		{"1234ABCDE56789FF", "5555", "58ad1d195b6daa58aa2ea29dc25b81c3"},
+		{"7D1324235F535AE7", "1", "a34c3361c7d57d61ca41f62a8042f069"},
+		{"5B03A9CF4A983143", "1234", "7af2d0b8629de3c704d40a14c9e8cb93"},
+	}
+
+	for _, tt := range tests {
+		if got := dmapPairingCode(tt.guid, tt.pin); got != tt.expected {
+			t.Errorf("Expected %s for %s and PIN %s, got %s", tt.expected, tt.guid, tt.pin, got)
+		}
+	}
+}
+
+// testPublisher records what a dmapPairingHandler publishes.
+type testPublisher struct {
+	mu         sync.Mutex
+	port       int
+	properties map[string]string
+	closed     bool
+}
+
+func (p *testPublisher) publish(name string, port int, properties map[string]string) (io.Closer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.port, p.properties = port, properties
+	return p, nil
+}
+
+func (p *testPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+func startDMAPPairing(t *testing.T, storage Storage) (*dmapPairingHandler, *testPublisher, *Config) {
+	t.Helper()
+	service := &Service{Identifier: "AABBCCDDEEFF", Protocol: ProtocolDMAP, Port: 3689, Enabled: true}
+	config := &Config{Name: "Living Room", Services: []*Service{service}}
+
+	handler, err := Pair(context.Background(), config, ProtocolDMAP, PairOptions{Storage: storage})
+	if err != nil {
+		t.Fatalf("Pair() error = %v", err)
+	}
+	dmap, ok := handler.(*dmapPairingHandler)
+	if !ok {
+		t.Fatalf("Expected DMAP pairing handler, got %T", handler)
+	}
+	dmap.guid = "0000000000000001"
+
+	publisher := &testPublisher{}
+	dmap.publish = publisher.publish
+	if err := dmap.Begin(context.Background()); err != nil {
+		t.Fatalf("Begin() error = %v", err)
+	}
+	t.Cleanup(func() { dmap.Close() })
+	return dmap, publisher, config
+}
+
+func requestDMAPPairing(t *testing.T, publisher *testPublisher, code string) *http.Response {
+	t.Helper()
+	url := fmt.Sprintf("http://127.0.0.1:%d/pair?pairingcode=%s&servicename=test", publisher.port, code)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestDMAPPairing(t *testing.T) {
+	storage := NewMemoryStorage()
+	handler, publisher, config := startDMAPPairing(t, storage)
+	handler.Pin("1234")
+
+	if handler.DeviceProvidesPin() {
+		t.Error("Expected PIN to be entered on the device")
+	}
+	if publisher.properties["Pair"] != "0000000000000001" || publisher.properties["DvNm"] != defaultClientName {
+		t.Errorf("Unexpected properties %v", publisher.properties)
+	}
+
+	resp := requestDMAPPairing(t, publisher, "690E6FF61E0D7C747654A42AED17047D")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	expected := dmapContainer("cmpa",
+		dmapTag("cmpg", []byte{0, 0, 0, 0, 0, 0, 0, 1}),
+		dmapTag("cmnm", []byte(defaultClientName)),
+		dmapTag("cmty", []byte("iPhone")),
+	)
+	if !bytes.Equal(body, expected) {
+		t.Errorf("Expected response %x, got %x", expected, body)
+	}
+
+	if err := handler.Finish(context.Background()); err != nil {
+		t.Fatalf("Finish() error = %v", err)
+	}
+	if !handler.HasPaired() {
+		t.Error("Expected handler to have paired")
+	}
+	if !publisher.closed {
+		t.Error("Expected service to be unpublished")
+	}
+	if got := config.Services[0].Credentials; got != "0x0000000000000001" {
+		t.Errorf("Expected credentials 0x0000000000000001, got %q", got)
+	}
+
+	settings, err := storage.GetSettings(context.Background(), config)
+	if err != nil {
+		t.Fatalf("GetSettings() error = %v", err)
+	}
+	if settings.Protocols.DMAP[settingCredentials] != "0x0000000000000001" {
+		t.Errorf("Expected credentials in storage, got %v", settings.Protocols.DMAP[settingCredentials])
+	}
+}
+
+func TestDMAPPairingWrongPin(t *testing.T) {
+	handler, publisher, config := startDMAPPairing(t, nil)
+	handler.Pin("1111")
+
+	resp := requestDMAPPairing(t, publisher, "690E6FF61E0D7C747654A42AED17047D")
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", resp.StatusCode)
+	}
+	if err := handler.Finish(context.Background()); !errors.Is(err, ErrPairing) {
+		t.Errorf("Expected ErrPairing, got %v", err)
+	}
+	if config.Services[0].Credentials != "" {
+		t.Errorf("Expected no credentials, got %q", config.Services[0].Credentials)
+	}
+}
+
+func TestDMAPPairingAnyPin(t *testing.T) {
+	handler, publisher, _ := startDMAPPairing(t, nil)
+
+	if resp := requestDMAPPairing(t, publisher, "00000000000000000000000000000000"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if !handler.HasPaired() {
+		t.Error("Expected any PIN to be accepted when none is set")
+	}
+}
+
+func TestMDNSServiceRecords(t *testing.T) {
+	service := &mdnsService{
+		Type:       dmapRemoteServiceType,
+		Name:       fmt.Sprintf("%040d", binary.BigEndian.Uint32([]byte{10, 0, 0, 1})),
+		Address:    []byte{10, 0, 0, 1},
+		Port:       1234,
+		Properties: map[string]string{"Pair": "0000000000000001", "txtvers": "1"},
+	}
+
+	// Records must be understood by our own discovery
+	msg := new(dns.Msg)
+	msg.Answer = service.records(mdnsRecordTTL)
+	parser := newServiceParser()
+	keys := parser.add(msg)
+	if len(keys) != 1 {
+		t.Fatalf("Expected one instance, got %v", keys)
+	}
+	entry := parser.entry(keys[0])
+	if entry.Name != "0000000000000000000000000000000167772161._touch-remote._tcp.local." {
+		t.Errorf("Unexpected name %q", entry.Name)
+	}
+	if entry.Port != 1234 || len(entry.Addresses) != 1 || !entry.Addresses[0].IP.Equal(service.Address) {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+	if len(entry.InfoFields) != 2 || entry.InfoFields[0] != "Pair=0000000000000001" {
+		t.Errorf("Unexpected TXT %v", entry.InfoFields)
+	}
+
+	for _, question := range []dns.Question{
+		{Name: "_touch-remote._tcp.local.", Qtype: dns.TypePTR},
+		{Name: entry.Name, Qtype: dns.TypeSRV},
+	} {
+		if answers := service.answers(question); len(answers) != 4 {
+			t.Errorf("Expected 4 answers to %s, got %d", question.Name, len(answers))
+		}
+	}
+	if answers := service.answers(dns.Question{Name: "_airplay._tcp.local.", Qtype: dns.TypePTR}); answers != nil {
+		t.Errorf("Expected no answers, got %v", answers)
+	}
+}
@@ -0,0 +1,318 @@
+package pyatv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// mdnsPort is the port used for both multicast and unicast DNS-SD queries.
+const mdnsPort = 5353
+
+// unicastResend is how often an unanswered unicast query is sent again.
+const unicastResend = time.Second
+
+// sleepProxyService is announced by Bonjour sleep proxies, which answer for
+// devices in deep sleep.
+const sleepProxyService = "_sleep-proxy._udp"
+
+// newServiceQuery creates a DNS-SD query asking for all services in one message.
+func newServiceQuery(services []string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.Id = dns.Id()
+	for _, service := range services {
+		msg.Question = append(msg.Question, dns.Question{
+			Name:   dns.Fqdn(service + ".local"),
+			Qtype:  dns.TypePTR,
+			Qclass: dns.ClassINET,
+		})
+	}
+	return msg
+}
+
+// ServiceEntry is a DNS-SD service instance found during discovery.
+type ServiceEntry struct {
+	Name       string // Full instance name, e.g. "Living Room._airplay._tcp.local."
+	Host       string
+	Addresses  []net.IPAddr // Every address of the host, IPv6 link-local ones with zone
+	Interface  string       // Interface the entry was received on, empty if unknown
+	Port       int
+	InfoFields []string
+	TTL        time.Duration // Zero when the service is going away
+	DeepSleep  bool          // Announced by a sleep proxy on behalf of the device
+}
+
+// serviceParser collects DNS-SD records from one or more messages and resolves
+// them into service entries.
+type serviceParser struct {
+	instances map[string]string
+	ttl       map[string]uint32
+	srv       map[string]*dns.SRV
+	txt       map[string][]string
+	addrs     map[string][]net.IP
+}
+
+func newServiceParser() *serviceParser {
+	return &serviceParser{
+		instances: make(map[string]string),
+		ttl:       make(map[string]uint32),
+		srv:       make(map[string]*dns.SRV),
+		txt:       make(map[string][]string),
+		addrs:     make(map[string][]net.IP),
+	}
+}
+
+// add records all answers and additional records of a message and returns
+// the instances affected by it.
+func (p *serviceParser) add(msg *dns.Msg) []string {
+	affected := make(map[string]bool)
+	var hosts []string
+
+	records := append(append([]dns.RR{}, msg.Answer...), msg.Extra...)
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.PTR:
+			key := strings.ToLower(rr.Ptr)
+			p.instances[key] = rr.Ptr
+			p.ttl[key] = rr.Hdr.Ttl
+			affected[key] = true
+		case *dns.SRV:
+			p.srv[name] = rr
+			p.instances[name] = rr.Hdr.Name
+			if _, ok := p.ttl[name]; !ok || rr.Hdr.Ttl == 0 {
+				p.ttl[name] = rr.Hdr.Ttl
+			}
+			affected[name] = true
+		case *dns.TXT:
+			p.txt[name] = rr.Txt
+			p.instances[name] = rr.Hdr.Name
+			affected[name] = true
+		case *dns.A:
+			p.addAddress(name, rr.A, rr.Hdr.Ttl)
+			hosts = append(hosts, name)
+		case *dns.AAAA:
+			p.addAddress(name, rr.AAAA, rr.Hdr.Ttl)
+			hosts = append(hosts, name)
+		}
+	}
+
+	// New addresses affect every instance running on that host
+	for _, host := range hosts {
+		for key, srv := range p.srv {
+			if strings.EqualFold(srv.Target, host) {
+				affected[key] = true
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(affected))
+	for key := range affected {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// addAddress records an address of a host, or forgets it if the TTL is zero.
+func (p *serviceParser) addAddress(host string, ip net.IP, ttl uint32) {
+	var addrs []net.IP
+	for _, addr := range p.addrs[host] {
+		if !addr.Equal(ip) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if ttl > 0 {
+		addrs = append(addrs, ip)
+	}
+	p.addrs[host] = addrs
+}
+
+// entry resolves a single instance, or returns nil if its port is not known.
+func (p *serviceParser) entry(key string) *ServiceEntry {
+	srv, ok := p.srv[key]
+	if !ok {
+		return nil
+	}
+
+	entry := &ServiceEntry{
+		Name: unescapeDNS(p.instances[key]),
+		Host: srv.Target,
+		Port: int(srv.Port),
+		TTL:  time.Duration(p.ttl[key]) * time.Second,
+	}
+	for _, ip := range p.addrs[strings.ToLower(srv.Target)] {
+		entry.Addresses = append(entry.Addresses, net.IPAddr{IP: ip})
+	}
+	for _, txt := range p.txt[key] {
+		entry.InfoFields = append(entry.InfoFields, unescapeDNS(txt))
+	}
+	return entry
+}
+
+// entries returns every service instance that has a known port.
+func (p *serviceParser) entries() []*ServiceEntry {
+	var result []*ServiceEntry
+	for key := range p.instances {
+		if entry := p.entry(key); entry != nil {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// remove forgets everything known about an instance.
+func (p *serviceParser) remove(key string) {
+	delete(p.instances, key)
+	delete(p.ttl, key)
+	delete(p.srv, key)
+	delete(p.txt, key)
+}
+
+// markDeepSleep marks entries as in deep sleep if the records they came with
+// were sent by a sleep proxy. Like in pyatv, that is the case when all
+// services are on port 0 or when a host announcing itself as sleep proxy
+// answers for another one.
+func markDeepSleep(records []dns.RR, entries []*ServiceEntry) {
+	proxies := make(map[string]bool)
+	for _, rr := range records {
+		if srv, ok := rr.(*dns.SRV); ok && isQueriedService(srv.Hdr.Name, []string{sleepProxyService}) {
+			proxies[strings.ToLower(srv.Target)] = true
+		}
+	}
+
+	portZero := len(entries) > 0
+	for _, entry := range entries {
+		portZero = portZero && entry.Port == 0
+	}
+	for _, entry := range entries {
+		proxied := len(proxies) > 0 && !proxies[strings.ToLower(entry.Host)]
+		entry.DeepSleep = entry.DeepSleep || portZero || proxied
+	}
+}
+
+// unescapeDNS reverses the presentation format escaping done by the dns package.
+func unescapeDNS(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigits(s[i+1:i+4]) {
+			n, _ := strconv.Atoi(s[i+1 : i+4])
+			b.WriteByte(byte(n))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i+1])
+		i++
+	}
+	return b.String()
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// unicastQuery sends a DNS-SD query for services straight to a port of a
+// host and calls found for every resolved entry. Entries are always
+// attributed to the queried address, since that is the address known to be
+// reachable.
+func unicastQuery(ctx context.Context, host string, port int, services []string, found func(*ServiceEntry)) error {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	query, err := newServiceQuery(services).Pack()
+	if err != nil {
+		return err
+	}
+
+	parser := newServiceParser()
+	buf := make([]byte, 65536)
+	answered := false
+	var records []dns.RR
+
+	for !answered && ctx.Err() == nil {
+		if _, err := conn.Write(query); err != nil {
+			return err
+		}
+
+		for {
+			deadline := time.Now().Add(unicastResend)
+			if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+				deadline = d
+			}
+			conn.SetReadDeadline(deadline)
+
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return err
+			}
+
+			msg := new(dns.Msg)
+			if err := msg.Unpack(buf[:n]); err != nil || !msg.Response {
+				continue
+			}
+
+			parser.add(msg)
+			records = append(append(records, msg.Answer...), msg.Extra...)
+			if !msg.Truncated {
+				answered = true
+				break
+			}
+		}
+	}
+
+	var entries []*ServiceEntry
+	for _, entry := range parser.entries() {
+		if !isQueriedService(entry.Name, services) {
+			continue
+		}
+
+		entry.Addresses = []net.IPAddr{{IP: addr.IP, Zone: addr.Zone}}
+		entries = append(entries, entry)
+	}
+
+	markDeepSleep(records, entries)
+	for _, entry := range entries {
+		found(entry)
+	}
+
+	return nil
+}
+
+func isQueriedService(name string, services []string) bool {
+	name = strings.ToLower(name)
+	for _, service := range services {
+		if strings.Contains(name, "."+service+".") {
+			return true
+		}
+	}
+	return false
+}
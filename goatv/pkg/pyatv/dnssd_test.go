@@ -0,0 +1,241 @@
+package pyatv
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestServiceParserEntries(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = []dns.RR{
+		&dns.PTR{
+			Hdr: dns.RR_Header{Name: "_airplay._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 120},
+			Ptr: "Living Room._airplay._tcp.local.",
+		},
+	}
+	msg.Extra = []dns.RR{
+		&dns.SRV{
+			Hdr:    dns.RR_Header{Name: "Living Room._airplay._tcp.local.", Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120},
+			Port:   7000,
+			Target: "living-room.local.",
+		},
+		&dns.TXT{
+			Hdr: dns.RR_Header{Name: "Living Room._airplay._tcp.local.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 120},
+			Txt: []string{"deviceid=AA:BB:CC:DD:EE:FF", "model=AppleTV6,2"},
+		},
+		&dns.A{
+			Hdr: dns.RR_Header{Name: "living-room.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+			A:   net.ParseIP("10.2.0.15"),
+		},
+	}
+
+	// Round trip through the wire format to get escaping right
+	data, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("Pack() error = %v", err)
+	}
+	decoded := new(dns.Msg)
+	if err := decoded.Unpack(data); err != nil {
+		t.Fatalf("Unpack() error = %v", err)
+	}
+
+	parser := newServiceParser()
+	parser.add(decoded)
+	entries := parser.entries()
+
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(entries))
+	}
+
+	entry := entries[0]
+	if entry.Name != "Living Room._airplay._tcp.local." {
+		t.Errorf("Expected unescaped name, got %q", entry.Name)
+	}
+	if entry.Port != 7000 {
+		t.Errorf("Expected port 7000, got %d", entry.Port)
+	}
+	if len(entry.Addresses) != 1 || !entry.Addresses[0].IP.Equal(net.ParseIP("10.2.0.15")) {
+		t.Errorf("Expected address 10.2.0.15, got %v", entry.Addresses)
+	}
+	if len(entry.InfoFields) != 2 || entry.InfoFields[1] != "model=AppleTV6,2" {
+		t.Errorf("Unexpected TXT fields: %v", entry.InfoFields)
+	}
+}
+
+func TestNewServiceQuery(t *testing.T) {
+	msg := newServiceQuery([]string{ServiceTypeMRP, ServiceTypeAirPlay})
+
+	if len(msg.Question) != 2 {
+		t.Fatalf("Expected 2 questions, got %d", len(msg.Question))
+	}
+	if msg.Question[0].Name != "_mediaremotetv._tcp.local." {
+		t.Errorf("Unexpected question name %q", msg.Question[0].Name)
+	}
+	if msg.Question[1].Qtype != dns.TypePTR {
+		t.Errorf("Expected PTR question, got %d", msg.Question[1].Qtype)
+	}
+}
+
+func TestAnsweredByProxy(t *testing.T) {
+	entry := &ServiceEntry{Addresses: []net.IPAddr{
+		{IP: net.ParseIP("fe80::2"), Zone: "eth0"},
+		{IP: net.ParseIP("10.0.0.2")},
+	}}
+
+	if answeredByProxy(entry, net.ParseIP("10.0.0.2")) {
+		t.Error("Expected answer from device itself")
+	}
+	if !answeredByProxy(entry, net.ParseIP("10.0.0.1")) {
+		t.Error("Expected answer from sleep proxy")
+	}
+	if answeredByProxy(entry, net.ParseIP("fe80::1")) {
+		t.Error("Expected IPv6 source to be ignored")
+	}
+}
+
+func TestMarkDeepSleep(t *testing.T) {
+	srv := func(name, target string) dns.RR {
+		return &dns.SRV{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120},
+			Target: target,
+		}
+	}
+	proxy := srv("70-35-60-63.1 Kitchen._sleep-proxy._udp.local.", "kitchen.local.")
+
+	tests := []struct {
+		name     string
+		records  []dns.RR
+		ports    []int
+		expected bool
+	}{
+		{"awake", nil, []int{7000, 49152}, false},
+		{"all on port 0", nil, []int{0, 0}, true},
+		{"some on port 0", nil, []int{0, 49152}, false},
+		{"answered by proxy", []dns.RR{proxy}, []int{7000}, true},
+		{"proxy itself", []dns.RR{srv("70-35-60-63.1 Living Room._sleep-proxy._udp.local.", "Living-Room.local.")}, []int{7000}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var entries []*ServiceEntry
+			for _, port := range tt.ports {
+				entries = append(entries, &ServiceEntry{Host: "living-room.local.", Port: port})
+			}
+			markDeepSleep(tt.records, entries)
+			for _, entry := range entries {
+				if entry.DeepSleep != tt.expected {
+					t.Errorf("Expected DeepSleep %v on port %d, got %v", tt.expected, entry.Port, entry.DeepSleep)
+				}
+			}
+		})
+	}
+}
+
+func TestUnicastQueryDeepSleep(t *testing.T) {
+	// A sleep proxy answering for a device with every service on port 0
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 65536)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		query := new(dns.Msg)
+		if err := query.Unpack(buf[:n]); err != nil {
+			return
+		}
+
+		msg := new(dns.Msg)
+		msg.SetReply(query)
+		for _, name := range []string{"Living Room._airplay._tcp.local.", "Living Room._mediaremotetv._tcp.local."} {
+			msg.Answer = append(msg.Answer,
+				&dns.PTR{
+					Hdr: dns.RR_Header{Name: name[len("Living Room."):], Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 120},
+					Ptr: name,
+				},
+				&dns.SRV{
+					Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120},
+					Target: "living-room.local.",
+				})
+		}
+		data, _ := msg.Pack()
+		conn.WriteToUDP(data, addr)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var entries []*ServiceEntry
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	services := []string{ServiceTypeAirPlay, ServiceTypeMRP}
+	if err := unicastQuery(ctx, "127.0.0.1", port, services, func(entry *ServiceEntry) {
+		entries = append(entries, entry)
+	}); err != nil {
+		t.Fatalf("unicastQuery() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		if !entry.DeepSleep {
+			t.Errorf("Expected %q to be in deep sleep", entry.Name)
+		}
+	}
+}
+
+func TestServiceParserKeepsAllAddresses(t *testing.T) {
+	header := func(rrtype uint16, ttl uint32) dns.RR_Header {
+		return dns.RR_Header{Name: "living-room.local.", Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = []dns.RR{
+		&dns.SRV{
+			Hdr:    dns.RR_Header{Name: "Living Room._airplay._tcp.local.", Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120},
+			Port:   7000,
+			Target: "living-room.local.",
+		},
+		&dns.A{Hdr: header(dns.TypeA, 120), A: net.ParseIP("10.0.0.2")},
+		&dns.A{Hdr: header(dns.TypeA, 120), A: net.ParseIP("192.168.1.2")},
+		&dns.AAAA{Hdr: header(dns.TypeAAAA, 120), AAAA: net.ParseIP("fe80::2")},
+	}
+
+	browser := &mdnsBrowser{services: []string{ServiceTypeAirPlay}, parser: newServiceParser()}
+	entries := browser.handle(msg, net.ParseIP("10.0.0.2"), "eth0")
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(entries))
+	}
+
+	addresses := entries[0].Addresses
+	if len(addresses) != 3 {
+		t.Fatalf("Expected 3 addresses, got %v", addresses)
+	}
+	if addresses[2].Zone != "eth0" {
+		t.Errorf("Expected link-local address with zone eth0, got %v", addresses[2])
+	}
+	if addresses[0].Zone != "" {
+		t.Errorf("Expected no zone on IPv4 address, got %v", addresses[0])
+	}
+	if entries[0].Interface != "eth0" {
+		t.Errorf("Expected interface eth0, got %q", entries[0].Interface)
+	}
+
+	// Goodbye for one address removes only that address
+	goodbye := new(dns.Msg)
+	goodbye.Response = true
+	goodbye.Answer = []dns.RR{&dns.A{Hdr: header(dns.TypeA, 0), A: net.ParseIP("192.168.1.2")}}
+	entries = browser.handle(goodbye, net.ParseIP("10.0.0.2"), "eth0")
+	if len(entries) != 1 || len(entries[0].Addresses) != 2 {
+		t.Fatalf("Expected 2 addresses after goodbye, got %v", entries)
+	}
+}
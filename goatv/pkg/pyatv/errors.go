@@ -1,6 +1,10 @@
 package pyatv
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 // Common errors used by the library.
 var (
@@ -95,3 +99,20 @@ func NewHTTPError(message string, statusCode int) *HTTPError {
 		StatusCode: statusCode,
 	}
 }
+
+// BackOffError is returned when a device refuses pairing attempts for a while,
+// usually after too many wrong PINs. It matches both ErrBackOff and
+// ErrAuthentication with errors.Is.
+type BackOffError struct {
+	Delay time.Duration // Time to wait before trying again
+}
+
+// Error implements the error interface.
+func (e *BackOffError) Error() string {
+	return fmt.Sprintf("%v: retry in %s", ErrBackOff, e.Delay)
+}
+
+// Unwrap returns ErrBackOff and ErrAuthentication.
+func (e *BackOffError) Unwrap() []error {
+	return []error{ErrBackOff, ErrAuthentication}
+}
@@ -0,0 +1,389 @@
+package pyatv
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/opack"
+	"github.com/alexjsteffen/goatv/pkg/pyatv/tlv8"
+)
+
+// hapExchange tells a transport which pairing procedure a message is part of.
+type hapExchange int
+
+const (
+	exchangePairSetup hapExchange = iota
+	exchangePairVerify
+	// exchangeTransientPairSetup is pair-setup that stops after M4
+	exchangeTransientPairSetup
+	// exchangePairings lists, adds or removes pairings on a verified session
+	exchangePairings
+)
+
+// setup returns true for both kinds of pair-setup.
+func (k hapExchange) setup() bool {
+	return k == exchangePairSetup || k == exchangeTransientPairSetup
+}
+
+// transientPIN is the fixed PIN of transient pair-setup.
+const transientPIN = "3939"
+
+// pairingTransport carries HAP pairing messages to a device. Every protocol
+// wraps them differently.
+type pairingTransport interface {
+	// exchange sends a message and returns the response from the device
+	exchange(ctx context.Context, kind hapExchange, items tlv8.Items) (tlv8.Items, error)
+	// stream returns the underlying connection, including data that was
+	// received but not consumed yet
+	stream() net.Conn
+	Close() error
+}
+
+// exchangePairing sends a message and checks the response for errors and the
+// expected state.
+func exchangePairing(ctx context.Context, transport pairingTransport, kind hapExchange, items tlv8.Items) (tlv8.Items, error) {
+	state, _ := items.Uint(tlv8.TagState)
+
+	resp, err := transport.exchange(ctx, kind, items)
+	if err != nil {
+		return nil, err
+	}
+	if err := pairingError(resp); err != nil {
+		return nil, err
+	}
+	if got, ok := resp.Uint(tlv8.TagState); !ok || got != state+1 {
+		return nil, fmt.Errorf("%w: expected state M%d, got %s", ErrInvalidResponse, state+1, resp)
+	}
+	return resp, nil
+}
+
+// requireItems returns the values of tags that must be present in a message.
+func requireItems(items tlv8.Items, tags ...tlv8.Tag) ([][]byte, error) {
+	values := make([][]byte, len(tags))
+	for i, tag := range tags {
+		value, ok := items.Get(tag)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s missing in %s", ErrInvalidResponse, tag, items)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// hkdfExpand derives a 32 byte key with HKDF-SHA512, as used everywhere in HAP.
+func hkdfExpand(salt, info string, secret []byte) []byte {
+	key, err := hkdf.Key(sha512.New, secret, []byte(salt), info, chacha20poly1305.KeySize)
+	if err != nil {
+		// Only possible for absurd key lengths
+		panic(err)
+	}
+	return key
+}
+
+// pairingNonce pads a message nonce like "PS-Msg05" to the 12 bytes used by
+// ChaCha20-Poly1305.
+func pairingNonce(label string) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	copy(nonce[chacha20poly1305.NonceSize-len(label):], label)
+	return nonce
+}
+
+// sealPairing encrypts a pairing message with a key and a message nonce.
+func sealPairing(key []byte, label string, plaintext []byte) []byte {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		panic(err)
+	}
+	return aead.Seal(nil, pairingNonce(label), plaintext, nil)
+}
+
+// openPairing decrypts a message sealed with sealPairing.
+func openPairing(key []byte, label string, ciphertext []byte) (tlv8.Items, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		panic(err)
+	}
+	plaintext, err := aead.Open(nil, pairingNonce(label), ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt %s", ErrAuthentication, label)
+	}
+	items, err := tlv8.Decode(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	return items, nil
+}
+
+// hapPairSetupClient runs pair-setup (M1-M6) with a device, which shows a PIN
+// after the first exchange and creates new credentials once it is entered.
+type hapPairSetupClient struct {
+	transport pairingTransport
+	signer    ed25519.PrivateKey
+	pairingID []byte
+	name      string // Sent along with our keys if not empty
+
+	salt         []byte
+	serverPublic []byte
+}
+
+// newHAPPairSetupClient creates a pair-setup client that registers our
+// long-term key under pairingID.
+func newHAPPairSetupClient(transport pairingTransport, pairingID []byte, signer ed25519.PrivateKey, name string) *hapPairSetupClient {
+	return &hapPairSetupClient{transport: transport, signer: signer, pairingID: pairingID, name: name}
+}
+
+// start sends M1, after which the device shows the PIN.
+func (c *hapPairSetupClient) start(ctx context.Context) error {
+	resp, err := exchangePairing(ctx, c.transport, exchangePairSetup, tlv8.Items{
+		tlv8.Uint(tlv8.TagMethod, uint64(tlv8.MethodPairSetup)),
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M1)),
+	})
+	if err != nil {
+		return err
+	}
+
+	values, err := requireItems(resp, tlv8.TagSalt, tlv8.TagPublicKey)
+	if err != nil {
+		return err
+	}
+	c.salt, c.serverPublic = values[0], values[1]
+	return nil
+}
+
+// finish authenticates with the PIN (M3-M4), exchanges long-term keys (M5-M6)
+// and returns the new credentials.
+func (c *hapPairSetupClient) finish(ctx context.Context, pin string) (*Credentials, error) {
+	if c.salt == nil {
+		return nil, fmt.Errorf("%w: pair-setup not started", ErrInvalidState)
+	}
+
+	srp, err := proveSRP(ctx, c.transport, exchangePairSetup, pin, c.salt, c.serverPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionKey := srp.SessionKey()
+	encryptKey := hkdfExpand("Pair-Setup-Encrypt-Salt", "Pair-Setup-Encrypt-Info", sessionKey)
+	controllerX := hkdfExpand("Pair-Setup-Controller-Sign-Salt", "Pair-Setup-Controller-Sign-Info", sessionKey)
+
+	public := c.signer.Public().(ed25519.PublicKey)
+	signature := ed25519.Sign(c.signer, concat(controllerX, c.pairingID, public))
+	items := tlv8.Items{
+		tlv8.Bytes(tlv8.TagIdentifier, c.pairingID),
+		tlv8.Bytes(tlv8.TagPublicKey, public),
+		tlv8.Bytes(tlv8.TagSignature, signature),
+	}
+	if c.name != "" {
+		name, err := opack.Marshal(map[string]any{"name": c.name})
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, tlv8.Bytes(tlv8.TagName, name))
+	}
+	encrypted := sealPairing(encryptKey, "PS-Msg05", items.Encode())
+
+	resp, err := exchangePairing(ctx, c.transport, exchangePairSetup, tlv8.Items{
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M5)),
+		tlv8.Bytes(tlv8.TagEncryptedData, encrypted),
+	})
+	if err != nil {
+		return nil, err
+	}
+	values, err := requireItems(resp, tlv8.TagEncryptedData)
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := openPairing(encryptKey, "PS-Msg06", values[0])
+	if err != nil {
+		return nil, err
+	}
+	if values, err = requireItems(device, tlv8.TagIdentifier, tlv8.TagPublicKey, tlv8.TagSignature); err != nil {
+		return nil, err
+	}
+	atvID, ltpk, deviceSignature := values[0], values[1], values[2]
+	if len(ltpk) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: invalid device public key", ErrAuthentication)
+	}
+
+	accessoryX := hkdfExpand("Pair-Setup-Accessory-Sign-Salt", "Pair-Setup-Accessory-Sign-Info", sessionKey)
+	if !ed25519.Verify(ltpk, concat(accessoryX, atvID, ltpk), deviceSignature) {
+		return nil, fmt.Errorf("%w: invalid device signature", ErrAuthentication)
+	}
+
+	return &Credentials{
+		Type:     CredentialsHAP,
+		LTPK:     ltpk,
+		LTSK:     c.signer.Seed(),
+		DeviceID: atvID,
+		ClientID: c.pairingID,
+	}, nil
+}
+
+// proveSRP proves knowledge of the PIN to the device and checks its proof in
+// return (M3-M4).
+func proveSRP(ctx context.Context, transport pairingTransport, kind hapExchange, pin string, salt, serverPublic []byte) (*srpClient, error) {
+	private := make([]byte, 32)
+	if _, err := rand.Read(private); err != nil {
+		return nil, err
+	}
+	srp := newSRPClient(srpGroupHAP, srpUsername, pin, private)
+	proof, err := srp.Process(salt, serverPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := exchangePairing(ctx, transport, kind, tlv8.Items{
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M3)),
+		tlv8.Bytes(tlv8.TagPublicKey, srp.PublicKey()),
+		tlv8.Bytes(tlv8.TagProof, proof),
+	})
+	if err != nil {
+		return nil, err
+	}
+	values, err := requireItems(resp, tlv8.TagProof)
+	if err != nil {
+		return nil, err
+	}
+	if err := srp.Verify(values[0]); err != nil {
+		return nil, err
+	}
+	return srp, nil
+}
+
+// hapTransientPairSetup runs pair-setup with the fixed PIN and stops after
+// M4. Nothing is stored on the device, session keys are derived from the SRP
+// session key instead.
+func hapTransientPairSetup(ctx context.Context, transport pairingTransport) (*hapSharedSecret, error) {
+	resp, err := exchangePairing(ctx, transport, exchangeTransientPairSetup, tlv8.Items{
+		tlv8.Uint(tlv8.TagMethod, uint64(tlv8.MethodPairSetup)),
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M1)),
+		tlv8.Uint(tlv8.TagFlags, uint64(tlv8.FlagTransientPairing)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	values, err := requireItems(resp, tlv8.TagSalt, tlv8.TagPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	srp, err := proveSRP(ctx, transport, exchangeTransientPairSetup, transientPIN, values[0], values[1])
+	if err != nil {
+		return nil, err
+	}
+	return &hapSharedSecret{secret: srp.SessionKey()}, nil
+}
+
+// hapPairVerify runs pair-verify (M1-M4) with stored credentials and returns
+// the X25519 shared secret that session keys are derived from.
+func hapPairVerify(ctx context.Context, transport pairingTransport, credentials *Credentials) (*hapSharedSecret, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	public := private.PublicKey().Bytes()
+
+	resp, err := exchangePairing(ctx, transport, exchangePairVerify, tlv8.Items{
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M1)),
+		tlv8.Bytes(tlv8.TagPublicKey, public),
+	})
+	if err != nil {
+		return nil, err
+	}
+	values, err := requireItems(resp, tlv8.TagPublicKey, tlv8.TagEncryptedData)
+	if err != nil {
+		return nil, err
+	}
+	devicePublic := values[0]
+
+	peer, err := ecdh.X25519().NewPublicKey(devicePublic)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid device public key", ErrAuthentication)
+	}
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAuthentication, err)
+	}
+
+	encryptKey := hkdfExpand("Pair-Verify-Encrypt-Salt", "Pair-Verify-Encrypt-Info", shared)
+	device, err := openPairing(encryptKey, "PV-Msg02", values[1])
+	if err != nil {
+		return nil, err
+	}
+	if values, err = requireItems(device, tlv8.TagIdentifier, tlv8.TagSignature); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(values[0], credentials.DeviceID) {
+		return nil, fmt.Errorf("%w: device identifier does not match credentials", ErrAuthentication)
+	}
+	if !ed25519.Verify(credentials.LTPK, concat(devicePublic, credentials.DeviceID, public), values[1]) {
+		return nil, fmt.Errorf("%w: invalid device signature", ErrAuthentication)
+	}
+
+	signer := ed25519.NewKeyFromSeed(credentials.LTSK)
+	signature := ed25519.Sign(signer, concat(public, credentials.ClientID, devicePublic))
+	encrypted := sealPairing(encryptKey, "PV-Msg03", tlv8.Encode(
+		tlv8.Bytes(tlv8.TagIdentifier, credentials.ClientID),
+		tlv8.Bytes(tlv8.TagSignature, signature),
+	))
+
+	if _, err := exchangePairing(ctx, transport, exchangePairVerify, tlv8.Items{
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M3)),
+		tlv8.Bytes(tlv8.TagEncryptedData, encrypted),
+	}); err != nil {
+		return nil, err
+	}
+	return &hapSharedSecret{secret: shared}, nil
+}
+
+// hapSharedSecret is the result of pair-verify or transient pair-setup.
+type hapSharedSecret struct {
+	secret []byte
+}
+
+// keys derives the output and input session keys with the salt and info
+// strings of a protocol.
+func (s *hapSharedSecret) keys(info hapKeyInfo) (output, input []byte) {
+	return hkdfExpand(info.salt, info.outputInfo, s.secret), hkdfExpand(info.salt, info.inputInfo, s.secret)
+}
+
+// hapSession is a connection to a service that passed pair-verify. Traffic on
+// it is encrypted with keys derived from the shared secret from now on, if
+// there is one.
+type hapSession struct {
+	transport pairingTransport
+	secret    *hapSharedSecret
+}
+
+func closeSessions(sessions map[Protocol]*hapSession) {
+	for _, session := range sessions {
+		session.transport.Close()
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// newPairingID creates a random identifier in the UUID format Apple devices
+// use for pairing identifiers.
+func newPairingID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	id[6] = id[6]&0x0F | 0x40 // Version 4
+	id[8] = id[8]&0x3F | 0x80 // Variant 10
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16]))
+}
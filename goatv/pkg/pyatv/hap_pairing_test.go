@@ -0,0 +1,704 @@
+package pyatv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/mrp"
+	"github.com/alexjsteffen/goatv/pkg/pyatv/opack"
+	"github.com/alexjsteffen/goatv/pkg/pyatv/tlv8"
+)
+
+// testAccessory is the device side of HAP pair-setup and pair-verify.
+type testAccessory struct {
+	mu      sync.Mutex
+	pin     string
+	id      []byte
+	signer  ed25519.PrivateKey
+	clients map[string]ed25519.PublicKey // Paired controllers by identifier
+
+	srp       *srpServer
+	setupKey  []byte
+	transient bool
+	hkp       []string          // X-Apple-HKP of every AirPlay request
+	paths     []string          // Path of every AirPlay request
+	names     map[string]string // Names controllers introduced themselves with
+
+	verifyPrivate *ecdh.PrivateKey
+	clientPublic  []byte
+	verifyShared  []byte
+	shared        []byte // Shared secret of the last successful pair-verify
+}
+
+func newTestAccessory(t *testing.T, pin string) *testAccessory {
+	t.Helper()
+	_, signer, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	return &testAccessory{
+		pin:     pin,
+		id:      []byte("AA:BB:CC:DD:EE:FF"),
+		signer:  signer,
+		clients: make(map[string]ed25519.PublicKey),
+		names:   make(map[string]string),
+	}
+}
+
+func randomBytes(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
+
+func accessoryError(state tlv8.State) tlv8.Items {
+	return tlv8.Items{
+		tlv8.Uint(tlv8.TagState, uint64(state)),
+		tlv8.Uint(tlv8.TagError, uint64(tlv8.ErrorAuthentication)),
+	}
+}
+
+// handle answers a pairing message.
+func (a *testAccessory) handle(kind hapExchange, items tlv8.Items) tlv8.Items {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	state, _ := items.Uint(tlv8.TagState)
+	if kind == exchangePairSetup {
+		switch tlv8.State(state) {
+		case tlv8.M1:
+			return a.setupM2(items)
+		case tlv8.M3:
+			return a.setupM4(items)
+		case tlv8.M5:
+			return a.setupM6(items)
+		}
+	} else {
+		switch tlv8.State(state) {
+		case tlv8.M1:
+			return a.verifyM2(items)
+		case tlv8.M3:
+			return a.verifyM4(items)
+		}
+	}
+	return accessoryError(tlv8.State(state + 1))
+}
+
+func (a *testAccessory) setupPIN() string {
+	if a.transient {
+		return transientPIN
+	}
+	return a.pin
+}
+
+func (a *testAccessory) setupM2(items tlv8.Items) tlv8.Items {
+	flags, _ := items.Uint(tlv8.TagFlags)
+	a.transient = tlv8.Flag(flags)&tlv8.FlagTransientPairing != 0
+
+	salt := randomBytes(16)
+	a.srp = newSRPServer(srpGroupHAP, srpUsername, a.setupPIN(), salt, randomBytes(32))
+	return tlv8.Items{
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M2)),
+		tlv8.Bytes(tlv8.TagSalt, salt),
+		tlv8.Bytes(tlv8.TagPublicKey, a.srp.PublicKey()),
+	}
+}
+
+func (a *testAccessory) setupM4(items tlv8.Items) tlv8.Items {
+	clientPublic, _ := items.Get(tlv8.TagPublicKey)
+	clientProof, _ := items.Get(tlv8.TagProof)
+
+	if a.srp == nil {
+		return accessoryError(tlv8.M4)
+	}
+	proof, err := a.srp.Process(clientPublic, clientProof)
+	if err != nil {
+		return accessoryError(tlv8.M4)
+	}
+	a.setupKey = a.srp.SessionKey()
+	if a.transient {
+		a.shared = a.setupKey
+	}
+	return tlv8.Items{
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M4)),
+		tlv8.Bytes(tlv8.TagProof, proof),
+	}
+}
+
+func (a *testAccessory) setupM6(items tlv8.Items) tlv8.Items {
+	encryptKey := hkdfExpand("Pair-Setup-Encrypt-Salt", "Pair-Setup-Encrypt-Info", a.setupKey)
+	encrypted, _ := items.Get(tlv8.TagEncryptedData)
+	client, err := openPairing(encryptKey, "PS-Msg05", encrypted)
+	if err != nil {
+		return accessoryError(tlv8.M6)
+	}
+
+	clientID, _ := client.Get(tlv8.TagIdentifier)
+	ltpk, _ := client.Get(tlv8.TagPublicKey)
+	signature, _ := client.Get(tlv8.TagSignature)
+	controllerX := hkdfExpand("Pair-Setup-Controller-Sign-Salt", "Pair-Setup-Controller-Sign-Info", a.setupKey)
+	if !ed25519.Verify(ltpk, concat(controllerX, clientID, ltpk), signature) {
+		return accessoryError(tlv8.M6)
+	}
+	a.clients[string(clientID)] = ltpk
+	if data, ok := client.Get(tlv8.TagName); ok {
+		name, _ := opack.UnmarshalMap(data)
+		a.names[string(clientID)], _ = name["name"].(string)
+	}
+
+	public := a.signer.Public().(ed25519.PublicKey)
+	accessoryX := hkdfExpand("Pair-Setup-Accessory-Sign-Salt", "Pair-Setup-Accessory-Sign-Info", a.setupKey)
+	return tlv8.Items{
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M6)),
+		tlv8.Bytes(tlv8.TagEncryptedData, sealPairing(encryptKey, "PS-Msg06", tlv8.Encode(
+			tlv8.Bytes(tlv8.TagIdentifier, a.id),
+			tlv8.Bytes(tlv8.TagPublicKey, public),
+			tlv8.Bytes(tlv8.TagSignature, ed25519.Sign(a.signer, concat(accessoryX, a.id, public))),
+		))),
+	}
+}
+
+func (a *testAccessory) verifyM2(items tlv8.Items) tlv8.Items {
+	a.clientPublic, _ = items.Get(tlv8.TagPublicKey)
+	peer, err := ecdh.X25519().NewPublicKey(a.clientPublic)
+	if err != nil {
+		return accessoryError(tlv8.M2)
+	}
+	a.verifyPrivate, _ = ecdh.X25519().GenerateKey(rand.Reader)
+	a.verifyShared, _ = a.verifyPrivate.ECDH(peer)
+
+	public := a.verifyPrivate.PublicKey().Bytes()
+	encryptKey := hkdfExpand("Pair-Verify-Encrypt-Salt", "Pair-Verify-Encrypt-Info", a.verifyShared)
+	return tlv8.Items{
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M2)),
+		tlv8.Bytes(tlv8.TagPublicKey, public),
+		tlv8.Bytes(tlv8.TagEncryptedData, sealPairing(encryptKey, "PV-Msg02", tlv8.Encode(
+			tlv8.Bytes(tlv8.TagIdentifier, a.id),
+			tlv8.Bytes(tlv8.TagSignature, ed25519.Sign(a.signer, concat(public, a.id, a.clientPublic))),
+		))),
+	}
+}
+
+func (a *testAccessory) verifyM4(items tlv8.Items) tlv8.Items {
+	encryptKey := hkdfExpand("Pair-Verify-Encrypt-Salt", "Pair-Verify-Encrypt-Info", a.verifyShared)
+	encrypted, _ := items.Get(tlv8.TagEncryptedData)
+	client, err := openPairing(encryptKey, "PV-Msg03", encrypted)
+	if err != nil {
+		return accessoryError(tlv8.M4)
+	}
+
+	clientID, _ := client.Get(tlv8.TagIdentifier)
+	signature, _ := client.Get(tlv8.TagSignature)
+	ltpk, ok := a.clients[string(clientID)]
+	public := a.verifyPrivate.PublicKey().Bytes()
+	if !ok || !ed25519.Verify(ltpk, concat(a.clientPublic, clientID, public), signature) {
+		return accessoryError(tlv8.M4)
+	}
+	a.shared = a.verifyShared
+	return tlv8.Items{tlv8.Uint(tlv8.TagState, uint64(tlv8.M4))}
+}
+
+func (a *testAccessory) forget() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	clear(a.clients)
+}
+
+func (a *testAccessory) paired(clientID []byte) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.clients[string(clientID)]
+	return ok
+}
+
+// introduce records the name from a DeviceInfoMessage.
+func (a *testAccessory) introduce(info *mrp.DeviceInfoMessage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.names[info.UniqueIdentifier] = info.Name
+}
+
+func (a *testAccessory) name(clientID []byte) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.names[string(clientID)]
+}
+
+func (a *testAccessory) sharedSecret() []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.shared
+}
+
+// serveMRP answers DeviceInfo and CryptoPairing messages. Once pair-verify
+// passed, it encrypts the connection and answers every request with an empty
+// message of the same type.
+func serveMRP(conn net.Conn, accessory *testAccessory) {
+	reader := bufio.NewReader(conn)
+	for {
+		msg, err := readMRPMessage(reader)
+		if err != nil {
+			return
+		}
+
+		var resp *mrp.ProtocolMessage
+		var verified bool
+		switch msg.Type {
+		case mrp.TypeDeviceInfo:
+			accessory.introduce(msg.DeviceInfo)
+			resp = mrpDeviceInfo("device", "Living Room")
+			resp.Identifier = msg.Identifier
+		case mrp.TypeCryptoPairing:
+			items, _ := mrpPairingItems(msg)
+
+			kind := exchangePairSetup
+			if mrpPairVerifyMessage(items) {
+				kind = exchangePairVerify
+			}
+			respItems := accessory.handle(kind, items)
+			state, _ := respItems.Uint(tlv8.TagState)
+			_, failed := respItems.Get(tlv8.TagError)
+			verified = kind == exchangePairVerify && tlv8.State(state) == tlv8.M4 && !failed
+			resp = mrpCryptoPairing(respItems, 0)
+		default:
+			if msg.Identifier == "" {
+				continue
+			}
+			resp = mrp.NewMessage(msg.Type)
+			resp.Identifier = msg.Identifier
+		}
+		if writeMRPMessage(conn, resp) != nil {
+			return
+		}
+
+		if verified {
+			secret := &hapSharedSecret{secret: accessory.sharedSecret()}
+			input, output := secret.keys(mrpSessionKeys)
+			if conn, err = newSessionConn(&bufferedConn{Conn: conn, reader: reader}, ProtocolMRP, output, input); err != nil {
+				return
+			}
+			reader = bufio.NewReader(conn)
+		}
+	}
+}
+
+// serveCompanion answers pairing frames.
+func serveCompanion(conn net.Conn, accessory *testAccessory) {
+	reader := bufio.NewReader(conn)
+	for {
+		frameType, payload, err := readCompanionFrame(reader)
+		if err != nil {
+			return
+		}
+		message, err := opack.UnmarshalMap(payload)
+		if err != nil {
+			return
+		}
+		data, _ := message["_pd"].([]byte)
+		items, _ := tlv8.Decode(data)
+
+		kind, respType := exchangePairSetup, companionPairSetupNext
+		if frameType == companionPairVerifyStart || frameType == companionPairVerifyNext {
+			kind, respType = exchangePairVerify, companionPairVerifyNext
+		}
+		resp, _ := opack.Marshal(map[string]any{"_pd": accessory.handle(kind, items).Encode()})
+		if writeCompanionFrame(conn, respType, resp) != nil {
+			return
+		}
+	}
+}
+
+// serveAirPlay answers pairing requests on a keep-alive connection.
+func serveAirPlay(conn net.Conn, accessory *testAccessory) {
+	reader := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(req.Body)
+		items, _ := tlv8.Decode(data)
+		accessory.mu.Lock()
+		accessory.hkp = append(accessory.hkp, req.Header.Get("X-Apple-HKP"))
+		accessory.paths = append(accessory.paths, req.URL.Path)
+		accessory.mu.Unlock()
+
+		status, body := http.StatusOK, []byte(nil)
+		switch req.URL.Path {
+		case "/pair-pin-start":
+		case "/pair-setup":
+			body = accessory.handle(exchangePairSetup, items).Encode()
+		case "/pair-verify":
+			body = accessory.handle(exchangePairVerify, items).Encode()
+		default:
+			status = http.StatusNotFound
+		}
+
+		resp := &http.Response{
+			StatusCode:    status,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			ContentLength: int64(len(body)),
+			Body:          io.NopCloser(bytes.NewReader(body)),
+		}
+		if resp.Write(conn) != nil {
+			return
+		}
+	}
+}
+
+// startTestAccessory serves pairing for a protocol and returns a config with
+// a service pointing at it.
+func startTestAccessory(t *testing.T, protocol Protocol, accessory *testAccessory) *Config {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	serve := map[Protocol]func(net.Conn, *testAccessory){
+		ProtocolMRP:       serveMRP,
+		ProtocolCompanion: serveCompanion,
+		ProtocolAirPlay:   serveAirPlay,
+	}[protocol]
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn, accessory)
+			}()
+		}
+	}()
+
+	// AirPlay services must announce HAP support, or legacy pairing is used
+	service := &Service{
+		Identifier: "AABBCCDDEEFF",
+		Protocol:   protocol,
+		Port:       listener.Addr().(*net.TCPAddr).Port,
+		Enabled:    true,
+	}
+	if protocol == ProtocolAirPlay {
+		service.Capabilities.Features = AirPlayFeatureCoreUtilsPairingAndEncryption
+	}
+	return &Config{
+		Address:  net.ParseIP("127.0.0.1"),
+		Name:     "Living Room",
+		Services: []*Service{service},
+	}
+}
+
+func pairTestAccessory(ctx context.Context, config *Config, protocol Protocol, pin string, opts PairOptions) error {
+	handler, err := Pair(ctx, config, protocol, opts)
+	if err != nil {
+		return err
+	}
+	defer handler.Close()
+
+	if err := handler.Begin(ctx); err != nil {
+		return err
+	}
+	handler.Pin(pin)
+	return handler.Finish(ctx)
+}
+
+func TestPairAndVerify(t *testing.T) {
+	for _, protocol := range []Protocol{ProtocolMRP, ProtocolAirPlay, ProtocolCompanion} {
+		t.Run(protocol.String(), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			accessory := newTestAccessory(t, "1234")
+			config := startTestAccessory(t, protocol, accessory)
+			storage := NewMemoryStorage()
+
+			if err := pairTestAccessory(ctx, config, protocol, "1234", PairOptions{Storage: storage}); err != nil {
+				t.Fatalf("Pairing failed: %v", err)
+			}
+
+			service := config.GetService(protocol)
+			credentials, err := ParseCredentials(service.Credentials)
+			if err != nil || credentials.Type != CredentialsHAP {
+				t.Fatalf("Expected HAP credentials, got %q: %v", service.Credentials, err)
+			}
+			if !bytes.Equal(credentials.DeviceID, accessory.id) {
+				t.Errorf("Expected device identifier %q, got %q", accessory.id, credentials.DeviceID)
+			}
+			if !accessory.paired(credentials.ClientID) {
+				t.Errorf("Expected device to know client %q", credentials.ClientID)
+			}
+
+			atv := NewAppleTVConnection(config, ConnectOptions{Protocol: &protocol})
+			if err := atv.Connect(ctx); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer atv.Close()
+
+			session := atv.sessions[protocol]
+			if session == nil {
+				t.Fatalf("Expected a verified session for %s", protocol)
+			}
+			if !bytes.Equal(session.secret.secret, accessory.sharedSecret()) {
+				t.Error("Expected shared secret to match the device")
+			}
+		})
+	}
+}
+
+func TestPairWrongPin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	accessory := newTestAccessory(t, "1234")
+	config := startTestAccessory(t, ProtocolMRP, accessory)
+
+	err := pairTestAccessory(ctx, config, ProtocolMRP, "4321", PairOptions{})
+	if !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Expected ErrAuthentication, got %v", err)
+	}
+	if service := config.GetService(ProtocolMRP); service.Credentials != "" {
+		t.Errorf("Expected no credentials, got %q", service.Credentials)
+	}
+}
+
+func TestPairNotStarted(t *testing.T) {
+	config := &Config{Services: []*Service{{Protocol: ProtocolMRP, Port: 49152}}}
+	handler := NewPairingHandler(config, config.Services[0], ProtocolMRP, PairOptions{})
+	handler.Pin("1234")
+
+	if err := handler.Finish(context.Background()); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Expected ErrInvalidState, got %v", err)
+	}
+}
+
+func TestConnectUnknownCredentials(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	accessory := newTestAccessory(t, "1234")
+	config := startTestAccessory(t, ProtocolCompanion, accessory)
+	if err := pairTestAccessory(ctx, config, ProtocolCompanion, "1234", PairOptions{}); err != nil {
+		t.Fatalf("Pairing failed: %v", err)
+	}
+	accessory.forget()
+
+	protocol := ProtocolCompanion
+	atv := NewAppleTVConnection(config, ConnectOptions{Protocol: &protocol})
+	if err := atv.Connect(ctx); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Expected ErrAuthentication, got %v", err)
+	}
+}
+
+func TestConnectIgnoresUnusedProtocols(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	accessory := newTestAccessory(t, "1234")
+	config := startTestAccessory(t, ProtocolCompanion, accessory)
+	if err := pairTestAccessory(ctx, config, ProtocolCompanion, "1234", PairOptions{}); err != nil {
+		t.Fatalf("Pairing failed: %v", err)
+	}
+	accessory.forget()
+
+	atv := NewAppleTVConnection(config, ConnectOptions{})
+	if err := atv.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer atv.Close()
+
+	if session := atv.sessions[ProtocolCompanion]; session != nil {
+		t.Error("Expected Companion not to be verified")
+	}
+}
+
+func TestConnectInvalidCredentials(t *testing.T) {
+	config := &Config{
+		Address:  net.ParseIP("127.0.0.1"),
+		Services: []*Service{{Protocol: ProtocolMRP, Port: 1, Enabled: true, Credentials: "invalid"}},
+	}
+	atv := NewAppleTVConnection(config, ConnectOptions{})
+	if err := atv.Connect(context.Background()); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected ErrInvalidCredentials, got %v", err)
+	}
+}
+
+func TestConnectTransient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	accessory := newTestAccessory(t, "1234")
+	config := startTestAccessory(t, ProtocolAirPlay, accessory)
+	service := config.GetService(ProtocolAirPlay)
+	service.Pairing = PairingRequirementNotNeeded
+	service.Capabilities.Features |= AirPlayFeatureSystemPairing
+
+	protocol := ProtocolAirPlay
+	atv := NewAppleTVConnection(config, ConnectOptions{Protocol: &protocol})
+	if err := atv.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer atv.Close()
+
+	session := atv.sessions[ProtocolAirPlay]
+	if session == nil {
+		t.Fatal("Expected a session from transient pairing")
+	}
+	if !bytes.Equal(session.secret.secret, accessory.sharedSecret()) {
+		t.Error("Expected shared secret to match the device")
+	}
+	if service.Credentials != "" {
+		t.Errorf("Expected no credentials to be stored, got %q", service.Credentials)
+	}
+
+	accessory.mu.Lock()
+	defer accessory.mu.Unlock()
+	if len(accessory.hkp) == 0 {
+		t.Error("Expected pairing requests")
+	}
+	for _, hkp := range accessory.hkp {
+		if hkp != "4" {
+			t.Errorf("Expected X-Apple-HKP 4, got %v", accessory.hkp)
+			break
+		}
+	}
+	// There is no PIN to show
+	for _, path := range accessory.paths {
+		if path == "/pair-pin-start" {
+			t.Errorf("Expected no /pair-pin-start, got %v", accessory.paths)
+			break
+		}
+	}
+}
+
+func TestConnectSkipsUnusedTransient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	accessory := newTestAccessory(t, "1234")
+	config := startTestAccessory(t, ProtocolAirPlay, accessory)
+	service := config.GetService(ProtocolAirPlay)
+	service.Pairing = PairingRequirementNotNeeded
+	service.Capabilities.Features |= AirPlayFeatureSystemPairing
+
+	atv := NewAppleTVConnection(config, ConnectOptions{})
+	if err := atv.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer atv.Close()
+
+	if session := atv.sessions[ProtocolAirPlay]; session != nil {
+		t.Error("Expected no session that nothing uses")
+	}
+	accessory.mu.Lock()
+	defer accessory.mu.Unlock()
+	if len(accessory.paths) != 0 {
+		t.Errorf("Expected no pairing requests, got %v", accessory.paths)
+	}
+}
+
+func TestTransientPairing(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol Protocol
+		pairing  PairingRequirement
+		features AirPlayFeatures
+		expected bool
+	}{
+		{"not needed", ProtocolAirPlay, PairingRequirementNotNeeded, AirPlayFeatureSystemPairing, true},
+		{"optional", ProtocolAirPlay, PairingRequirementOptional, AirPlayFeatureCoreUtilsPairingAndEncryption, true},
+		{"mandatory", ProtocolAirPlay, PairingRequirementMandatory, AirPlayFeatureSystemPairing, false},
+		{"no HAP support", ProtocolAirPlay, PairingRequirementNotNeeded, 0, false},
+		{"not AirPlay", ProtocolCompanion, PairingRequirementNotNeeded, AirPlayFeatureSystemPairing, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &Service{Protocol: tt.protocol, Pairing: tt.pairing}
+			service.Capabilities.Features = tt.features
+			if got := transientPairing(service); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestPairIdentity(t *testing.T) {
+	signer := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+	opts := PairOptions{Name: "Kitchen Remote", ClientID: "kitchen", PrivateKey: signer}
+
+	for _, protocol := range []Protocol{ProtocolMRP, ProtocolAirPlay, ProtocolCompanion} {
+		t.Run(protocol.String(), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			accessory := newTestAccessory(t, "1234")
+			config := startTestAccessory(t, protocol, accessory)
+			if err := pairTestAccessory(ctx, config, protocol, "1234", opts); err != nil {
+				t.Fatalf("Pairing failed: %v", err)
+			}
+
+			credentials, _ := ParseCredentials(config.GetService(protocol).Credentials)
+			if string(credentials.ClientID) != "kitchen" || !bytes.Equal(credentials.LTSK, signer.Seed()) {
+				t.Errorf("Expected credentials with our identity, got %+v", credentials)
+			}
+			if name := accessory.name(credentials.ClientID); name != "Kitchen Remote" {
+				t.Errorf("Expected device to know us as Kitchen Remote, got %q", name)
+			}
+		})
+	}
+}
+
+func TestPairIdentityDefaults(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	accessory := newTestAccessory(t, "1234")
+	config := startTestAccessory(t, ProtocolMRP, accessory)
+	config.Services = append(config.Services, startTestAccessory(t, ProtocolCompanion, accessory).Services...)
+
+	storage := NewMemoryStorage()
+	settings, _ := storage.GetSettings(ctx, config)
+	settings.Info.Name = "Stored Remote"
+
+	for _, protocol := range []Protocol{ProtocolMRP, ProtocolCompanion} {
+		if err := pairTestAccessory(ctx, config, protocol, "1234", PairOptions{Storage: storage}); err != nil {
+			t.Fatalf("Pairing %s failed: %v", protocol, err)
+		}
+	}
+
+	mrpCredentials, _ := ParseCredentials(config.GetService(ProtocolMRP).Credentials)
+	companion, _ := ParseCredentials(config.GetService(ProtocolCompanion).Credentials)
+	if !bytes.Equal(mrpCredentials.ClientID, companion.ClientID) || !bytes.Equal(mrpCredentials.LTSK, companion.LTSK) {
+		t.Errorf("Expected the same identity for both protocols, got %q and %q", mrpCredentials.ClientID, companion.ClientID)
+	}
+	if name := accessory.name(mrpCredentials.ClientID); name != "Stored Remote" {
+		t.Errorf("Expected name from storage, got %q", name)
+	}
+}
+
+func TestResolveIdentity(t *testing.T) {
+	config := &Config{Services: []*Service{{Protocol: ProtocolMRP, Port: 1}}}
+	if _, err := resolveIdentity(context.Background(), config, PairOptions{PrivateKey: make([]byte, 3)}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Expected ErrInvalidConfig, got %v", err)
+	}
+
+	identity, err := resolveIdentity(context.Background(), config, PairOptions{})
+	if err != nil || identity.name != defaultClientName || identity.clientID == "" || identity.signer == nil {
+		t.Errorf("Expected a new identity named %s, got %+v: %v", defaultClientName, identity, err)
+	}
+}
@@ -0,0 +1,560 @@
+package pyatv
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/tlv8"
+)
+
+// hapHandshakeTimeout limits how long a client may take to pair on a
+// connection accepted by a HAPServer listener.
+const hapHandshakeTimeout = 30 * time.Second
+
+// HAPServerOptions configures a HAPServer.
+type HAPServerOptions struct {
+	PIN        string // PIN clients must enter during pair-setup
+	Identifier string // Pairing identifier, a new UUID if empty
+	Seed       []byte // Ed25519 seed of the long-term key, random if empty
+	Name       string // Device name told to MRP clients
+
+	// AllowTransient accepts transient pair-setup with the fixed PIN from
+	// AirPlay clients, like HomePods do. Anyone can pass it, so it is never
+	// accepted on other protocols.
+	AllowTransient bool
+}
+
+// HAPServer is the accessory side of HAP pairing, for fake devices, proxies
+// and receivers. It accepts pair-setup with a PIN, remembers the long-term
+// keys of paired clients and answers pair-verify, after which the connection
+// is encrypted like an Apple TV would do it. The same server can accept MRP,
+// Companion and AirPlay connections. AirPlay clients may also be allowed to
+// use transient pair-setup, see HAPServerOptions.AllowTransient.
+type HAPServer struct {
+	pin            string
+	id             []byte
+	name           string
+	signer         ed25519.PrivateKey
+	allowTransient bool
+
+	mu      sync.Mutex
+	clients map[string]hapServerClient // By pairing identifier
+}
+
+// hapServerClient is a client paired with a HAPServer.
+type hapServerClient struct {
+	ltpk  ed25519.PublicKey
+	admin bool // Allowed to manage pairings
+}
+
+// NewHAPServer creates a server without any paired clients.
+func NewHAPServer(opts HAPServerOptions) (*HAPServer, error) {
+	if opts.PIN == "" {
+		return nil, fmt.Errorf("%w: no PIN", ErrInvalidConfig)
+	}
+	if opts.Identifier == "" {
+		opts.Identifier = newPairingID()
+	}
+	if opts.Name == "" {
+		opts.Name = defaultClientName
+	}
+
+	seed := opts.Seed
+	if len(seed) == 0 {
+		seed = make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%w: expected %d byte seed, got %d", ErrInvalidConfig, ed25519.SeedSize, len(seed))
+	}
+
+	return &HAPServer{
+		pin:            opts.PIN,
+		id:             []byte(opts.Identifier),
+		name:           opts.Name,
+		signer:         ed25519.NewKeyFromSeed(seed),
+		allowTransient: opts.AllowTransient,
+		clients:        make(map[string]hapServerClient),
+	}, nil
+}
+
+// Identifier returns the pairing identifier of the server.
+func (s *HAPServer) Identifier() string {
+	return string(s.id)
+}
+
+// PublicKey returns the long-term public key of the server.
+func (s *HAPServer) PublicKey() ed25519.PublicKey {
+	return s.signer.Public().(ed25519.PublicKey)
+}
+
+// Clients returns the long-term public keys of all paired clients by pairing
+// identifier.
+func (s *HAPServer) Clients() map[string]ed25519.PublicKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clients := make(map[string]ed25519.PublicKey, len(s.clients))
+	for id, client := range s.clients {
+		clients[id] = client.ltpk
+	}
+	return clients
+}
+
+// AddClient pairs an admin client without pair-setup, e.g. to restore
+// pairings returned by Clients earlier.
+func (s *HAPServer) AddClient(identifier string, ltpk ed25519.PublicKey) error {
+	return s.addClient(identifier, ltpk, true)
+}
+
+func (s *HAPServer) addClient(identifier string, ltpk ed25519.PublicKey, admin bool) error {
+	if len(ltpk) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: expected %d byte public key, got %d", ErrInvalidCredentials, ed25519.PublicKeySize, len(ltpk))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[identifier] = hapServerClient{ltpk: ltpk, admin: admin}
+	return nil
+}
+
+// RemoveClient forgets a paired client.
+func (s *HAPServer) RemoveClient(identifier string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, identifier)
+}
+
+func (s *HAPServer) client(identifier []byte) (hapServerClient, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client, ok := s.clients[string(identifier)]
+	return client, ok
+}
+
+// HandlePairings answers a request to list, add or remove pairings, which a
+// verified client sends over its encrypted connection. AirPlay clients post
+// it to /pair-list, /pair-add or /pair-remove, MRP clients send it in a
+// CryptoPairingMessage. The client is the pairing identifier the connection
+// was verified with, see HAPServerConn.Client. Like in HAP, only admin
+// clients may manage pairings.
+func (s *HAPServer) HandlePairings(client string, request []byte) []byte {
+	items, err := tlv8.Decode(request)
+	if err != nil {
+		return tlv8.Encode(
+			tlv8.Uint(tlv8.TagState, uint64(tlv8.M2)),
+			tlv8.Uint(tlv8.TagError, uint64(tlv8.ErrorUnknown)),
+		)
+	}
+	return s.handlePairings(client, items).Encode()
+}
+
+func (s *HAPServer) handlePairings(client string, items tlv8.Items) tlv8.Items {
+	method, _ := items.Uint(tlv8.TagMethod)
+	identifier, _ := items.Get(tlv8.TagIdentifier)
+	resp := tlv8.Items{tlv8.Uint(tlv8.TagState, uint64(tlv8.M2))}
+
+	// Transient sessions have no client, which is never paired
+	if paired, ok := s.client([]byte(client)); client == "" || !ok || !paired.admin {
+		return append(resp, tlv8.Uint(tlv8.TagError, uint64(tlv8.ErrorAuthentication)))
+	}
+
+	switch tlv8.Method(method) {
+	case tlv8.MethodListPairings:
+		s.mu.Lock()
+		ids := make([]string, 0, len(s.clients))
+		for id := range s.clients {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for i, id := range ids {
+			if i > 0 {
+				resp = append(resp, tlv8.Separator())
+			}
+			var permissions uint64
+			if s.clients[id].admin {
+				permissions = hapPermissionAdmin
+			}
+			resp = append(resp,
+				tlv8.String(tlv8.TagIdentifier, id),
+				tlv8.Bytes(tlv8.TagPublicKey, s.clients[id].ltpk),
+				tlv8.Uint(tlv8.TagPermissions, permissions),
+			)
+		}
+		s.mu.Unlock()
+	case tlv8.MethodAddPairing:
+		ltpk, _ := items.Get(tlv8.TagPublicKey)
+		permissions, _ := items.Uint(tlv8.TagPermissions)
+		if len(identifier) == 0 || s.addClient(string(identifier), ltpk, permissions&hapPermissionAdmin != 0) != nil {
+			resp = append(resp, tlv8.Uint(tlv8.TagError, uint64(tlv8.ErrorUnknown)))
+		}
+	case tlv8.MethodRemovePairing:
+		s.RemoveClient(string(identifier))
+	default:
+		resp = append(resp, tlv8.Uint(tlv8.TagError, uint64(tlv8.ErrorUnknown)))
+	}
+	return resp
+}
+
+// pairingServerTransport receives pairing messages from a client and sends
+// the responses, framed like a protocol does.
+type pairingServerTransport interface {
+	receive() (hapExchange, tlv8.Items, error)
+	send(kind hapExchange, items tlv8.Items) error
+	// stream returns the connection without losing data already received.
+	stream() net.Conn
+}
+
+// HAPServerConn is a connection that passed pairing with a HAPServer,
+// encrypted with the session keys of the protocol.
+type HAPServerConn struct {
+	net.Conn
+	client string
+}
+
+// Client returns the pairing identifier the client passed pair-verify with,
+// or an empty string after transient pair-setup.
+func (c *HAPServerConn) Client() string {
+	return c.client
+}
+
+// Accept runs pairing with a client on a new connection, until it has passed
+// pair-verify or transient pair-setup. It returns the connection encrypted
+// with the session keys of the protocol, which should be used for everything
+// after that. Clients may run pair-setup first on the same connection.
+func (s *HAPServer) Accept(ctx context.Context, conn net.Conn, protocol Protocol) (*HAPServerConn, error) {
+	var transport pairingServerTransport
+	switch protocol {
+	case ProtocolMRP:
+		transport = newMRPPairingServerTransport(conn, string(s.id), s.name)
+	case ProtocolCompanion:
+		transport = newCompanionPairingServerTransport(conn)
+	case ProtocolAirPlay:
+		transport = newAirPlayPairingServerTransport(conn)
+	default:
+		return nil, fmt.Errorf("%w: HAP pairing over %s", ErrNotSupported, protocol)
+	}
+	info, err := sessionKeyInfo(protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := bindContext(ctx, conn)
+	defer stop()
+
+	exchange := &hapServerExchange{server: s, protocol: protocol}
+	for {
+		kind, items, err := transport.receive()
+		if err != nil {
+			return nil, connectionError(ctx, err)
+		}
+		resp, secret := exchange.handle(kind, items)
+		if err := transport.send(kind, resp); err != nil {
+			return nil, connectionError(ctx, err)
+		}
+		if secret != nil {
+			// Keys are named from the client side
+			input, output := secret.keys(info)
+			secured, err := newSessionConn(transport.stream(), protocol, output, input)
+			if err != nil {
+				return nil, err
+			}
+			return &HAPServerConn{Conn: secured, client: exchange.client}, nil
+		}
+	}
+}
+
+// Listener wraps a listener so that Accept returns connections that passed
+// pairing, encrypted with the session keys of protocol, as *HAPServerConn.
+// Connections that only run pair-setup or fail pairing are closed.
+func (s *HAPServer) Listener(listener net.Listener, protocol Protocol) net.Listener {
+	l := &hapListener{
+		Listener: listener,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.run(s, protocol)
+	return l
+}
+
+// hapListener is the listener returned by HAPServer.Listener. Pairing runs
+// in the background, so that a slow client does not block others.
+type hapListener struct {
+	net.Listener
+	conns chan net.Conn
+
+	done      chan struct{}
+	err       error // Why accepting stopped, nil if closed
+	closeOnce sync.Once
+}
+
+func (l *hapListener) run(server *HAPServer, protocol Protocol) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.closeOnce.Do(func() {
+				l.err = err
+				close(l.done)
+			})
+			return
+		}
+
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), hapHandshakeTimeout)
+			defer cancel()
+
+			secured, err := server.Accept(ctx, conn, protocol)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			select {
+			case l.conns <- secured:
+			case <-l.done:
+				secured.Close()
+			}
+		}()
+	}
+}
+
+// Accept waits for the next client that passed pairing.
+func (l *hapListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections.
+func (l *hapListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+// hapServerExchange is the state of pairing with a client on one connection.
+type hapServerExchange struct {
+	server   *HAPServer
+	protocol Protocol
+
+	srp       *srpServer
+	transient bool
+
+	verifyPrivate *ecdh.PrivateKey
+	clientPublic  []byte
+	verifyShared  []byte
+	client        string // Pairing identifier that passed pair-verify
+}
+
+// errUnexpectedMessage is returned for messages out of order.
+var errUnexpectedMessage = errors.New("unexpected pairing message")
+
+// handle answers a message from the client. The shared secret is returned
+// once the client has passed pair-verify or transient pair-setup. Failures
+// are reported to the client as authentication errors.
+func (e *hapServerExchange) handle(kind hapExchange, items tlv8.Items) (tlv8.Items, *hapSharedSecret) {
+	state, _ := items.Uint(tlv8.TagState)
+
+	var resp tlv8.Items
+	var secret *hapSharedSecret
+	var err error
+	switch {
+	case kind.setup() && state == uint64(tlv8.M1):
+		resp, err = e.setupM2(kind, items)
+	case kind.setup() && state == uint64(tlv8.M3):
+		resp, secret, err = e.setupM4(items)
+	case kind.setup() && state == uint64(tlv8.M5):
+		resp, err = e.setupM6(items)
+	case kind == exchangePairVerify && state == uint64(tlv8.M1):
+		resp, err = e.verifyM2(items)
+	case kind == exchangePairVerify && state == uint64(tlv8.M3):
+		resp, secret, err = e.verifyM4(items)
+	default:
+		err = errUnexpectedMessage
+	}
+
+	if err != nil {
+		return tlv8.Items{
+			tlv8.Uint(tlv8.TagState, state+1),
+			tlv8.Uint(tlv8.TagError, uint64(tlv8.ErrorAuthentication)),
+		}, nil
+	}
+	return resp, secret
+}
+
+func (e *hapServerExchange) setupM2(kind hapExchange, items tlv8.Items) (tlv8.Items, error) {
+	flags, _ := items.Uint(tlv8.TagFlags)
+	e.transient = kind == exchangeTransientPairSetup || tlv8.Flag(flags)&tlv8.FlagTransientPairing != 0
+	if e.transient && (!e.server.allowTransient || e.protocol != ProtocolAirPlay) {
+		return nil, fmt.Errorf("%w: transient pair-setup over %s", ErrAuthentication, e.protocol)
+	}
+
+	pin := e.server.pin
+	if e.transient {
+		pin = transientPIN
+	}
+	salt, private := make([]byte, 16), make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(private); err != nil {
+		return nil, err
+	}
+	e.srp = newSRPServer(srpGroupHAP, srpUsername, pin, salt, private)
+
+	return tlv8.Items{
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M2)),
+		tlv8.Bytes(tlv8.TagSalt, salt),
+		tlv8.Bytes(tlv8.TagPublicKey, e.srp.PublicKey()),
+	}, nil
+}
+
+func (e *hapServerExchange) setupM4(items tlv8.Items) (tlv8.Items, *hapSharedSecret, error) {
+	if e.srp == nil {
+		return nil, nil, errUnexpectedMessage
+	}
+	values, err := requireItems(items, tlv8.TagPublicKey, tlv8.TagProof)
+	if err != nil {
+		return nil, nil, err
+	}
+	proof, err := e.srp.Process(values[0], values[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp := tlv8.Items{
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M4)),
+		tlv8.Bytes(tlv8.TagProof, proof),
+	}
+	if e.transient {
+		return resp, &hapSharedSecret{secret: e.srp.SessionKey()}, nil
+	}
+	return resp, nil, nil
+}
+
+func (e *hapServerExchange) setupM6(items tlv8.Items) (tlv8.Items, error) {
+	if e.srp == nil || e.srp.SessionKey() == nil || e.transient {
+		return nil, errUnexpectedMessage
+	}
+	sessionKey := e.srp.SessionKey()
+	encryptKey := hkdfExpand("Pair-Setup-Encrypt-Salt", "Pair-Setup-Encrypt-Info", sessionKey)
+
+	values, err := requireItems(items, tlv8.TagEncryptedData)
+	if err != nil {
+		return nil, err
+	}
+	client, err := openPairing(encryptKey, "PS-Msg05", values[0])
+	if err != nil {
+		return nil, err
+	}
+	if values, err = requireItems(client, tlv8.TagIdentifier, tlv8.TagPublicKey, tlv8.TagSignature); err != nil {
+		return nil, err
+	}
+	clientID, ltpk, signature := values[0], values[1], values[2]
+	if len(ltpk) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: invalid client public key", ErrAuthentication)
+	}
+	controllerX := hkdfExpand("Pair-Setup-Controller-Sign-Salt", "Pair-Setup-Controller-Sign-Info", sessionKey)
+	if !ed25519.Verify(ltpk, concat(controllerX, clientID, ltpk), signature) {
+		return nil, fmt.Errorf("%w: invalid client signature", ErrAuthentication)
+	}
+	if err := e.server.addClient(string(clientID), ltpk, true); err != nil {
+		return nil, err
+	}
+
+	public := e.server.PublicKey()
+	accessoryX := hkdfExpand("Pair-Setup-Accessory-Sign-Salt", "Pair-Setup-Accessory-Sign-Info", sessionKey)
+	encrypted := sealPairing(encryptKey, "PS-Msg06", tlv8.Encode(
+		tlv8.Bytes(tlv8.TagIdentifier, e.server.id),
+		tlv8.Bytes(tlv8.TagPublicKey, public),
+		tlv8.Bytes(tlv8.TagSignature, ed25519.Sign(e.server.signer, concat(accessoryX, e.server.id, public))),
+	))
+	e.srp = nil
+
+	return tlv8.Items{
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M6)),
+		tlv8.Bytes(tlv8.TagEncryptedData, encrypted),
+	}, nil
+}
+
+func (e *hapServerExchange) verifyM2(items tlv8.Items) (tlv8.Items, error) {
+	values, err := requireItems(items, tlv8.TagPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := ecdh.X25519().NewPublicKey(values[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid client public key", ErrAuthentication)
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAuthentication, err)
+	}
+	e.verifyPrivate, e.clientPublic, e.verifyShared = private, values[0], shared
+
+	id := e.server.id
+	public := private.PublicKey().Bytes()
+	encryptKey := hkdfExpand("Pair-Verify-Encrypt-Salt", "Pair-Verify-Encrypt-Info", shared)
+	encrypted := sealPairing(encryptKey, "PV-Msg02", tlv8.Encode(
+		tlv8.Bytes(tlv8.TagIdentifier, id),
+		tlv8.Bytes(tlv8.TagSignature, ed25519.Sign(e.server.signer, concat(public, id, e.clientPublic))),
+	))
+
+	return tlv8.Items{
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M2)),
+		tlv8.Bytes(tlv8.TagPublicKey, public),
+		tlv8.Bytes(tlv8.TagEncryptedData, encrypted),
+	}, nil
+}
+
+func (e *hapServerExchange) verifyM4(items tlv8.Items) (tlv8.Items, *hapSharedSecret, error) {
+	if e.verifyShared == nil {
+		return nil, nil, errUnexpectedMessage
+	}
+	encryptKey := hkdfExpand("Pair-Verify-Encrypt-Salt", "Pair-Verify-Encrypt-Info", e.verifyShared)
+
+	values, err := requireItems(items, tlv8.TagEncryptedData)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := openPairing(encryptKey, "PV-Msg03", values[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if values, err = requireItems(client, tlv8.TagIdentifier, tlv8.TagSignature); err != nil {
+		return nil, nil, err
+	}
+	clientID, signature := values[0], values[1]
+
+	paired, ok := e.server.client(clientID)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: unknown client %s", ErrAuthentication, clientID)
+	}
+	public := e.verifyPrivate.PublicKey().Bytes()
+	if !ed25519.Verify(paired.ltpk, concat(e.clientPublic, clientID, public), signature) {
+		return nil, nil, fmt.Errorf("%w: invalid client signature", ErrAuthentication)
+	}
+
+	shared := e.verifyShared
+	e.verifyPrivate, e.clientPublic, e.verifyShared = nil, nil, nil
+	e.client = string(clientID)
+	return tlv8.Items{tlv8.Uint(tlv8.TagState, uint64(tlv8.M4))}, &hapSharedSecret{secret: shared}, nil
+}
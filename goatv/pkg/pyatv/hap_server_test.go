@@ -0,0 +1,346 @@
+package pyatv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/mrp"
+)
+
+func TestSRPServerExchange(t *testing.T) {
+	for _, group := range []*srpGroup{srpGroupHAP, srpGroupLegacy} {
+		salt := bytes.Repeat([]byte{0x17}, 16)
+		client := newSRPClient(group, srpUsername, "1234", bytes.Repeat([]byte{0x42}, 32))
+		server := newSRPServer(group, srpUsername, "1234", salt, bytes.Repeat([]byte{0x24}, 32))
+
+		clientProof, err := client.Process(salt, server.PublicKey())
+		if err != nil {
+			t.Fatalf("Process() error = %v", err)
+		}
+		serverProof, err := server.Process(client.PublicKey(), clientProof)
+		if err != nil {
+			t.Fatalf("Process() error = %v", err)
+		}
+		if !bytes.Equal(server.SessionKey(), client.SessionKey()) {
+			t.Errorf("Expected session key %X, got %X", client.SessionKey(), server.SessionKey())
+		}
+		if err := client.Verify(serverProof); err != nil {
+			t.Errorf("Verify() error = %v", err)
+		}
+	}
+}
+
+func TestSRPServerWrongPassword(t *testing.T) {
+	salt := bytes.Repeat([]byte{0x17}, 16)
+	client := newSRPClient(srpGroupHAP, srpUsername, "4321", bytes.Repeat([]byte{0x42}, 32))
+	server := newSRPServer(srpGroupHAP, srpUsername, "1234", salt, bytes.Repeat([]byte{0x24}, 32))
+
+	proof, err := client.Process(salt, server.PublicKey())
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if _, err := server.Process(client.PublicKey(), proof); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Expected ErrAuthentication, got %v", err)
+	}
+	if server.SessionKey() != nil {
+		t.Error("Expected no session key")
+	}
+}
+
+// echoConn sends back everything received.
+func echoConn(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+// startHAPServer serves protocol with server and hands encrypted connections
+// to serve.
+func startHAPServer(t *testing.T, protocol Protocol, server *HAPServer, serve func(net.Conn)) *Config {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	secured := server.Listener(listener, protocol)
+	t.Cleanup(func() { secured.Close() })
+
+	go func() {
+		for {
+			conn, err := secured.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+
+	service := &Service{
+		Identifier: "AABBCCDDEEFF",
+		Protocol:   protocol,
+		Port:       listener.Addr().(*net.TCPAddr).Port,
+		Enabled:    true,
+	}
+	if protocol == ProtocolAirPlay {
+		service.Capabilities.Features = AirPlayFeatureCoreUtilsPairingAndEncryption
+	}
+	return &Config{
+		Address:  net.ParseIP("127.0.0.1"),
+		Name:     "Living Room",
+		Services: []*Service{service},
+	}
+}
+
+func newTestHAPServer(t *testing.T) *HAPServer {
+	t.Helper()
+	server, err := NewHAPServer(HAPServerOptions{PIN: "1234", Identifier: "accessory"})
+	if err != nil {
+		t.Fatalf("NewHAPServer() error = %v", err)
+	}
+	return server
+}
+
+// echoMessage sends a message framed like protocol over an encrypted
+// connection and returns what comes back.
+func echoMessage(t *testing.T, conn net.Conn, protocol Protocol, message []byte) []byte {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var err error
+	var received []byte
+	switch protocol {
+	case ProtocolMRP:
+		if err = mrp.WriteFrame(conn, message); err == nil {
+			received, err = mrp.ReadFrame(bufio.NewReader(conn))
+		}
+	case ProtocolCompanion:
+		if err = writeCompanionFrame(conn, 8, message); err == nil {
+			_, received, err = readCompanionFrame(conn)
+		}
+	default:
+		if _, err = conn.Write(message); err == nil {
+			received = make([]byte, len(message))
+			_, err = io.ReadFull(conn, received)
+		}
+	}
+	if err != nil {
+		t.Fatalf("Echo failed: %v", err)
+	}
+	return received
+}
+
+func TestHAPServerPairAndVerify(t *testing.T) {
+	for _, protocol := range []Protocol{ProtocolMRP, ProtocolAirPlay, ProtocolCompanion} {
+		t.Run(protocol.String(), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			server := newTestHAPServer(t)
+			config := startHAPServer(t, protocol, server, echoConn)
+			if err := pairTestAccessory(ctx, config, protocol, "1234", PairOptions{}); err != nil {
+				t.Fatalf("Pairing failed: %v", err)
+			}
+
+			credentials, err := ParseCredentials(config.GetService(protocol).Credentials)
+			if err != nil {
+				t.Fatalf("ParseCredentials() error = %v", err)
+			}
+			if string(credentials.DeviceID) != "accessory" || !bytes.Equal(credentials.LTPK, server.PublicKey()) {
+				t.Errorf("Expected credentials of the server, got %+v", credentials)
+			}
+			if _, ok := server.Clients()[string(credentials.ClientID)]; !ok {
+				t.Errorf("Expected server to know client %q", credentials.ClientID)
+			}
+
+			atv := NewAppleTVConnection(config, ConnectOptions{Protocol: &protocol})
+			if err := atv.Connect(ctx); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer atv.Close()
+
+			message := bytes.Repeat([]byte("hello"), 300)
+			if protocol == ProtocolMRP {
+				// MRP took the session over, the echo is the answer to a request
+				request := mrp.NewMessage(mrp.TypeGeneric)
+				request.Generic = &mrp.GenericMessage{Value: message}
+				resp, err := atv.mrp.request(ctx, request)
+				if err != nil {
+					t.Fatalf("request() error = %v", err)
+				}
+				if resp.Generic == nil || !bytes.Equal(resp.Generic.Value, message) {
+					t.Errorf("Expected %q back, got %+v", message, resp.Generic)
+				}
+				return
+			}
+
+			session := atv.sessions[protocol]
+			info, _ := sessionKeyInfo(protocol)
+			output, input := session.secret.keys(info)
+			conn, err := newSessionConn(session.transport.stream(), protocol, output, input)
+			if err != nil {
+				t.Fatalf("newSessionConn() error = %v", err)
+			}
+
+			if received := echoMessage(t, conn, protocol, message); !bytes.Equal(received, message) {
+				t.Errorf("Expected %q back, got %q", message, received)
+			}
+		})
+	}
+}
+
+func TestHAPServerWrongPin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	server := newTestHAPServer(t)
+	config := startHAPServer(t, ProtocolCompanion, server, echoConn)
+
+	err := pairTestAccessory(ctx, config, ProtocolCompanion, "4321", PairOptions{})
+	if !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Expected ErrAuthentication, got %v", err)
+	}
+	if clients := server.Clients(); len(clients) != 0 {
+		t.Errorf("Expected no clients, got %v", clients)
+	}
+}
+
+func TestHAPServerUnknownClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	server := newTestHAPServer(t)
+	config := startHAPServer(t, ProtocolMRP, server, echoConn)
+	if err := pairTestAccessory(ctx, config, ProtocolMRP, "1234", PairOptions{}); err != nil {
+		t.Fatalf("Pairing failed: %v", err)
+	}
+	for id := range server.Clients() {
+		server.RemoveClient(id)
+	}
+
+	atv := NewAppleTVConnection(config, ConnectOptions{})
+	if err := atv.Connect(ctx); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Expected ErrAuthentication, got %v", err)
+	}
+}
+
+func TestHAPServerTransient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	server, err := NewHAPServer(HAPServerOptions{PIN: "1234", AllowTransient: true})
+	if err != nil {
+		t.Fatalf("NewHAPServer() error = %v", err)
+	}
+	config := startHAPServer(t, ProtocolAirPlay, server, echoConn)
+	service := config.GetService(ProtocolAirPlay)
+	service.Pairing = PairingRequirementNotNeeded
+	service.Capabilities.Features |= AirPlayFeatureSystemPairing
+
+	protocol := ProtocolAirPlay
+	atv := NewAppleTVConnection(config, ConnectOptions{Protocol: &protocol})
+	if err := atv.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer atv.Close()
+
+	session := atv.sessions[ProtocolAirPlay]
+	conn, err := session.secure(airPlaySessionKeys)
+	if err != nil {
+		t.Fatalf("secure() error = %v", err)
+	}
+	if received := echoMessage(t, conn, ProtocolAirPlay, []byte("ping")); string(received) != "ping" {
+		t.Errorf("Expected ping back, got %q", received)
+	}
+	if clients := server.Clients(); len(clients) != 0 {
+		t.Errorf("Expected no clients after transient pairing, got %v", clients)
+	}
+}
+
+func TestHAPServerTransientRejected(t *testing.T) {
+	tests := []struct {
+		name           string
+		protocol       Protocol
+		allowTransient bool
+	}{
+		{"MRP", ProtocolMRP, false},
+		{"MRP allowed", ProtocolMRP, true},
+		{"AirPlay", ProtocolAirPlay, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			server, err := NewHAPServer(HAPServerOptions{PIN: "1234", AllowTransient: tt.allowTransient})
+			if err != nil {
+				t.Fatalf("NewHAPServer() error = %v", err)
+			}
+			served := make(chan struct{}, 1)
+			config := startHAPServer(t, tt.protocol, server, func(net.Conn) { served <- struct{}{} })
+
+			transport, err := openPairingTransport(ctx, config, config.GetService(tt.protocol), "client", "goatv")
+			if err != nil {
+				t.Fatalf("openPairingTransport() error = %v", err)
+			}
+			defer transport.Close()
+
+			if _, err := hapTransientPairSetup(ctx, transport); !errors.Is(err, ErrAuthentication) {
+				t.Errorf("Expected ErrAuthentication, got %v", err)
+			}
+			select {
+			case <-served:
+				t.Error("Expected no connection to be accepted")
+			default:
+			}
+		})
+	}
+}
+
+func TestNewHAPServerInvalid(t *testing.T) {
+	tests := []HAPServerOptions{
+		{},
+		{PIN: "1234", Seed: []byte{1, 2, 3}},
+	}
+	for _, opts := range tests {
+		if _, err := NewHAPServer(opts); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("Expected ErrInvalidConfig for %+v, got %v", opts, err)
+		}
+	}
+}
+
+func TestMessageConnPartialWrites(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	key1, key2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	sender, _ := newSessionConn(client, ProtocolCompanion, key1, key2)
+	receiver, _ := newSessionConn(server, ProtocolCompanion, key2, key1)
+
+	// An empty message is sent in plain text, the header is written alone
+	frames := [][]byte{{8, 0, 0, 0}, {8, 0, 0, 5}, []byte("hello")}
+	go func() {
+		for _, frame := range frames {
+			sender.Write(frame)
+		}
+	}()
+
+	reader := bufio.NewReader(receiver)
+	for _, expected := range []string{"", "hello"} {
+		frameType, payload, err := readCompanionFrame(reader)
+		if err != nil {
+			t.Fatalf("readCompanionFrame() error = %v", err)
+		}
+		if frameType != 8 || string(payload) != expected {
+			t.Errorf("Expected frame 8 with %q, got %d with %q", expected, frameType, payload)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package pyatv
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// hapKeyInfo holds the HKDF salt and info strings a protocol derives its
+// session keys with after pair-verify.
+type hapKeyInfo struct {
+	salt       string
+	outputInfo string // Key for data we send
+	inputInfo  string // Key for data we receive
+}
+
+// Session keys of each protocol, as seen from the client.
+var (
+	mrpSessionKeys       = hapKeyInfo{"MediaRemote-Salt", "MediaRemote-Write-Encryption-Key", "MediaRemote-Read-Encryption-Key"}
+	companionSessionKeys = hapKeyInfo{"", "ClientEncrypt-main", "ServerEncrypt-main"}
+	airPlaySessionKeys   = hapKeyInfo{"Control-Salt", "Control-Write-Encryption-Key", "Control-Read-Encryption-Key"}
+)
+
+// chacha20Nonce is the way a message counter is turned into a nonce.
+type chacha20Nonce int
+
+const (
+	// chacha20Nonce64 puts the counter as 64 bit little endian after four
+	// zero bytes. Used by HAP framing and MRP.
+	chacha20Nonce64 chacha20Nonce = iota
+	// chacha20Nonce96 uses the counter as 96 bit little endian. Used by
+	// Companion.
+	chacha20Nonce96
+)
+
+// chacha20Cipher encrypts and decrypts messages in one session with
+// ChaCha20-Poly1305. Each direction has its own key and counts its messages
+// to get the nonce.
+type chacha20Cipher struct {
+	output, input         cipher.AEAD
+	outCounter, inCounter uint64
+	nonceFormat           chacha20Nonce
+}
+
+func newChaCha20Cipher(outputKey, inputKey []byte, nonceFormat chacha20Nonce) (*chacha20Cipher, error) {
+	output, err := chacha20poly1305.New(outputKey)
+	if err != nil {
+		return nil, err
+	}
+	input, err := chacha20poly1305.New(inputKey)
+	if err != nil {
+		return nil, err
+	}
+	return &chacha20Cipher{output: output, input: input, nonceFormat: nonceFormat}, nil
+}
+
+func (c *chacha20Cipher) nonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	if c.nonceFormat == chacha20Nonce64 {
+		binary.LittleEndian.PutUint64(nonce[4:], counter)
+	} else {
+		binary.LittleEndian.PutUint64(nonce, counter)
+	}
+	return nonce
+}
+
+// seal encrypts the next outgoing message.
+func (c *chacha20Cipher) seal(plaintext, aad []byte) []byte {
+	sealed := c.output.Seal(nil, c.nonce(c.outCounter), plaintext, aad)
+	c.outCounter++
+	return sealed
+}
+
+// open decrypts the next incoming message.
+func (c *chacha20Cipher) open(ciphertext, aad []byte) ([]byte, error) {
+	plaintext, err := c.input.Open(nil, c.nonce(c.inCounter), ciphertext, aad)
+	c.inCounter++
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt message %d", ErrAuthentication, c.inCounter-1)
+	}
+	return plaintext, nil
+}
+
+// HAP framing, section 5.2.2 of the specification (release R1). Every frame
+// starts with the plaintext length as 16 bit little endian, which is also the
+// additional authenticated data of the frame.
+const (
+	hapFrameSize  = 1024
+	hapLengthSize = 2
+)
+
+// hapConn encrypts a connection with HAP framing, so that it can be used as
+// an ordinary stream. This is what AirPlay uses for its control channel after
+// pair-verify.
+type hapConn struct {
+	net.Conn
+	cipher *chacha20Cipher
+
+	readMu  sync.Mutex
+	raw     []byte // Received data not forming a complete frame yet
+	pending []byte // Decrypted data not read yet
+	readErr error
+	buffer  [4096]byte
+
+	writeMu sync.Mutex
+}
+
+// newHAPConn wraps conn. A server must swap the keys.
+func newHAPConn(conn net.Conn, outputKey, inputKey []byte) (*hapConn, error) {
+	cipher, err := newChaCha20Cipher(outputKey, inputKey, chacha20Nonce64)
+	if err != nil {
+		return nil, err
+	}
+	return &hapConn{Conn: conn, cipher: cipher}, nil
+}
+
+// Read reads decrypted data.
+func (c *hapConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readFrame reads until a frame is complete and decrypts it. Data already
+// received is kept if reading fails, e.g. because of a deadline.
+func (c *hapConn) readFrame() error {
+	for {
+		if len(c.raw) >= hapLengthSize {
+			end := hapLengthSize + int(binary.LittleEndian.Uint16(c.raw)) + chacha20poly1305.Overhead
+			if len(c.raw) >= end {
+				plaintext, err := c.cipher.open(c.raw[hapLengthSize:end], c.raw[:hapLengthSize])
+				if err != nil {
+					// The counters are out of sync, nothing can be read anymore
+					c.readErr = err
+					return err
+				}
+				c.raw = c.raw[end:]
+				c.pending = plaintext
+				return nil
+			}
+		}
+
+		n, err := c.Conn.Read(c.buffer[:])
+		c.raw = append(c.raw, c.buffer[:n]...)
+		if err != nil && n == 0 {
+			return err
+		}
+	}
+}
+
+// Write encrypts data and writes it in frames of at most 1024 bytes.
+func (c *hapConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var data []byte
+	for remaining := b; len(remaining) > 0; {
+		frame := remaining[:min(len(remaining), hapFrameSize)]
+		remaining = remaining[len(frame):]
+
+		length := binary.LittleEndian.AppendUint16(nil, uint16(len(frame)))
+		data = append(data, length...)
+		data = append(data, c.cipher.seal(frame, length)...)
+	}
+	if _, err := c.Conn.Write(data); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// messageFraming describes the framing of a message based protocol, so that
+// messageConn can encrypt the payload of every message.
+type messageFraming interface {
+	// parse returns the sizes of the header and payload of the message at the
+	// start of data. The header size is zero if data holds no complete header.
+	parse(data []byte) (headerSize, payloadSize int, err error)
+	// resize returns a copy of a header with another payload size.
+	resize(header []byte, payloadSize int) []byte
+	// encrypted returns the additional authenticated data of a message, and
+	// whether it is encrypted at all.
+	encrypted(header []byte, payloadSize int) (aad []byte, ok bool)
+}
+
+// messageConn encrypts the messages of a protocol that does its own framing,
+// like MRP and Companion. The stream read and written is framed exactly like
+// without encryption, only the payloads are encrypted on the wire.
+type messageConn struct {
+	net.Conn
+	cipher  *chacha20Cipher
+	framing messageFraming
+
+	readMu  sync.Mutex
+	raw     []byte // Received data not forming a complete message yet
+	pending []byte // Decrypted messages not read yet
+	readErr error
+	buffer  [4096]byte
+
+	writeMu  sync.Mutex
+	unsealed []byte // Written data not forming a complete message yet
+}
+
+// Read reads decrypted messages.
+func (c *messageConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.readMessage(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readMessage reads until a message is complete and decrypts it.
+func (c *messageConn) readMessage() error {
+	for {
+		headerSize, payloadSize, err := c.framing.parse(c.raw)
+		if err != nil {
+			c.readErr = err
+			return err
+		}
+		if end := headerSize + payloadSize; headerSize > 0 && len(c.raw) >= end {
+			header, payload := c.raw[:headerSize], c.raw[headerSize:end]
+			if aad, ok := c.framing.encrypted(header, payloadSize); ok {
+				if payload, err = c.cipher.open(payload, aad); err != nil {
+					c.readErr = err
+					return err
+				}
+			}
+			c.pending = append(c.framing.resize(header, len(payload)), payload...)
+			c.raw = c.raw[end:]
+			return nil
+		}
+
+		n, err := c.Conn.Read(c.buffer[:])
+		c.raw = append(c.raw, c.buffer[:n]...)
+		if err != nil && n == 0 {
+			return err
+		}
+	}
+}
+
+// Write encrypts and sends every message that is complete. The rest is kept
+// until the message is completed by the next write.
+func (c *messageConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.unsealed = append(c.unsealed, b...)
+	var data []byte
+	for {
+		headerSize, payloadSize, err := c.framing.parse(c.unsealed)
+		if err != nil {
+			return 0, err
+		}
+		end := headerSize + payloadSize
+		if headerSize == 0 || len(c.unsealed) < end {
+			break
+		}
+
+		header, payload := c.unsealed[:headerSize], c.unsealed[headerSize:end]
+		wireHeader := c.framing.resize(header, payloadSize+chacha20poly1305.Overhead)
+		if aad, ok := c.framing.encrypted(wireHeader, payloadSize); ok {
+			data = append(data, wireHeader...)
+			data = append(data, c.cipher.seal(payload, aad)...)
+		} else {
+			data = append(data, c.unsealed[:end]...)
+		}
+		c.unsealed = c.unsealed[end:]
+	}
+
+	if len(data) > 0 {
+		if _, err := c.Conn.Write(data); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// newSessionConn encrypts a connection the way a protocol does after
+// pair-verify. The keys are those of the side using the connection.
+func newSessionConn(conn net.Conn, protocol Protocol, outputKey, inputKey []byte) (net.Conn, error) {
+	switch protocol {
+	case ProtocolMRP:
+		cipher, err := newChaCha20Cipher(outputKey, inputKey, chacha20Nonce64)
+		if err != nil {
+			return nil, err
+		}
+		return &messageConn{Conn: conn, cipher: cipher, framing: mrpFraming{}}, nil
+	case ProtocolCompanion:
+		cipher, err := newChaCha20Cipher(outputKey, inputKey, chacha20Nonce96)
+		if err != nil {
+			return nil, err
+		}
+		return &messageConn{Conn: conn, cipher: cipher, framing: companionFraming{}}, nil
+	case ProtocolAirPlay:
+		return newHAPConn(conn, outputKey, inputKey)
+	default:
+		return nil, fmt.Errorf("%w: encryption for %s", ErrNotSupported, protocol)
+	}
+}
+
+// sessionKeyInfo returns how a protocol derives its session keys.
+func sessionKeyInfo(protocol Protocol) (hapKeyInfo, error) {
+	switch protocol {
+	case ProtocolMRP:
+		return mrpSessionKeys, nil
+	case ProtocolCompanion:
+		return companionSessionKeys, nil
+	case ProtocolAirPlay:
+		return airPlaySessionKeys, nil
+	default:
+		return hapKeyInfo{}, fmt.Errorf("%w: encryption for %s", ErrNotSupported, protocol)
+	}
+}
+
+// secure encrypts the connection of a verified session with HAP framing and
+// keys derived with info.
+func (s *hapSession) secure(info hapKeyInfo) (net.Conn, error) {
+	if s.secret == nil {
+		return nil, fmt.Errorf("%w: session has no encryption keys", ErrNotSupported)
+	}
+	output, input := s.secret.keys(info)
+	return newHAPConn(s.transport.stream(), output, input)
+}
@@ -0,0 +1,177 @@
+package pyatv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	testOutputKey = bytes.Repeat([]byte{'o'}, chacha20poly1305.KeySize)
+	testInputKey  = bytes.Repeat([]byte{'i'}, chacha20poly1305.KeySize)
+)
+
+func TestChaCha20CipherNonce(t *testing.T) {
+	tests := []struct {
+		format   chacha20Nonce
+		expected []byte
+	}{
+		{chacha20Nonce64, []byte{0, 0, 0, 0, 0x02, 0x01, 0, 0, 0, 0, 0, 0}},
+		{chacha20Nonce96, []byte{0x02, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		cipher, err := newChaCha20Cipher(testOutputKey, testInputKey, tt.format)
+		if err != nil {
+			t.Fatalf("newChaCha20Cipher() error = %v", err)
+		}
+		if nonce := cipher.nonce(0x0102); !bytes.Equal(nonce, tt.expected) {
+			t.Errorf("Expected nonce %x, got %x", tt.expected, nonce)
+		}
+	}
+}
+
+func TestChaCha20CipherRoundTrip(t *testing.T) {
+	for _, format := range []chacha20Nonce{chacha20Nonce64, chacha20Nonce96} {
+		client, _ := newChaCha20Cipher(testOutputKey, testInputKey, format)
+		server, _ := newChaCha20Cipher(testInputKey, testOutputKey, format)
+
+		for _, message := range []string{"first", "second", "third"} {
+			sealed := client.seal([]byte(message), []byte("aad"))
+			opened, err := server.open(sealed, []byte("aad"))
+			if err != nil {
+				t.Fatalf("open() error = %v", err)
+			}
+			if string(opened) != message {
+				t.Errorf("Expected %q, got %q", message, opened)
+			}
+		}
+
+		// A replayed message fails since the counter has moved on
+		sealed := server.seal([]byte("reply"), nil)
+		if _, err := client.open(sealed, nil); err != nil {
+			t.Errorf("open() error = %v", err)
+		}
+		if _, err := client.open(sealed, nil); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("Expected ErrAuthentication, got %v", err)
+		}
+	}
+}
+
+func TestChaCha20CipherInvalidKey(t *testing.T) {
+	if _, err := newChaCha20Cipher([]byte("short"), testInputKey, chacha20Nonce64); err == nil {
+		t.Error("Expected error for invalid key")
+	}
+}
+
+// hapConnPair returns both ends of an encrypted connection.
+func hapConnPair(t *testing.T) (client, server *hapConn) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	client, err := newHAPConn(clientConn, testOutputKey, testInputKey)
+	if err != nil {
+		t.Fatalf("newHAPConn() error = %v", err)
+	}
+	server, err = newHAPConn(serverConn, testInputKey, testOutputKey)
+	if err != nil {
+		t.Fatalf("newHAPConn() error = %v", err)
+	}
+	return client, server
+}
+
+func TestHAPConnRoundTrip(t *testing.T) {
+	client, server := hapConnPair(t)
+
+	request := bytes.Repeat([]byte("0123456789"), 300)
+	go client.Write(request)
+
+	received := make([]byte, len(request))
+	if _, err := io.ReadFull(server, received); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if !bytes.Equal(received, request) {
+		t.Error("Expected server to receive what client sent")
+	}
+
+	go server.Write([]byte("response"))
+	received = make([]byte, 8)
+	if _, err := io.ReadFull(client, received); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if string(received) != "response" {
+		t.Errorf("Expected %q, got %q", "response", received)
+	}
+}
+
+func TestHAPConnFrames(t *testing.T) {
+	client, server := hapConnPair(t)
+
+	go client.Write(make([]byte, 2500))
+
+	var sizes []int
+	for total := 0; total < 2500; {
+		var length [hapLengthSize]byte
+		if _, err := io.ReadFull(server.Conn, length[:]); err != nil {
+			t.Fatalf("ReadFull() error = %v", err)
+		}
+		size := int(binary.LittleEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(server.Conn, make([]byte, size+chacha20poly1305.Overhead)); err != nil {
+			t.Fatalf("ReadFull() error = %v", err)
+		}
+		sizes = append(sizes, size)
+		total += size
+	}
+
+	expected := []int{1024, 1024, 452}
+	if len(sizes) != len(expected) {
+		t.Fatalf("Expected frames of %v, got %v", expected, sizes)
+	}
+	for i := range expected {
+		if sizes[i] != expected[i] {
+			t.Errorf("Expected frames of %v, got %v", expected, sizes)
+		}
+	}
+}
+
+func TestHAPConnTampered(t *testing.T) {
+	client, server := hapConnPair(t)
+
+	// Encrypt with the wrong key
+	go func() {
+		length := []byte{4, 0}
+		forged, _ := newChaCha20Cipher(testInputKey, testInputKey, chacha20Nonce64)
+		client.Conn.Write(append(length, forged.seal([]byte("evil"), length)...))
+	}()
+
+	buf := make([]byte, 4)
+	if _, err := server.Read(buf); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Expected ErrAuthentication, got %v", err)
+	}
+	if _, err := server.Read(buf); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Expected ErrAuthentication on next read, got %v", err)
+	}
+}
+
+func TestHAPSessionKeys(t *testing.T) {
+	secret := &hapSharedSecret{secret: []byte("shared secret")}
+
+	for _, info := range []hapKeyInfo{mrpSessionKeys, companionSessionKeys, airPlaySessionKeys} {
+		output, input := secret.keys(info)
+		if !bytes.Equal(output, hkdfExpand(info.salt, info.outputInfo, secret.secret)) {
+			t.Errorf("Expected output key derived with %q", info.outputInfo)
+		}
+		if bytes.Equal(output, input) {
+			t.Errorf("Expected different keys for %q and %q", info.outputInfo, info.inputInfo)
+		}
+	}
+}
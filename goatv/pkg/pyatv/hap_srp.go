@@ -0,0 +1,314 @@
+package pyatv
+
+import (
+	"crypto/sha1"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+	"math/big"
+	"time"
+
+	"filippo.io/bigmod"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/tlv8"
+)
+
+// srpUsername is the fixed SRP username used by HAP pair-setup.
+const srpUsername = "Pair-Setup"
+
+// srpGroup holds the parameters of an SRP-6a group and the hash it is used
+// with.
+type srpGroup struct {
+	N       *big.Int
+	g       *big.Int
+	modulus *bigmod.Modulus // N for constant time arithmetic
+	hash    func() hash.Hash
+
+	// sessionKey derives K from the premaster secret S
+	sessionKey func(group *srpGroup, premaster []byte) []byte
+}
+
+// srpGroupHAP is the 3072-bit group from RFC 5054 with SHA-512, used by HAP
+// pair-setup for MRP, AirPlay 2 and Companion.
+var srpGroupHAP = newSRPGroup(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05"+
+		"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB"+
+		"9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF695581718"+
+		"3995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33"+
+		"A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7"+
+		"ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864"+
+		"D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E2"+
+		"08E24FA074E5AB3143DB5BFCE0FD108E4B82D120A93AD2CAFFFFFFFFFFFFFFFF",
+	5, sha512.New, srpHashSessionKey)
+
+// srpGroupLegacy is the 2048-bit group from RFC 5054 with SHA-1, used by
+// legacy AirPlay pairing on older Apple TVs.
+var srpGroupLegacy = newSRPGroup(
+	"AC6BDB41324A9A9BF166DE5E1389582FAF72B6651987EE07FC3192943DB56050"+
+		"A37329CBB4A099ED8193E0757767A13DD52312AB4B03310DCD7F48A9DA04FD50"+
+		"E8083969EDB767B0CF6095179A163AB3661A05FBD5FAAAE82918A9962F0B93B8"+
+		"55F97993EC975EEAA80D740ADBF4FF747359D041D5C33EA71D281E446B14773B"+
+		"CA97B43A23FB801676BD207A436C6481F1D2B9078717461A5B9D32E688F87748"+
+		"544523B524B0D57D5EA77A2775D2ECFA032CFBDBF52FB3786160279004E57AE6"+
+		"AF874E7303CE53299CCC041C7BC308D82A5698F3A8D0C38271AE35F8E9DBFBB6"+
+		"94B5C803D89F7AE435DE236D525F54759B65E372FCD68EF20FA7111F9E4AFF73",
+	2, sha1.New, srpInterleavedSessionKey)
+
+func newSRPGroup(prime string, generator int64, hash func() hash.Hash, sessionKey func(*srpGroup, []byte) []byte) *srpGroup {
+	N, ok := new(big.Int).SetString(prime, 16)
+	if !ok {
+		panic("invalid SRP prime")
+	}
+	modulus, err := bigmod.NewModulus(N.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	return &srpGroup{N: N, g: big.NewInt(generator), modulus: modulus, hash: hash, sessionKey: sessionKey}
+}
+
+// srpHashSessionKey is the standard K = H(S).
+func srpHashSessionKey(group *srpGroup, premaster []byte) []byte {
+	return group.digest(premaster)
+}
+
+// srpInterleavedSessionKey is K = H(S | 00000000) | H(S | 00000001), which
+// legacy AirPlay uses to get a key long enough for AES.
+func srpInterleavedSessionKey(group *srpGroup, premaster []byte) []byte {
+	first := group.digest(premaster, []byte{0, 0, 0, 0})
+	second := group.digest(premaster, []byte{0, 0, 0, 1})
+	return append(first, second...)
+}
+
+// digest hashes the concatenation of values.
+func (g *srpGroup) digest(values ...[]byte) []byte {
+	h := g.hash()
+	for _, value := range values {
+		h.Write(value)
+	}
+	return h.Sum(nil)
+}
+
+// clientProof computes M1 = H(H(N) xor H(g) | H(I) | s | A | B | K).
+func (g *srpGroup) clientProof(username string, salt []byte, A, B *big.Int, key []byte) []byte {
+	hashN := g.digest(g.N.Bytes())
+	hashG := g.digest(g.g.Bytes())
+	for i := range hashN {
+		hashN[i] ^= hashG[i]
+	}
+	return g.digest(
+		new(big.Int).SetBytes(hashN).Bytes(),
+		new(big.Int).SetBytes(g.digest([]byte(username))).Bytes(),
+		new(big.Int).SetBytes(salt).Bytes(),
+		A.Bytes(),
+		B.Bytes(),
+		key)
+}
+
+// pad left-pads a number with zeros to the length of N.
+func (g *srpGroup) pad(n *big.Int) []byte {
+	return n.FillBytes(make([]byte, (g.N.BitLen()+7)/8))
+}
+
+// nat returns n mod N for constant time arithmetic.
+func (g *srpGroup) nat(n *big.Int) *bigmod.Nat {
+	x, err := bigmod.NewNat().SetBytes(new(big.Int).Mod(n, g.N).Bytes(), g.modulus)
+	if err != nil {
+		panic(err) // Reduced mod N above
+	}
+	return x
+}
+
+// exp returns base^exponent mod N. Its time depends on the length of the
+// big endian exponent, but not on its value or on base.
+func (g *srpGroup) exp(base *bigmod.Nat, exponent []byte) *bigmod.Nat {
+	return bigmod.NewNat().Exp(base, exponent, g.modulus)
+}
+
+// number converts the result of constant time arithmetic back for encoding.
+func (g *srpGroup) number(x *bigmod.Nat) *big.Int {
+	return new(big.Int).SetBytes(x.Bytes(g.modulus))
+}
+
+// srpClient is the client side of an SRP-6a exchange. Numbers are encoded
+// big endian without leading zeros, except where RFC 5054 pads them to the
+// length of N, which is what Apple devices expect. Exponentiation and
+// arithmetic mod N on secrets are constant time with bigmod, and proofs are
+// compared in constant time. The exponent a + u * x is a plain integer and is
+// computed with math/big, which makes no such promise.
+type srpClient struct {
+	group    *srpGroup
+	username string
+	password string
+
+	private []byte   // a
+	public  *big.Int // A
+
+	key   []byte // K
+	proof []byte // M1
+}
+
+// newSRPClient creates a client that authenticates with a password, usually
+// the PIN shown by the device. private is the random secret a, which should
+// be at least 32 bytes.
+func newSRPClient(group *srpGroup, username, password string, private []byte) *srpClient {
+	return &srpClient{
+		group:    group,
+		username: username,
+		password: password,
+		private:  private,
+		public:   group.number(group.exp(group.nat(group.g), private)),
+	}
+}
+
+// PublicKey returns A = g^a.
+func (c *srpClient) PublicKey() []byte {
+	return c.public.Bytes()
+}
+
+// Process computes the session key from the salt and public key B sent by the
+// device and returns the client proof M1 to send back.
+func (c *srpClient) Process(salt, serverPublic []byte) ([]byte, error) {
+	group := c.group
+	B := new(big.Int).SetBytes(serverPublic)
+	if new(big.Int).Mod(B, group.N).Sign() == 0 {
+		return nil, fmt.Errorf("%w: invalid SRP public key from device", ErrAuthentication)
+	}
+
+	// k = H(N | PAD(g)), u = H(PAD(A) | PAD(B))
+	k := new(big.Int).SetBytes(group.digest(group.N.Bytes(), group.pad(group.g)))
+	u := new(big.Int).SetBytes(group.digest(group.pad(c.public), group.pad(B)))
+	if u.Sign() == 0 {
+		return nil, fmt.Errorf("%w: invalid SRP scrambling parameter", ErrAuthentication)
+	}
+
+	// x = H(s | H(I | ":" | P))
+	identity := group.digest([]byte(c.username + ":" + c.password))
+	x := group.digest(salt, identity)
+
+	// S = (B - k * g^x) ^ (a + u * x), with the exponent padded to a length
+	// that does not depend on its value
+	kgx := group.exp(group.nat(group.g), x).Mul(group.nat(k), group.modulus)
+	base := group.nat(B).Sub(kgx, group.modulus)
+	exponent := new(big.Int).Mul(u, new(big.Int).SetBytes(x))
+	exponent.Add(exponent, new(big.Int).SetBytes(c.private))
+	size := max(len(c.private), 2*len(x)) + 1
+	premaster := group.number(group.exp(base, exponent.FillBytes(make([]byte, size))))
+
+	c.key = group.sessionKey(group, premaster.Bytes())
+
+	c.proof = group.clientProof(c.username, salt, c.public, B, c.key)
+	return c.proof, nil
+}
+
+// Verify checks the server proof M2 = H(A | M1 | K), which proves that the
+// device knows the password too.
+func (c *srpClient) Verify(serverProof []byte) error {
+	if c.proof == nil {
+		return fmt.Errorf("%w: SRP exchange not processed", ErrInvalidState)
+	}
+
+	expected := c.group.digest(c.public.Bytes(), c.proof, c.key)
+	if subtle.ConstantTimeCompare(expected, serverProof) != 1 {
+		return fmt.Errorf("%w: SRP proof from device does not match", ErrAuthentication)
+	}
+	return nil
+}
+
+// SessionKey returns the shared session key K, available after Process.
+func (c *srpClient) SessionKey() []byte {
+	return c.key
+}
+
+// srpServer is the device side of an SRP-6a exchange, used when we act as an
+// accessory. Numbers are encoded and secrets handled like in srpClient.
+type srpServer struct {
+	group    *srpGroup
+	username string
+	salt     []byte
+
+	verifier *bigmod.Nat // v
+	private  []byte      // b
+	public   *big.Int    // B
+
+	key []byte // K
+}
+
+// newSRPServer creates a server that accepts a password. private is the
+// random secret b, which should be at least 32 bytes.
+func newSRPServer(group *srpGroup, username, password string, salt, private []byte) *srpServer {
+	// v = g^x, x = H(s | H(I | ":" | P))
+	identity := group.digest([]byte(username + ":" + password))
+	v := group.exp(group.nat(group.g), group.digest(salt, identity))
+
+	// B = k * v + g^b
+	k := new(big.Int).SetBytes(group.digest(group.N.Bytes(), group.pad(group.g)))
+	B := group.nat(k).Mul(v, group.modulus)
+	B.Add(group.exp(group.nat(group.g), private), group.modulus)
+
+	return &srpServer{
+		group:    group,
+		username: username,
+		salt:     salt,
+		verifier: v,
+		private:  private,
+		public:   group.number(B),
+	}
+}
+
+// PublicKey returns B.
+func (s *srpServer) PublicKey() []byte {
+	return s.public.Bytes()
+}
+
+// Process computes the session key from the public key A sent by the client
+// and checks its proof M1. It returns the server proof M2 to send back.
+func (s *srpServer) Process(clientPublic, clientProof []byte) ([]byte, error) {
+	group := s.group
+	A := new(big.Int).SetBytes(clientPublic)
+	if new(big.Int).Mod(A, group.N).Sign() == 0 {
+		return nil, fmt.Errorf("%w: invalid SRP public key from client", ErrAuthentication)
+	}
+
+	// u = H(PAD(A) | PAD(B))
+	u := new(big.Int).SetBytes(group.digest(group.pad(A), group.pad(s.public)))
+	if u.Sign() == 0 {
+		return nil, fmt.Errorf("%w: invalid SRP scrambling parameter", ErrAuthentication)
+	}
+
+	// S = (A * v^u) ^ b
+	base := group.exp(s.verifier, u.Bytes()).Mul(group.nat(A), group.modulus)
+	premaster := group.number(group.exp(base, s.private))
+	key := group.sessionKey(group, premaster.Bytes())
+
+	expected := group.clientProof(s.username, s.salt, A, s.public, key)
+	if subtle.ConstantTimeCompare(expected, clientProof) != 1 {
+		return nil, fmt.Errorf("%w: SRP proof from client does not match", ErrAuthentication)
+	}
+	s.key = key
+	return group.digest(A.Bytes(), clientProof, key), nil
+}
+
+// SessionKey returns the shared session key K, available after Process.
+func (s *srpServer) SessionKey() []byte {
+	return s.key
+}
+
+// pairingError returns the error reported in a pairing response, or nil if
+// there is none. A back off request carries the delay mandated by the device.
+func pairingError(items tlv8.Items) error {
+	code, ok := items.Uint(tlv8.TagError)
+	if !ok {
+		return nil
+	}
+
+	if tlv8.ErrorCode(code) == tlv8.ErrorBackOff {
+		seconds, _ := items.Uint(tlv8.TagBackOff)
+		return &BackOffError{Delay: time.Duration(seconds) * time.Second}
+	}
+	return fmt.Errorf("%w: device returned error %s", ErrAuthentication, tlv8.ErrorCode(code))
+}
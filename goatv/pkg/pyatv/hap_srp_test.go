@@ -0,0 +1,165 @@
+package pyatv
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/tlv8"
+)
+
+func hexBytes(t *testing.T, value string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(strings.ReplaceAll(value, " ", ""))
+	if err != nil {
+		t.Fatalf("invalid hex %q: %v", value, err)
+	}
+	return data
+}
+
+func TestSRPClientRFC5054Vectors(t *testing.T) {
+	// Test vectors from RFC 5054 appendix B
+	group := newSRPGroup("EEAF0AB9ADB38DD69C33F80AFA8FC5E86072618775FF3C0B9EA2314C9C256576"+
+		"D674DF7496EA81D3383B4813D692C6E0E0D5D8E250B98BE48E495C1D6089DAD1"+
+		"5DC7D7B46154D6B6CE8EF4AD69B15D4982559B297BCF1885C529F566660E57EC"+
+		"68EDBC3C05726CC02FD4CBF4976EAA9AFD5138FE8376435B9FC61D2FC0EB06E3",
+		2, sha1.New, srpHashSessionKey)
+	salt := hexBytes(t, "BEB25379 D1A8581E B5A72767 3A2441EE")
+	a := hexBytes(t, "60975527 035CF2AD 1989806F 0407210B C81EDC04 E2762A56 AFD529DD DA2D4393")
+	b := hexBytes(t, "E487CB59 D31AC550 471E81F0 0F6928E0 1DDA08E9 74A004F4 9E61F5D1 05284D20")
+	expectedA := hexBytes(t, "61D5E490 F6F1B795 47B0704C 436F523D D0E560F0 C64115BB 72557EC4 4352E890"+
+		"3211C046 92272D8B 2D1A5358 A2CF1B6E 0BFCF99F 921530EC 8E393561 79EAE45E"+
+		"42BA92AE ACED8251 71E1E8B9 AF6D9C03 E1327F44 BE087EF0 6530E69F 66615261"+
+		"EEF54073 CA11CF58 58F0EDFD FE15EFEA B349EF5D 76988A36 72FAC47B 0769447B")
+	expectedB := hexBytes(t, "BD0C6151 2C692C0C B6D041FA 01BB152D 4916A1E7 7AF46AE1 05393011 BAF38964"+
+		"DC46A067 0DD125B9 5A981652 236F99D9 B681CBF8 7837EC99 6C6DA044 53728610"+
+		"D0C6DDB5 8B318885 D7D82C7F 8DEB75CE 7BD4FBAA 37089E6F 9C6059F3 88838E7A"+
+		"00030B33 1EB76840 910440B1 B27AAEAE EB4012B7 D7665238 A8E3FB00 4B117B58")
+	premaster := hexBytes(t, "B0DC82BA BCF30674 AE450C02 87745E79 90A3381F 63B387AA F271A10D 233861E3"+
+		"59B48220 F7C4693C 9AE12B0A 6F67809F 0876E2D0 13800D6C 41BB59B6 D5979B5C"+
+		"00A172B4 A2A5903A 0BDCAF8A 709585EB 2AFAFA8F 3499B200 210DCC1F 10EB3394"+
+		"3CD67FC8 8A2F39A4 BE5BEC4E C0A3212D C346D7E4 74B29EDE 8A469FFE CA686E5A")
+
+	client := newSRPClient(group, "alice", "password123", a)
+	if !bytes.Equal(client.PublicKey(), expectedA) {
+		t.Fatalf("Expected A %X, got %X", expectedA, client.PublicKey())
+	}
+
+	server := newSRPServer(group, "alice", "password123", salt, b)
+	if !bytes.Equal(server.PublicKey(), expectedB) {
+		t.Fatalf("Expected B %X, got %X", expectedB, server.PublicKey())
+	}
+
+	proof, err := client.Process(salt, expectedB)
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if _, err := server.Process(client.PublicKey(), proof); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	expected := group.digest(premaster)
+	if !bytes.Equal(client.SessionKey(), expected) {
+		t.Errorf("Expected client session key %X, got %X", expected, client.SessionKey())
+	}
+	if !bytes.Equal(server.SessionKey(), expected) {
+		t.Errorf("Expected server session key %X, got %X", expected, server.SessionKey())
+	}
+}
+
+func TestSRPClientExchange(t *testing.T) {
+	tests := []struct {
+		name    string
+		group   *srpGroup
+		keySize int
+	}{
+		{"HAP", srpGroupHAP, 64},
+		{"Legacy", srpGroupLegacy, 40},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			salt := bytes.Repeat([]byte{0x17}, 16)
+			client := newSRPClient(tt.group, srpUsername, "1234", bytes.Repeat([]byte{0x42}, 32))
+			server := newSRPServer(tt.group, srpUsername, "1234", salt, bytes.Repeat([]byte{0x24}, 32))
+
+			proof, err := client.Process(salt, server.PublicKey())
+			if err != nil {
+				t.Fatalf("Process() error = %v", err)
+			}
+			serverProof, err := server.Process(client.PublicKey(), proof)
+			if err != nil {
+				t.Fatalf("Process() error = %v", err)
+			}
+			if len(client.SessionKey()) != tt.keySize || !bytes.Equal(client.SessionKey(), server.SessionKey()) {
+				t.Fatalf("Expected session key %X, got %X", server.SessionKey(), client.SessionKey())
+			}
+			if err := client.Verify(serverProof); err != nil {
+				t.Errorf("Verify() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestSRPClientWrongPassword(t *testing.T) {
+	salt := bytes.Repeat([]byte{0x17}, 16)
+	client := newSRPClient(srpGroupHAP, srpUsername, "1111", bytes.Repeat([]byte{0x42}, 32))
+	server := newSRPServer(srpGroupHAP, srpUsername, "1234", salt, bytes.Repeat([]byte{0x24}, 32))
+
+	proof, err := client.Process(salt, server.PublicKey())
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if _, err := server.Process(client.PublicKey(), proof); !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("Expected ErrAuthentication from server, got %v", err)
+	}
+
+	// A proof made with the session key of the right password is rejected too
+	right := newSRPClient(srpGroupHAP, srpUsername, "1234", bytes.Repeat([]byte{0x42}, 32))
+	if _, err := right.Process(salt, server.PublicKey()); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	serverProof := srpGroupHAP.digest(client.PublicKey(), proof, right.SessionKey())
+	if err := client.Verify(serverProof); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Expected ErrAuthentication, got %v", err)
+	}
+}
+
+func TestSRPClientInvalidInput(t *testing.T) {
+	client := newSRPClient(srpGroupHAP, srpUsername, "1234", bytes.Repeat([]byte{0x42}, 32))
+	if err := client.Verify([]byte{1, 2, 3}); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Expected ErrInvalidState before Process, got %v", err)
+	}
+
+	for _, public := range [][]byte{{0}, srpGroupHAP.N.Bytes()} {
+		if _, err := client.Process([]byte{1}, public); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("Expected ErrAuthentication for B=%X..., got %v", public[:1], err)
+		}
+	}
+}
+
+func TestPairingError(t *testing.T) {
+	if err := pairingError(tlv8.Items{tlv8.Uint(tlv8.TagState, uint64(tlv8.M2))}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	err := pairingError(tlv8.Items{tlv8.Uint(tlv8.TagError, uint64(tlv8.ErrorAuthentication))})
+	if !errors.Is(err, ErrAuthentication) || errors.Is(err, ErrBackOff) {
+		t.Errorf("Expected ErrAuthentication, got %v", err)
+	}
+
+	err = pairingError(tlv8.Items{
+		tlv8.Uint(tlv8.TagError, uint64(tlv8.ErrorBackOff)),
+		tlv8.Uint(tlv8.TagBackOff, 30),
+	})
+	var backOff *BackOffError
+	if !errors.As(err, &backOff) || backOff.Delay != 30*time.Second {
+		t.Fatalf("Expected BackOffError with 30s delay, got %v", err)
+	}
+	if !errors.Is(err, ErrBackOff) || !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Expected error to match ErrBackOff and ErrAuthentication, got %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package pyatv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kinds of identities. Identities of the same kind are comparable across
+// protocols, so an MRP service and an AirPlay service announcing the same MAC
+// address belong to the same device.
+const (
+	identityMAC       = "mac"
+	identityMRP       = "mrp"
+	identityPairing   = "pairing"
+	identityCompanion = "companion"
+	identityDMAP      = "dmap"
+)
+
+// identity is a normalized identifier used to correlate services.
+type identity struct {
+	kind  string
+	value string
+}
+
+func (i identity) key() string {
+	return i.kind + ":" + i.value
+}
+
+// identifierSources lists where each protocol announces identifiers and what
+// kind of identity they hold. The property "name" refers to the service name.
+var identifierSources = []struct {
+	protocol Protocol
+	property string
+	kind     string
+}{
+	{ProtocolAirPlay, "deviceid", identityMAC},
+	{ProtocolAirPlay, "pi", identityPairing},
+	{ProtocolRAOP, "name", identityMAC},
+	{ProtocolMRP, "UniqueIdentifier", identityMRP},
+	{ProtocolMRP, "macAddress", identityMAC},
+	{ProtocolMRP, "LocalAirPlayReceiverPairingIdentity", identityPairing},
+	{ProtocolCompanion, "rpMRtID", identityMRP},
+	{ProtocolCompanion, "rpMac", identityMAC},
+	{ProtocolCompanion, "rpHA", identityCompanion},
+	{ProtocolDMAP, "HSGID", identityDMAP},
+}
+
+// entryIdentifiers returns the identifiers announced by a service together
+// with their normalized identities. Values that do not look like what they
+// should be, like flags in rpMac, are skipped.
+func entryIdentifiers(protocol Protocol, name string, txtRecords map[string]string) ([]DeviceIdentifier, []identity) {
+	var ids []DeviceIdentifier
+	var identities []identity
+	for _, source := range identifierSources {
+		if source.protocol != protocol {
+			continue
+		}
+
+		var value string
+		var ok bool
+		if source.property == "name" {
+			// RAOP services are named "AABBCCDDEEFF@Living Room"
+			value, _, ok = strings.Cut(name, "@")
+		} else {
+			value, ok = txtValue(txtRecords, source.property)
+		}
+		if !ok {
+			continue
+		}
+
+		normalized, ok := normalizeIdentity(source.kind, value)
+		if !ok {
+			continue
+		}
+		ids = append(ids, DeviceIdentifier{Protocol: protocol, Property: source.property, Value: value})
+		identities = append(identities, identity{kind: source.kind, value: normalized})
+	}
+	return ids, identities
+}
+
+// normalizeIdentity makes an identifier comparable, or returns false if it is
+// not valid for its kind.
+func normalizeIdentity(kind, value string) (string, bool) {
+	if kind != identityMAC {
+		return strings.ToUpper(value), value != ""
+	}
+
+	mac := strings.ToUpper(strings.NewReplacer(":", "", "-", "").Replace(value))
+	if len(mac) != 12 || strings.Trim(mac, "0123456789ABCDEF") != "" || mac == "000000000000" {
+		return "", false
+	}
+	return mac, true
+}
+
+// findDevice returns the key of the device an entry belongs to. Devices are
+// matched on shared identities first and devices that turn out to be the same
+// are merged. Without a match, a device at one of the entry's addresses is
+// used unless it has a different identity of the same kind, since addresses
+// get reused. Must be called with s.mu held.
+func (s *Scanner) findDevice(entry *ServiceEntry, identities []identity) string {
+	var key string
+	for _, ident := range identities {
+		device, ok := s.identities[ident.key()]
+		if !ok || device == key {
+			continue
+		}
+		if key == "" {
+			key = device
+		} else {
+			s.mergeDevice(key, device)
+		}
+	}
+	if key != "" {
+		return key
+	}
+
+	for device, config := range s.devices {
+		if sharesAddress(config, entry) && !s.conflicts(device, identities) {
+			return device
+		}
+	}
+
+	// New device, keyed on something stable that is not already taken
+	switch {
+	case len(identities) > 0:
+		key = identities[0].key()
+	case len(entry.Addresses) > 0:
+		key = entry.Addresses[0].IP.String()
+	default:
+		key = strings.ToLower(entry.Name)
+	}
+	for base, n := key, 2; s.devices[key] != nil; n++ {
+		key = fmt.Sprintf("%s#%d", base, n)
+	}
+	return key
+}
+
+// conflicts returns true if a device has an identity of the same kind as one
+// of identities, but with another value.
+func (s *Scanner) conflicts(device string, identities []identity) bool {
+	for known, owner := range s.identities {
+		if owner != device {
+			continue
+		}
+		kind, value, _ := strings.Cut(known, ":")
+		for _, ident := range identities {
+			if ident.kind == kind && ident.value != value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sharesAddress(config *Config, entry *ServiceEntry) bool {
+	for _, addr := range entry.Addresses {
+		for _, known := range config.Addresses {
+			if known.IP.Equal(addr.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mergeDevice moves everything known about one device into another, after an
+// entry revealed that they are the same. Must be called with s.mu held.
+func (s *Scanner) mergeDevice(into, from string) {
+	target, source := s.devices[into], s.devices[from]
+
+	for _, service := range source.Services {
+		target.AddService(service)
+	}
+	for serviceType, properties := range source.Properties {
+		if _, ok := target.Properties[serviceType]; !ok {
+			target.Properties[serviceType] = properties
+		}
+	}
+	for _, id := range source.Identifiers {
+		target.setIdentifier(id)
+	}
+
+	target.Addresses = mergeAddresses(s.opts.AddressFamily, target.Addresses, source.Addresses)
+	if len(target.Addresses) > 0 {
+		target.Address = target.Addresses[0].IP
+	}
+	if target.Identifier == "" {
+		target.Identifier = source.Identifier
+	}
+	mergeDeviceInfo(target.DeviceInfo, source.DeviceInfo)
+
+	for key, device := range s.identities {
+		if device == from {
+			s.identities[key] = into
+		}
+	}
+	for _, watched := range s.watched {
+		if watched.device == from {
+			watched.device = into
+		}
+	}
+
+	// Watch reports the merged device as gone, it lives on in the other one
+	if _, ok := s.reported[from]; ok {
+		s.merged = append(s.merged, source)
+	}
+	delete(s.reported, from)
+	delete(s.devices, from)
+}
+
+// forgetDevice removes a device and its identities. Must be called with s.mu held.
+func (s *Scanner) forgetDevice(device string) {
+	for key, owner := range s.identities {
+		if owner == device {
+			delete(s.identities, key)
+		}
+	}
+	delete(s.devices, device)
+	delete(s.reported, device)
+}
+
+// mergeDeviceInfo fills in whatever into does not know yet from from.
+func mergeDeviceInfo(into, from *DeviceInfo) {
+	if into.OperatingSystem == OperatingSystemUnknown {
+		into.OperatingSystem = from.OperatingSystem
+	}
+	if into.Version == "" {
+		into.Version = from.Version
+	}
+	if into.BuildNumber == "" {
+		into.BuildNumber = from.BuildNumber
+	}
+	if into.Model == DeviceModelUnknown {
+		into.Model = from.Model
+	}
+	if into.RawModel == "" {
+		into.RawModel = from.RawModel
+	}
+	if into.MAC == "" {
+		into.MAC = from.MAC
+	}
+	if into.OutputDeviceID == "" {
+		into.OutputDeviceID = from.OutputDeviceID
+	}
+}
+
+// setIdentifier records an identifier, replacing an older value announced by
+// the same protocol and property.
+func (c *Config) setIdentifier(id DeviceIdentifier) {
+	for i, known := range c.Identifiers {
+		if known.Protocol == id.Protocol && known.Property == id.Property {
+			c.Identifiers[i] = id
+			return
+		}
+	}
+	c.Identifiers = append(c.Identifiers, id)
+}
@@ -0,0 +1,159 @@
+package pyatv
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func testEntry(name, address string, txt ...string) *ServiceEntry {
+	return &ServiceEntry{
+		Name:       name,
+		Addresses:  []net.IPAddr{{IP: net.ParseIP(address)}},
+		Port:       1234,
+		InfoFields: txt,
+		TTL:        120 * time.Second,
+	}
+}
+
+func TestScannerCorrelatesProtocols(t *testing.T) {
+	scanner := NewScanner(ScanOptions{})
+
+	scanner.handleEntry(testEntry("Living Room._mediaremotetv._tcp.local.", "10.0.0.2",
+		"UniqueIdentifier=4D797FD3-3538-427E-A47B-A32FC6CF3A69", "macAddress=aa:bb:cc:dd:ee:ff"))
+	scanner.handleEntry(testEntry("Living Room._companion-link._tcp.local.", "10.0.0.2",
+		"rpMRtID=4d797fd3-3538-427e-a47b-a32fc6cf3a69", "rpHA=9948cfb6da55", "rpMac=2"))
+	scanner.handleEntry(testEntry("Living Room._airplay._tcp.local.", "10.0.0.2",
+		"deviceid=AA:BB:CC:DD:EE:FF"))
+	scanner.handleEntry(testEntry("AABBCCDDEEFF@Living Room._raop._tcp.local.", "10.0.0.2"))
+
+	if len(scanner.devices) != 1 {
+		t.Fatalf("Expected 1 device, got %d", len(scanner.devices))
+	}
+
+	var config *Config
+	for _, c := range scanner.devices {
+		config = c
+	}
+	if len(config.Services) != 4 {
+		t.Errorf("Expected 4 services, got %d", len(config.Services))
+	}
+
+	expected := map[Protocol]int{ProtocolMRP: 2, ProtocolCompanion: 2, ProtocolAirPlay: 1, ProtocolRAOP: 1}
+	got := make(map[Protocol]int)
+	for _, id := range config.Identifiers {
+		got[id.Protocol]++
+	}
+	for protocol, count := range expected {
+		if got[protocol] != count {
+			t.Errorf("Expected %d identifiers from %s, got %d", count, protocol, got[protocol])
+		}
+	}
+}
+
+func TestScannerMergesDevices(t *testing.T) {
+	scanner := NewScanner(ScanOptions{})
+
+	// Nothing ties these two together until MRP shows up
+	scanner.handleEntry(testEntry("Living Room._companion-link._tcp.local.", "10.0.0.2",
+		"rpMRtID=4D797FD3-3538-427E-A47B-A32FC6CF3A69"))
+	scanner.handleEntry(testEntry("Living Room._airplay._tcp.local.", "fd00::2",
+		"deviceid=AA:BB:CC:DD:EE:FF"))
+	if len(scanner.devices) != 2 {
+		t.Fatalf("Expected 2 devices before merge, got %d", len(scanner.devices))
+	}
+
+	scanner.handleEntry(testEntry("Living Room._mediaremotetv._tcp.local.", "10.0.0.2",
+		"UniqueIdentifier=4D797FD3-3538-427E-A47B-A32FC6CF3A69", "macAddress=AA:BB:CC:DD:EE:FF"))
+	if len(scanner.devices) != 1 {
+		t.Fatalf("Expected 1 device after merge, got %d", len(scanner.devices))
+	}
+
+	for _, config := range scanner.devices {
+		if len(config.Services) != 3 {
+			t.Errorf("Expected 3 services, got %d", len(config.Services))
+		}
+		if len(config.Addresses) != 2 {
+			t.Errorf("Expected both addresses, got %v", config.Addresses)
+		}
+	}
+}
+
+func TestScannerAddressFallback(t *testing.T) {
+	scanner := NewScanner(ScanOptions{})
+
+	// DMAP has nothing in common with other protocols except the address
+	scanner.handleEntry(testEntry("Living Room._mediaremotetv._tcp.local.", "10.0.0.2",
+		"UniqueIdentifier=4D797FD3-3538-427E-A47B-A32FC6CF3A69"))
+	scanner.handleEntry(testEntry("Living Room._dacp._tcp.local.", "10.0.0.2", "HSGID=ABCD"))
+	if len(scanner.devices) != 1 {
+		t.Fatalf("Expected DMAP to join by address, got %d devices", len(scanner.devices))
+	}
+
+	// A different device reusing the address is not merged
+	scanner.handleEntry(testEntry("Kitchen._mediaremotetv._tcp.local.", "10.0.0.2",
+		"UniqueIdentifier=11111111-2222-3333-4444-555555555555"))
+	if len(scanner.devices) != 2 {
+		t.Errorf("Expected conflicting identifiers to create a new device, got %d devices", len(scanner.devices))
+	}
+}
+
+func TestScannerDeepSleep(t *testing.T) {
+	scanner := NewScanner(ScanOptions{})
+
+	mrp := testEntry("Living Room._mediaremotetv._tcp.local.", "10.0.0.2",
+		"UniqueIdentifier=4D797FD3-3538-427E-A47B-A32FC6CF3A69")
+	scanner.handleEntry(mrp)
+
+	asleep := testEntry("Living Room._airplay._tcp.local.", "10.0.0.2", "deviceid=AA:BB:CC:DD:EE:FF")
+	asleep.Port, asleep.DeepSleep = 0, true
+	scanner.handleEntry(asleep)
+	scanner.handleEntry(mrp)
+
+	if len(scanner.devices) != 1 {
+		t.Fatalf("Expected 1 device, got %d", len(scanner.devices))
+	}
+	var config *Config
+	for _, c := range scanner.devices {
+		config = c
+	}
+	if !config.DeepSleep {
+		t.Error("Expected device in deep sleep")
+	}
+
+	// The port the device announced itself is kept
+	awake := testEntry("Living Room._airplay._tcp.local.", "10.0.0.2", "deviceid=AA:BB:CC:DD:EE:FF")
+	scanner.handleEntry(awake)
+	scanner.handleEntry(asleep)
+	if port := config.GetService(ProtocolAirPlay).Port; port != 1234 {
+		t.Errorf("Expected port 1234, got %d", port)
+	}
+
+	scanner.handleEntry(awake)
+	if config.DeepSleep {
+		t.Error("Expected device to be awake")
+	}
+}
+
+func TestNormalizeIdentity(t *testing.T) {
+	tests := []struct {
+		kind     string
+		value    string
+		expected string
+		ok       bool
+	}{
+		{identityMAC, "aa:bb:cc:dd:ee:ff", "AABBCCDDEEFF", true},
+		{identityMAC, "AABBCCDDEEFF", "AABBCCDDEEFF", true},
+		{identityMAC, "2", "", false},
+		{identityMAC, "00:00:00:00:00:00", "", false},
+		{identityMRP, "4d797fd3", "4D797FD3", true},
+		{identityMRP, "", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := normalizeIdentity(tt.kind, tt.value)
+		if got != tt.expected || ok != tt.ok {
+			t.Errorf("normalizeIdentity(%s, %q) = %q, %v, want %q, %v", tt.kind, tt.value, got, ok, tt.expected, tt.ok)
+		}
+	}
+}
@@ -78,6 +78,9 @@ type Service struct {
 	Enabled          bool
 	RequiresPassword bool
 	Pairing          PairingRequirement
+	Capabilities     Capabilities
+
+	deepSleep bool // Last announced by a sleep proxy
 }
 
 // DeviceInfo represents general device information.
@@ -91,15 +94,24 @@ type DeviceInfo struct {
 	OutputDeviceID  string
 }
 
+// DeviceIdentifier is an identifier announced by one of the services of a device.
+type DeviceIdentifier struct {
+	Protocol Protocol
+	Property string // TXT property it was announced in, "name" for the service name
+	Value    string
+}
+
 // Config represents a device configuration.
 type Config struct {
-	Address    net.IP
-	Name       string
-	DeepSleep  bool
-	Services   []*Service
-	DeviceInfo *DeviceInfo
-	Properties map[string]map[string]string
-	Identifier string
+	Address     net.IP
+	Addresses   []net.IPAddr // Every address seen for the device, in the order to try them
+	Name        string
+	DeepSleep   bool
+	Services    []*Service
+	DeviceInfo  *DeviceInfo
+	Properties  map[string]map[string]string
+	Identifier  string
+	Identifiers []DeviceIdentifier // Identifiers per protocol, used to tell which services belong together
 }
 
 // GetService looks up a service based on protocol.
@@ -304,6 +316,15 @@ type PairingHandler interface {
 	Finish(ctx context.Context) error
 }
 
+// PairingManager manages the controllers a device trusts.
+type PairingManager interface {
+	Service() *Service
+	Close() error
+	Pairings(ctx context.Context) ([]Pairing, error)
+	RemovePairing(ctx context.Context, identifier string) error
+	Unpair(ctx context.Context) error
+}
+
 // AppleTV represents a connection to an Apple TV.
 type AppleTV interface {
 	Connect(ctx context.Context) error
@@ -337,6 +358,8 @@ type Storage interface {
 // Settings represents device settings.
 type Settings struct {
 	Identifier string
+	Name       string // Name of the device, as last seen in a scan
+	MAC        string // MAC address of the device, as last seen in a scan
 	Protocols  ProtocolSettings
 	Info       InfoSettings
 }
@@ -350,8 +373,9 @@ type ProtocolSettings struct {
 	RAOP      map[string]interface{}
 }
 
-// InfoSettings contains device info settings.
+// InfoSettings describes goatv as a client of the device, like it is shown
+// in the list of paired controllers.
 type InfoSettings struct {
-	Name string
-	MAC  string
+	Name string // Name we pair with as a controller, unless PairOptions has one
+	MAC  string // MAC address we present to the device
 }
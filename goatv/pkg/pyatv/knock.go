@@ -0,0 +1,110 @@
+package pyatv
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Knocking opens a TCP connection to a port and closes it right away. A device
+// sleeping behind a Bonjour sleep proxy is woken up as soon as any of its
+// services is accessed, which is what knocking emulates.
+
+// knockPorts are ports a device normally listens on, used as a best effort to
+// wake devices when nothing else is known about them.
+var knockPorts = []int{3689, 7000, 49152, 32498}
+
+const (
+	// knockInterval is the time between two rounds of knocks.
+	knockInterval = 2 * time.Second
+
+	// wakeTimeout is how long Connect waits for a device to wake up.
+	wakeTimeout = 30 * time.Second
+)
+
+// knock knocks on all ports of all hosts at once and returns true if any of
+// them accepted the connection.
+func knock(ctx context.Context, hosts []string, ports []int) bool {
+	ctx, cancel := context.WithTimeout(ctx, knockInterval)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		accepted bool
+	)
+	for _, host := range hosts {
+		for _, port := range ports {
+			wg.Add(1)
+			go func(address string) {
+				defer wg.Done()
+
+				var dialer net.Dialer
+				conn, err := dialer.DialContext(ctx, "tcp", address)
+				if err != nil {
+					return
+				}
+				conn.Close()
+
+				mu.Lock()
+				accepted = true
+				mu.Unlock()
+			}(net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+	}
+	wg.Wait()
+
+	return accepted
+}
+
+// knocker keeps knocking on ports of a host until ctx is done.
+func knocker(ctx context.Context, host string, ports []int) {
+	for {
+		knock(ctx, []string{host}, ports)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(knockInterval):
+		}
+	}
+}
+
+// wakeDevice wakes a device in deep sleep. It keeps knocking on all of its
+// addresses until one of the ports accepts a connection, meaning the device
+// itself is up again.
+func wakeDevice(ctx context.Context, hosts []string, ports []int) error {
+	for {
+		if knock(ctx, hosts, ports) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(knockInterval):
+		}
+	}
+}
+
+// wakePorts returns the ports used to wake a device: all of its service ports
+// followed by the default knock ports.
+func wakePorts(config *Config) []int {
+	seen := make(map[int]bool)
+	var ports []int
+	for _, service := range config.Services {
+		if service.Port != 0 && !seen[service.Port] {
+			seen[service.Port] = true
+			ports = append(ports, service.Port)
+		}
+	}
+	for _, port := range knockPorts {
+		if !seen[port] {
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
@@ -0,0 +1,39 @@
+package pyatv
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWakeDevice(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	if err := wakeDevice(ctx, []string{"127.0.0.2", "127.0.0.1"}, []int{port}); err != nil {
+		t.Errorf("wakeDevice() error = %v", err)
+	}
+}
+
+func TestWakePorts(t *testing.T) {
+	config := &Config{
+		Services: []*Service{
+			{Protocol: ProtocolMRP, Port: 49153},
+			{Protocol: ProtocolAirPlay, Port: 7000},
+		},
+	}
+
+	expected := []int{49153, 7000, 3689, 49152, 32498}
+	if got := wakePorts(config); !reflect.DeepEqual(got, expected) {
+		t.Errorf("wakePorts() = %v, want %v", got, expected)
+	}
+}
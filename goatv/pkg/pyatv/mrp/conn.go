@@ -0,0 +1,192 @@
+package mrp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MaxMessageSize protects against garbage lengths.
+const MaxMessageSize = 16 << 20
+
+// ErrClosed is returned when a connection is used after it was closed.
+var ErrClosed = errors.New("MRP connection closed")
+
+// WriteFrame writes a message prefixed with its length as a varint.
+func WriteFrame(w io.Writer, message []byte) error {
+	_, err := w.Write(append(binary.AppendUvarint(nil, uint64(len(message))), message...))
+	return err
+}
+
+// ReadFrame reads a message prefixed with its length as a varint.
+func ReadFrame(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > MaxMessageSize {
+		return nil, fmt.Errorf("%w: message of %d bytes", ErrMalformed, size)
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// Handler is called with every message that is not the response to a
+// request, in the order they arrive. It is called from the goroutine reading
+// the connection, so it must not wait for responses itself.
+type Handler func(message *ProtocolMessage)
+
+// Conn sends and receives ProtocolMessages over a connection, which is
+// already encrypted if it needs to be. Responses are matched to their request
+// by identifier.
+type Conn struct {
+	conn    io.ReadWriteCloser
+	handler Handler
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]chan *ProtocolMessage
+	err     error // Why the connection stopped
+	done    chan struct{}
+}
+
+// NewConn starts reading messages from conn. handler may be nil.
+func NewConn(conn io.ReadWriteCloser, handler Handler) *Conn {
+	c := &Conn{
+		conn:    conn,
+		handler: handler,
+		pending: make(map[string]chan *ProtocolMessage),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop(bufio.NewReader(conn))
+	return c
+}
+
+func (c *Conn) readLoop(reader *bufio.Reader) {
+	for {
+		frame, err := ReadFrame(reader)
+		if err != nil {
+			c.stop(err)
+			return
+		}
+		message := &ProtocolMessage{}
+		if err := Unmarshal(frame, message); err != nil {
+			c.stop(err)
+			return
+		}
+
+		c.mu.Lock()
+		response, ok := c.pending[message.Identifier]
+		delete(c.pending, message.Identifier)
+		c.mu.Unlock()
+
+		switch {
+		case ok:
+			response <- message
+		case c.handler != nil:
+			c.handler(message)
+		}
+	}
+}
+
+// stop ends the connection with an error, which waiting requests get.
+func (c *Conn) stop(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.pending = nil
+	close(c.done)
+	c.conn.Close()
+}
+
+// Send sends a message without waiting for a response.
+func (c *Conn) Send(message *ProtocolMessage) error {
+	data, err := Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.Err(); err != nil {
+		return err
+	}
+	if err := WriteFrame(c.conn, data); err != nil {
+		c.stop(err)
+		return err
+	}
+	return nil
+}
+
+// Request sends a message and waits for the message that has the same
+// identifier, which is created if the message has none. The error code of
+// the response is left to the caller.
+func (c *Conn) Request(ctx context.Context, message *ProtocolMessage) (*ProtocolMessage, error) {
+	if message.Identifier == "" {
+		message.Identifier = NewIdentifier()
+	}
+
+	response := make(chan *ProtocolMessage, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.pending[message.Identifier] = response
+	c.mu.Unlock()
+
+	forget := func() {
+		c.mu.Lock()
+		delete(c.pending, message.Identifier)
+		c.mu.Unlock()
+	}
+
+	if err := c.Send(message); err != nil {
+		forget()
+		return nil, err
+	}
+
+	select {
+	case resp := <-response:
+		return resp, nil
+	case <-c.done:
+		// The response may have come just before the connection stopped
+		select {
+		case resp := <-response:
+			return resp, nil
+		default:
+			return nil, c.Err()
+		}
+	case <-ctx.Done():
+		forget()
+		return nil, ctx.Err()
+	}
+}
+
+// Done is closed when the connection stops.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection stopped, or nil if it is still running.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	c.stop(ErrClosed)
+	return nil
+}
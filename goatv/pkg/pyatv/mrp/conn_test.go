@@ -0,0 +1,150 @@
+package mrp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFrames(t *testing.T) {
+	var buffer bytes.Buffer
+	messages := [][]byte{{}, []byte("short"), bytes.Repeat([]byte{0x42}, 300)}
+	for _, message := range messages {
+		if err := WriteFrame(&buffer, message); err != nil {
+			t.Fatalf("WriteFrame() error = %v", err)
+		}
+	}
+	if prefix := buffer.Bytes()[7:9]; !bytes.Equal(prefix, []byte{0xAC, 0x02}) {
+		t.Errorf("Expected varint length ac02, got %x", prefix)
+	}
+
+	reader := bufio.NewReader(&buffer)
+	for _, expected := range messages {
+		message, err := ReadFrame(reader)
+		if err != nil {
+			t.Fatalf("ReadFrame() error = %v", err)
+		}
+		if !bytes.Equal(message, expected) {
+			t.Errorf("Expected %x, got %x", expected, message)
+		}
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	reader := bufio.NewReader(bytes.NewReader([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0x0F}))
+	if _, err := ReadFrame(reader); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Expected ErrMalformed, got %v", err)
+	}
+}
+
+// fakeDevice reads messages from a connection and answers with reply.
+func fakeDevice(t *testing.T, conn net.Conn, reply func(*ProtocolMessage) []*ProtocolMessage) {
+	t.Helper()
+	go func() {
+		reader := bufio.NewReader(conn)
+		for {
+			frame, err := ReadFrame(reader)
+			if err != nil {
+				return
+			}
+			message := &ProtocolMessage{}
+			if err := Unmarshal(frame, message); err != nil {
+				return
+			}
+			for _, response := range reply(message) {
+				data, _ := Marshal(response)
+				if err := WriteFrame(conn, data); err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+func TestConnRequest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, device := net.Pipe()
+	defer device.Close()
+
+	// The device sends an update and an unrelated message before answering
+	fakeDevice(t, device, func(request *ProtocolMessage) []*ProtocolMessage {
+		return []*ProtocolMessage{
+			{Type: TypeVolumeDidChange, VolumeDidChange: &VolumeDidChangeMessage{Volume: 0.5}},
+			{Type: TypeGetVolumeResult, Identifier: "other"},
+			{Type: TypeGetVolumeResult, Identifier: request.Identifier, GetVolumeResult: &GetVolumeResultMessage{Volume: 0.5}},
+		}
+	})
+
+	received := make(chan *ProtocolMessage, 2)
+	conn := NewConn(client, func(message *ProtocolMessage) { received <- message })
+	defer conn.Close()
+
+	request := NewMessage(TypeGetVolume)
+	request.GetVolume = &GetVolumeMessage{OutputDeviceUID: "uid"}
+	response, err := conn.Request(ctx, request)
+	if err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	if request.Identifier == "" || response.Identifier != request.Identifier {
+		t.Errorf("Expected response to %q, got %+v", request.Identifier, response)
+	}
+	if response.GetVolumeResult == nil || response.GetVolumeResult.Volume != 0.5 {
+		t.Errorf("Unexpected response %+v", response)
+	}
+
+	for _, expected := range []MessageType{TypeVolumeDidChange, TypeGetVolumeResult} {
+		if message := <-received; message.Type != expected {
+			t.Errorf("Expected %d to be handled, got %+v", expected, message)
+		}
+	}
+}
+
+func TestConnRequestContext(t *testing.T) {
+	client, device := net.Pipe()
+	defer device.Close()
+	fakeDevice(t, device, func(*ProtocolMessage) []*ProtocolMessage { return nil })
+
+	conn := NewConn(client, nil)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := conn.Request(ctx, NewMessage(TypeGeneric)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if conn.Err() != nil {
+		t.Errorf("Expected connection to keep running, got %v", conn.Err())
+	}
+}
+
+func TestConnClosed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, device := net.Pipe()
+	fakeDevice(t, device, func(*ProtocolMessage) []*ProtocolMessage {
+		device.Close()
+		return nil
+	})
+
+	conn := NewConn(client, nil)
+	if _, err := conn.Request(ctx, NewMessage(TypeGeneric)); err == nil {
+		t.Error("Expected request to fail when the device disconnects")
+	}
+	select {
+	case <-conn.Done():
+	case <-ctx.Done():
+		t.Fatal("Expected connection to stop")
+	}
+
+	conn.Close()
+	if err := conn.Send(NewMessage(TypeGeneric)); err == nil {
+		t.Error("Expected error sending on a stopped connection")
+	}
+}
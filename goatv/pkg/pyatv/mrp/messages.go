@@ -0,0 +1,853 @@
+package mrp
+
+// The messages below follow the definitions of MediaRemote. Fields that are
+// never used by a remote control are left out and skipped when decoding.
+
+// Command is a playback command.
+type Command int32
+
+// Values of Command.
+const (
+	CommandUnknown                    Command = 0
+	CommandPlay                       Command = 1
+	CommandPause                      Command = 2
+	CommandTogglePlayPause            Command = 3
+	CommandStop                       Command = 4
+	CommandNextTrack                  Command = 5
+	CommandPreviousTrack              Command = 6
+	CommandAdvanceShuffleMode         Command = 7
+	CommandAdvanceRepeatMode          Command = 8
+	CommandBeginFastForward           Command = 9
+	CommandEndFastForward             Command = 10
+	CommandBeginRewind                Command = 11
+	CommandEndRewind                  Command = 12
+	CommandRewind15Seconds            Command = 13
+	CommandFastForward15Seconds       Command = 14
+	CommandRewind30Seconds            Command = 15
+	CommandFastForward30Seconds       Command = 16
+	CommandSkipForward                Command = 18
+	CommandSkipBackward               Command = 19
+	CommandChangePlaybackRate         Command = 20
+	CommandRateTrack                  Command = 21
+	CommandLikeTrack                  Command = 22
+	CommandDislikeTrack               Command = 23
+	CommandBookmarkTrack              Command = 24
+	CommandNextChapter                Command = 25
+	CommandPreviousChapter            Command = 26
+	CommandNextAlbum                  Command = 27
+	CommandPreviousAlbum              Command = 28
+	CommandNextPlaylist               Command = 29
+	CommandPreviousPlaylist           Command = 30
+	CommandBanTrack                   Command = 31
+	CommandAddTrackToWishList         Command = 32
+	CommandRemoveTrackFromWishList    Command = 33
+	CommandNextInContext              Command = 34
+	CommandPreviousInContext          Command = 35
+	CommandResetPlaybackTimeout       Command = 41
+	CommandSeekToPlaybackPosition     Command = 45
+	CommandChangeRepeatMode           Command = 46
+	CommandChangeShuffleMode          Command = 47
+	CommandSetPlaybackQueue           Command = 48
+	CommandAddNowPlayingItemToLibrary Command = 49
+	CommandCreateRadioStation         Command = 50
+	CommandAddItemToLibrary           Command = 51
+	CommandInsertIntoPlaybackQueue    Command = 52
+	CommandEnableLanguageOption       Command = 53
+	CommandDisableLanguageOption      Command = 54
+	CommandReshuffle                  Command = 63
+	CommandChangeQueueEndAction       Command = 135
+)
+
+// PlaybackState is the state of a player.
+type PlaybackState int32
+
+// Values of PlaybackState.
+const (
+	PlaybackStateUnknown     PlaybackState = 0
+	PlaybackStatePlaying     PlaybackState = 1
+	PlaybackStatePaused      PlaybackState = 2
+	PlaybackStateStopped     PlaybackState = 3
+	PlaybackStateInterrupted PlaybackState = 4
+	PlaybackStateSeeking     PlaybackState = 5
+)
+
+// RepeatMode is the repeat mode of a player.
+type RepeatMode int32
+
+// Values of RepeatMode.
+const (
+	RepeatModeUnknown RepeatMode = 0
+	RepeatModeOff     RepeatMode = 1
+	RepeatModeOne     RepeatMode = 2
+	RepeatModeAll     RepeatMode = 3
+)
+
+// ShuffleMode is the shuffle mode of a player.
+type ShuffleMode int32
+
+// Values of ShuffleMode.
+const (
+	ShuffleModeUnknown ShuffleMode = 0
+	ShuffleModeOff     ShuffleMode = 1
+	ShuffleModeAlbums  ShuffleMode = 2
+	ShuffleModeSongs   ShuffleMode = 3
+)
+
+// DeviceClass is the kind of a device.
+type DeviceClass int32
+
+// Values of DeviceClass.
+const (
+	DeviceClassInvalid   DeviceClass = 0
+	DeviceClassIPhone    DeviceClass = 1
+	DeviceClassIPod      DeviceClass = 2
+	DeviceClassIPad      DeviceClass = 3
+	DeviceClassAppleTV   DeviceClass = 4
+	DeviceClassIFPGA     DeviceClass = 5
+	DeviceClassWatch     DeviceClass = 6
+	DeviceClassAccessory DeviceClass = 7
+	DeviceClassBridge    DeviceClass = 8
+	DeviceClassMac       DeviceClass = 9
+)
+
+// SendError tells why a command was not delivered.
+type SendError int32
+
+// Values of SendError.
+const (
+	SendErrorNoError                   SendError = 0
+	SendErrorApplicationNotFound       SendError = 1
+	SendErrorConnectionFailed          SendError = 2
+	SendErrorIgnored                   SendError = 3
+	SendErrorCouldNotLaunchApplication SendError = 4
+	SendErrorTimedOut                  SendError = 5
+	SendErrorOriginDoesNotExist        SendError = 6
+	SendErrorInvalidOptions            SendError = 7
+	SendErrorNoCommandHandlers         SendError = 8
+	SendErrorApplicationNotInstalled   SendError = 9
+	SendErrorNotSupported              SendError = 10
+)
+
+// String returns the name of the error.
+func (e SendError) String() string {
+	switch e {
+	case SendErrorNoError:
+		return "NoError"
+	case SendErrorApplicationNotFound:
+		return "ApplicationNotFound"
+	case SendErrorConnectionFailed:
+		return "ConnectionFailed"
+	case SendErrorIgnored:
+		return "Ignored"
+	case SendErrorCouldNotLaunchApplication:
+		return "CouldNotLaunchApplication"
+	case SendErrorTimedOut:
+		return "TimedOut"
+	case SendErrorOriginDoesNotExist:
+		return "OriginDoesNotExist"
+	case SendErrorInvalidOptions:
+		return "InvalidOptions"
+	case SendErrorNoCommandHandlers:
+		return "NoCommandHandlers"
+	case SendErrorApplicationNotInstalled:
+		return "ApplicationNotInstalled"
+	case SendErrorNotSupported:
+		return "NotSupported"
+	default:
+		return "Unknown"
+	}
+}
+
+// HandlerReturnStatus is how the app handled a command.
+type HandlerReturnStatus int32
+
+// Some values of HandlerReturnStatus.
+const (
+	HandlerReturnStatusSuccess                    HandlerReturnStatus = 0
+	HandlerReturnStatusNoSuchContent              HandlerReturnStatus = 1
+	HandlerReturnStatusCommandFailed              HandlerReturnStatus = 2
+	HandlerReturnStatusNoActionableNowPlayingItem HandlerReturnStatus = 10
+	HandlerReturnStatusDeviceNotFound             HandlerReturnStatus = 20
+)
+
+// ConnectionState is the state announced in SetConnectionStateMessage.
+type ConnectionState int32
+
+// Values of ConnectionState.
+const (
+	ConnectionStateNone         ConnectionState = 0
+	ConnectionStateConnecting   ConnectionState = 1
+	ConnectionStateConnected    ConnectionState = 2
+	ConnectionStateDisconnected ConnectionState = 3
+)
+
+// VolumeCapabilities tells how the volume of a device can be changed.
+type VolumeCapabilities int32
+
+// Values of VolumeCapabilities.
+const (
+	VolumeCapabilitiesNone     VolumeCapabilities = 0
+	VolumeCapabilitiesRelative VolumeCapabilities = 1
+	VolumeCapabilitiesAbsolute VolumeCapabilities = 2
+	VolumeCapabilitiesBoth     VolumeCapabilities = 3
+)
+
+// KeyboardState is the state of the virtual keyboard.
+type KeyboardState int32
+
+// Values of KeyboardState.
+const (
+	KeyboardStateUnknown         KeyboardState = 0
+	KeyboardStateNotEditing      KeyboardState = 1
+	KeyboardStateDidBeginEditing KeyboardState = 2
+	KeyboardStateEditing         KeyboardState = 3
+	KeyboardStateTextDidChange   KeyboardState = 4
+	KeyboardStateDidEndEditing   KeyboardState = 5
+	KeyboardStateResponse        KeyboardState = 6
+)
+
+// ActionType is what a TextInputMessage does with the text.
+type ActionType int32
+
+// Values of ActionType.
+const (
+	ActionTypeUnknown ActionType = 0
+	ActionTypeInsert  ActionType = 1
+	ActionTypeSet     ActionType = 2
+	ActionTypeDelete  ActionType = 3
+	ActionTypeClear   ActionType = 4
+)
+
+// MediaType is the kind of media of a content item.
+type MediaType int32
+
+// Values of MediaType.
+const (
+	MediaTypeUnknown MediaType = 0
+	MediaTypeAudio   MediaType = 1
+	MediaTypeVideo   MediaType = 2
+)
+
+// MediaSubType refines MediaType.
+type MediaSubType int32
+
+// Values of MediaSubType.
+const (
+	MediaSubTypeUnknown   MediaSubType = 0
+	MediaSubTypeMusic     MediaSubType = 1
+	MediaSubTypePodcast   MediaSubType = 4
+	MediaSubTypeAudioBook MediaSubType = 5
+	MediaSubTypeITunesU   MediaSubType = 6
+)
+
+// ModifyOutputContextRequestType is the kind of output context change.
+type ModifyOutputContextRequestType int32
+
+// SharedAudioPresentation is the only ModifyOutputContextRequestType.
+const SharedAudioPresentation ModifyOutputContextRequestType = 1
+
+// DeviceInfoMessage describes the sender of the message. It must be the first
+// message sent to a device.
+type DeviceInfoMessage struct {
+	UniqueIdentifier            string               `proto:"1"`
+	Name                        string               `proto:"2"`
+	LocalizedModelName          string               `proto:"3"`
+	SystemBuildVersion          string               `proto:"4"`
+	ApplicationBundleIdentifier string               `proto:"5"`
+	ApplicationBundleVersion    string               `proto:"6"`
+	ProtocolVersion             int32                `proto:"7"`
+	LastSupportedMessageType    uint32               `proto:"8"`
+	SupportsSystemPairing       bool                 `proto:"9"`
+	AllowsPairing               bool                 `proto:"10"`
+	Connected                   bool                 `proto:"11"`
+	SystemMediaApplication      string               `proto:"12"`
+	SupportsACL                 bool                 `proto:"13"`
+	SupportsSharedQueue         bool                 `proto:"14"`
+	SupportsExtendedMotion      bool                 `proto:"15"`
+	BluetoothAddress            []byte               `proto:"16"`
+	SharedQueueVersion          uint32               `proto:"17"`
+	DeviceUID                   string               `proto:"19"`
+	ManagedConfigDeviceID       string               `proto:"20"`
+	DeviceClass                 DeviceClass          `proto:"21"`
+	LogicalDeviceCount          uint32               `proto:"22"`
+	TightlySyncedGroup          bool                 `proto:"23"`
+	IsProxyGroupPlayer          bool                 `proto:"24"`
+	TightSyncUID                string               `proto:"25"`
+	GroupUID                    string               `proto:"26"`
+	GroupName                   string               `proto:"27"`
+	GroupedDevices              []*DeviceInfoMessage `proto:"28"`
+	IsGroupLeader               bool                 `proto:"29"`
+	IsAirplayActive             bool                 `proto:"30"`
+	SystemPodcastApplication    string               `proto:"31"`
+	SenderDefaultGroupUID       string               `proto:"32"`
+	AirplayReceivers            []string             `proto:"33"`
+	LinkAgent                   string               `proto:"34"`
+	ClusterID                   string               `proto:"35"`
+	ClusterLeaderID             string               `proto:"36"`
+	ClusterType                 uint32               `proto:"37"`
+	IsClusterAware              bool                 `proto:"38"`
+	ModelID                     string               `proto:"39"`
+	SupportsMultiplayer         bool                 `proto:"40"`
+	RoutingContextID            string               `proto:"41"`
+	AirPlayGroupID              string               `proto:"42"`
+	SystemBooksApplication      string               `proto:"43"`
+	ClusteredDevices            []*DeviceInfoMessage `proto:"44"`
+	SupportsOutputContextSync   bool                 `proto:"49"`
+	ComputerName                string               `proto:"50"`
+	ConfiguredClusterSize       uint32               `proto:"51"`
+}
+
+// CryptoPairingMessage carries TLV8 encoded HAP pairing data.
+type CryptoPairingMessage struct {
+	PairingData          []byte `proto:"1"`
+	Status               *int32 `proto:"2"`
+	IsRetrying           *bool  `proto:"3"`
+	IsUsingSystemPairing *bool  `proto:"4"`
+	State                *int32 `proto:"5"` // 2 for the first pair-setup message, 0 otherwise
+}
+
+// SetConnectionStateMessage tells the device we are connected. It must be
+// the first message once the connection is encrypted.
+type SetConnectionStateMessage struct {
+	State ConnectionState `proto:"1"`
+}
+
+// ClientUpdatesConfigMessage subscribes to updates from the device.
+type ClientUpdatesConfigMessage struct {
+	ArtworkUpdates      bool `proto:"1"`
+	NowPlayingUpdates   bool `proto:"2"`
+	VolumeUpdates       bool `proto:"3"`
+	KeyboardUpdates     bool `proto:"4"`
+	OutputDeviceUpdates bool `proto:"5"`
+}
+
+// WakeDeviceMessage wakes up a sleeping device.
+type WakeDeviceMessage struct{}
+
+// GenericMessage is used as heartbeat.
+type GenericMessage struct {
+	Key   string `proto:"1"`
+	Value []byte `proto:"2"`
+}
+
+// NotificationMessage carries notifications by name.
+type NotificationMessage struct {
+	Notification []string `proto:"1"`
+	UserInfo     [][]byte `proto:"2"`
+}
+
+// Origin is where a player lives, normally the device itself.
+type Origin struct {
+	Type            int32              `proto:"1"`
+	DisplayName     string             `proto:"2"`
+	Identifier      int32              `proto:"3"`
+	DeviceInfo      *DeviceInfoMessage `proto:"4"`
+	IsLocallyHosted bool               `proto:"5"`
+}
+
+// NowPlayingClient is an app that plays media.
+type NowPlayingClient struct {
+	ProcessIdentifier                 int32    `proto:"1"`
+	BundleIdentifier                  string   `proto:"2"`
+	ParentApplicationBundleIdentifier string   `proto:"3"`
+	ProcessUserIdentifier             int32    `proto:"4"`
+	NowPlayingVisibility              int32    `proto:"5"`
+	DisplayName                       string   `proto:"7"`
+	BundleIdentifierHierarchy         []string `proto:"8"`
+}
+
+// NowPlayingPlayer is one of the players of an app.
+type NowPlayingPlayer struct {
+	Identifier       string `proto:"1"`
+	DisplayName      string `proto:"2"`
+	IsDefaultPlayer  bool   `proto:"3"`
+	AudioSessionType int32  `proto:"4"`
+	MxSessionIDs     int64  `proto:"5"`
+	AudioSessionID   uint32 `proto:"6"`
+	IconURL          string `proto:"7"`
+}
+
+// PlayerPath identifies a player of an app on an origin.
+type PlayerPath struct {
+	Origin *Origin           `proto:"1"`
+	Client *NowPlayingClient `proto:"2"`
+	Player *NowPlayingPlayer `proto:"3"`
+}
+
+// CommandInfo tells if a player supports a command, and how.
+type CommandInfo struct {
+	Command               Command     `proto:"1"`
+	Enabled               *bool       `proto:"2"` // Enabled if not set
+	Active                bool        `proto:"3"`
+	PreferredIntervals    []float64   `proto:"4"`
+	LocalizedTitle        string      `proto:"5"`
+	MinimumRating         float32     `proto:"6"`
+	MaximumRating         float32     `proto:"7"`
+	SupportedRates        []float32   `proto:"8"`
+	LocalizedShortTitle   string      `proto:"9"`
+	RepeatMode            RepeatMode  `proto:"10"`
+	ShuffleMode           ShuffleMode `proto:"11"`
+	PresentationStyle     int32       `proto:"12"`
+	SkipInterval          int32       `proto:"13"`
+	NumAvailableSkips     int32       `proto:"14"`
+	SkipFrequency         int32       `proto:"15"`
+	CanScrub              int32       `proto:"16"`
+	SupportsSharedQueue   bool        `proto:"20"`
+	UpNextItemCount       int32       `proto:"21"`
+	PreferredPlaybackRate float32     `proto:"22"`
+}
+
+// SupportedCommands lists the commands of a player.
+type SupportedCommands struct {
+	SupportedCommands []*CommandInfo `proto:"1"`
+}
+
+// NowPlayingInfo is the legacy description of what is playing.
+type NowPlayingInfo struct {
+	Album                  string      `proto:"1"`
+	Artist                 string      `proto:"2"`
+	Duration               float64     `proto:"3"`
+	ElapsedTime            float64     `proto:"4"`
+	PlaybackRate           float32     `proto:"5"`
+	RepeatMode             RepeatMode  `proto:"6"`
+	ShuffleMode            ShuffleMode `proto:"7"`
+	Timestamp              float64     `proto:"8"`
+	Title                  string      `proto:"9"`
+	UniqueIdentifier       uint64      `proto:"10"`
+	IsExplicitTrack        bool        `proto:"11"`
+	IsMusicApp             bool        `proto:"12"`
+	RadioStationIdentifier int64       `proto:"13"`
+	RadioStationHash       string      `proto:"14"`
+	RadioStationName       string      `proto:"15"`
+	ArtworkDataDigest      []byte      `proto:"16"`
+	IsAlwaysLive           bool        `proto:"17"`
+	IsAdvertisement        bool        `proto:"18"`
+}
+
+// ContentItemMetadata describes a content item. Numbers that may
+// legitimately be zero are pointers, so that they can be told from missing
+// ones.
+type ContentItemMetadata struct {
+	Title                     string       `proto:"1"`
+	Subtitle                  string       `proto:"2"`
+	IsContainer               bool         `proto:"3"`
+	IsPlayable                bool         `proto:"4"`
+	PlaybackProgress          float32      `proto:"5"`
+	AlbumName                 string       `proto:"6"`
+	TrackArtistName           string       `proto:"7"`
+	AlbumArtistName           string       `proto:"8"`
+	DirectorName              string       `proto:"9"`
+	SeasonNumber              int32        `proto:"10"`
+	EpisodeNumber             int32        `proto:"11"`
+	ReleaseDate               float64      `proto:"12"`
+	PlayCount                 int32        `proto:"13"`
+	Duration                  *float64     `proto:"14"`
+	LocalizedContentRating    string       `proto:"15"`
+	IsExplicitItem            bool         `proto:"16"`
+	PlaylistType              int32        `proto:"17"`
+	RadioStationType          int32        `proto:"18"`
+	ArtworkAvailable          bool         `proto:"19"`
+	InfoAvailable             bool         `proto:"21"`
+	LanguageOptionsAvailable  bool         `proto:"22"`
+	NumberOfSections          int32        `proto:"23"`
+	LyricsAvailable           bool         `proto:"24"`
+	IsStreamingContent        bool         `proto:"26"`
+	IsCurrentlyPlaying        bool         `proto:"27"`
+	CollectionIdentifier      string       `proto:"28"`
+	ProfileIdentifier         string       `proto:"29"`
+	StartTime                 float64      `proto:"30"`
+	ArtworkMIMEType           string       `proto:"31"`
+	AssetURLString            string       `proto:"32"`
+	Composer                  string       `proto:"33"`
+	DiscNumber                int32        `proto:"34"`
+	ElapsedTime               *float64     `proto:"35"`
+	Genre                     string       `proto:"36"`
+	IsAlwaysLive              bool         `proto:"37"`
+	PlaybackRate              *float32     `proto:"39"`
+	ChapterCount              int32        `proto:"40"`
+	TotalDiscCount            int32        `proto:"41"`
+	TotalTrackCount           int32        `proto:"42"`
+	TrackNumber               int32        `proto:"43"`
+	ContentIdentifier         string       `proto:"44"`
+	IsSharable                bool         `proto:"46"`
+	IsLiked                   bool         `proto:"48"`
+	IsInWishList              bool         `proto:"49"`
+	RadioStationIdentifier    int64        `proto:"50"`
+	RadioStationName          string       `proto:"52"`
+	RadioStationString        string       `proto:"53"`
+	ITunesStoreIdentifier     int64        `proto:"54"`
+	ITunesStoreSubscriptionID int64        `proto:"55"`
+	ITunesStoreArtistID       int64        `proto:"56"`
+	ITunesStoreAlbumID        int64        `proto:"57"`
+	DefaultPlaybackRate       float32      `proto:"59"`
+	SeriesName                string       `proto:"63"`
+	MediaType                 MediaType    `proto:"64"`
+	MediaSubType              MediaSubType `proto:"65"`
+	IsSteerable               bool         `proto:"69"`
+	ArtworkURL                string       `proto:"70"`
+	LyricsURL                 string       `proto:"71"`
+	ElapsedTimeTimestamp      *float64     `proto:"74"`
+	InferredTimestamp         float64      `proto:"75"`
+	ServiceIdentifier         string       `proto:"76"`
+	ArtworkDataWidth          int32        `proto:"77"`
+	ArtworkDataHeight         int32        `proto:"78"`
+	ArtworkIdentifier         string       `proto:"80"`
+	IsLoading                 bool         `proto:"81"`
+	LegacyUniqueIdentifier    int64        `proto:"83"`
+	EpisodeType               int32        `proto:"84"`
+	ArtworkFileURL            string       `proto:"85"`
+	BrandIdentifier           string       `proto:"86"`
+	LocalizedDurationString   string       `proto:"87"`
+	AlbumYear                 string       `proto:"88"`
+}
+
+// LanguageOption is an audio or subtitle track.
+type LanguageOption struct {
+	Type            int32    `proto:"1"`
+	LanguageTag     string   `proto:"2"`
+	Characteristics []string `proto:"3"`
+	DisplayName     string   `proto:"4"`
+	Identifier      string   `proto:"5"`
+}
+
+// ContentItem is an item in a playback queue.
+type ContentItem struct {
+	Identifier             string               `proto:"1"`
+	Metadata               *ContentItemMetadata `proto:"2"`
+	ArtworkData            []byte               `proto:"3"`
+	Info                   string               `proto:"4"`
+	CurrentLanguageOptions []*LanguageOption    `proto:"6"`
+	ParentIdentifier       string               `proto:"9"`
+	AncestorIdentifier     string               `proto:"10"`
+	QueueIdentifier        string               `proto:"11"`
+	RequestIdentifier      string               `proto:"12"`
+	ArtworkDataWidth       int32                `proto:"13"`
+	ArtworkDataHeight      int32                `proto:"14"`
+}
+
+// PlaybackQueueContext identifies a revision of a playback queue.
+type PlaybackQueueContext struct {
+	Revision string `proto:"1"`
+}
+
+// PlaybackQueue is the queue of a player. Location is the index of the item
+// that is playing.
+type PlaybackQueue struct {
+	Location                        int32                 `proto:"1"`
+	ContentItems                    []*ContentItem        `proto:"2"`
+	Context                         *PlaybackQueueContext `proto:"3"`
+	RequestID                       string                `proto:"4"`
+	ResolvedPlayerPath              *PlayerPath           `proto:"5"`
+	SendingPlaybackQueueTransaction bool                  `proto:"6"`
+	QueueIdentifier                 string                `proto:"7"`
+}
+
+// PlaybackQueueCapabilities tells how a playback queue can be requested.
+type PlaybackQueueCapabilities struct {
+	RequestByRange       bool `proto:"1"`
+	RequestByIdentifiers bool `proto:"2"`
+	RequestByRequest     bool `proto:"3"`
+}
+
+// PlaybackQueueRequestMessage asks for the playback queue of a player.
+type PlaybackQueueRequestMessage struct {
+	Location                                int32                 `proto:"1"`
+	Length                                  int32                 `proto:"2"`
+	IncludeMetadata                         bool                  `proto:"3"`
+	ArtworkWidth                            float64               `proto:"4"`
+	ArtworkHeight                           float64               `proto:"5"`
+	IncludeLyrics                           bool                  `proto:"6"`
+	IncludeSections                         bool                  `proto:"7"`
+	IncludeInfo                             bool                  `proto:"8"`
+	IncludeLanguageOptions                  bool                  `proto:"9"`
+	Context                                 *PlaybackQueueContext `proto:"10"`
+	RequestID                               string                `proto:"11"`
+	ContentItemIdentifiers                  []string              `proto:"12"`
+	ReturnContentItemAssetsInUserCompletion bool                  `proto:"13"`
+	PlayerPath                              *PlayerPath           `proto:"14"`
+	CachingPolicy                           int32                 `proto:"15"`
+	Label                                   string                `proto:"16"`
+	IsLegacyNowPlayingInfoRequest           bool                  `proto:"17"`
+}
+
+// SetStateMessage updates the state of a player. Only the parts that changed
+// are set.
+type SetStateMessage struct {
+	NowPlayingInfo            *NowPlayingInfo              `proto:"1"`
+	SupportedCommands         *SupportedCommands           `proto:"2"`
+	PlaybackQueue             *PlaybackQueue               `proto:"3"`
+	DisplayID                 string                       `proto:"4"`
+	DisplayName               string                       `proto:"5"`
+	PlaybackState             *PlaybackState               `proto:"6"`
+	PlaybackQueueCapabilities *PlaybackQueueCapabilities   `proto:"8"`
+	PlayerPath                *PlayerPath                  `proto:"9"`
+	Request                   *PlaybackQueueRequestMessage `proto:"10"`
+	PlaybackStateTimestamp    float64                      `proto:"11"`
+}
+
+// SetArtworkMessage carries artwork of what is playing.
+type SetArtworkMessage struct {
+	JPEGData []byte `proto:"1"`
+}
+
+// UpdateContentItemMessage updates content items that are already known.
+type UpdateContentItemMessage struct {
+	ContentItems []*ContentItem `proto:"1"`
+	PlayerPath   *PlayerPath    `proto:"2"`
+}
+
+// SetNowPlayingClientMessage tells which app is playing.
+type SetNowPlayingClientMessage struct {
+	Client *NowPlayingClient `proto:"1"`
+}
+
+// SetNowPlayingPlayerMessage tells which player of an app is playing.
+type SetNowPlayingPlayerMessage struct {
+	PlayerPath *PlayerPath `proto:"1"`
+}
+
+// UpdateClientMessage updates the details of an app.
+type UpdateClientMessage struct {
+	Client *NowPlayingClient `proto:"1"`
+}
+
+// RemoveClientMessage tells that an app is gone.
+type RemoveClientMessage struct {
+	Client *NowPlayingClient `proto:"1"`
+}
+
+// RemovePlayerMessage tells that a player is gone.
+type RemovePlayerMessage struct {
+	PlayerPath *PlayerPath `proto:"1"`
+}
+
+// PlayerClientPropertiesMessage updates properties of a player.
+type PlayerClientPropertiesMessage struct {
+	PlayerPath           *PlayerPath `proto:"1"`
+	LastPlayingTimestamp float64     `proto:"2"`
+}
+
+// OriginClientPropertiesMessage updates properties of an origin.
+type OriginClientPropertiesMessage struct {
+	LastPlayingTimestamp float64 `proto:"1"`
+}
+
+// CommandOptions are the arguments of a command.
+type CommandOptions struct {
+	SourceID                string      `proto:"2"`
+	MediaType               string      `proto:"3"`
+	ExternalPlayerCommand   bool        `proto:"4"`
+	SkipInterval            float32     `proto:"5"`
+	PlaybackRate            float32     `proto:"6"`
+	Rating                  float32     `proto:"7"`
+	Negative                bool        `proto:"8"`
+	PlaybackPosition        float64     `proto:"9"`
+	RepeatMode              RepeatMode  `proto:"10"`
+	ShuffleMode             ShuffleMode `proto:"11"`
+	TrackID                 uint64      `proto:"12"`
+	RadioStationID          int64       `proto:"13"`
+	RadioStationHash        string      `proto:"14"`
+	DestinationAppDisplayID string      `proto:"16"`
+	SendOptions             *uint32     `proto:"17"`
+	ContextID               string      `proto:"19"`
+	StationURL              string      `proto:"21"`
+	ContentItemID           string      `proto:"24"`
+}
+
+// SendCommandMessage sends a playback command to a player, or to the active
+// one if PlayerPath is not set. The device answers with
+// SendCommandResultMessage.
+type SendCommandMessage struct {
+	Command    Command         `proto:"1"`
+	Options    *CommandOptions `proto:"2"`
+	PlayerPath *PlayerPath     `proto:"3"`
+}
+
+// SendCommandResultStatus is the status of a command in a player.
+type SendCommandResultStatus struct {
+	StatusCode     HandlerReturnStatus `proto:"1"`
+	Type           int32               `proto:"2"`
+	CustomData     []byte              `proto:"5"`
+	CustomDataType string              `proto:"6"`
+}
+
+// SendCommandResult is the detailed result of a command.
+type SendCommandResult struct {
+	PlayerPath *PlayerPath                `proto:"1"`
+	SendError  SendError                  `proto:"2"`
+	Statuses   []*SendCommandResultStatus `proto:"3"`
+}
+
+// SendCommandResultMessage is the answer to SendCommandMessage.
+type SendCommandResultMessage struct {
+	SendError                SendError           `proto:"1"`
+	HandlerReturnStatus      HandlerReturnStatus `proto:"2"`
+	HandlerReturnStatusDatas [][]byte            `proto:"3"`
+	CommandID                string              `proto:"4"`
+	PlayerPath               *PlayerPath         `proto:"5"`
+	CommandResult            *SendCommandResult  `proto:"6"`
+}
+
+// SendHIDEventMessage sends a HID event, like a button press.
+type SendHIDEventMessage struct {
+	HIDEventData []byte `proto:"1"`
+}
+
+// SendButtonEventMessage sends a button press or release by HID usage.
+type SendButtonEventMessage struct {
+	UsagePage  uint32 `proto:"1"`
+	Usage      uint32 `proto:"2"`
+	ButtonDown bool   `proto:"3"`
+}
+
+// VolumeControlAvailabilityMessage tells if and how volume can be changed.
+type VolumeControlAvailabilityMessage struct {
+	VolumeControlAvailable bool               `proto:"1"`
+	VolumeCapabilities     VolumeCapabilities `proto:"2"`
+}
+
+// VolumeControlCapabilitiesDidChangeMessage tells that the volume
+// capabilities of an output device changed.
+type VolumeControlCapabilitiesDidChangeMessage struct {
+	Capabilities    *VolumeControlAvailabilityMessage `proto:"1"`
+	EndpointUID     string                            `proto:"3"`
+	OutputDeviceUID string                            `proto:"4"`
+}
+
+// GetVolumeMessage asks for the volume of an output device. The device
+// answers with GetVolumeResultMessage.
+type GetVolumeMessage struct {
+	OutputDeviceUID string `proto:"1"`
+}
+
+// GetVolumeResultMessage is the answer to GetVolumeMessage.
+type GetVolumeResultMessage struct {
+	Volume float32 `proto:"1"`
+}
+
+// SetVolumeMessage changes the volume of an output device, from 0 to 1.
+type SetVolumeMessage struct {
+	Volume          *float32 `proto:"1"`
+	OutputDeviceUID string   `proto:"2"`
+}
+
+// VolumeDidChangeMessage tells that the volume of an output device changed.
+type VolumeDidChangeMessage struct {
+	Volume          float32 `proto:"1"`
+	EndpointUID     string  `proto:"2"`
+	OutputDeviceUID string  `proto:"3"`
+}
+
+// AVOutputDeviceDescriptor describes an output device, like a speaker.
+type AVOutputDeviceDescriptor struct {
+	Name                     string                      `proto:"1"`
+	UniqueIdentifier         string                      `proto:"2"`
+	GroupID                  string                      `proto:"3"`
+	ModelID                  string                      `proto:"4"`
+	MACAddress               []byte                      `proto:"5"`
+	CanAccessRemoteAssets    bool                        `proto:"6"`
+	IsRemoteControllable     bool                        `proto:"7"`
+	IsGroupLeader            bool                        `proto:"8"`
+	IsGroupable              bool                        `proto:"9"`
+	DeviceType               int32                       `proto:"10"`
+	DeviceSubType            int32                       `proto:"11"`
+	BatteryLevel             float32                     `proto:"13"`
+	IsLocalDevice            bool                        `proto:"14"`
+	SupportsExternalScreen   bool                        `proto:"15"`
+	RequiresAuthorization    bool                        `proto:"16"`
+	IsDeviceGroupable        bool                        `proto:"19"`
+	LogicalDeviceID          string                      `proto:"21"`
+	IsProxyGroupPlayer       bool                        `proto:"22"`
+	FirmwareVersion          string                      `proto:"23"`
+	Volume                   float32                     `proto:"24"`
+	IsVolumeControlAvailable bool                        `proto:"25"`
+	ParentGroupIdentifier    string                      `proto:"34"`
+	VolumeCapabilities       VolumeCapabilities          `proto:"37"`
+	SupportsHAP              bool                        `proto:"39"`
+	ClusterCompositions      []*AVOutputDeviceDescriptor `proto:"41"`
+	ClusterType              uint32                      `proto:"42"`
+	PrimaryUID               string                      `proto:"43"`
+	AirPlayGroupID           string                      `proto:"51"`
+	ClusterID                string                      `proto:"58"`
+	IsClusterLeader          bool                        `proto:"59"`
+	ParentUniqueIdentifier   string                      `proto:"61"`
+	RoomID                   string                      `proto:"62"`
+	RoomName                 string                      `proto:"63"`
+}
+
+// UpdateOutputDeviceMessage tells about new or changed output devices.
+type UpdateOutputDeviceMessage struct {
+	OutputDevices             []*AVOutputDeviceDescriptor `proto:"1"`
+	EndpointUID               string                      `proto:"2"`
+	ClusterAwareOutputDevices []*AVOutputDeviceDescriptor `proto:"3"`
+}
+
+// RemoveOutputDevicesMessage tells that output devices are gone.
+type RemoveOutputDevicesMessage struct {
+	OutputDeviceUIDs []string `proto:"1"`
+	EndpointUID      string   `proto:"2"`
+}
+
+// ModifyOutputContextRequestMessage changes the output devices that play
+// along with the device.
+type ModifyOutputContextRequestMessage struct {
+	Type                        ModifyOutputContextRequestType `proto:"1"`
+	AddingDevices               []string                       `proto:"2"`
+	RemovingDevices             []string                       `proto:"3"`
+	SettingDevices              []string                       `proto:"4"`
+	ClusterAwareAddingDevices   []string                       `proto:"5"`
+	ClusterAwareRemovingDevices []string                       `proto:"6"`
+	ClusterAwareSettingDevices  []string                       `proto:"7"`
+}
+
+// AudioFadeMessage fades the audio of a player.
+type AudioFadeMessage struct {
+	PlayerPath *PlayerPath `proto:"1"`
+	FadeType   int32       `proto:"2"`
+}
+
+// AudioFadeResponseMessage is the answer to AudioFadeMessage.
+type AudioFadeResponseMessage struct {
+	FadeDuration int64 `proto:"1"`
+}
+
+// ConfigureConnectionMessage joins the connection to a group.
+type ConfigureConnectionMessage struct {
+	GroupID string `proto:"1"`
+}
+
+// TextInputTraits describes the text field being edited.
+type TextInputTraits struct {
+	AutocapitalizationType        int32    `proto:"1"`
+	KeyboardType                  int32    `proto:"2"`
+	ReturnKeyType                 int32    `proto:"3"`
+	Autocorrection                bool     `proto:"4"`
+	Spellchecking                 bool     `proto:"5"`
+	EnablesReturnKeyAutomatically bool     `proto:"6"`
+	SecureTextEntry               bool     `proto:"7"`
+	ValidTextRangeLocation        uint64   `proto:"8"`
+	ValidTextRangeLength          uint64   `proto:"9"`
+	PINEntrySeparatorIndexes      []uint64 `proto:"10"`
+}
+
+// TextEditingAttributes describes a text field.
+type TextEditingAttributes struct {
+	Title       string           `proto:"1"`
+	Prompt      string           `proto:"2"`
+	InputTraits *TextInputTraits `proto:"3"`
+}
+
+// KeyboardMessage tells about the state of the virtual keyboard. It is also
+// the answer to GetKeyboardSession.
+type KeyboardMessage struct {
+	State                   KeyboardState          `proto:"1"`
+	Attributes              *TextEditingAttributes `proto:"3"`
+	EncryptedTextCyphertext []byte                 `proto:"4"`
+}
+
+// TextInputMessage changes the text of the virtual keyboard.
+type TextInputMessage struct {
+	Timestamp  float64    `proto:"1"`
+	Text       string     `proto:"2"`
+	ActionType ActionType `proto:"3"`
+}
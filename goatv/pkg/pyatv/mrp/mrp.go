@@ -0,0 +1,370 @@
+// Package mrp implements the message layer of the Media Remote Protocol
+// (MRP), which modern Apple TVs are controlled with.
+//
+// Every message is a protobuf encoded ProtocolMessage. The type field tells
+// which of its extension fields holds the actual message. Messages are
+// described by structs with a proto tag holding the field number and are
+// encoded and decoded by reflection:
+//
+//	bool, ints and enums   varint
+//	float32                fixed32
+//	float64                fixed64
+//	string, []byte         length delimited
+//	*Struct                embedded message
+//	[]T                    repeated field (packed numbers are decoded too)
+//	*T                     optional scalar that is sent even when zero
+//
+// Other scalars are left out when zero. Fields without a struct field are
+// skipped when decoding, or kept as is in a []byte field tagged
+// proto:"unknown" if the message has one.
+package mrp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ErrMalformed is returned when data is not a valid message.
+var ErrMalformed = errors.New("malformed MRP message")
+
+// ErrUnsupported is returned when a value can not be encoded.
+var ErrUnsupported = errors.New("unsupported MRP type")
+
+// field is a struct field that maps to a protobuf field.
+type field struct {
+	number protowire.Number
+	index  int
+}
+
+// messageInfo describes how a struct is encoded.
+type messageInfo struct {
+	fields   []field
+	byNumber map[protowire.Number]int // Struct field index by field number
+	unknown  int                      // Index of the unknown field, -1 if none
+}
+
+var messageInfos sync.Map // reflect.Type -> *messageInfo
+
+func getMessageInfo(t reflect.Type) (*messageInfo, error) {
+	if info, ok := messageInfos.Load(t); ok {
+		return info.(*messageInfo), nil
+	}
+
+	info := &messageInfo{byNumber: make(map[protowire.Number]int), unknown: -1}
+	for i := 0; i < t.NumField(); i++ {
+		tag, ok := t.Field(i).Tag.Lookup("proto")
+		if !ok {
+			continue
+		}
+		if tag == "unknown" {
+			info.unknown = i
+			continue
+		}
+		number, err := strconv.Atoi(tag)
+		if err != nil || !protowire.Number(number).IsValid() {
+			return nil, fmt.Errorf("%w: bad tag %q on %s.%s", ErrUnsupported, tag, t, t.Field(i).Name)
+		}
+		info.fields = append(info.fields, field{number: protowire.Number(number), index: i})
+		info.byNumber[protowire.Number(number)] = i
+	}
+
+	messageInfos.Store(t, info)
+	return info, nil
+}
+
+// structOf returns the struct a message pointer points to.
+func structOf(message any) (reflect.Value, error) {
+	v := reflect.ValueOf(message)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("%w: %T is not a pointer to a struct", ErrUnsupported, message)
+	}
+	return v.Elem(), nil
+}
+
+// Marshal encodes a message, which must be a pointer to a struct.
+func Marshal(message any) ([]byte, error) {
+	v, err := structOf(message)
+	if err != nil {
+		return nil, err
+	}
+	return appendMessage(nil, v)
+}
+
+func appendMessage(data []byte, v reflect.Value) ([]byte, error) {
+	info, err := getMessageInfo(v.Type())
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range info.fields {
+		if data, err = appendField(data, f.number, v.Field(f.index)); err != nil {
+			return nil, err
+		}
+	}
+	if info.unknown >= 0 {
+		data = append(data, v.Field(info.unknown).Bytes()...)
+	}
+	return data, nil
+}
+
+func appendField(data []byte, number protowire.Number, v reflect.Value) ([]byte, error) {
+	switch {
+	case v.Kind() == reflect.Pointer:
+		if v.IsNil() {
+			return data, nil
+		}
+		return appendValue(data, number, v.Elem())
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8:
+		for i := 0; i < v.Len(); i++ {
+			item := v.Index(i)
+			if item.Kind() == reflect.Pointer {
+				if item.IsNil() {
+					continue
+				}
+				item = item.Elem()
+			}
+			var err error
+			if data, err = appendValue(data, number, item); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	case v.IsZero():
+		return data, nil
+	default:
+		return appendValue(data, number, v)
+	}
+}
+
+func appendValue(data []byte, number protowire.Number, v reflect.Value) ([]byte, error) {
+	wireType, ok := wireTypeOf(v.Type())
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupported, v.Type())
+	}
+	data = protowire.AppendTag(data, number, wireType)
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return protowire.AppendVarint(data, protowire.EncodeBool(v.Bool())), nil
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		// Negative numbers are sign extended to 64 bits like protobuf does
+		return protowire.AppendVarint(data, uint64(v.Int())), nil
+	case reflect.Uint32, reflect.Uint64:
+		return protowire.AppendVarint(data, v.Uint()), nil
+	case reflect.Float32:
+		return protowire.AppendFixed32(data, math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		return protowire.AppendFixed64(data, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return protowire.AppendString(data, v.String()), nil
+	case reflect.Slice:
+		return protowire.AppendBytes(data, v.Bytes()), nil
+	default:
+		inner, err := appendMessage(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		return protowire.AppendBytes(data, inner), nil
+	}
+}
+
+// wireTypeOf returns the wire type a single value of a type is encoded with.
+func wireTypeOf(t reflect.Type) (protowire.Type, bool) {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint32, reflect.Uint64:
+		return protowire.VarintType, true
+	case reflect.Float32:
+		return protowire.Fixed32Type, true
+	case reflect.Float64:
+		return protowire.Fixed64Type, true
+	case reflect.String, reflect.Struct:
+		return protowire.BytesType, true
+	case reflect.Slice:
+		return protowire.BytesType, t.Elem().Kind() == reflect.Uint8
+	default:
+		return 0, false
+	}
+}
+
+// Unmarshal decodes data into a message, which must be a pointer to a
+// struct. Like protobuf, decoding into a message that is already filled in
+// merges data into it: scalars are replaced, embedded messages are merged and
+// repeated fields are appended to.
+func Unmarshal(data []byte, message any) error {
+	v, err := structOf(message)
+	if err != nil {
+		return err
+	}
+	return consumeMessage(data, v)
+}
+
+func consumeMessage(data []byte, v reflect.Value) error {
+	info, err := getMessageInfo(v.Type())
+	if err != nil {
+		return err
+	}
+
+	for len(data) > 0 {
+		number, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", ErrMalformed, protowire.ParseError(n))
+		}
+
+		index, known := info.byNumber[number]
+		if known {
+			m, err := consumeField(data[n:], wireType, v.Field(index))
+			if err != nil {
+				return err
+			}
+			if m >= 0 {
+				data = data[n+m:]
+				continue
+			}
+		}
+
+		// Unknown field, or a known one with a wire type we can not decode
+		m := protowire.ConsumeFieldValue(number, wireType, data[n:])
+		if m < 0 {
+			return fmt.Errorf("%w: %v", ErrMalformed, protowire.ParseError(m))
+		}
+		if info.unknown >= 0 {
+			unknown := v.Field(info.unknown)
+			unknown.SetBytes(append(unknown.Bytes(), data[:n+m]...))
+		}
+		data = data[n+m:]
+	}
+	return nil
+}
+
+// consumeField decodes the value of a field and returns its length, or -1 if
+// the wire type does not match the field.
+func consumeField(data []byte, wireType protowire.Type, v reflect.Value) (int, error) {
+	switch {
+	case v.Kind() == reflect.Pointer:
+		if expected, _ := wireTypeOf(v.Type().Elem()); wireType != expected {
+			return -1, nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return consumeValue(data, v.Elem())
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8:
+		return consumeRepeated(data, wireType, v)
+	default:
+		if expected, _ := wireTypeOf(v.Type()); wireType != expected {
+			return -1, nil
+		}
+		return consumeValue(data, v)
+	}
+}
+
+// consumeRepeated decodes one item of a repeated field, or all of them if
+// they are packed.
+func consumeRepeated(data []byte, wireType protowire.Type, v reflect.Value) (int, error) {
+	itemType := v.Type().Elem()
+	valueType := itemType
+	if itemType.Kind() == reflect.Pointer {
+		valueType = itemType.Elem()
+	}
+
+	expected, _ := wireTypeOf(valueType)
+	packed := wireType == protowire.BytesType && expected != protowire.BytesType
+	if wireType != expected && !packed {
+		return -1, nil
+	}
+
+	newItem := func() (reflect.Value, reflect.Value) {
+		if itemType.Kind() == reflect.Pointer {
+			item := reflect.New(valueType)
+			return item, item.Elem()
+		}
+		item := reflect.New(itemType).Elem()
+		return item, item
+	}
+
+	if !packed {
+		item, value := newItem()
+		n, err := consumeValue(data, value)
+		if err != nil {
+			return 0, err
+		}
+		v.Set(reflect.Append(v, item))
+		return n, nil
+	}
+
+	values, n := protowire.ConsumeBytes(data)
+	if n < 0 {
+		return 0, fmt.Errorf("%w: %v", ErrMalformed, protowire.ParseError(n))
+	}
+	for len(values) > 0 {
+		item, value := newItem()
+		m, err := consumeValue(values, value)
+		if err != nil {
+			return 0, err
+		}
+		v.Set(reflect.Append(v, item))
+		values = values[m:]
+	}
+	return n, nil
+}
+
+// consumeValue decodes a single value of the wire type of v.
+func consumeValue(data []byte, v reflect.Value) (int, error) {
+	var n int
+	switch v.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint32, reflect.Uint64:
+		var value uint64
+		value, n = protowire.ConsumeVarint(data)
+		if n < 0 {
+			break
+		}
+		switch v.Kind() {
+		case reflect.Bool:
+			v.SetBool(protowire.DecodeBool(value))
+		case reflect.Uint32, reflect.Uint64:
+			v.SetUint(value)
+		default:
+			v.SetInt(int64(value))
+		}
+	case reflect.Float32:
+		var value uint32
+		if value, n = protowire.ConsumeFixed32(data); n >= 0 {
+			v.SetFloat(float64(math.Float32frombits(value)))
+		}
+	case reflect.Float64:
+		var value uint64
+		if value, n = protowire.ConsumeFixed64(data); n >= 0 {
+			v.SetFloat(math.Float64frombits(value))
+		}
+	case reflect.String:
+		var value string
+		if value, n = protowire.ConsumeString(data); n >= 0 {
+			v.SetString(value)
+		}
+	case reflect.Slice:
+		var value []byte
+		if value, n = protowire.ConsumeBytes(data); n >= 0 {
+			v.SetBytes(bytes.Clone(value))
+		}
+	case reflect.Struct:
+		var value []byte
+		if value, n = protowire.ConsumeBytes(data); n >= 0 {
+			if err := consumeMessage(value, v); err != nil {
+				return 0, err
+			}
+		}
+	default:
+		return 0, fmt.Errorf("%w: %s", ErrUnsupported, v.Type())
+	}
+
+	if n < 0 {
+		return 0, fmt.Errorf("%w: %v", ErrMalformed, protowire.ParseError(n))
+	}
+	return n, nil
+}
@@ -0,0 +1,255 @@
+package mrp
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func float32p(value float32) *float32 { return &value }
+
+func float64p(value float64) *float64 { return &value }
+
+func TestMarshal(t *testing.T) {
+	state := PlaybackStatePaused
+	tests := []struct {
+		name     string
+		message  any
+		expected []byte
+	}{
+		{"empty", &ProtocolMessage{}, nil},
+		{"varint and string", &ProtocolMessage{Type: TypeSendCommand, Identifier: "ab"}, []byte{0x08, 0x01, 0x12, 0x02, 'a', 'b'}},
+		{"large field number", &ProtocolMessage{UniqueIdentifier: "x"}, []byte{0xAA, 0x05, 0x01, 'x'}},
+		{"zero is left out", &SendButtonEventMessage{UsagePage: 1}, []byte{0x08, 0x01}},
+		{"bool", &SendButtonEventMessage{ButtonDown: true}, []byte{0x18, 0x01}},
+		{"negative int", &PlaybackQueue{Location: -1}, []byte{0x08, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}},
+		{"float", &GetVolumeResultMessage{Volume: 0.5}, []byte{0x0D, 0x00, 0x00, 0x00, 0x3F}},
+		{"double", &CommandOptions{PlaybackPosition: 2}, []byte{0x49, 0, 0, 0, 0, 0, 0, 0, 0x40}},
+		{"optional zero", &SetVolumeMessage{Volume: float32p(0)}, []byte{0x0D, 0, 0, 0, 0}},
+		{"optional enum", &SetStateMessage{PlaybackState: &state}, []byte{0x30, 0x02}},
+		{"bytes", &SendHIDEventMessage{HIDEventData: []byte{1, 2}}, []byte{0x0A, 0x02, 0x01, 0x02}},
+		{"repeated", &NotificationMessage{Notification: []string{"a", "b"}}, []byte{0x0A, 0x01, 'a', 0x0A, 0x01, 'b'}},
+		{"empty message", &ProtocolMessage{WakeDevice: &WakeDeviceMessage{}}, []byte{0xEA, 0x02, 0x00}},
+		{
+			"embedded",
+			&ProtocolMessage{Type: TypeSetConnectionState, SetConnectionState: &SetConnectionStateMessage{State: ConnectionStateConnected}},
+			[]byte{0x08, 0x26, 0xD2, 0x02, 0x02, 0x08, 0x02},
+		},
+		{
+			"repeated messages",
+			&SupportedCommands{SupportedCommands: []*CommandInfo{{Command: CommandPlay}, {Command: CommandPause}}},
+			[]byte{0x0A, 0x02, 0x08, 0x01, 0x0A, 0x02, 0x08, 0x02},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := Marshal(tt.message)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if !bytes.Equal(data, tt.expected) {
+				t.Errorf("Expected %x, got %x", tt.expected, data)
+			}
+		})
+	}
+}
+
+func TestMarshalUnsupported(t *testing.T) {
+	type badTag struct {
+		Value int32 `proto:"zero"`
+	}
+	type badType struct {
+		Value map[string]int `proto:"1"`
+	}
+
+	for _, message := range []any{nil, ProtocolMessage{}, &badTag{}, &badType{Value: map[string]int{"a": 1}}} {
+		if _, err := Marshal(message); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("Expected ErrUnsupported for %T, got %v", message, err)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	state := PlaybackStatePlaying
+	sendOptions := uint32(0)
+	messages := []*ProtocolMessage{
+		{
+			Type:             TypeSetState,
+			Identifier:       "id",
+			ErrorCode:        ErrorCodeTheDeviceIsNotPaired,
+			UniqueIdentifier: "unique",
+			SetState: &SetStateMessage{
+				PlaybackState: &state,
+				SupportedCommands: &SupportedCommands{SupportedCommands: []*CommandInfo{
+					{Command: CommandSkipForward, PreferredIntervals: []float64{10, 15}},
+				}},
+				PlaybackQueue: &PlaybackQueue{
+					Location: 1,
+					ContentItems: []*ContentItem{{
+						Identifier: "item",
+						Metadata: &ContentItemMetadata{
+							Title:        "Song",
+							Duration:     float64p(123.5),
+							ElapsedTime:  float64p(0),
+							PlaybackRate: float32p(1),
+							MediaType:    MediaTypeAudio,
+						},
+					}},
+				},
+				PlayerPath: &PlayerPath{
+					Client: &NowPlayingClient{BundleIdentifier: "com.apple.TVMusic"},
+					Player: &NowPlayingPlayer{Identifier: "MediaRemote-DefaultPlayer"},
+				},
+			},
+		},
+		{
+			Type: TypeSendCommand,
+			SendCommand: &SendCommandMessage{
+				Command: CommandChangeRepeatMode,
+				Options: &CommandOptions{RepeatMode: RepeatModeAll, SendOptions: &sendOptions},
+			},
+		},
+		{
+			Type: TypeDeviceInfo,
+			DeviceInfo: &DeviceInfoMessage{
+				UniqueIdentifier: "client",
+				Name:             "goatv",
+				DeviceClass:      DeviceClassIPhone,
+				AirplayReceivers: []string{"a", "b"},
+				GroupedDevices:   []*DeviceInfoMessage{{Name: "Kitchen"}},
+			},
+		},
+		{
+			Type: TypeUpdateOutputDevice,
+			UpdateOutputDevice: &UpdateOutputDeviceMessage{
+				OutputDevices: []*AVOutputDeviceDescriptor{{Name: "Living Room", UniqueIdentifier: "uid", Volume: 0.25}},
+			},
+		},
+		{
+			Type: TypeKeyboard,
+			Keyboard: &KeyboardMessage{
+				State: KeyboardStateEditing,
+				Attributes: &TextEditingAttributes{
+					Title:       "Search",
+					InputTraits: &TextInputTraits{PINEntrySeparatorIndexes: []uint64{3, 6}},
+				},
+			},
+		},
+		{Type: TypeGetKeyboardSession, GetKeyboardSession: new(string)},
+		{Type: TypeTextInput, TextInput: &TextInputMessage{Text: "hello", ActionType: ActionTypeSet}},
+	}
+
+	for _, message := range messages {
+		data, err := Marshal(message)
+		if err != nil {
+			t.Fatalf("Marshal() error = %v", err)
+		}
+		decoded := &ProtocolMessage{}
+		if err := Unmarshal(data, decoded); err != nil {
+			t.Fatalf("Unmarshal() error = %v", err)
+		}
+		if !reflect.DeepEqual(decoded, message) {
+			t.Errorf("Expected %+v, got %+v", message, decoded)
+		}
+	}
+}
+
+func TestUnmarshalUnknownFields(t *testing.T) {
+	// SendHIDEvent with a fixed32 field 9 added, followed by an unknown
+	// extension 99 and an unknown fixed64 field
+	unknown := []byte{0x9A, 0x06, 0x01, 0x00, 0x41, 1, 2, 3, 4, 5, 6, 7, 8}
+	data := append([]byte{0x08, 0x08, 0x6A, 0x08, 0x0A, 0x01, 0xAB, 0x4D, 1, 2, 3, 4}, unknown...)
+
+	message := &ProtocolMessage{}
+	if err := Unmarshal(data, message); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if message.Type != TypeSendHIDEvent || !bytes.Equal(message.SendHIDEvent.HIDEventData, []byte{0xAB}) {
+		t.Errorf("Unexpected message %+v", message)
+	}
+	if !bytes.Equal(message.Unknown, unknown) {
+		t.Errorf("Expected unknown fields %x, got %x", unknown, message.Unknown)
+	}
+
+	// Unknown fields are sent on as they were
+	encoded, err := Marshal(message)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if !bytes.HasSuffix(encoded, unknown) {
+		t.Errorf("Expected %x to end with %x", encoded, unknown)
+	}
+}
+
+func TestUnmarshalWrongWireType(t *testing.T) {
+	// type as a string and identifier as a varint are skipped
+	message := &ProtocolMessage{}
+	if err := Unmarshal([]byte{0x0A, 0x01, 'x', 0x10, 0x01, 0x20, 0x03}, message); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if message.Type != TypeUnknown || message.Identifier != "" || message.ErrorCode != ErrorCodeOperationNotPermitted {
+		t.Errorf("Unexpected message %+v", message)
+	}
+	if !bytes.Equal(message.Unknown, []byte{0x0A, 0x01, 'x', 0x10, 0x01}) {
+		t.Errorf("Expected skipped fields in unknown, got %x", message.Unknown)
+	}
+}
+
+func TestUnmarshalPacked(t *testing.T) {
+	message := &TextInputTraits{}
+	if err := Unmarshal([]byte{0x52, 0x02, 0x01, 0x02, 0x50, 0x01}, message); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	expected := []uint64{1, 2, 1}
+	if !reflect.DeepEqual(message.PINEntrySeparatorIndexes, expected) {
+		t.Errorf("Expected %v, got %v", expected, message.PINEntrySeparatorIndexes)
+	}
+}
+
+func TestUnmarshalMerges(t *testing.T) {
+	item := &ContentItem{
+		Identifier: "item",
+		Metadata:   &ContentItemMetadata{Title: "Song", ElapsedTime: float64p(1)},
+	}
+	update, _ := Marshal(&ContentItem{Metadata: &ContentItemMetadata{ElapsedTime: float64p(5), Genre: "Pop"}})
+
+	if err := Unmarshal(update, item); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	metadata := item.Metadata
+	if item.Identifier != "item" || metadata.Title != "Song" || metadata.Genre != "Pop" || *metadata.ElapsedTime != 5 {
+		t.Errorf("Unexpected merge result %+v", metadata)
+	}
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"truncated tag":     {0x80},
+		"truncated varint":  {0x08, 0x80},
+		"truncated string":  {0x12, 0x05, 'a'},
+		"truncated message": {0xD2, 0x02, 0x05, 0x08},
+		"bad embedded":      {0xD2, 0x02, 0x01, 0x80},
+		"truncated unknown": {0x9A, 0x06, 0x05},
+		"invalid field":     {0x00},
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := Unmarshal(data, &ProtocolMessage{}); !errors.Is(err, ErrMalformed) {
+				t.Errorf("Expected ErrMalformed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNewMessage(t *testing.T) {
+	first, second := NewMessage(TypeGeneric), NewMessage(TypeGeneric)
+	if first.Type != TypeGeneric || len(first.UniqueIdentifier) != 36 {
+		t.Errorf("Unexpected message %+v", first)
+	}
+	if first.UniqueIdentifier == second.UniqueIdentifier {
+		t.Error("Expected unique identifiers to differ")
+	}
+}
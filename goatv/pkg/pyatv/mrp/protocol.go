@@ -0,0 +1,192 @@
+package mrp
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// MessageType tells which message a ProtocolMessage carries.
+type MessageType int32
+
+// Values of ProtocolMessage.Type.
+const (
+	TypeUnknown                            MessageType = 0
+	TypeSendCommand                        MessageType = 1
+	TypeSendCommandResult                  MessageType = 2
+	TypeGetState                           MessageType = 3
+	TypeSetState                           MessageType = 4
+	TypeSetArtwork                         MessageType = 5
+	TypeRegisterHIDDevice                  MessageType = 6
+	TypeRegisterHIDDeviceResult            MessageType = 7
+	TypeSendHIDEvent                       MessageType = 8
+	TypeSendHIDReport                      MessageType = 9
+	TypeSendVirtualTouchEvent              MessageType = 10
+	TypeNotification                       MessageType = 11
+	TypeContentItemsChangedNotification    MessageType = 12
+	TypeDeviceInfo                         MessageType = 15
+	TypeClientUpdatesConfig                MessageType = 16
+	TypeVolumeControlAvailability          MessageType = 17
+	TypeKeyboard                           MessageType = 23
+	TypeGetKeyboardSession                 MessageType = 24
+	TypeTextInput                          MessageType = 25
+	TypePlaybackQueueRequest               MessageType = 32
+	TypeTransaction                        MessageType = 33
+	TypeCryptoPairing                      MessageType = 34
+	TypeSetReadyState                      MessageType = 36
+	TypeDeviceInfoUpdate                   MessageType = 37
+	TypeSetConnectionState                 MessageType = 38
+	TypeSendButtonEvent                    MessageType = 39
+	TypeSetHiliteMode                      MessageType = 40
+	TypeWakeDevice                         MessageType = 41
+	TypeGeneric                            MessageType = 42
+	TypeSetNowPlayingClient                MessageType = 46
+	TypeSetNowPlayingPlayer                MessageType = 47
+	TypeModifyOutputContextRequest         MessageType = 48
+	TypeGetVolume                          MessageType = 49
+	TypeGetVolumeResult                    MessageType = 50
+	TypeSetVolume                          MessageType = 51
+	TypeVolumeDidChange                    MessageType = 52
+	TypeRemoveClient                       MessageType = 53
+	TypeRemovePlayer                       MessageType = 54
+	TypeUpdateClient                       MessageType = 55
+	TypeUpdateContentItem                  MessageType = 56
+	TypeUpdateContentItemArtwork           MessageType = 57
+	TypeUpdatePlayer                       MessageType = 58
+	TypeGetVolumeControlCapabilities       MessageType = 62
+	TypeGetVolumeControlCapabilitiesResult MessageType = 63
+	TypeVolumeControlCapabilitiesDidChange MessageType = 64
+	TypeUpdateOutputDevice                 MessageType = 65
+	TypeRemoveOutputDevices                MessageType = 66
+	TypeSetDefaultSupportedCommands        MessageType = 72
+	TypeSetDiscoveryMode                   MessageType = 101
+	TypeUpdateEndPoints                    MessageType = 102
+	TypeRemoveEndpoints                    MessageType = 103
+	TypePlayerClientProperties             MessageType = 104
+	TypeOriginClientProperties             MessageType = 105
+	TypeAudioFade                          MessageType = 106
+	TypeAudioFadeResponse                  MessageType = 107
+	TypeConfigureConnection                MessageType = 120
+)
+
+// LastSupportedMessageType is the newest message type we know of, which is
+// announced in DeviceInfoMessage.
+const LastSupportedMessageType = 108
+
+// ErrorCode is the error a device reports in a ProtocolMessage.
+type ErrorCode int32
+
+// Some values of ProtocolMessage.ErrorCode.
+const (
+	ErrorCodeNoError                        ErrorCode = 0
+	ErrorCodeUnknownError                   ErrorCode = 1
+	ErrorCodeInvalidOperation               ErrorCode = 2
+	ErrorCodeOperationNotPermitted          ErrorCode = 3
+	ErrorCodeClientDoesNotExist             ErrorCode = 4
+	ErrorCodeOriginDoesNotExist             ErrorCode = 5
+	ErrorCodeUnsupportedOperation           ErrorCode = 6
+	ErrorCodeEncryptionFailure              ErrorCode = 23
+	ErrorCodeTheOperationTimedOut           ErrorCode = 26
+	ErrorCodeFailedToConnectToRemoteDevice  ErrorCode = 100
+	ErrorCodeAuthenticationTokenIsInvalid   ErrorCode = 101
+	ErrorCodeTheClientHasDisconnected       ErrorCode = 104
+	ErrorCodeTheServerHasDisconnected       ErrorCode = 105
+	ErrorCodePairingFunctionalityIsLocked   ErrorCode = 107
+	ErrorCodeTheDeviceIsNotPaired           ErrorCode = 110
+	ErrorCodeTheConnectionTimedout          ErrorCode = 113
+	ErrorCodePairingWithThisDeviceIsBlocked ErrorCode = 114
+	ErrorCodeConnectionBlockedByServer      ErrorCode = 116
+	ErrorCodeOtherUnknownError              ErrorCode = 299
+)
+
+// ProtocolMessage is the envelope of every MRP message. Type tells which of
+// the message fields is set. Messages without a field here end up in Unknown
+// and are sent on unchanged when the message is encoded again.
+type ProtocolMessage struct {
+	Type                MessageType `proto:"1"`
+	Identifier          string      `proto:"2"` // Set on requests and copied to their response
+	AuthenticationToken string      `proto:"3"`
+	ErrorCode           ErrorCode   `proto:"4"`
+	Timestamp           uint64      `proto:"5"`
+	ErrorDescription    string      `proto:"78"`
+	UniqueIdentifier    string      `proto:"85"`
+
+	SendCommand                        *SendCommandMessage                        `proto:"6"`
+	SendCommandResult                  *SendCommandResultMessage                  `proto:"7"`
+	SetState                           *SetStateMessage                           `proto:"9"`
+	SetArtwork                         *SetArtworkMessage                         `proto:"10"`
+	SendHIDEvent                       *SendHIDEventMessage                       `proto:"13"`
+	Notification                       *NotificationMessage                       `proto:"16"`
+	DeviceInfo                         *DeviceInfoMessage                         `proto:"20"`
+	ClientUpdatesConfig                *ClientUpdatesConfigMessage                `proto:"21"`
+	VolumeControlAvailability          *VolumeControlAvailabilityMessage          `proto:"22"`
+	Keyboard                           *KeyboardMessage                           `proto:"28"`
+	GetKeyboardSession                 *string                                    `proto:"29"`
+	TextInput                          *TextInputMessage                          `proto:"30"`
+	PlaybackQueueRequest               *PlaybackQueueRequestMessage               `proto:"37"`
+	CryptoPairing                      *CryptoPairingMessage                      `proto:"39"`
+	SetConnectionState                 *SetConnectionStateMessage                 `proto:"42"`
+	SendButtonEvent                    *SendButtonEventMessage                    `proto:"43"`
+	WakeDevice                         *WakeDeviceMessage                         `proto:"45"`
+	Generic                            *GenericMessage                            `proto:"46"`
+	SetNowPlayingClient                *SetNowPlayingClientMessage                `proto:"50"`
+	SetNowPlayingPlayer                *SetNowPlayingPlayerMessage                `proto:"51"`
+	ModifyOutputContextRequest         *ModifyOutputContextRequestMessage         `proto:"52"`
+	GetVolume                          *GetVolumeMessage                          `proto:"53"`
+	GetVolumeResult                    *GetVolumeResultMessage                    `proto:"54"`
+	SetVolume                          *SetVolumeMessage                          `proto:"55"`
+	VolumeDidChange                    *VolumeDidChangeMessage                    `proto:"56"`
+	RemoveClient                       *RemoveClientMessage                       `proto:"57"`
+	RemovePlayer                       *RemovePlayerMessage                       `proto:"58"`
+	UpdateClient                       *UpdateClientMessage                       `proto:"59"`
+	UpdateContentItem                  *UpdateContentItemMessage                  `proto:"60"`
+	VolumeControlCapabilitiesDidChange *VolumeControlCapabilitiesDidChangeMessage `proto:"68"`
+	UpdateOutputDevice                 *UpdateOutputDeviceMessage                 `proto:"69"`
+	RemoveOutputDevices                *RemoveOutputDevicesMessage                `proto:"70"`
+	SetDefaultSupportedCommands        *SetStateMessage                           `proto:"75"` // Has the fields of SetStateMessage
+	PlayerClientProperties             *PlayerClientPropertiesMessage             `proto:"86"`
+	OriginClientProperties             *OriginClientPropertiesMessage             `proto:"87"`
+	AudioFade                          *AudioFadeMessage                          `proto:"88"`
+	AudioFadeResponse                  *AudioFadeResponseMessage                  `proto:"89"`
+	ConfigureConnection                *ConfigureConnectionMessage                `proto:"94"`
+
+	Unknown []byte `proto:"unknown"`
+}
+
+// NewMessage creates a ProtocolMessage of a type with a new unique
+// identifier. The message itself must be set by the caller.
+func NewMessage(messageType MessageType) *ProtocolMessage {
+	return &ProtocolMessage{Type: messageType, UniqueIdentifier: NewIdentifier()}
+}
+
+// String returns the type of the message and its identifier, for logging.
+func (m *ProtocolMessage) String() string {
+	if m.Identifier == "" {
+		return fmt.Sprintf("ProtocolMessage{Type: %d}", m.Type)
+	}
+	return fmt.Sprintf("ProtocolMessage{Type: %d, Identifier: %s}", m.Type, m.Identifier)
+}
+
+// Err returns an error for the ErrorCode of a message, or nil if there is
+// none.
+func (m *ProtocolMessage) Err() error {
+	if m.ErrorCode == ErrorCodeNoError {
+		return nil
+	}
+	if m.ErrorDescription != "" {
+		return fmt.Errorf("error %d: %s", m.ErrorCode, m.ErrorDescription)
+	}
+	return fmt.Errorf("error %d", m.ErrorCode)
+}
+
+// NewIdentifier returns a random upper case UUID, which is what devices use
+// as message identifiers.
+func NewIdentifier() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	id[6] = id[6]&0x0F | 0x40 // Version 4
+	id[8] = id[8]&0x3F | 0x80 // Variant 10
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16]))
+}
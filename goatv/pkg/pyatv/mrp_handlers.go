@@ -0,0 +1,652 @@
+package pyatv
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/mrp"
+)
+
+// mrpOutputDevicesTimeout is how long changes to output devices wait for the
+// device to confirm them. Not all devices do.
+const mrpOutputDevicesTimeout = 5 * time.Second
+
+// connectMRP starts MRP on a session that passed pair-verify and switches the
+// handlers that MRP implements over to it.
+func (a *AppleTVConnection) connectMRP(ctx context.Context, session *hapSession) error {
+	transport, ok := session.transport.(*mrpPairingTransport)
+	if !ok || session.secret == nil {
+		return fmt.Errorf("%w: MRP session without encryption keys", ErrInvalidState)
+	}
+	output, input := session.secret.keys(mrpSessionKeys)
+	conn, err := newSessionConn(transport.stream(), ProtocolMRP, output, input)
+	if err != nil {
+		return err
+	}
+
+	// Handlers must listen before the first message arrives
+	protocol := newMRPProtocol(transport.deviceInfo)
+	states := newMRPPlayerStates(protocol)
+	metadata := &mrpMetadata{atv: a, protocol: protocol, states: states}
+	push := &mrpPushUpdater{protocol: protocol, states: states}
+	states.updated = push.update
+	power := newMRPPower(protocol)
+	audio := newMRPAudio(protocol)
+	keyboard := newMRPKeyboard(protocol)
+
+	if err := protocol.start(ctx, conn); err != nil {
+		return err
+	}
+	go protocol.watch(a.connectionLost)
+
+	a.mrp = protocol
+	a.remote = &mrpRemoteControl{defaultRemoteControl: defaultRemoteControl{atv: a}, protocol: protocol, states: states}
+	a.metadata = metadata
+	a.push = push
+	a.power = power
+	a.audio = audio
+	a.keyboard = keyboard
+	return nil
+}
+
+// connectionLost tells the device listener that a protocol connection broke.
+func (a *AppleTVConnection) connectionLost(err error) {
+	a.mu.RLock()
+	listener := a.deviceListener
+	a.mu.RUnlock()
+
+	if listener != nil {
+		listener.ConnectionLost(err)
+	}
+}
+
+// mrpMetadata tells what plays from the state the device sends over MRP.
+type mrpMetadata struct {
+	atv      *AppleTVConnection
+	protocol *mrpProtocol
+	states   *mrpPlayerStates
+}
+
+func (m *mrpMetadata) DeviceID() string {
+	return m.atv.config.Identifier
+}
+
+// Artwork asks the device for the artwork of the item that plays. The size is
+// a wish the device may ignore. Artwork is scaled to keep its aspect ratio if
+// width or height is nil.
+func (m *mrpMetadata) Artwork(ctx context.Context, width, height *int) (*ArtworkInfo, error) {
+	m.states.mu.Lock()
+	player := m.states.playing()
+	location, identifier := player.location, ""
+	var mimeType string
+	if item := player.item(); item != nil {
+		identifier = item.Identifier
+		if item.Metadata != nil {
+			mimeType = item.Metadata.ArtworkMIMEType
+		}
+	}
+	m.states.mu.Unlock()
+
+	if m.ArtworkID() == "" {
+		return nil, nil
+	}
+
+	request := &mrp.PlaybackQueueRequestMessage{
+		Location:                                int32(location),
+		Length:                                  1,
+		ArtworkHeight:                           -1,
+		ReturnContentItemAssetsInUserCompletion: true,
+	}
+	if width != nil {
+		request.ArtworkWidth = float64(*width)
+	}
+	if height != nil {
+		request.ArtworkHeight = float64(*height)
+	}
+	message := mrp.NewMessage(mrp.TypePlaybackQueueRequest)
+	message.PlaybackQueueRequest = request
+
+	resp, err := m.protocol.request(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	if resp.SetState == nil || resp.SetState.PlaybackQueue == nil {
+		return nil, nil
+	}
+	for _, item := range resp.SetState.PlaybackQueue.ContentItems {
+		if len(item.ArtworkData) == 0 || (identifier != "" && item.Identifier != identifier) {
+			continue
+		}
+		return &ArtworkInfo{
+			Bytes:    item.ArtworkData,
+			MimeType: mimeType,
+			Width:    int(item.ArtworkDataWidth),
+			Height:   int(item.ArtworkDataHeight),
+		}, nil
+	}
+	return nil, nil
+}
+
+func (m *mrpMetadata) ArtworkID() string {
+	m.states.mu.Lock()
+	defer m.states.mu.Unlock()
+
+	player := m.states.playing()
+	metadata := player.metadata()
+	if metadata == nil || (!metadata.ArtworkAvailable && metadata.ArtworkURL == "") {
+		return ""
+	}
+	switch {
+	case metadata.ArtworkIdentifier != "":
+		return metadata.ArtworkIdentifier
+	case metadata.ContentIdentifier != "":
+		return metadata.ContentIdentifier
+	default:
+		return player.item().Identifier
+	}
+}
+
+func (m *mrpMetadata) Playing(ctx context.Context) (*Playing, error) {
+	return m.playing(), nil
+}
+
+func (m *mrpMetadata) playing() *Playing {
+	m.states.mu.Lock()
+	defer m.states.mu.Unlock()
+	return mrpPlaying(m.states.playing(), time.Now())
+}
+
+func (m *mrpMetadata) App() *App {
+	return m.states.app()
+}
+
+// mrpPushUpdater passes on what plays whenever the device tells it changed.
+type mrpPushUpdater struct {
+	protocol *mrpProtocol
+	states   *mrpPlayerStates
+
+	mu       sync.Mutex
+	active   bool
+	listener PushListener
+	last     *Playing // Last update passed on
+}
+
+func (p *mrpPushUpdater) Active() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active
+}
+
+// Start passes on what plays now and every change after that. initialDelay
+// is not needed by MRP.
+func (p *mrpPushUpdater) Start(initialDelay int) {
+	p.mu.Lock()
+	if p.active {
+		p.mu.Unlock()
+		return
+	}
+	p.active = true
+	p.last = nil
+	p.mu.Unlock()
+
+	p.update()
+}
+
+func (p *mrpPushUpdater) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active = false
+}
+
+func (p *mrpPushUpdater) SetListener(listener PushListener) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.listener = listener
+}
+
+// update passes on what plays, unless it is the same as last time.
+func (p *mrpPushUpdater) update() {
+	p.states.mu.Lock()
+	playing := mrpPlaying(p.states.playing(), time.Now())
+	p.states.mu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.active || p.listener == nil || reflect.DeepEqual(playing, p.last) {
+		return
+	}
+	p.last = playing
+
+	listener := p.listener
+	p.protocol.notify(func() { listener.PlaystatusUpdate(p, playing) })
+}
+
+// mrpPower tells if a device is on from the number of logical devices in its
+// DeviceInfoMessage, which drops to zero when it sleeps.
+type mrpPower struct {
+	protocol *mrpProtocol
+
+	mu         sync.Mutex
+	deviceInfo *mrp.DeviceInfoMessage
+	listener   PowerListener
+	changed    chan struct{} // Closed when the power state changes
+}
+
+func newMRPPower(protocol *mrpProtocol) *mrpPower {
+	p := &mrpPower{protocol: protocol, deviceInfo: protocol.deviceInfo, changed: make(chan struct{})}
+	protocol.listen(p.handleDeviceInfo, mrp.TypeDeviceInfo, mrp.TypeDeviceInfoUpdate)
+	return p
+}
+
+func (p *mrpPower) handleDeviceInfo(message *mrp.ProtocolMessage) {
+	if message.DeviceInfo == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	oldState := mrpPowerState(p.deviceInfo)
+	p.deviceInfo = message.DeviceInfo
+	newState := mrpPowerState(p.deviceInfo)
+	if newState == oldState {
+		return
+	}
+
+	close(p.changed)
+	p.changed = make(chan struct{})
+	if listener := p.listener; listener != nil {
+		p.protocol.notify(func() { listener.PowerstateUpdate(oldState, newState) })
+	}
+}
+
+func mrpPowerState(info *mrp.DeviceInfoMessage) PowerState {
+	switch {
+	case info == nil:
+		return PowerStateUnknown
+	case info.LogicalDeviceCount >= 1:
+		return PowerStateOn
+	default:
+		return PowerStateOff
+	}
+}
+
+func (p *mrpPower) PowerState() PowerState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return mrpPowerState(p.deviceInfo)
+}
+
+func (p *mrpPower) TurnOn(ctx context.Context, awaitNewState bool) error {
+	return p.turn(ctx, PowerStateOn, awaitNewState, func() error {
+		return p.protocol.send(mrp.NewMessage(mrp.TypeWakeDevice))
+	})
+}
+
+// TurnOff opens the sleep menu by holding home and selects sleep.
+func (p *mrpPower) TurnOff(ctx context.Context, awaitNewState bool) error {
+	return p.turn(ctx, PowerStateOff, awaitNewState, func() error {
+		if err := p.protocol.press(ctx, mrpKeyHome, InputActionHold, true); err != nil {
+			return err
+		}
+		if err := sleep(ctx, mrpCommandDelay); err != nil {
+			return err
+		}
+		return p.protocol.press(ctx, mrpKeySelect, InputActionSingleTap, true)
+	})
+}
+
+// turn runs change and optionally waits until the device reports state.
+func (p *mrpPower) turn(ctx context.Context, state PowerState, awaitNewState bool, change func() error) error {
+	if err := change(); err != nil {
+		return err
+	}
+	for awaitNewState {
+		p.mu.Lock()
+		current, changed := mrpPowerState(p.deviceInfo), p.changed
+		p.mu.Unlock()
+		if current == state {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-p.protocol.conn.Done():
+			return fmt.Errorf("%w: %v", ErrConnectionLost, p.protocol.conn.Err())
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ErrOperationTimeout, ctx.Err())
+		}
+	}
+	return nil
+}
+
+func (p *mrpPower) SetListener(listener PowerListener) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.listener = listener
+}
+
+// mrpAudio controls the volume and output devices of a device over MRP.
+// Volume is from 0 to 100, like everywhere else.
+type mrpAudio struct {
+	protocol *mrpProtocol
+
+	mu             sync.Mutex
+	deviceUID      string // Output device of the device itself
+	available      bool
+	capabilities   mrp.VolumeCapabilities
+	volume         float64
+	volumeChanged  chan struct{} // Closed when the volume changes
+	outputDevices  []OutputDevice
+	devicesChanged chan struct{} // Closed when output devices change
+	listener       AudioListener
+}
+
+func newMRPAudio(protocol *mrpProtocol) *mrpAudio {
+	a := &mrpAudio{
+		protocol:       protocol,
+		volumeChanged:  make(chan struct{}),
+		devicesChanged: make(chan struct{}),
+	}
+	a.deviceUID, a.outputDevices = mrpOutputDevices(protocol.deviceInfo)
+	protocol.listen(a.handle,
+		mrp.TypeVolumeControlAvailability,
+		mrp.TypeVolumeControlCapabilitiesDidChange,
+		mrp.TypeVolumeDidChange,
+		mrp.TypeDeviceInfo,
+		mrp.TypeDeviceInfoUpdate,
+	)
+	return a
+}
+
+// mrpOutputDevices returns the UID of the output device of a device and the
+// devices it plays on.
+func mrpOutputDevices(info *mrp.DeviceInfoMessage) (string, []OutputDevice) {
+	if info == nil {
+		return "", nil
+	}
+	uid := info.ClusterID
+	if uid == "" {
+		uid = info.DeviceUID
+	}
+
+	var devices []OutputDevice
+	if info.IsGroupLeader && !info.IsProxyGroupPlayer {
+		devices = append(devices, OutputDevice{Name: info.Name, Identifier: info.UniqueIdentifier})
+	}
+	for _, device := range info.GroupedDevices {
+		devices = append(devices, OutputDevice{Name: device.Name, Identifier: device.DeviceUID})
+	}
+	return uid, devices
+}
+
+func (a *mrpAudio) handle(message *mrp.ProtocolMessage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch {
+	case message.VolumeControlAvailability != nil:
+		a.updateCapabilities(message.VolumeControlAvailability)
+	case message.VolumeControlCapabilitiesDidChange != nil:
+		changed := message.VolumeControlCapabilitiesDidChange
+		if changed.OutputDeviceUID == a.deviceUID && changed.Capabilities != nil {
+			a.updateCapabilities(changed.Capabilities)
+		}
+	case message.VolumeDidChange != nil:
+		changed := message.VolumeDidChange
+		if changed.OutputDeviceUID != a.deviceUID {
+			return
+		}
+		oldLevel, newLevel := a.volume, math.Round(float64(changed.Volume)*1000)/10
+		a.volume = newLevel
+		close(a.volumeChanged)
+		a.volumeChanged = make(chan struct{})
+		if listener := a.listener; listener != nil && newLevel != oldLevel {
+			a.protocol.notify(func() { listener.VolumeUpdate(oldLevel, newLevel) })
+		}
+	case message.DeviceInfo != nil:
+		oldDevices := a.outputDevices
+		a.deviceUID, a.outputDevices = mrpOutputDevices(message.DeviceInfo)
+		newDevices := a.outputDevices
+		close(a.devicesChanged)
+		a.devicesChanged = make(chan struct{})
+		if listener := a.listener; listener != nil && !reflect.DeepEqual(oldDevices, newDevices) {
+			a.protocol.notify(func() { listener.OutputDevicesUpdate(oldDevices, newDevices) })
+		}
+	}
+}
+
+func (a *mrpAudio) updateCapabilities(availability *mrp.VolumeControlAvailabilityMessage) {
+	a.available = availability.VolumeControlAvailable
+	a.capabilities = availability.VolumeCapabilities
+}
+
+// absolute returns true if the volume can be set to a level. The caller must
+// hold a.mu.
+func (a *mrpAudio) absolute() bool {
+	return a.available && (a.capabilities == mrp.VolumeCapabilitiesAbsolute || a.capabilities == mrp.VolumeCapabilitiesBoth)
+}
+
+func (a *mrpAudio) Volume() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.volume
+}
+
+// SetVolume changes the volume and waits until the device reports it.
+func (a *mrpAudio) SetVolume(ctx context.Context, level float64) error {
+	if level < 0 || level > 100 {
+		return fmt.Errorf("%w: volume %v is not between 0 and 100", ErrProtocol, level)
+	}
+
+	a.mu.Lock()
+	uid, volume, changed, absolute := a.deviceUID, a.volume, a.volumeChanged, a.absolute()
+	a.mu.Unlock()
+	if uid == "" {
+		return fmt.Errorf("%w: no output device", ErrProtocol)
+	}
+
+	message := mrp.NewMessage(mrp.TypeSetVolume)
+	target := float32(level / 100)
+	message.SetVolume = &mrp.SetVolumeMessage{Volume: &target, OutputDeviceUID: uid}
+	if err := a.protocol.send(message); err != nil {
+		return err
+	}
+	if !absolute || volume == level {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mrpResponseTimeout)
+	defer cancel()
+	select {
+	case <-changed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: volume did not change", ErrOperationTimeout)
+	}
+}
+
+// VolumeUp increases the volume by one step.
+func (a *mrpAudio) VolumeUp(ctx context.Context) error {
+	return a.step(ctx, mrpKeyVolumeUp, 5)
+}
+
+// VolumeDown decreases the volume by one step.
+func (a *mrpAudio) VolumeDown(ctx context.Context) error {
+	return a.step(ctx, mrpKeyVolumeDown, -5)
+}
+
+// step presses a volume key if the device supports it, so that it decides
+// how large a step is. Otherwise the volume is set delta away.
+func (a *mrpAudio) step(ctx context.Context, key mrpKey, delta float64) error {
+	a.mu.Lock()
+	volume, changed, absolute := a.volume, a.volumeChanged, a.absolute()
+	relative := a.available && (a.capabilities == mrp.VolumeCapabilitiesRelative || a.capabilities == mrp.VolumeCapabilitiesBoth)
+	a.mu.Unlock()
+
+	level := math.Max(0, math.Min(100, volume+delta))
+	if absolute && level == volume {
+		return nil
+	}
+	if !relative {
+		if !absolute {
+			return fmt.Errorf("%w: volume cannot be changed", ErrNotSupported)
+		}
+		return a.SetVolume(ctx, level)
+	}
+
+	if err := a.protocol.press(ctx, key, InputActionSingleTap, false); err != nil {
+		return err
+	}
+	if !absolute {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mrpResponseTimeout)
+	defer cancel()
+	select {
+	case <-changed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: volume did not change", ErrOperationTimeout)
+	}
+}
+
+func (a *mrpAudio) OutputDevices() []OutputDevice {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]OutputDevice(nil), a.outputDevices...)
+}
+
+func (a *mrpAudio) AddOutputDevices(ctx context.Context, devices ...string) error {
+	return a.modifyOutputDevices(ctx, &mrp.ModifyOutputContextRequestMessage{
+		AddingDevices:             devices,
+		ClusterAwareAddingDevices: devices,
+	})
+}
+
+func (a *mrpAudio) RemoveOutputDevices(ctx context.Context, devices ...string) error {
+	return a.modifyOutputDevices(ctx, &mrp.ModifyOutputContextRequestMessage{
+		RemovingDevices:             devices,
+		ClusterAwareRemovingDevices: devices,
+	})
+}
+
+func (a *mrpAudio) SetOutputDevices(ctx context.Context, devices ...string) error {
+	return a.modifyOutputDevices(ctx, &mrp.ModifyOutputContextRequestMessage{
+		SettingDevices:             devices,
+		ClusterAwareSettingDevices: devices,
+	})
+}
+
+// modifyOutputDevices sends a change of output devices and waits a while for
+// the device to report the new ones.
+func (a *mrpAudio) modifyOutputDevices(ctx context.Context, request *mrp.ModifyOutputContextRequestMessage) error {
+	a.mu.Lock()
+	changed := a.devicesChanged
+	a.mu.Unlock()
+
+	request.Type = mrp.SharedAudioPresentation
+	message := mrp.NewMessage(mrp.TypeModifyOutputContextRequest)
+	message.ModifyOutputContextRequest = request
+	if err := a.protocol.send(message); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(mrpOutputDevicesTimeout)
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrOperationTimeout, ctx.Err())
+	}
+	return nil
+}
+
+func (a *mrpAudio) SetListener(listener AudioListener) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.listener = listener
+}
+
+// mrpKeyboard types on the virtual keyboard of a device over MRP.
+type mrpKeyboard struct {
+	protocol *mrpProtocol
+
+	mu       sync.Mutex
+	state    KeyboardFocusState
+	listener KeyboardListener
+}
+
+func newMRPKeyboard(protocol *mrpProtocol) *mrpKeyboard {
+	k := &mrpKeyboard{protocol: protocol}
+	protocol.listen(k.handle, mrp.TypeKeyboard)
+	return k
+}
+
+func (k *mrpKeyboard) handle(message *mrp.ProtocolMessage) {
+	if message.Keyboard == nil {
+		return
+	}
+
+	var newState KeyboardFocusState
+	switch message.Keyboard.State {
+	case mrp.KeyboardStateDidBeginEditing, mrp.KeyboardStateEditing, mrp.KeyboardStateTextDidChange:
+		newState = KeyboardFocusStateFocused
+	case mrp.KeyboardStateNotEditing, mrp.KeyboardStateDidEndEditing:
+		newState = KeyboardFocusStateUnfocused
+	default:
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	oldState := k.state
+	k.state = newState
+	if listener := k.listener; listener != nil && newState != oldState {
+		k.protocol.notify(func() { listener.FocusstateUpdate(oldState, newState) })
+	}
+}
+
+func (k *mrpKeyboard) TextFocusState() KeyboardFocusState {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.state
+}
+
+// TextGet is not supported, devices only send the text encrypted.
+func (k *mrpKeyboard) TextGet(ctx context.Context) (string, error) {
+	return "", fmt.Errorf("%w: MRP keyboard text is encrypted", ErrNotSupported)
+}
+
+func (k *mrpKeyboard) TextClear(ctx context.Context) error {
+	return k.input(mrp.ActionTypeClear, "")
+}
+
+func (k *mrpKeyboard) TextAppend(ctx context.Context, text string) error {
+	return k.input(mrp.ActionTypeInsert, text)
+}
+
+func (k *mrpKeyboard) TextSet(ctx context.Context, text string) error {
+	return k.input(mrp.ActionTypeSet, text)
+}
+
+func (k *mrpKeyboard) input(action mrp.ActionType, text string) error {
+	message := mrp.NewMessage(mrp.TypeTextInput)
+	message.TextInput = &mrp.TextInputMessage{
+		Timestamp:  cocoaTime(time.Now()),
+		Text:       text,
+		ActionType: action,
+	}
+	return k.protocol.send(message)
+}
+
+func (k *mrpKeyboard) SetListener(listener KeyboardListener) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.listener = listener
+}
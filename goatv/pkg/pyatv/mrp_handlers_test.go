@@ -0,0 +1,384 @@
+package pyatv
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/mrp"
+)
+
+// fakeMRPDevice is an MRP device behind a HAPServer. It records every message
+// it gets after pair-verify and sends back what reply returns.
+type fakeMRPDevice struct {
+	received chan *mrp.ProtocolMessage
+	reply    func(*mrp.ProtocolMessage) []*mrp.ProtocolMessage
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// mrpAnswer answers requests with an empty message of the same type.
+func mrpAnswer(message *mrp.ProtocolMessage) []*mrp.ProtocolMessage {
+	if message.Identifier == "" {
+		return nil
+	}
+	resp := mrp.NewMessage(message.Type)
+	resp.Identifier = message.Identifier
+	return []*mrp.ProtocolMessage{resp}
+}
+
+func (d *fakeMRPDevice) serve(conn net.Conn) {
+	d.mu.Lock()
+	d.conn = conn
+	d.mu.Unlock()
+
+	reader := bufio.NewReader(conn)
+	for {
+		message, err := readMRPMessage(reader)
+		if err != nil {
+			return
+		}
+		d.received <- message
+		for _, resp := range d.reply(message) {
+			if d.push(resp) != nil {
+				return
+			}
+		}
+	}
+}
+
+// push sends a message to the client.
+func (d *fakeMRPDevice) push(message *mrp.ProtocolMessage) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return writeMRPMessage(d.conn, message)
+}
+
+// expect returns the next message of a type the device got.
+func (d *fakeMRPDevice) expect(t *testing.T, messageType mrp.MessageType) *mrp.ProtocolMessage {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case message := <-d.received:
+			if message.Type == messageType {
+				return message
+			}
+		case <-timeout:
+			t.Fatalf("Expected message of type %d", messageType)
+			return nil
+		}
+	}
+}
+
+// connectFakeMRPDevice pairs with a fake device and connects to it. reply may
+// be nil to answer requests with mrpAnswer.
+func connectFakeMRPDevice(t *testing.T, reply func(*mrp.ProtocolMessage) []*mrp.ProtocolMessage) (*fakeMRPDevice, *AppleTVConnection) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if reply == nil {
+		reply = mrpAnswer
+	}
+	device := &fakeMRPDevice{received: make(chan *mrp.ProtocolMessage, 100), reply: reply}
+	config := startHAPServer(t, ProtocolMRP, newTestHAPServer(t), device.serve)
+	if err := pairTestAccessory(ctx, config, ProtocolMRP, "1234", PairOptions{}); err != nil {
+		t.Fatalf("Pairing failed: %v", err)
+	}
+
+	atv := NewAppleTVConnection(config, ConnectOptions{})
+	if err := atv.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	t.Cleanup(func() { atv.Close() })
+	return device, atv
+}
+
+// testListener records what listeners are told.
+type testListener struct {
+	events chan any
+}
+
+func newTestListener() *testListener {
+	return &testListener{events: make(chan any, 100)}
+}
+
+func (l *testListener) PlaystatusUpdate(updater PushUpdater, playstatus *Playing) {
+	l.events <- playstatus
+}
+
+func (l *testListener) PlaystatusError(updater PushUpdater, err error) {
+	l.events <- err
+}
+
+func (l *testListener) PowerstateUpdate(oldState, newState PowerState) {
+	l.events <- [2]PowerState{oldState, newState}
+}
+
+func (l *testListener) VolumeUpdate(oldLevel, newLevel float64) {
+	l.events <- [2]float64{oldLevel, newLevel}
+}
+
+func (l *testListener) OutputDevicesUpdate(oldDevices, newDevices []OutputDevice) {
+	l.events <- newDevices
+}
+
+func (l *testListener) FocusstateUpdate(oldState, newState KeyboardFocusState) {
+	l.events <- [2]KeyboardFocusState{oldState, newState}
+}
+
+func (l *testListener) ConnectionLost(err error) {
+	l.events <- err
+}
+
+func (l *testListener) ConnectionClosed() {
+	l.events <- "closed"
+}
+
+func (l *testListener) next(t *testing.T) any {
+	t.Helper()
+	select {
+	case event := <-l.events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected listener to be called")
+		return nil
+	}
+}
+
+func TestConnectMRP(t *testing.T) {
+	device, atv := connectFakeMRPDevice(t, nil)
+
+	// SetConnectionState must come first once the connection is encrypted
+	first := <-device.received
+	if first.Type != mrp.TypeSetConnectionState || first.SetConnectionState.State != mrp.ConnectionStateConnected {
+		t.Errorf("Expected SetConnectionState first, got %+v", first)
+	}
+	config := device.expect(t, mrp.TypeClientUpdatesConfig).ClientUpdatesConfig
+	expected := mrp.ClientUpdatesConfigMessage{ArtworkUpdates: true, VolumeUpdates: true, KeyboardUpdates: true, OutputDeviceUpdates: true}
+	if config == nil || *config != expected {
+		t.Errorf("Expected %+v, got %+v", expected, config)
+	}
+	device.expect(t, mrp.TypeGetKeyboardSession)
+
+	if _, ok := atv.RemoteControl().(*mrpRemoteControl); !ok {
+		t.Errorf("Expected MRP remote control, got %T", atv.RemoteControl())
+	}
+	if _, ok := atv.Metadata().(*mrpMetadata); !ok {
+		t.Errorf("Expected MRP metadata, got %T", atv.Metadata())
+	}
+	if _, ok := atv.PushUpdater().(*mrpPushUpdater); !ok {
+		t.Errorf("Expected MRP push updater, got %T", atv.PushUpdater())
+	}
+	if _, ok := atv.Audio().(*mrpAudio); !ok {
+		t.Errorf("Expected MRP audio, got %T", atv.Audio())
+	}
+	if _, ok := atv.Keyboard().(*mrpKeyboard); !ok {
+		t.Errorf("Expected MRP keyboard, got %T", atv.Keyboard())
+	}
+	if state := atv.Power().PowerState(); state != PowerStateOn {
+		t.Errorf("Expected device to be on, got %s", state)
+	}
+}
+
+func TestConnectMRPRejected(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The device rejects our subscription to updates
+	device := &fakeMRPDevice{received: make(chan *mrp.ProtocolMessage, 100)}
+	device.reply = func(message *mrp.ProtocolMessage) []*mrp.ProtocolMessage {
+		resp := mrpAnswer(message)
+		for _, r := range resp {
+			r.ErrorCode = mrp.ErrorCodeOperationNotPermitted
+		}
+		return resp
+	}
+	config := startHAPServer(t, ProtocolMRP, newTestHAPServer(t), device.serve)
+	if err := pairTestAccessory(ctx, config, ProtocolMRP, "1234", PairOptions{}); err != nil {
+		t.Fatalf("Pairing failed: %v", err)
+	}
+
+	atv := NewAppleTVConnection(config, ConnectOptions{})
+	if err := atv.Connect(ctx); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Expected ErrProtocol, got %v", err)
+	}
+	if _, ok := atv.RemoteControl().(*defaultRemoteControl); !ok {
+		t.Errorf("Expected handlers to stay unchanged, got %T", atv.RemoteControl())
+	}
+}
+
+func TestMRPMetadata(t *testing.T) {
+	device, atv := connectFakeMRPDevice(t, nil)
+	listener := newTestListener()
+	atv.PushUpdater().SetListener(listener)
+	atv.PushUpdater().Start(0)
+	if playing := listener.next(t).(*Playing); playing.DeviceState != DeviceStateIdle {
+		t.Errorf("Expected nothing to play at first, got %+v", playing)
+	}
+
+	client := &mrp.NowPlayingClient{BundleIdentifier: "com.apple.TVMusic", DisplayName: "Music"}
+	path := &mrp.PlayerPath{Client: client, Player: &mrp.NowPlayingPlayer{Identifier: mrpDefaultPlayer}}
+	playbackState := mrp.PlaybackStatePlaying
+	duration, rate := 240.5, float32(1)
+	messages := []*mrp.ProtocolMessage{
+		{Type: mrp.TypeSetNowPlayingClient, SetNowPlayingClient: &mrp.SetNowPlayingClientMessage{Client: client}},
+		{Type: mrp.TypeSetState, SetState: &mrp.SetStateMessage{
+			PlayerPath:    path,
+			PlaybackState: &playbackState,
+			SupportedCommands: &mrp.SupportedCommands{SupportedCommands: []*mrp.CommandInfo{
+				{Command: mrp.CommandChangeShuffleMode, ShuffleMode: mrp.ShuffleModeAlbums},
+				{Command: mrp.CommandChangeRepeatMode, RepeatMode: mrp.RepeatModeAll},
+			}},
+			PlaybackQueue: &mrp.PlaybackQueue{ContentItems: []*mrp.ContentItem{{
+				Identifier: "item",
+				Metadata: &mrp.ContentItemMetadata{
+					Title:           "Song",
+					TrackArtistName: "Artist",
+					AlbumName:       "Album",
+					Duration:        &duration,
+					PlaybackRate:    &rate,
+					MediaType:       mrp.MediaTypeAudio,
+				},
+			}}},
+		}},
+		{Type: mrp.TypeUpdateContentItem, UpdateContentItem: &mrp.UpdateContentItemMessage{
+			PlayerPath:   path,
+			ContentItems: []*mrp.ContentItem{{Identifier: "item", Metadata: &mrp.ContentItemMetadata{Genre: "Pop"}}},
+		}},
+	}
+	for _, message := range messages {
+		if err := device.push(message); err != nil {
+			t.Fatalf("push() error = %v", err)
+		}
+	}
+
+	var playing *Playing
+	for playing == nil || playing.Genre == "" {
+		playing = listener.next(t).(*Playing)
+	}
+	if playing.Title != "Song" || playing.Artist != "Artist" || playing.Album != "Album" || playing.Hash != "item" {
+		t.Errorf("Unexpected metadata %+v", playing)
+	}
+	if playing.DeviceState != DeviceStatePlaying || playing.MediaType != MediaTypeMusic {
+		t.Errorf("Expected music to play, got %s %s", playing.MediaType, playing.DeviceState)
+	}
+	if playing.TotalTime == nil || *playing.TotalTime != 240 {
+		t.Errorf("Expected total time 240, got %v", playing.TotalTime)
+	}
+	if *playing.Shuffle != ShuffleStateAlbums || *playing.Repeat != RepeatStateAll {
+		t.Errorf("Expected shuffle albums and repeat all, got %s %s", *playing.Shuffle, *playing.Repeat)
+	}
+
+	current, err := atv.Metadata().Playing(context.Background())
+	if err != nil || current.Title != "Song" {
+		t.Errorf("Expected Playing() to return the same, got %+v: %v", current, err)
+	}
+	if app := atv.Metadata().App(); app == nil || *app != (App{Name: "Music", Identifier: "com.apple.TVMusic"}) {
+		t.Errorf("Unexpected app %+v", app)
+	}
+}
+
+func TestMRPPowerAudioKeyboard(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var device *fakeMRPDevice
+	device, atv := connectFakeMRPDevice(t, func(message *mrp.ProtocolMessage) []*mrp.ProtocolMessage {
+		if message.SetVolume == nil {
+			return mrpAnswer(message)
+		}
+		// The device confirms volume changes
+		return []*mrp.ProtocolMessage{{Type: mrp.TypeVolumeDidChange, VolumeDidChange: &mrp.VolumeDidChangeMessage{
+			Volume:          *message.SetVolume.Volume,
+			OutputDeviceUID: message.SetVolume.OutputDeviceUID,
+		}}}
+	})
+	listener := newTestListener()
+	atv.Power().SetListener(listener)
+	atv.Audio().SetListener(listener)
+	atv.Keyboard().SetListener(listener)
+
+	// The device goes to sleep and tells its output device
+	device.push(&mrp.ProtocolMessage{Type: mrp.TypeDeviceInfoUpdate, DeviceInfo: &mrp.DeviceInfoMessage{
+		Name:             "Living Room",
+		UniqueIdentifier: "device",
+		DeviceUID:        "uid",
+		IsGroupLeader:    true,
+	}})
+	if event := listener.next(t); event != [2]PowerState{PowerStateOn, PowerStateOff} {
+		t.Errorf("Expected power state update, got %v", event)
+	}
+	if event := listener.next(t).([]OutputDevice); len(event) != 1 || event[0].Identifier != "device" {
+		t.Errorf("Expected output devices update, got %v", event)
+	}
+
+	if err := atv.Power().TurnOn(ctx, false); err != nil {
+		t.Fatalf("TurnOn() error = %v", err)
+	}
+	device.expect(t, mrp.TypeWakeDevice)
+
+	device.push(&mrp.ProtocolMessage{
+		Type:                      mrp.TypeVolumeControlAvailability,
+		VolumeControlAvailability: &mrp.VolumeControlAvailabilityMessage{VolumeControlAvailable: true, VolumeCapabilities: mrp.VolumeCapabilitiesAbsolute},
+	})
+	device.push(&mrp.ProtocolMessage{Type: mrp.TypeVolumeDidChange, VolumeDidChange: &mrp.VolumeDidChangeMessage{Volume: 0.25, OutputDeviceUID: "uid"}})
+	if event := listener.next(t); event != [2]float64{0, 25} {
+		t.Errorf("Expected volume update, got %v", event)
+	}
+
+	if err := atv.Audio().VolumeUp(ctx); err != nil {
+		t.Fatalf("VolumeUp() error = %v", err)
+	}
+	if volume := device.expect(t, mrp.TypeSetVolume).SetVolume; *volume.Volume != 0.3 || volume.OutputDeviceUID != "uid" {
+		t.Errorf("Unexpected SetVolume %+v", volume)
+	}
+	if event := listener.next(t); event != [2]float64{25, 30} {
+		t.Errorf("Expected volume update, got %v", event)
+	}
+	if volume := atv.Audio().Volume(); volume != 30 {
+		t.Errorf("Expected volume 30, got %v", volume)
+	}
+	if err := atv.Audio().SetVolume(ctx, 101); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Expected ErrProtocol, got %v", err)
+	}
+
+	device.push(&mrp.ProtocolMessage{Type: mrp.TypeKeyboard, Keyboard: &mrp.KeyboardMessage{State: mrp.KeyboardStateDidBeginEditing}})
+	if event := listener.next(t); event != [2]KeyboardFocusState{KeyboardFocusStateUnknown, KeyboardFocusStateFocused} {
+		t.Errorf("Expected focus state update, got %v", event)
+	}
+	if err := atv.Keyboard().TextSet(ctx, "hello"); err != nil {
+		t.Fatalf("TextSet() error = %v", err)
+	}
+	if input := device.expect(t, mrp.TypeTextInput).TextInput; input.Text != "hello" || input.ActionType != mrp.ActionTypeSet {
+		t.Errorf("Unexpected TextInput %+v", input)
+	}
+}
+
+func TestMRPConnectionLost(t *testing.T) {
+	device, atv := connectFakeMRPDevice(t, nil)
+	listener := newTestListener()
+	atv.SetDeviceListener(listener)
+
+	device.mu.Lock()
+	device.conn.Close()
+	device.mu.Unlock()
+
+	if err, _ := listener.next(t).(error); !errors.Is(err, ErrConnectionLost) {
+		t.Errorf("Expected ErrConnectionLost, got %v", err)
+	}
+	if err := atv.Metadata().(*mrpMetadata).protocol.send(mrp.NewMessage(mrp.TypeGeneric)); !errors.Is(err, ErrConnectionLost) {
+		t.Errorf("Expected ErrConnectionLost, got %v", err)
+	}
+
+	atv.Close()
+	if event := listener.next(t); event != "closed" {
+		t.Errorf("Expected connection to be closed, got %v", event)
+	}
+}
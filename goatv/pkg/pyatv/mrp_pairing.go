@@ -0,0 +1,246 @@
+package pyatv
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/mrp"
+	"github.com/alexjsteffen/goatv/pkg/pyatv/tlv8"
+)
+
+// mrpDeviceInfo creates the DeviceInfoMessage that must be the first message
+// sent to a device. It presents us as a remote control app on an iPhone.
+func mrpDeviceInfo(identifier, name string) *mrp.ProtocolMessage {
+	message := mrp.NewMessage(mrp.TypeDeviceInfo)
+	message.DeviceInfo = &mrp.DeviceInfoMessage{
+		UniqueIdentifier:            identifier,
+		Name:                        name,
+		LocalizedModelName:          "iPhone",
+		SystemBuildVersion:          "18G82",
+		ApplicationBundleIdentifier: "com.apple.TVRemote",
+		ApplicationBundleVersion:    "344.28",
+		ProtocolVersion:             1,
+		LastSupportedMessageType:    mrp.LastSupportedMessageType,
+		SupportsSystemPairing:       true,
+		AllowsPairing:               true,
+		SystemMediaApplication:      "com.apple.TVMusic",
+		SupportsACL:                 true,
+		SupportsSharedQueue:         true,
+		SupportsExtendedMotion:      true,
+		SharedQueueVersion:          2,
+		DeviceClass:                 mrp.DeviceClassIPhone,
+		LogicalDeviceCount:          1,
+	}
+	return message
+}
+
+// mrpCryptoPairing creates a CryptoPairingMessage carrying TLV8 data. state is
+// 2 for the first message of pair-setup and 0 otherwise.
+func mrpCryptoPairing(items tlv8.Items, state int32) *mrp.ProtocolMessage {
+	status, retrying, systemPairing := int32(0), false, false
+	message := mrp.NewMessage(mrp.TypeCryptoPairing)
+	message.CryptoPairing = &mrp.CryptoPairingMessage{
+		PairingData:          items.Encode(),
+		Status:               &status,
+		IsRetrying:           &retrying,
+		IsUsingSystemPairing: &systemPairing,
+		State:                &state,
+	}
+	return message
+}
+
+// mrpPairingItems decodes the TLV8 data of a CryptoPairingMessage.
+func mrpPairingItems(message *mrp.ProtocolMessage) (tlv8.Items, error) {
+	if message.CryptoPairing == nil {
+		return nil, fmt.Errorf("%w: no pairing data in message", ErrInvalidResponse)
+	}
+	items, err := tlv8.Decode(message.CryptoPairing.PairingData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	return items, nil
+}
+
+// writeMRPMessage encodes a message and writes it prefixed with its length.
+func writeMRPMessage(w io.Writer, message *mrp.ProtocolMessage) error {
+	data, err := mrp.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return mrp.WriteFrame(w, data)
+}
+
+// readMRPMessage reads a length prefixed message and decodes it.
+func readMRPMessage(r *bufio.Reader) (*mrp.ProtocolMessage, error) {
+	frame, err := mrp.ReadFrame(r)
+	if err != nil {
+		if errors.Is(err, mrp.ErrMalformed) {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+		}
+		return nil, err
+	}
+	message := &mrp.ProtocolMessage{}
+	if err := mrp.Unmarshal(frame, message); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	return message, nil
+}
+
+// mrpFraming is the messageFraming of MRP. Every message is encrypted, the
+// length prefix is not authenticated.
+type mrpFraming struct{}
+
+func (mrpFraming) parse(data []byte) (int, int, error) {
+	size, n := binary.Uvarint(data)
+	switch {
+	case n == 0:
+		return 0, 0, nil
+	case n < 0 || size > mrp.MaxMessageSize:
+		return 0, 0, fmt.Errorf("%w: invalid message length", ErrInvalidResponse)
+	}
+	return n, int(size), nil
+}
+
+func (mrpFraming) resize(header []byte, payloadSize int) []byte {
+	return binary.AppendUvarint(nil, uint64(payloadSize))
+}
+
+func (mrpFraming) encrypted(header []byte, payloadSize int) ([]byte, bool) {
+	return nil, true
+}
+
+// mrpPairVerifyMessage tells pair-verify messages from pair-setup messages,
+// which MRP sends the same way.
+func mrpPairVerifyMessage(items tlv8.Items) bool {
+	state, _ := items.Uint(tlv8.TagState)
+	switch tlv8.State(state) {
+	case tlv8.M1:
+		_, ok := items.Get(tlv8.TagMethod)
+		return !ok
+	case tlv8.M3:
+		_, ok := items.Get(tlv8.TagProof)
+		return !ok
+	default:
+		return false
+	}
+}
+
+// mrpPairingTransport sends pairing messages over an MRP connection.
+type mrpPairingTransport struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	deviceInfo *mrp.DeviceInfoMessage // How the device introduced itself
+}
+
+// newMRPPairingTransport introduces us to the device with a DeviceInfoMessage,
+// which must be sent before anything else.
+func newMRPPairingTransport(ctx context.Context, conn net.Conn, clientID, name string) (*mrpPairingTransport, error) {
+	t := &mrpPairingTransport{conn: conn, reader: bufio.NewReader(conn)}
+
+	info := mrpDeviceInfo(clientID, name)
+	info.Identifier = mrp.NewIdentifier()
+	resp, err := t.roundTrip(ctx, info, mrp.TypeDeviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	t.deviceInfo = resp.DeviceInfo
+	if t.deviceInfo == nil {
+		t.deviceInfo = &mrp.DeviceInfoMessage{}
+	}
+	return t, nil
+}
+
+// roundTrip sends a message and waits for a message of a type, ignoring any
+// other messages the device sends meanwhile.
+func (t *mrpPairingTransport) roundTrip(ctx context.Context, message *mrp.ProtocolMessage, responseType mrp.MessageType) (*mrp.ProtocolMessage, error) {
+	stop := bindContext(ctx, t.conn)
+	defer stop()
+
+	if err := writeMRPMessage(t.conn, message); err != nil {
+		return nil, connectionError(ctx, err)
+	}
+	for {
+		resp, err := readMRPMessage(t.reader)
+		if errors.Is(err, ErrInvalidResponse) {
+			return nil, err
+		} else if err != nil {
+			return nil, connectionError(ctx, err)
+		}
+		if resp.Type == responseType {
+			return resp, nil
+		}
+	}
+}
+
+func (t *mrpPairingTransport) exchange(ctx context.Context, kind hapExchange, items tlv8.Items) (tlv8.Items, error) {
+	var state int32
+	if value, _ := items.Uint(tlv8.TagState); kind.setup() && value == uint64(tlv8.M1) {
+		state = 2
+	}
+
+	resp, err := t.roundTrip(ctx, mrpCryptoPairing(items, state), mrp.TypeCryptoPairing)
+	if err != nil {
+		return nil, err
+	}
+	return mrpPairingItems(resp)
+}
+
+func (t *mrpPairingTransport) stream() net.Conn {
+	return &bufferedConn{Conn: t.conn, reader: t.reader}
+}
+
+func (t *mrpPairingTransport) Close() error {
+	return t.conn.Close()
+}
+
+// mrpPairingServerTransport receives pairing messages from an MRP client. It
+// answers the DeviceInfoMessage on its own.
+type mrpPairingServerTransport struct {
+	conn             net.Conn
+	reader           *bufio.Reader
+	identifier, name string // Who we are in our DeviceInfoMessage
+}
+
+func newMRPPairingServerTransport(conn net.Conn, identifier, name string) *mrpPairingServerTransport {
+	return &mrpPairingServerTransport{conn: conn, reader: bufio.NewReader(conn), identifier: identifier, name: name}
+}
+
+func (t *mrpPairingServerTransport) receive() (hapExchange, tlv8.Items, error) {
+	for {
+		msg, err := readMRPMessage(t.reader)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch msg.Type {
+		case mrp.TypeDeviceInfo:
+			resp := mrpDeviceInfo(t.identifier, t.name)
+			resp.Identifier = msg.Identifier
+			if err := writeMRPMessage(t.conn, resp); err != nil {
+				return 0, nil, err
+			}
+		case mrp.TypeCryptoPairing:
+			items, err := mrpPairingItems(msg)
+			if err != nil {
+				return 0, nil, err
+			}
+			if mrpPairVerifyMessage(items) {
+				return exchangePairVerify, items, nil
+			}
+			return exchangePairSetup, items, nil
+		}
+	}
+}
+
+func (t *mrpPairingServerTransport) send(kind hapExchange, items tlv8.Items) error {
+	return writeMRPMessage(t.conn, mrpCryptoPairing(items, 0))
+}
+
+func (t *mrpPairingServerTransport) stream() net.Conn {
+	return &bufferedConn{Conn: t.conn, reader: t.reader}
+}
@@ -0,0 +1,404 @@
+package pyatv
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/mrp"
+)
+
+// mrpDefaultPlayer is the player of apps that have only one.
+const mrpDefaultPlayer = "MediaRemote-DefaultPlayer"
+
+// cocoaEpoch is where the timestamps of MRP metadata count from.
+var cocoaEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// mrpPlayer is what a player of an app told us about what it plays.
+type mrpPlayer struct {
+	identifier    string
+	client        *mrpClient
+	playbackState *mrp.PlaybackState
+	commands      []*mrp.CommandInfo
+	items         []*mrp.ContentItem
+	location      int
+}
+
+// item returns the item being played, or nil if there is none.
+func (p *mrpPlayer) item() *mrp.ContentItem {
+	if p.location < 0 || p.location >= len(p.items) {
+		return nil
+	}
+	return p.items[p.location]
+}
+
+func (p *mrpPlayer) metadata() *mrp.ContentItemMetadata {
+	if item := p.item(); item != nil {
+		return item.Metadata
+	}
+	return nil
+}
+
+// state returns the playback state, or false if the player never told it.
+// Players keep saying they play while seeking, which only the playback rate
+// shows.
+func (p *mrpPlayer) state() (mrp.PlaybackState, bool) {
+	if p.playbackState == nil {
+		return 0, false
+	}
+	metadata := p.metadata()
+	switch state := *p.playbackState; state {
+	case mrp.PlaybackStatePaused:
+		// Nothing is paused if the queue is empty
+		return state, metadata != nil
+	case mrp.PlaybackStatePlaying:
+		if metadata == nil || metadata.PlaybackRate == nil {
+			return state, true
+		}
+		rate := float64(*metadata.PlaybackRate)
+		if !closeTo(rate, 0) && !closeTo(rate, 1) {
+			return mrp.PlaybackStateSeeking, true
+		}
+		return state, true
+	default:
+		return state, true
+	}
+}
+
+// command returns what the player or its app supports of a command, or nil if
+// neither tells.
+func (p *mrpPlayer) command(command mrp.Command) *mrp.CommandInfo {
+	commands := p.commands
+	if p.client != nil {
+		commands = append(commands[:len(commands):len(commands)], p.client.commands...)
+	}
+	for _, info := range commands {
+		if info.Command == command {
+			return info
+		}
+	}
+	return nil
+}
+
+func (p *mrpPlayer) handleSetState(message *mrp.SetStateMessage) {
+	if message.PlaybackState != nil {
+		state := *message.PlaybackState
+		p.playbackState = &state
+	}
+	if message.SupportedCommands != nil {
+		p.commands = message.SupportedCommands.SupportedCommands
+	}
+	if queue := message.PlaybackQueue; queue != nil {
+		p.items = queue.ContentItems
+		p.location = int(queue.Location)
+	}
+}
+
+// handleUpdateContentItem merges new metadata into the items we know.
+func (p *mrpPlayer) handleUpdateContentItem(message *mrp.UpdateContentItemMessage) {
+	for _, update := range message.ContentItems {
+		for _, item := range p.items {
+			if item.Identifier != update.Identifier || update.Metadata == nil {
+				continue
+			}
+			if item.Metadata == nil {
+				item.Metadata = &mrp.ContentItemMetadata{}
+			}
+			if data, err := mrp.Marshal(update.Metadata); err == nil {
+				mrp.Unmarshal(data, item.Metadata)
+			}
+		}
+	}
+}
+
+// mrpClient is an app that plays media.
+type mrpClient struct {
+	bundleIdentifier string
+	displayName      string
+	players          map[string]*mrpPlayer
+	active           *mrpPlayer
+	commands         []*mrp.CommandInfo // Supported by all players of the app
+}
+
+// activePlayer returns the player that plays now, which is the default
+// player unless the app said otherwise.
+func (c *mrpClient) activePlayer() *mrpPlayer {
+	if c.active != nil {
+		return c.active
+	}
+	if player, ok := c.players[mrpDefaultPlayer]; ok {
+		return player
+	}
+	return &mrpPlayer{client: c}
+}
+
+func (c *mrpClient) player(player *mrp.NowPlayingPlayer) *mrpPlayer {
+	var identifier string
+	if player != nil {
+		identifier = player.Identifier
+	}
+	if _, ok := c.players[identifier]; !ok {
+		c.players[identifier] = &mrpPlayer{identifier: identifier, client: c}
+	}
+	return c.players[identifier]
+}
+
+func (c *mrpClient) update(client *mrp.NowPlayingClient) {
+	if client != nil && client.DisplayName != "" {
+		c.displayName = client.DisplayName
+	}
+}
+
+// mrpPlayerStates keeps track of what every app on a device plays, from the
+// messages the device sends.
+type mrpPlayerStates struct {
+	mu      sync.Mutex
+	clients map[string]*mrpClient // By bundle identifier
+	active  *mrpClient
+
+	// updated is called when what plays now may have changed
+	updated func()
+}
+
+func newMRPPlayerStates(protocol *mrpProtocol) *mrpPlayerStates {
+	s := &mrpPlayerStates{clients: make(map[string]*mrpClient)}
+	protocol.listen(s.handle,
+		mrp.TypeSetState,
+		mrp.TypeUpdateContentItem,
+		mrp.TypeSetNowPlayingClient,
+		mrp.TypeSetNowPlayingPlayer,
+		mrp.TypeUpdateClient,
+		mrp.TypeRemoveClient,
+		mrp.TypeRemovePlayer,
+		mrp.TypeSetDefaultSupportedCommands,
+	)
+	return s
+}
+
+func (s *mrpPlayerStates) client(client *mrp.NowPlayingClient) *mrpClient {
+	var bundle string
+	if client != nil {
+		bundle = client.BundleIdentifier
+	}
+	if _, ok := s.clients[bundle]; !ok {
+		s.clients[bundle] = &mrpClient{bundleIdentifier: bundle, players: make(map[string]*mrpPlayer)}
+		s.clients[bundle].update(client)
+	}
+	return s.clients[bundle]
+}
+
+func (s *mrpPlayerStates) player(path *mrp.PlayerPath) *mrpPlayer {
+	if path == nil {
+		path = &mrp.PlayerPath{}
+	}
+	return s.client(path.Client).player(path.Player)
+}
+
+// playing returns the player that plays now. The caller must hold s.mu.
+func (s *mrpPlayerStates) playing() *mrpPlayer {
+	if s.active == nil {
+		return &mrpPlayer{}
+	}
+	return s.active.activePlayer()
+}
+
+func (s *mrpPlayerStates) handle(message *mrp.ProtocolMessage) {
+	s.mu.Lock()
+	changed := s.update(message)
+	updated := s.updated
+	s.mu.Unlock()
+
+	if changed && updated != nil {
+		updated()
+	}
+}
+
+// update applies a message and returns true if it may have changed what plays
+// now.
+func (s *mrpPlayerStates) update(message *mrp.ProtocolMessage) bool {
+	switch {
+	case message.SetState != nil:
+		player := s.player(message.SetState.PlayerPath)
+		player.handleSetState(message.SetState)
+		return player == s.playing()
+	case message.UpdateContentItem != nil:
+		player := s.player(message.UpdateContentItem.PlayerPath)
+		player.handleUpdateContentItem(message.UpdateContentItem)
+		return player == s.playing()
+	case message.SetNowPlayingClient != nil:
+		s.active = s.client(message.SetNowPlayingClient.Client)
+		return true
+	case message.SetNowPlayingPlayer != nil:
+		path := message.SetNowPlayingPlayer.PlayerPath
+		if path == nil {
+			path = &mrp.PlayerPath{}
+		}
+		client := s.client(path.Client)
+		client.active = client.player(path.Player)
+		return client == s.active
+	case message.UpdateClient != nil:
+		client := s.client(message.UpdateClient.Client)
+		client.update(message.UpdateClient.Client)
+		return client == s.active
+	case message.RemoveClient != nil && message.RemoveClient.Client != nil:
+		bundle := message.RemoveClient.Client.BundleIdentifier
+		client, ok := s.clients[bundle]
+		if !ok {
+			return false
+		}
+		delete(s.clients, bundle)
+		if client == s.active {
+			s.active = nil
+			return true
+		}
+		return false
+	case message.RemovePlayer != nil:
+		path := message.RemovePlayer.PlayerPath
+		if path == nil || path.Player == nil || path.Player.Identifier == "" {
+			return false
+		}
+		client := s.client(path.Client)
+		player := client.player(path.Player)
+		delete(client.players, player.identifier)
+		if player == client.active {
+			client.active = nil
+			return client == s.active
+		}
+		return false
+	case message.SetDefaultSupportedCommands != nil:
+		commands := message.SetDefaultSupportedCommands
+		var path mrp.PlayerPath
+		if commands.PlayerPath != nil {
+			path = *commands.PlayerPath
+		}
+		client := s.client(path.Client)
+		client.commands = nil
+		if commands.SupportedCommands != nil {
+			client.commands = commands.SupportedCommands.SupportedCommands
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// app returns the app that plays now, or nil if none does.
+func (s *mrpPlayerStates) app() *App {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active == nil {
+		return nil
+	}
+	return &App{Name: s.active.displayName, Identifier: s.active.bundleIdentifier}
+}
+
+// mrpPlaying describes what a player plays at a point in time.
+func mrpPlaying(player *mrpPlayer, now time.Time) *Playing {
+	playing := &Playing{
+		MediaType:   MediaTypeUnknown,
+		DeviceState: DeviceStateIdle,
+	}
+	if item := player.item(); item != nil {
+		playing.Hash = item.Identifier
+	}
+
+	state, ok := player.state()
+	if ok {
+		playing.DeviceState = mrpDeviceState(state)
+	}
+
+	shuffle, repeat := ShuffleStateOff, RepeatStateOff
+	if info := player.command(mrp.CommandChangeShuffleMode); info != nil {
+		switch info.ShuffleMode {
+		case mrp.ShuffleModeOff:
+		case mrp.ShuffleModeAlbums:
+			shuffle = ShuffleStateAlbums
+		default:
+			shuffle = ShuffleStateSongs
+		}
+	}
+	if info := player.command(mrp.CommandChangeRepeatMode); info != nil {
+		switch info.RepeatMode {
+		case mrp.RepeatModeOne:
+			repeat = RepeatStateTrack
+		case mrp.RepeatModeAll:
+			repeat = RepeatStateAll
+		}
+	}
+	playing.Shuffle, playing.Repeat = &shuffle, &repeat
+
+	metadata := player.metadata()
+	if metadata == nil {
+		return playing
+	}
+	switch metadata.MediaType {
+	case mrp.MediaTypeAudio:
+		playing.MediaType = MediaTypeMusic
+	case mrp.MediaTypeVideo:
+		playing.MediaType = MediaTypeVideo
+	}
+	playing.Title = metadata.Title
+	playing.Artist = metadata.TrackArtistName
+	playing.Album = metadata.AlbumName
+	playing.Genre = metadata.Genre
+	playing.SeriesName = metadata.SeriesName
+	playing.ContentIdentifier = metadata.ContentIdentifier
+	playing.SeasonNumber = nonZero(int(metadata.SeasonNumber))
+	playing.EpisodeNumber = nonZero(int(metadata.EpisodeNumber))
+	playing.ITunesStoreIdentifier = nonZero(int(metadata.ITunesStoreIdentifier))
+
+	if metadata.Duration != nil && !math.IsNaN(*metadata.Duration) {
+		total := int(*metadata.Duration)
+		playing.TotalTime = &total
+	}
+
+	// The elapsed time is as of a timestamp, after which it runs on at the
+	// playback rate
+	if metadata.ElapsedTimeTimestamp != nil && *metadata.ElapsedTimeTimestamp != 0 {
+		var elapsed, rate float64
+		if metadata.ElapsedTime != nil {
+			elapsed = *metadata.ElapsedTime
+		}
+		if metadata.PlaybackRate != nil {
+			rate = float64(*metadata.PlaybackRate)
+		}
+		if playing.DeviceState == DeviceStatePlaying && !closeTo(rate, 0) {
+			timestamp := cocoaEpoch.Add(time.Duration(*metadata.ElapsedTimeTimestamp * float64(time.Second)))
+			elapsed += now.Sub(timestamp).Seconds()
+		}
+		position := int(elapsed)
+		playing.Position = &position
+	}
+	return playing
+}
+
+func mrpDeviceState(state mrp.PlaybackState) DeviceState {
+	switch state {
+	case mrp.PlaybackStatePlaying:
+		return DeviceStatePlaying
+	case mrp.PlaybackStateStopped:
+		return DeviceStateStopped
+	case mrp.PlaybackStateInterrupted:
+		return DeviceStateLoading
+	case mrp.PlaybackStateSeeking:
+		return DeviceStateSeeking
+	default:
+		return DeviceStatePaused
+	}
+}
+
+// cocoaTime returns a time in seconds since cocoaEpoch.
+func cocoaTime(t time.Time) float64 {
+	return t.Sub(cocoaEpoch).Seconds()
+}
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func nonZero(value int) *int {
+	if value == 0 {
+		return nil
+	}
+	return &value
+}
@@ -0,0 +1,65 @@
+package pyatv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/mrp"
+)
+
+func TestMRPPlayingDeviceState(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    *mrp.PlaybackState
+		metadata *mrp.ContentItemMetadata
+		expected DeviceState
+	}{
+		{"no state", nil, &mrp.ContentItemMetadata{}, DeviceStateIdle},
+		{"playing", playbackState(mrp.PlaybackStatePlaying), &mrp.ContentItemMetadata{PlaybackRate: rate(1)}, DeviceStatePlaying},
+		{"playing stopped", playbackState(mrp.PlaybackStatePlaying), &mrp.ContentItemMetadata{PlaybackRate: rate(0)}, DeviceStatePlaying},
+		{"seeking", playbackState(mrp.PlaybackStatePlaying), &mrp.ContentItemMetadata{PlaybackRate: rate(2)}, DeviceStateSeeking},
+		{"paused", playbackState(mrp.PlaybackStatePaused), &mrp.ContentItemMetadata{}, DeviceStatePaused},
+		{"paused empty", playbackState(mrp.PlaybackStatePaused), nil, DeviceStateIdle},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			player := &mrpPlayer{client: &mrpClient{}, playbackState: tt.state}
+			if tt.metadata != nil {
+				player.items = []*mrp.ContentItem{{Metadata: tt.metadata}}
+			}
+			if state := mrpPlaying(player, time.Now()).DeviceState; state != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, state)
+			}
+		})
+	}
+}
+
+func TestMRPPlayingPosition(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	elapsed, timestamp := 10.0, cocoaTime(now.Add(-5*time.Second))
+	player := &mrpPlayer{
+		client:        &mrpClient{},
+		playbackState: playbackState(mrp.PlaybackStatePlaying),
+		items: []*mrp.ContentItem{{Metadata: &mrp.ContentItemMetadata{
+			ElapsedTime:          &elapsed,
+			ElapsedTimeTimestamp: &timestamp,
+			PlaybackRate:         rate(1),
+		}}},
+	}
+	if position := mrpPlaying(player, now).Position; position == nil || *position != 15 {
+		t.Errorf("Expected position 15 while playing, got %v", position)
+	}
+
+	player.playbackState = playbackState(mrp.PlaybackStatePaused)
+	if position := mrpPlaying(player, now).Position; position == nil || *position != 10 {
+		t.Errorf("Expected position 10 while paused, got %v", position)
+	}
+}
+
+func playbackState(state mrp.PlaybackState) *mrp.PlaybackState {
+	return &state
+}
+
+func rate(rate float32) *float32 {
+	return &rate
+}
@@ -0,0 +1,206 @@
+package pyatv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/mrp"
+)
+
+const (
+	// mrpResponseTimeout is how long a device may take to answer a request.
+	mrpResponseTimeout = 5 * time.Second
+
+	// mrpHeartbeatInterval is how often we check that the device is still
+	// there. A failed heartbeat is retried once right away before the
+	// connection is considered lost.
+	mrpHeartbeatInterval = 30 * time.Second
+)
+
+// mrpProtocol is an encrypted MRP connection to a device. Messages that are
+// not responses go to listeners by type, which keep track of the state of the
+// device.
+type mrpProtocol struct {
+	conn       *mrp.Conn
+	deviceInfo *mrp.DeviceInfoMessage // How the device introduced itself
+
+	mu        sync.Mutex
+	listeners map[mrp.MessageType][]func(*mrp.ProtocolMessage)
+	events    []func() // Waiting to be delivered to listeners of the user
+	wake      chan struct{}
+
+	closed atomic.Bool  // Closed by us rather than lost
+	lost   atomic.Value // Why the connection was lost, if we know better than conn
+}
+
+func newMRPProtocol(deviceInfo *mrp.DeviceInfoMessage) *mrpProtocol {
+	return &mrpProtocol{
+		deviceInfo: deviceInfo,
+		listeners:  make(map[mrp.MessageType][]func(*mrp.ProtocolMessage)),
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// listen calls handler with every message of the given types. Handlers are
+// called one at a time from the goroutine reading the connection, so they must
+// not wait for responses. They should pass events on with notify.
+func (p *mrpProtocol) listen(handler func(*mrp.ProtocolMessage), types ...mrp.MessageType) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range types {
+		p.listeners[t] = append(p.listeners[t], handler)
+	}
+}
+
+func (p *mrpProtocol) dispatch(message *mrp.ProtocolMessage) {
+	p.mu.Lock()
+	handlers := p.listeners[message.Type]
+	p.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(message)
+	}
+}
+
+// notify calls fn from a goroutine of its own, in the order notify was
+// called. Listeners of the user are called this way, so that they may use the
+// connection.
+func (p *mrpProtocol) notify(fn func()) {
+	p.mu.Lock()
+	p.events = append(p.events, fn)
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *mrpProtocol) deliver() {
+	for {
+		select {
+		case <-p.wake:
+		case <-p.conn.Done():
+			return
+		}
+
+		p.mu.Lock()
+		events := p.events
+		p.events = nil
+		p.mu.Unlock()
+
+		for _, fn := range events {
+			fn()
+		}
+	}
+}
+
+// start takes over a connection that passed pair-verify and subscribes to
+// updates from the device.
+func (p *mrpProtocol) start(ctx context.Context, conn net.Conn) error {
+	p.conn = mrp.NewConn(conn, p.dispatch)
+	go p.deliver()
+
+	// This must be the first message after encryption was enabled
+	state := mrp.NewMessage(mrp.TypeSetConnectionState)
+	state.SetConnectionState = &mrp.SetConnectionStateMessage{State: mrp.ConnectionStateConnected}
+	if err := p.send(state); err != nil {
+		p.conn.Close()
+		return err
+	}
+
+	config := mrp.NewMessage(mrp.TypeClientUpdatesConfig)
+	config.ClientUpdatesConfig = &mrp.ClientUpdatesConfigMessage{
+		ArtworkUpdates:      true,
+		VolumeUpdates:       true,
+		KeyboardUpdates:     true,
+		OutputDeviceUpdates: true,
+	}
+	if _, err := p.request(ctx, config); err != nil {
+		p.conn.Close()
+		return err
+	}
+
+	keyboard, err := p.request(ctx, mrp.NewMessage(mrp.TypeGetKeyboardSession))
+	if err != nil {
+		p.conn.Close()
+		return err
+	}
+	if keyboard.Keyboard != nil {
+		keyboard.Type = mrp.TypeKeyboard
+		p.dispatch(keyboard)
+	}
+
+	go p.heartbeat()
+	return nil
+}
+
+// send sends a message that the device does not answer.
+func (p *mrpProtocol) send(message *mrp.ProtocolMessage) error {
+	if err := p.conn.Send(message); err != nil {
+		return fmt.Errorf("%w: %v", ErrConnectionLost, err)
+	}
+	return nil
+}
+
+// request sends a message and waits for the answer.
+func (p *mrpProtocol) request(ctx context.Context, message *mrp.ProtocolMessage) (*mrp.ProtocolMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, mrpResponseTimeout)
+	defer cancel()
+
+	resp, err := p.conn.Request(ctx, message)
+	if err != nil {
+		return nil, connectionError(ctx, err)
+	}
+	if err := resp.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProtocol, err)
+	}
+	return resp, nil
+}
+
+func (p *mrpProtocol) heartbeat() {
+	ticker := time.NewTicker(mrpHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.conn.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var err error
+		for attempt := 0; attempt < 2; attempt++ {
+			if _, err = p.request(context.Background(), mrp.NewMessage(mrp.TypeGeneric)); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			p.lost.Store(fmt.Errorf("heartbeat failed: %w", err))
+			p.conn.Close()
+			return
+		}
+	}
+}
+
+// watch calls lost once the connection stops, unless it was closed.
+func (p *mrpProtocol) watch(lost func(err error)) {
+	<-p.conn.Done()
+	if p.closed.Load() {
+		return
+	}
+	err, _ := p.lost.Load().(error)
+	if err == nil {
+		err = fmt.Errorf("%w: %v", ErrConnectionLost, p.conn.Err())
+	}
+	lost(err)
+}
+
+func (p *mrpProtocol) close() {
+	p.closed.Store(true)
+	p.conn.Close()
+}
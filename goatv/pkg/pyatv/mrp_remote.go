@@ -0,0 +1,311 @@
+package pyatv
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/mrp"
+)
+
+const (
+	// mrpHoldDuration is how long a button is held for InputActionHold.
+	mrpHoldDuration = time.Second
+
+	// mrpCommandDelay separates commands that the device must not merge.
+	mrpCommandDelay = 100 * time.Millisecond
+
+	// mrpDefaultSkipInterval is how far to skip if neither the caller nor
+	// the app tells.
+	mrpDefaultSkipInterval = 15
+)
+
+// mrpKey is a button by HID usage page and usage.
+type mrpKey struct {
+	usagePage uint16
+	usage     uint16
+}
+
+var (
+	mrpKeyUp         = mrpKey{1, 0x8C}
+	mrpKeyDown       = mrpKey{1, 0x8D}
+	mrpKeyLeft       = mrpKey{1, 0x8B}
+	mrpKeyRight      = mrpKey{1, 0x8A}
+	mrpKeySelect     = mrpKey{1, 0x89}
+	mrpKeyMenu       = mrpKey{1, 0x86}
+	mrpKeySuspend    = mrpKey{1, 0x82}
+	mrpKeyWakeUp     = mrpKey{1, 0x83}
+	mrpKeyHome       = mrpKey{12, 0x40}
+	mrpKeyTopMenu    = mrpKey{12, 0x60}
+	mrpKeyVolumeUp   = mrpKey{12, 0xE9}
+	mrpKeyVolumeDown = mrpKey{12, 0xEA}
+)
+
+// mrpHIDEvent returns a message that presses or releases a key. The event
+// starts with a mach absolute time, which devices do not seem to care about,
+// and is otherwise in the format devices expect.
+func mrpHIDEvent(key mrpKey, down bool) *mrp.ProtocolMessage {
+	data := []byte{
+		0x43, 0x89, 0x22, 0xCF, 0x08, 0x02, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x02, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00,
+		0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00,
+	}
+	data = binary.BigEndian.AppendUint16(data, key.usagePage)
+	data = binary.BigEndian.AppendUint16(data, key.usage)
+	if down {
+		data = binary.BigEndian.AppendUint16(data, 1)
+	} else {
+		data = binary.BigEndian.AppendUint16(data, 0)
+	}
+	data = append(data, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00)
+
+	message := mrp.NewMessage(mrp.TypeSendHIDEvent)
+	message.SendHIDEvent = &mrp.SendHIDEventMessage{HIDEventData: data}
+	return message
+}
+
+// press presses and releases a key as action tells. Unless flush is false,
+// every press is followed by a request, so that it is done when press
+// returns.
+func (p *mrpProtocol) press(ctx context.Context, key mrpKey, action InputAction, flush bool) error {
+	switch action {
+	case InputActionSingleTap:
+		return p.pressOnce(ctx, key, 0, flush)
+	case InputActionDoubleTap:
+		if err := p.pressOnce(ctx, key, 0, flush); err != nil {
+			return err
+		}
+		return p.pressOnce(ctx, key, 0, flush)
+	case InputActionHold:
+		return p.pressOnce(ctx, key, mrpHoldDuration, flush)
+	default:
+		return fmt.Errorf("%w: input action %s", ErrNotSupported, action)
+	}
+}
+
+func (p *mrpProtocol) pressOnce(ctx context.Context, key mrpKey, hold time.Duration, flush bool) error {
+	if err := p.send(mrpHIDEvent(key, true)); err != nil {
+		return err
+	}
+	if hold > 0 {
+		if err := sleep(ctx, hold); err != nil {
+			return err
+		}
+	}
+	if err := p.send(mrpHIDEvent(key, false)); err != nil {
+		return err
+	}
+	if !flush {
+		return nil
+	}
+	_, err := p.request(ctx, mrp.NewMessage(mrp.TypeGeneric))
+	return err
+}
+
+// CommandError is returned when a device did not carry out an MRP command. It
+// matches ErrCommand with errors.Is.
+type CommandError struct {
+	Command       mrp.Command
+	SendError     mrp.SendError           // Why the command was not delivered
+	HandlerStatus mrp.HandlerReturnStatus // What the player said about it
+}
+
+// Error implements the error interface.
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%v: command %d: %s (handler status %d)", ErrCommand, e.Command, e.SendError, e.HandlerStatus)
+}
+
+// Unwrap returns ErrCommand.
+func (e *CommandError) Unwrap() error {
+	return ErrCommand
+}
+
+// command sends a playback command to the active player. Commands the device
+// did not deliver fail with a CommandError.
+func (p *mrpProtocol) command(ctx context.Context, command mrp.Command, options *mrp.CommandOptions) error {
+	message := mrp.NewMessage(mrp.TypeSendCommand)
+	message.SendCommand = &mrp.SendCommandMessage{Command: command, Options: options}
+	resp, err := p.request(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	result := resp.SendCommandResult
+	if result == nil || result.SendError == mrp.SendErrorNoError {
+		return nil
+	}
+	return &CommandError{Command: command, SendError: result.SendError, HandlerStatus: result.HandlerReturnStatus}
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrOperationTimeout, ctx.Err())
+	}
+}
+
+// mrpRemoteControl sends buttons over MRP as HID events and media keys as
+// playback commands.
+type mrpRemoteControl struct {
+	defaultRemoteControl
+	protocol *mrpProtocol
+	states   *mrpPlayerStates
+}
+
+func (r *mrpRemoteControl) Up(ctx context.Context, action InputAction) error {
+	return r.protocol.press(ctx, mrpKeyUp, action, true)
+}
+
+func (r *mrpRemoteControl) Down(ctx context.Context, action InputAction) error {
+	return r.protocol.press(ctx, mrpKeyDown, action, true)
+}
+
+func (r *mrpRemoteControl) Left(ctx context.Context, action InputAction) error {
+	return r.protocol.press(ctx, mrpKeyLeft, action, true)
+}
+
+func (r *mrpRemoteControl) Right(ctx context.Context, action InputAction) error {
+	return r.protocol.press(ctx, mrpKeyRight, action, true)
+}
+
+func (r *mrpRemoteControl) Play(ctx context.Context) error {
+	return r.protocol.command(ctx, mrp.CommandPlay, nil)
+}
+
+// PlayPause toggles playback. Apps that do not support toggling get play or
+// pause depending on what they do.
+func (r *mrpRemoteControl) PlayPause(ctx context.Context) error {
+	r.states.mu.Lock()
+	player := r.states.playing()
+	toggle := player.command(mrp.CommandTogglePlayPause)
+	var state mrp.PlaybackState
+	if player.playbackState != nil {
+		state = *player.playbackState
+	}
+	r.states.mu.Unlock()
+
+	switch {
+	case toggle != nil && (toggle.Enabled == nil || *toggle.Enabled):
+		return r.protocol.command(ctx, mrp.CommandTogglePlayPause, nil)
+	case state == mrp.PlaybackStatePlaying:
+		return r.Pause(ctx)
+	case state == mrp.PlaybackStatePaused:
+		return r.Play(ctx)
+	default:
+		return nil
+	}
+}
+
+func (r *mrpRemoteControl) Pause(ctx context.Context) error {
+	return r.protocol.command(ctx, mrp.CommandPause, nil)
+}
+
+func (r *mrpRemoteControl) Stop(ctx context.Context) error {
+	return r.protocol.command(ctx, mrp.CommandStop, nil)
+}
+
+func (r *mrpRemoteControl) Next(ctx context.Context) error {
+	return r.protocol.command(ctx, mrp.CommandNextTrack, nil)
+}
+
+func (r *mrpRemoteControl) Previous(ctx context.Context) error {
+	return r.protocol.command(ctx, mrp.CommandPreviousTrack, nil)
+}
+
+func (r *mrpRemoteControl) Select(ctx context.Context, action InputAction) error {
+	return r.protocol.press(ctx, mrpKeySelect, action, true)
+}
+
+func (r *mrpRemoteControl) Menu(ctx context.Context, action InputAction) error {
+	return r.protocol.press(ctx, mrpKeyMenu, action, true)
+}
+
+func (r *mrpRemoteControl) VolumeUp(ctx context.Context) error {
+	return r.protocol.press(ctx, mrpKeyVolumeUp, InputActionSingleTap, true)
+}
+
+func (r *mrpRemoteControl) VolumeDown(ctx context.Context) error {
+	return r.protocol.press(ctx, mrpKeyVolumeDown, InputActionSingleTap, true)
+}
+
+func (r *mrpRemoteControl) Home(ctx context.Context, action InputAction) error {
+	return r.protocol.press(ctx, mrpKeyHome, action, true)
+}
+
+func (r *mrpRemoteControl) HomeHold(ctx context.Context) error {
+	return r.protocol.press(ctx, mrpKeyHome, InputActionHold, true)
+}
+
+func (r *mrpRemoteControl) TopMenu(ctx context.Context) error {
+	return r.protocol.press(ctx, mrpKeyTopMenu, InputActionSingleTap, true)
+}
+
+func (r *mrpRemoteControl) Suspend(ctx context.Context) error {
+	return r.protocol.press(ctx, mrpKeySuspend, InputActionSingleTap, true)
+}
+
+func (r *mrpRemoteControl) WakeUp(ctx context.Context) error {
+	return r.protocol.press(ctx, mrpKeyWakeUp, InputActionSingleTap, true)
+}
+
+// SkipForward skips timeInterval seconds ahead, or as far as the app
+// prefers if timeInterval is zero.
+func (r *mrpRemoteControl) SkipForward(ctx context.Context, timeInterval float64) error {
+	return r.skip(ctx, mrp.CommandSkipForward, timeInterval)
+}
+
+// SkipBackward skips timeInterval seconds back, or as far as the app prefers
+// if timeInterval is zero.
+func (r *mrpRemoteControl) SkipBackward(ctx context.Context, timeInterval float64) error {
+	return r.skip(ctx, mrp.CommandSkipBackward, timeInterval)
+}
+
+func (r *mrpRemoteControl) skip(ctx context.Context, command mrp.Command, timeInterval float64) error {
+	interval := float32(mrpDefaultSkipInterval)
+	if timeInterval > 0 {
+		interval = float32(int(timeInterval))
+	} else {
+		r.states.mu.Lock()
+		info := r.states.playing().command(command)
+		r.states.mu.Unlock()
+		if info != nil && len(info.PreferredIntervals) > 0 {
+			interval = float32(info.PreferredIntervals[0])
+		}
+	}
+	return r.protocol.command(ctx, command, &mrp.CommandOptions{SkipInterval: interval})
+}
+
+func (r *mrpRemoteControl) SetPosition(ctx context.Context, pos int) error {
+	return r.protocol.command(ctx, mrp.CommandSeekToPlaybackPosition, &mrp.CommandOptions{PlaybackPosition: float64(pos)})
+}
+
+func (r *mrpRemoteControl) SetShuffle(ctx context.Context, state ShuffleState) error {
+	options := &mrp.CommandOptions{SendOptions: new(uint32), ShuffleMode: mrp.ShuffleModeSongs}
+	switch state {
+	case ShuffleStateOff:
+		options.ShuffleMode = mrp.ShuffleModeOff
+	case ShuffleStateAlbums:
+		options.ShuffleMode = mrp.ShuffleModeAlbums
+	}
+	return r.protocol.command(ctx, mrp.CommandChangeShuffleMode, options)
+}
+
+func (r *mrpRemoteControl) SetRepeat(ctx context.Context, state RepeatState) error {
+	options := &mrp.CommandOptions{SendOptions: new(uint32), RepeatMode: mrp.RepeatModeAll}
+	switch state {
+	case RepeatStateOff:
+		options.RepeatMode = mrp.RepeatModeOff
+	case RepeatStateTrack:
+		options.RepeatMode = mrp.RepeatModeOne
+	}
+	return r.protocol.command(ctx, mrp.CommandChangeRepeatMode, options)
+}
@@ -0,0 +1,188 @@
+package pyatv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/mrp"
+)
+
+func TestMRPHIDEvent(t *testing.T) {
+	data := mrpHIDEvent(mrpKeyHome, true).SendHIDEvent.HIDEventData
+	if len(data) != 60 {
+		t.Fatalf("Expected 60 bytes, got %d", len(data))
+	}
+	if !bytes.Equal(data[43:49], []byte{0x00, 0x0C, 0x00, 0x40, 0x00, 0x01}) {
+		t.Errorf("Expected home pressed, got %x", data[43:49])
+	}
+	if data := mrpHIDEvent(mrpKeyHome, false).SendHIDEvent.HIDEventData; data[48] != 0 {
+		t.Errorf("Expected home released, got %x", data[43:49])
+	}
+}
+
+// expectPress checks that the device got a key pressed and released.
+func expectPress(t *testing.T, device *fakeMRPDevice, key mrpKey) {
+	t.Helper()
+	for _, down := range []bool{true, false} {
+		event := device.expect(t, mrp.TypeSendHIDEvent).SendHIDEvent.HIDEventData
+		if expected := mrpHIDEvent(key, down).SendHIDEvent.HIDEventData; !bytes.Equal(event, expected) {
+			t.Errorf("Expected %x, got %x", expected, event)
+		}
+	}
+	device.expect(t, mrp.TypeGeneric)
+}
+
+func TestMRPRemoteControlButtons(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	device, atv := connectFakeMRPDevice(t, nil)
+	remote := atv.RemoteControl()
+
+	if err := remote.Up(ctx, InputActionSingleTap); err != nil {
+		t.Fatalf("Up() error = %v", err)
+	}
+	expectPress(t, device, mrpKeyUp)
+
+	if err := remote.Select(ctx, InputActionDoubleTap); err != nil {
+		t.Fatalf("Select() error = %v", err)
+	}
+	expectPress(t, device, mrpKeySelect)
+	expectPress(t, device, mrpKeySelect)
+
+	start := time.Now()
+	if err := remote.Menu(ctx, InputActionHold); err != nil {
+		t.Fatalf("Menu() error = %v", err)
+	}
+	if held := time.Since(start); held < mrpHoldDuration {
+		t.Errorf("Expected menu to be held for %s, got %s", mrpHoldDuration, held)
+	}
+	expectPress(t, device, mrpKeyMenu)
+
+	if err := remote.Left(ctx, InputAction(42)); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestMRPRemoteControlCommands(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	device, atv := connectFakeMRPDevice(t, func(message *mrp.ProtocolMessage) []*mrp.ProtocolMessage {
+		if message.SendCommand == nil || message.SendCommand.Command != mrp.CommandStop {
+			return mrpAnswer(message)
+		}
+		// Nothing plays that could stop
+		resp := mrp.NewMessage(mrp.TypeSendCommandResult)
+		resp.Identifier = message.Identifier
+		resp.SendCommandResult = &mrp.SendCommandResultMessage{
+			SendError:           mrp.SendErrorNoCommandHandlers,
+			HandlerReturnStatus: mrp.HandlerReturnStatusNoActionableNowPlayingItem,
+		}
+		return []*mrp.ProtocolMessage{resp}
+	})
+	remote := atv.RemoteControl()
+
+	tests := []struct {
+		name     string
+		send     func() error
+		command  mrp.Command
+		expected mrp.CommandOptions
+	}{
+		{"play", func() error { return remote.Play(ctx) }, mrp.CommandPlay, mrp.CommandOptions{}},
+		{"next", func() error { return remote.Next(ctx) }, mrp.CommandNextTrack, mrp.CommandOptions{}},
+		{"skip default", func() error { return remote.SkipForward(ctx, 0) }, mrp.CommandSkipForward, mrp.CommandOptions{SkipInterval: 15}},
+		{"skip", func() error { return remote.SkipBackward(ctx, 10.5) }, mrp.CommandSkipBackward, mrp.CommandOptions{SkipInterval: 10}},
+		{"position", func() error { return remote.SetPosition(ctx, 123) }, mrp.CommandSeekToPlaybackPosition, mrp.CommandOptions{PlaybackPosition: 123}},
+		{"shuffle", func() error { return remote.SetShuffle(ctx, ShuffleStateAlbums) }, mrp.CommandChangeShuffleMode, mrp.CommandOptions{ShuffleMode: mrp.ShuffleModeAlbums}},
+		{"repeat", func() error { return remote.SetRepeat(ctx, RepeatStateTrack) }, mrp.CommandChangeRepeatMode, mrp.CommandOptions{RepeatMode: mrp.RepeatModeOne}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.send(); err != nil {
+				t.Fatalf("Command failed: %v", err)
+			}
+			command := device.expect(t, mrp.TypeSendCommand).SendCommand
+			if command.Command != tt.command {
+				t.Errorf("Expected command %d, got %d", tt.command, command.Command)
+			}
+			var options mrp.CommandOptions
+			if command.Options != nil {
+				options = *command.Options
+				// Only shuffle and repeat say how they are sent
+				if options.SendOptions != nil && *options.SendOptions != 0 {
+					t.Errorf("Expected send options 0, got %d", *options.SendOptions)
+				}
+				options.SendOptions = nil
+			}
+			if options != tt.expected {
+				t.Errorf("Expected options %+v, got %+v", tt.expected, options)
+			}
+		})
+	}
+
+	err := remote.Stop(ctx)
+	if !errors.Is(err, ErrCommand) {
+		t.Fatalf("Expected ErrCommand, got %v", err)
+	}
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) {
+		t.Fatalf("Expected CommandError, got %T", err)
+	}
+	if commandErr.Command != mrp.CommandStop || commandErr.SendError != mrp.SendErrorNoCommandHandlers ||
+		commandErr.HandlerStatus != mrp.HandlerReturnStatusNoActionableNowPlayingItem {
+		t.Errorf("Unexpected command error %+v", commandErr)
+	}
+}
+
+func TestMRPRemoteControlPlayPause(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	device, atv := connectFakeMRPDevice(t, nil)
+	listener := newTestListener()
+	atv.PushUpdater().SetListener(listener)
+	atv.PushUpdater().Start(0)
+	listener.next(t)
+
+	// Apps that cannot toggle are paused when they play
+	client := &mrp.NowPlayingClient{BundleIdentifier: "com.example.app"}
+	state := mrp.PlaybackStatePlaying
+	device.push(&mrp.ProtocolMessage{Type: mrp.TypeSetNowPlayingClient, SetNowPlayingClient: &mrp.SetNowPlayingClientMessage{Client: client}})
+	device.push(&mrp.ProtocolMessage{Type: mrp.TypeSetState, SetState: &mrp.SetStateMessage{
+		PlayerPath:    &mrp.PlayerPath{Client: client, Player: &mrp.NowPlayingPlayer{Identifier: mrpDefaultPlayer}},
+		PlaybackState: &state,
+		SupportedCommands: &mrp.SupportedCommands{SupportedCommands: []*mrp.CommandInfo{
+			{Command: mrp.CommandSkipForward, PreferredIntervals: []float64{30}},
+		}},
+	}})
+	for playing := listener.next(t).(*Playing); playing.DeviceState != DeviceStatePlaying; {
+		playing = listener.next(t).(*Playing)
+	}
+
+	if err := atv.RemoteControl().PlayPause(ctx); err != nil {
+		t.Fatalf("PlayPause() error = %v", err)
+	}
+	if command := device.expect(t, mrp.TypeSendCommand).SendCommand.Command; command != mrp.CommandPause {
+		t.Errorf("Expected pause, got %d", command)
+	}
+
+	if err := atv.RemoteControl().SkipForward(ctx, 0); err != nil {
+		t.Fatalf("SkipForward() error = %v", err)
+	}
+	if options := device.expect(t, mrp.TypeSendCommand).SendCommand.Options; options.SkipInterval != 30 {
+		t.Errorf("Expected the preferred interval, got %v", options.SkipInterval)
+	}
+}
+
+func TestMRPTurnOff(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	device, atv := connectFakeMRPDevice(t, nil)
+
+	if err := atv.Power().TurnOff(ctx, false); err != nil {
+		t.Fatalf("TurnOff() error = %v", err)
+	}
+	expectPress(t, device, mrpKeyHome)
+	expectPress(t, device, mrpKeySelect)
+}
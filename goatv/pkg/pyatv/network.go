@@ -0,0 +1,215 @@
+package pyatv
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// happyEyeballsDelay is how long a connection attempt runs on its own before
+// the next address is tried in parallel, as recommended by RFC 8305.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// allows returns true if an address may be used with this family preference.
+func (a AddressFamily) allows(ip net.IP) bool {
+	switch a {
+	case AddressFamilyIPv4:
+		return ip.To4() != nil
+	case AddressFamilyIPv6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// prefers returns true if an address belongs to the preferred family.
+func (a AddressFamily) prefers(ip net.IP) bool {
+	if a == AddressFamilyPreferIPv6 || a == AddressFamilyIPv6 {
+		return ip.To4() == nil
+	}
+	return ip.To4() != nil
+}
+
+// mergeAddresses puts newly seen addresses in front of the known ones, drops
+// duplicates and excluded families and orders the preferred family first.
+// Within a family the most recently seen address comes first, so a device that
+// moves is reached at its new address.
+func mergeAddresses(family AddressFamily, seen, known []net.IPAddr) []net.IPAddr {
+	var result []net.IPAddr
+	for _, addr := range append(append([]net.IPAddr{}, seen...), known...) {
+		if family.allows(addr.IP) && !containsAddress(result, addr) {
+			result = append(result, addr)
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return family.prefers(result[i].IP) && !family.prefers(result[j].IP)
+	})
+	return result
+}
+
+func containsAddress(addresses []net.IPAddr, addr net.IPAddr) bool {
+	for _, a := range addresses {
+		if a.IP.Equal(addr.IP) && a.Zone == addr.Zone {
+			return true
+		}
+	}
+	return false
+}
+
+// selectInterfaces looks up interfaces by name. Without names, every interface
+// that is up and supports multicast is returned.
+func selectInterfaces(names []string) ([]net.Interface, error) {
+	if len(names) > 0 {
+		var result []net.Interface
+		for _, name := range names {
+			iface, err := net.InterfaceByName(name)
+			if err != nil {
+				return nil, fmt.Errorf("%w: interface %s: %v", ErrInvalidConfig, name, err)
+			}
+			result = append(result, *iface)
+		}
+		return result, nil
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConnectionFailed, err)
+	}
+
+	var result []net.Interface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 && iface.Flags&net.FlagLoopback == 0 {
+			result = append(result, iface)
+		}
+	}
+	return result, nil
+}
+
+// dialAddresses connects to port on the first address that accepts. Attempts
+// are started in order, each one happyEyeballsDelay after the previous or as
+// soon as it fails. The first established connection wins and all other
+// attempts are abandoned.
+func dialAddresses(ctx context.Context, addresses []net.IPAddr, port int) (net.Conn, error) {
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("%w: no address to connect to", ErrConnectionFailed)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		conn net.Conn
+		err  error
+	}
+
+	var dialer net.Dialer
+	results := make(chan attempt)
+	next, pending := 0, 0
+
+	start := func() {
+		address := net.JoinHostPort(addresses[next].String(), strconv.Itoa(port))
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", address)
+			results <- attempt{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(addresses) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// Attempts still running are closed as they finish
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if next < len(addresses) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %v", ErrConnectionFailed, firstErr)
+}
+
+// connectAddresses returns the device addresses in the order they should be
+// tried.
+func (c *Config) connectAddresses() []net.IPAddr {
+	if len(c.Addresses) > 0 {
+		return c.Addresses
+	}
+	if c.Address != nil {
+		return []net.IPAddr{{IP: c.Address}}
+	}
+	return nil
+}
+
+// dial opens a TCP connection to a port on the device, falling back to the
+// other addresses if the preferred one does not answer.
+func (c *Config) dial(ctx context.Context, port int) (net.Conn, error) {
+	return dialAddresses(ctx, c.connectAddresses(), port)
+}
+
+// bindContext makes blocking reads and writes on conn fail once ctx is done.
+// The returned function must be called when the operation is over, it clears
+// the deadline again.
+func bindContext(ctx context.Context, conn net.Conn) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stopAfter := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	return func() {
+		stopAfter()
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// connectionError wraps an I/O error on an established connection. Errors
+// caused by ctx are reported as timeouts.
+func connectionError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %v", ErrOperationTimeout, ctx.Err())
+	}
+	return fmt.Errorf("%w: %v", ErrConnectionLost, err)
+}
+
+// bufferedConn is a connection that reads through a buffered reader, which
+// may hold data that was received before.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,87 @@
+package pyatv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMergeAddresses(t *testing.T) {
+	v4old := net.IPAddr{IP: net.ParseIP("10.0.0.2")}
+	v4new := net.IPAddr{IP: net.ParseIP("10.0.0.3")}
+	v6 := net.IPAddr{IP: net.ParseIP("fe80::2"), Zone: "eth0"}
+
+	tests := []struct {
+		family   AddressFamily
+		seen     []net.IPAddr
+		known    []net.IPAddr
+		expected []net.IPAddr
+	}{
+		{AddressFamilyAny, []net.IPAddr{v6, v4new}, []net.IPAddr{v4old}, []net.IPAddr{v4new, v4old, v6}},
+		{AddressFamilyPreferIPv6, []net.IPAddr{v4new}, []net.IPAddr{v4old, v6}, []net.IPAddr{v6, v4new, v4old}},
+		{AddressFamilyIPv4, []net.IPAddr{v6, v4new}, nil, []net.IPAddr{v4new}},
+		{AddressFamilyIPv6, []net.IPAddr{v6, v4new}, nil, []net.IPAddr{v6}},
+		{AddressFamilyAny, []net.IPAddr{v4old}, []net.IPAddr{v4old}, []net.IPAddr{v4old}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.family.String(), func(t *testing.T) {
+			got := mergeAddresses(tt.family, tt.seen, tt.known)
+			if len(got) != len(tt.expected) {
+				t.Fatalf("Expected %v, got %v", tt.expected, got)
+			}
+			for i := range got {
+				if !got[i].IP.Equal(tt.expected[i].IP) || got[i].Zone != tt.expected[i].Zone {
+					t.Errorf("Expected %v, got %v", tt.expected, got)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestDialAddressesFallback(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	// Nothing listens on 127.0.0.2, so the second address has to be used
+	addresses := []net.IPAddr{{IP: net.ParseIP("127.0.0.2")}, {IP: net.ParseIP("127.0.0.1")}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := dialAddresses(ctx, addresses, port)
+	if err != nil {
+		t.Fatalf("dialAddresses() error = %v", err)
+	}
+	defer conn.Close()
+
+	if remote := conn.RemoteAddr().(*net.TCPAddr); !remote.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("Expected connection to 127.0.0.1, got %s", remote.IP)
+	}
+}
+
+func TestDialAddressesAllFail(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	_, err = dialAddresses(context.Background(), []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, port)
+	if !errors.Is(err, ErrConnectionFailed) {
+		t.Errorf("Expected ErrConnectionFailed, got %v", err)
+	}
+
+	_, err = dialAddresses(context.Background(), nil, port)
+	if !errors.Is(err, ErrConnectionFailed) {
+		t.Errorf("Expected ErrConnectionFailed without addresses, got %v", err)
+	}
+}
@@ -0,0 +1,377 @@
+// Package opack encodes and decodes OPACK, the binary serialization format
+// used by the Companion protocol.
+//
+// Values map to Go types as follows: nil, bool, int64 (integers up to 2^63-1),
+// uint64 (larger integers), float64, string, []byte, UUID, []any and
+// map[string]any. Decoding resolves references to earlier objects, encoding
+// never produces them.
+package opack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ErrMalformed is returned when data is not valid OPACK.
+var ErrMalformed = errors.New("malformed OPACK data")
+
+// ErrUnsupported is returned when a value can not be encoded.
+var ErrUnsupported = errors.New("unsupported OPACK type")
+
+// UUID is a 16 byte UUID value.
+type UUID [16]byte
+
+// Marshal encodes a value to OPACK.
+func Marshal(value any) ([]byte, error) {
+	return appendValue(nil, value)
+}
+
+func appendValue(data []byte, value any) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return append(data, 0x04), nil
+	case bool:
+		if v {
+			return append(data, 0x01), nil
+		}
+		return append(data, 0x02), nil
+	case UUID:
+		return append(append(data, 0x05), v[:]...), nil
+	case int:
+		return appendInt(data, int64(v))
+	case int32:
+		return appendInt(data, int64(v))
+	case int64:
+		return appendInt(data, v)
+	case uint8:
+		return appendUint(data, uint64(v)), nil
+	case uint32:
+		return appendUint(data, uint64(v)), nil
+	case uint64:
+		return appendUint(data, v), nil
+	case float64:
+		data = append(data, 0x36)
+		return binary.LittleEndian.AppendUint64(data, math.Float64bits(v)), nil
+	case string:
+		return appendSized(data, 0x40, 0x61, []byte(v)), nil
+	case []byte:
+		return appendSized(data, 0x70, 0x91, v), nil
+	case []any:
+		data = appendCount(data, 0xD0, len(v))
+		for _, item := range v {
+			var err error
+			if data, err = appendValue(data, item); err != nil {
+				return nil, err
+			}
+		}
+		return appendTerminator(data, len(v)), nil
+	case map[string]any:
+		// Keys are sorted to make the output deterministic
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		data = appendCount(data, 0xE0, len(v))
+		for _, key := range keys {
+			data = appendSized(data, 0x40, 0x61, []byte(key))
+			var err error
+			if data, err = appendValue(data, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return appendTerminator(data, len(v)), nil
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupported, value)
+	}
+}
+
+func appendInt(data []byte, value int64) ([]byte, error) {
+	if value < 0 {
+		return nil, fmt.Errorf("%w: negative integer %d", ErrUnsupported, value)
+	}
+	return appendUint(data, uint64(value)), nil
+}
+
+func appendUint(data []byte, value uint64) []byte {
+	switch {
+	case value < 0x28:
+		return append(data, byte(value)+0x08)
+	case value <= math.MaxUint8:
+		return append(data, 0x30, byte(value))
+	case value <= math.MaxUint16:
+		return binary.LittleEndian.AppendUint16(append(data, 0x31), uint16(value))
+	case value <= math.MaxUint32:
+		return binary.LittleEndian.AppendUint32(append(data, 0x32), uint32(value))
+	default:
+		return binary.LittleEndian.AppendUint64(append(data, 0x33), value)
+	}
+}
+
+// appendSized appends a string or data value. Short values have their length
+// in the tag, longer ones a little endian length after it.
+func appendSized(data []byte, shortTag, longTag byte, value []byte) []byte {
+	size := len(value)
+	switch {
+	case size <= 0x20:
+		data = append(data, shortTag+byte(size))
+	case size <= math.MaxUint8:
+		data = append(data, longTag, byte(size))
+	case size <= math.MaxUint16:
+		data = binary.LittleEndian.AppendUint16(append(data, longTag+1), uint16(size))
+	case longTag == 0x61 && size <= 0xFFFFFF:
+		// Strings have a three byte length where data does not
+		data = append(data, longTag+2, byte(size), byte(size>>8), byte(size>>16))
+	case longTag == 0x61:
+		data = binary.LittleEndian.AppendUint32(append(data, longTag+3), uint32(size))
+	default:
+		data = binary.LittleEndian.AppendUint32(append(data, longTag+2), uint32(size))
+	}
+	return append(data, value...)
+}
+
+// appendCount appends the tag of a list or dictionary. Collections with 15 or
+// more items are terminated instead of counted.
+func appendCount(data []byte, tag byte, count int) []byte {
+	return append(data, tag+byte(min(count, 0xF)))
+}
+
+func appendTerminator(data []byte, count int) []byte {
+	if count >= 0xF {
+		return append(data, 0x03)
+	}
+	return data
+}
+
+// Unmarshal decodes an OPACK value. Trailing data is an error.
+func Unmarshal(data []byte) (any, error) {
+	d := &decoder{data: data}
+	value, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrMalformed, len(d.data)-d.pos)
+	}
+	return value, nil
+}
+
+// UnmarshalMap decodes an OPACK dictionary, which is what Companion messages
+// consist of.
+func UnmarshalMap(data []byte) (map[string]any, error) {
+	value, err := Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected dictionary, got %T", ErrMalformed, value)
+	}
+	return dict, nil
+}
+
+type decoder struct {
+	data    []byte
+	pos     int
+	objects []any // Previously decoded objects that can be referenced
+}
+
+func (d *decoder) take(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, fmt.Errorf("%w: need %d bytes at offset %d", ErrMalformed, n, d.pos)
+	}
+	value := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return value, nil
+}
+
+// uint reads a little endian integer of n bytes.
+func (d *decoder) uint(n int) (uint64, error) {
+	raw, err := d.take(n)
+	if err != nil {
+		return 0, err
+	}
+	var buf [8]byte
+	copy(buf[:], raw)
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+func (d *decoder) value() (any, error) {
+	raw, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	tag := raw[0]
+
+	switch {
+	case tag == 0x01:
+		return true, nil
+	case tag == 0x02:
+		return false, nil
+	case tag == 0x04:
+		return nil, nil
+	case tag >= 0x08 && tag <= 0x2F:
+		return int64(tag - 0x08), nil
+	case tag >= 0xA0 && tag <= 0xC0:
+		return d.reference(int(tag - 0xA0))
+	case tag >= 0xC1 && tag <= 0xC4:
+		index, err := d.uint(int(tag - 0xC0))
+		if err != nil {
+			return nil, err
+		}
+		return d.reference(int(index))
+	case tag&0xF0 == 0xD0:
+		return d.list(int(tag & 0x0F))
+	case tag&0xF0 == 0xE0:
+		return d.dict(int(tag & 0x0F))
+	}
+
+	value, err := d.object(tag)
+	if err != nil {
+		return nil, err
+	}
+	d.remember(value)
+	return value, nil
+}
+
+// remember makes a decoded object available for references. Like the encoder
+// on Apple devices, an object that is already known is not added again.
+func (d *decoder) remember(value any) {
+	for _, known := range d.objects {
+		if equal(known, value) {
+			return
+		}
+	}
+	d.objects = append(d.objects, value)
+}
+
+func equal(a, b any) bool {
+	if x, ok := a.([]byte); ok {
+		y, ok := b.([]byte)
+		return ok && bytes.Equal(x, y)
+	}
+	if _, ok := b.([]byte); ok {
+		return false
+	}
+	return a == b
+}
+
+// object decodes values that can be referenced later on.
+func (d *decoder) object(tag byte) (any, error) {
+	switch {
+	case tag == 0x05:
+		raw, err := d.take(16)
+		if err != nil {
+			return nil, err
+		}
+		return UUID(raw), nil
+	case tag == 0x06:
+		// Absolute time, only supported as an integer
+		value, err := d.uint(8)
+		return int64(value), err
+	case tag >= 0x30 && tag <= 0x33:
+		value, err := d.uint(1 << (tag & 0x0F))
+		if err != nil {
+			return nil, err
+		}
+		if value > math.MaxInt64 {
+			return value, nil
+		}
+		return int64(value), nil
+	case tag == 0x35:
+		value, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(value))), err
+	case tag == 0x36:
+		value, err := d.uint(8)
+		return math.Float64frombits(value), err
+	case tag >= 0x40 && tag <= 0x60:
+		raw, err := d.take(int(tag - 0x40))
+		return string(raw), err
+	case tag >= 0x61 && tag <= 0x64:
+		size, err := d.uint(int(tag - 0x60))
+		if err != nil {
+			return nil, err
+		}
+		raw, err := d.take(int(size))
+		return string(raw), err
+	case tag >= 0x70 && tag <= 0x90:
+		raw, err := d.take(int(tag - 0x70))
+		return append([]byte{}, raw...), err
+	case tag >= 0x91 && tag <= 0x94:
+		size, err := d.uint(1 << (tag - 0x91))
+		if err != nil {
+			return nil, err
+		}
+		raw, err := d.take(int(size))
+		return append([]byte{}, raw...), err
+	default:
+		return nil, fmt.Errorf("%w: unknown tag 0x%02x at offset %d", ErrMalformed, tag, d.pos-1)
+	}
+}
+
+func (d *decoder) reference(index int) (any, error) {
+	if index >= len(d.objects) {
+		return nil, fmt.Errorf("%w: reference to unknown object %d", ErrMalformed, index)
+	}
+	return d.objects[index], nil
+}
+
+// terminated returns true and skips the terminator if the next byte ends an
+// endless collection.
+func (d *decoder) terminated() (bool, error) {
+	if d.pos >= len(d.data) {
+		return false, fmt.Errorf("%w: unterminated collection", ErrMalformed)
+	}
+	if d.data[d.pos] == 0x03 {
+		d.pos++
+		return true, nil
+	}
+	return false, nil
+}
+
+func (d *decoder) list(count int) (any, error) {
+	list := []any{}
+	for i := 0; count == 0xF || i < count; i++ {
+		if count == 0xF {
+			if done, err := d.terminated(); err != nil || done {
+				return list, err
+			}
+		}
+		item, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+	return list, nil
+}
+
+func (d *decoder) dict(count int) (any, error) {
+	dict := map[string]any{}
+	for i := 0; count == 0xF || i < count; i++ {
+		if count == 0xF {
+			if done, err := d.terminated(); err != nil || done {
+				return dict, err
+			}
+		}
+		key, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: dictionary key of type %T", ErrMalformed, key)
+		}
+		value, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		dict[name] = value
+	}
+	return dict, nil
+}
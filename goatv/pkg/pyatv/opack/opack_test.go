@@ -0,0 +1,150 @@
+package opack
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    any
+		expected []byte
+	}{
+		{"true", true, []byte{0x01}},
+		{"false", false, []byte{0x02}},
+		{"nil", nil, []byte{0x04}},
+		{"small int", 0x27, []byte{0x2F}},
+		{"one byte int", 0x28, []byte{0x30, 0x28}},
+		{"two byte int", 0x1FF, []byte{0x31, 0xFF, 0x01}},
+		{"four byte int", 0x1FFFFFF, []byte{0x32, 0xFF, 0xFF, 0xFF, 0x01}},
+		{"eight byte int", uint64(0x1FFFFFFFFFFFFFF), []byte{0x33, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}},
+		{"float", 1.0, []byte{0x36, 0, 0, 0, 0, 0, 0, 0xF0, 0x3F}},
+		{"short string", "abc", []byte{0x43, 'a', 'b', 'c'}},
+		{"long string", strings.Repeat("a", 33), append([]byte{0x61, 0x21}, strings.Repeat("a", 33)...)},
+		{"short data", []byte{0x12, 0x34}, []byte{0x72, 0x12, 0x34}},
+		{"long data", bytes.Repeat([]byte{0x61}, 256), append([]byte{0x92, 0x00, 0x01}, bytes.Repeat([]byte{0x61}, 256)...)},
+		{"list", []any{1, "test", false}, []byte{0xD3, 0x09, 0x44, 't', 'e', 's', 't', 0x02}},
+		{"nested list", []any{[]any{true}}, []byte{0xD1, 0xD1, 0x01}},
+		{"dict", map[string]any{"a": 12}, []byte{0xE1, 0x41, 'a', 0x14}},
+		{"sorted dict", map[string]any{"b": 1, "a": 2}, []byte{0xE2, 0x41, 'a', 0x0A, 0x41, 'b', 0x09}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := Marshal(tt.value)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if !bytes.Equal(data, tt.expected) {
+				t.Errorf("Expected %x, got %x", tt.expected, data)
+			}
+		})
+	}
+}
+
+func TestMarshalEndlessList(t *testing.T) {
+	list := make([]any, 15)
+	for i := range list {
+		list[i] = true
+	}
+
+	data, err := Marshal(list)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	expected := append(append([]byte{0xDF}, bytes.Repeat([]byte{0x01}, 15)...), 0x03)
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Expected %x, got %x", expected, data)
+	}
+}
+
+func TestMarshalUnsupported(t *testing.T) {
+	for _, value := range []any{struct{}{}, -1, map[int]any{}} {
+		if _, err := Marshal(value); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("Expected ErrUnsupported for %T, got %v", value, err)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected any
+	}{
+		{"bool", []byte{0x01}, true},
+		{"nil", []byte{0x04}, nil},
+		{"uuid", append([]byte{0x05}, bytes.Repeat([]byte{0x12}, 16)...), UUID(bytes.Repeat([]byte{0x12}, 16))},
+		{"absolute time", []byte{0x06, 1, 0, 0, 0, 0, 0, 0, 0}, int64(1)},
+		{"small int", []byte{0x17}, int64(0xF)},
+		{"sized int", []byte{0x31, 0x01, 0x00}, int64(1)},
+		{"huge int", []byte{0x33, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, uint64(0xFFFFFFFFFFFFFFFF)},
+		{"float32", []byte{0x35, 0x00, 0x00, 0x80, 0x3F}, 1.0},
+		{"string", []byte{0x61, 0x03, 'a', 'b', 'c'}, "abc"},
+		{"data", []byte{0x91, 0x02, 0xAC, 0xDC}, []byte{0xAC, 0xDC}},
+		{"endless list", []byte{0xDF, 0x09, 0x0A, 0x03}, []any{int64(1), int64(2)}},
+		{"endless dict", []byte{0xEF, 0x41, 'a', 0x09, 0x03}, map[string]any{"a": int64(1)}},
+		{"reference", []byte{0xD3, 0x41, 'a', 0x41, 'b', 0xA1}, []any{"a", "b", "b"}},
+		{"long reference", []byte{0xD2, 0x41, 'a', 0xC1, 0x00}, []any{"a", "a"}},
+		{"repeated object", []byte{0xD4, 0x41, 'a', 0x41, 'a', 0x41, 'b', 0xA1}, []any{"a", "a", "b", "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := Unmarshal(tt.data)
+			if err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(value, tt.expected) {
+				t.Errorf("Expected %#v, got %#v", tt.expected, value)
+			}
+		})
+	}
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	tests := [][]byte{
+		{},
+		{0x43, 'a'},
+		{0xE1, 0x09, 0x09},
+		{0xDF, 0x09},
+		{0xA0},
+		{0x00},
+		{0x09, 0x09},
+	}
+
+	for _, data := range tests {
+		if _, err := Unmarshal(data); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Expected ErrMalformed for %x, got %v", data, err)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	message := map[string]any{
+		"_pd":   bytes.Repeat([]byte{0x42}, 300),
+		"_pwTy": int64(1),
+		"_x":    int64(123456),
+		"_c":    map[string]any{"name": "Living Room", "list": []any{true, nil}},
+	}
+
+	data, err := Marshal(message)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	decoded, err := UnmarshalMap(data)
+	if err != nil {
+		t.Fatalf("UnmarshalMap() error = %v", err)
+	}
+	if !reflect.DeepEqual(decoded, message) {
+		t.Errorf("Expected %v, got %v", message, decoded)
+	}
+
+	if _, err := UnmarshalMap([]byte{0x09}); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Expected ErrMalformed for non-dictionary, got %v", err)
+	}
+}
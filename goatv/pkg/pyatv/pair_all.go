@@ -0,0 +1,123 @@
+package pyatv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// pairAllPollInterval is how often PairAll checks if a device that was given
+// the PIN by the user has paired.
+const pairAllPollInterval = 500 * time.Millisecond
+
+// PinPrompt asks the user for the PIN of a service. It is called once the
+// device shows the PIN, or before pairing starts if the user must enter a PIN
+// of their choice on the device, like with DMAP.
+type PinPrompt func(ctx context.Context, service *Service) (string, error)
+
+// PairAllOptions contains options for PairAll.
+type PairAllOptions struct {
+	PairOptions
+	// IncludeOptional also pairs services where pairing is optional. MRP is
+	// always paired, since Connect cannot use it without credentials.
+	IncludeOptional bool
+}
+
+// PairResult is the outcome of pairing a service.
+type PairResult struct {
+	Service *Service
+	Err     error // Nil if the service was paired
+}
+
+// PairAll pairs every enabled service that needs pairing and has no
+// credentials yet, one after the other, asking for each PIN with prompt. The
+// credentials are saved to PairOptions.Storage as every service is paired.
+// It returns the result for every service it tried, and an error joining all
+// failures.
+func PairAll(ctx context.Context, config *Config, prompt PinPrompt, opts PairAllOptions) ([]PairResult, error) {
+	var results []PairResult
+	var errs []error
+	for _, service := range config.Services {
+		if !pairAllNeeded(service, opts.IncludeOptional) {
+			continue
+		}
+
+		err := pairService(ctx, config, service, prompt, opts.PairOptions)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", service.Protocol, err))
+		}
+		results = append(results, PairResult{Service: service, Err: err})
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// pairAllNeeded returns true if PairAll should pair a service.
+func pairAllNeeded(service *Service, includeOptional bool) bool {
+	if !service.Enabled || service.Credentials != "" {
+		return false
+	}
+	switch service.Pairing {
+	case PairingRequirementMandatory:
+		return true
+	case PairingRequirementOptional:
+		// Connect needs MRP credentials for remote control and metadata
+		return includeOptional || service.Protocol == ProtocolMRP
+	default:
+		return false
+	}
+}
+
+// pairService runs a pairing handler for a service from start to finish.
+func pairService(ctx context.Context, config *Config, service *Service, prompt PinPrompt, opts PairOptions) error {
+	handler, err := Pair(ctx, config, service.Protocol, opts)
+	if err != nil {
+		return err
+	}
+	defer handler.Close()
+
+	if !handler.DeviceProvidesPin() {
+		pin, err := prompt(ctx, service)
+		if err != nil {
+			return err
+		}
+		handler.Pin(pin)
+		if err := handler.Begin(ctx); err != nil {
+			return err
+		}
+		if err := waitForPairing(ctx, handler); err != nil {
+			return err
+		}
+		return handler.Finish(ctx)
+	}
+
+	if err := handler.Begin(ctx); err != nil {
+		return err
+	}
+	pin, err := prompt(ctx, service)
+	if err != nil {
+		return err
+	}
+	handler.Pin(pin)
+	return handler.Finish(ctx)
+}
+
+// waitForPairing waits until the device has called back after the user
+// entered the PIN on it.
+func waitForPairing(ctx context.Context, handler PairingHandler) error {
+	ticker := time.NewTicker(pairAllPollInterval)
+	defer ticker.Stop()
+
+	for !handler.HasPaired() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
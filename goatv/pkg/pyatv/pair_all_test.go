@@ -0,0 +1,148 @@
+package pyatv
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startPairAllDevice serves MRP and Companion, which must be paired, and
+// AirPlay, where pairing is optional.
+func startPairAllDevice(t *testing.T, server *HAPServer) *Config {
+	t.Helper()
+	config := startHAPServer(t, ProtocolMRP, server, echoConn)
+	for _, protocol := range []Protocol{ProtocolCompanion, ProtocolAirPlay} {
+		config.Services = append(config.Services, startHAPServer(t, protocol, server, echoConn).Services...)
+	}
+	for _, service := range config.Services {
+		service.Pairing = PairingRequirementMandatory
+	}
+	config.GetService(ProtocolAirPlay).Pairing = PairingRequirementOptional
+	return config
+}
+
+// testPrompt returns PINs by protocol and records what was asked for.
+type testPrompt struct {
+	mu    sync.Mutex
+	pins  map[Protocol]string
+	asked []Protocol
+}
+
+func (p *testPrompt) prompt(ctx context.Context, service *Service) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.asked = append(p.asked, service.Protocol)
+	pin, ok := p.pins[service.Protocol]
+	if !ok {
+		return "", errors.New("cancelled by user")
+	}
+	return pin, nil
+}
+
+func TestPairAll(t *testing.T) {
+	tests := []struct {
+		name            string
+		includeOptional bool
+		expected        []Protocol
+	}{
+		{"mandatory", false, []Protocol{ProtocolMRP, ProtocolCompanion}},
+		{"optional", true, []Protocol{ProtocolMRP, ProtocolCompanion, ProtocolAirPlay}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			config := startPairAllDevice(t, newTestHAPServer(t))
+			storage := NewMemoryStorage()
+			prompt := &testPrompt{pins: map[Protocol]string{ProtocolMRP: "1234", ProtocolCompanion: "1234", ProtocolAirPlay: "1234"}}
+
+			opts := PairAllOptions{PairOptions: PairOptions{Storage: storage}, IncludeOptional: tt.includeOptional}
+			results, err := PairAll(ctx, config, prompt.prompt, opts)
+			if err != nil {
+				t.Fatalf("PairAll() error = %v", err)
+			}
+			if len(results) != len(tt.expected) {
+				t.Fatalf("Expected %d results, got %v", len(tt.expected), results)
+			}
+			for i, protocol := range tt.expected {
+				if results[i].Service.Protocol != protocol || results[i].Err != nil {
+					t.Errorf("Expected %s to be paired, got %+v", protocol, results[i])
+				}
+				if prompt.asked[i] != protocol {
+					t.Errorf("Expected PIN prompt for %s, got %v", protocol, prompt.asked)
+				}
+			}
+
+			settings, _ := storage.GetSettings(ctx, config)
+			for _, service := range config.Services {
+				stored, _ := settings.Protocols.get(service.Protocol)[settingCredentials].(string)
+				if stored != service.Credentials {
+					t.Errorf("Expected %s credentials %q in storage, got %q", service.Protocol, service.Credentials, stored)
+				}
+			}
+			if paired := config.GetService(ProtocolAirPlay).Credentials != ""; paired != tt.includeOptional {
+				t.Errorf("Expected AirPlay paired to be %v", tt.includeOptional)
+			}
+
+			// Nothing left to pair
+			if results, err := PairAll(ctx, config, prompt.prompt, opts); err != nil || len(results) != 0 {
+				t.Errorf("Expected nothing to pair, got %v: %v", results, err)
+			}
+		})
+	}
+}
+
+func TestPairAllFailures(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	config := startPairAllDevice(t, newTestHAPServer(t))
+	config.GetService(ProtocolAirPlay).Pairing = PairingRequirementMandatory
+	prompt := &testPrompt{pins: map[Protocol]string{ProtocolMRP: "4321", ProtocolAirPlay: "1234"}}
+
+	results, err := PairAll(ctx, config, prompt.prompt, PairAllOptions{})
+	if !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Expected ErrAuthentication, got %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %v", results)
+	}
+	if !errors.Is(results[0].Err, ErrAuthentication) {
+		t.Errorf("Expected wrong PIN for MRP, got %v", results[0].Err)
+	}
+	if results[1].Err == nil || config.GetService(ProtocolCompanion).Credentials != "" {
+		t.Errorf("Expected Companion to fail without a PIN, got %v", results[1].Err)
+	}
+	if results[2].Err != nil || config.GetService(ProtocolAirPlay).Credentials == "" {
+		t.Errorf("Expected AirPlay to be paired anyway, got %v", results[2].Err)
+	}
+}
+
+func TestPairAllNeeded(t *testing.T) {
+	tests := []struct {
+		name            string
+		service         Service
+		includeOptional bool
+		expected        bool
+	}{
+		{"mandatory", Service{Enabled: true, Pairing: PairingRequirementMandatory}, false, true},
+		{"optional", Service{Enabled: true, Pairing: PairingRequirementOptional}, false, false},
+		{"optional included", Service{Enabled: true, Pairing: PairingRequirementOptional}, true, true},
+		{"optional MRP", Service{Protocol: ProtocolMRP, Enabled: true, Pairing: PairingRequirementOptional}, false, true},
+		{"not needed", Service{Enabled: true, Pairing: PairingRequirementNotNeeded}, true, false},
+		{"disabled", Service{Pairing: PairingRequirementMandatory}, false, false},
+		{"paired", Service{Enabled: true, Pairing: PairingRequirementMandatory, Credentials: "x"}, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pairAllNeeded(&tt.service, tt.includeOptional); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
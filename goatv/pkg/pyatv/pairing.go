@@ -2,8 +2,14 @@ package pyatv
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
 )
 
+// defaultClientName is the name we show up with on devices.
+const defaultClientName = "goatv"
+
 // DefaultPairingHandler provides a default pairing implementation.
 type DefaultPairingHandler struct {
 	config   *Config
@@ -12,6 +18,16 @@ type DefaultPairingHandler struct {
 	opts     PairOptions
 	pin      string
 	paired   bool
+
+	transport pairingTransport
+	setup     pairSetup
+}
+
+// pairSetup is a pair-setup procedure. The device shows a PIN once it is
+// started, which is needed to finish it.
+type pairSetup interface {
+	start(ctx context.Context) error
+	finish(ctx context.Context, pin string) (*Credentials, error)
 }
 
 // NewPairingHandler creates a new pairing handler.
@@ -31,7 +47,12 @@ func (p *DefaultPairingHandler) Service() *Service {
 
 // Close releases resources.
 func (p *DefaultPairingHandler) Close() error {
-	return nil
+	if p.transport == nil {
+		return nil
+	}
+	err := p.transport.Close()
+	p.transport, p.setup = nil, nil
+	return err
 }
 
 // Pin sets the PIN code for pairing.
@@ -44,7 +65,7 @@ func (p *DefaultPairingHandler) DeviceProvidesPin() bool {
 	switch p.protocol {
 	case ProtocolMRP:
 		return true
-	case ProtocolAirPlay:
+	case ProtocolAirPlay, ProtocolRAOP:
 		return true
 	case ProtocolCompanion:
 		return true
@@ -58,20 +79,258 @@ func (p *DefaultPairingHandler) HasPaired() bool {
 	return p.paired
 }
 
-// Begin starts the pairing process.
+// Begin connects to the device and starts pair-setup, after which the device
+// shows a PIN.
 func (p *DefaultPairingHandler) Begin(ctx context.Context) error {
-	// TODO: Implement actual pairing logic for each protocol
-	return ErrNotSupported
+	if p.transport != nil {
+		return fmt.Errorf("%w: pairing already started", ErrInvalidState)
+	}
+
+	identity, err := resolveIdentity(ctx, p.config, p.opts)
+	if err != nil {
+		return err
+	}
+	transport, err := openPairingTransport(ctx, p.config, p.service, identity.clientID, identity.name)
+	if err != nil {
+		return err
+	}
+
+	setup, err := newPairSetup(transport, p.service, identity)
+	if err != nil {
+		transport.Close()
+		return err
+	}
+	if err := setup.start(ctx); err != nil {
+		transport.Close()
+		return err
+	}
+
+	p.transport, p.setup = transport, setup
+	return nil
 }
 
-// Finish completes the pairing process.
+// Finish completes pair-setup with the PIN. The new credentials are stored on
+// the service and saved to PairOptions.Storage if there is one.
 func (p *DefaultPairingHandler) Finish(ctx context.Context) error {
-	// TODO: Implement actual pairing finish logic
 	if p.pin == "" {
 		return ErrNoCredentials
 	}
+	if p.setup == nil {
+		return fmt.Errorf("%w: pairing not started", ErrInvalidState)
+	}
+	defer p.Close()
 
-	// TODO: Verify PIN and complete pairing
+	credentials, err := p.setup.finish(ctx, p.pin)
+	if err != nil {
+		return err
+	}
 	p.paired = true
+	return saveCredentials(ctx, p.config, p.service, credentials, p.opts.Storage)
+}
+
+// saveCredentials stores credentials on a service and saves them to storage
+// if there is one.
+func saveCredentials(ctx context.Context, config *Config, service *Service, credentials *Credentials, storage Storage) error {
+	service.Credentials = credentials.String()
+	if storage != nil {
+		if err := storage.UpdateSettings(ctx, config); err != nil {
+			return fmt.Errorf("%w: %v", ErrSettings, err)
+		}
+	}
 	return nil
 }
+
+// clearCredentials removes the credentials of a pairing from a service and
+// from storage if there is one. Credentials of other pairings are kept.
+func clearCredentials(ctx context.Context, config *Config, service *Service, clientID string, storage Storage) error {
+	if credentials, err := ParseCredentials(service.Credentials); err == nil && string(credentials.ClientID) == clientID {
+		service.Credentials = ""
+	}
+	if storage == nil {
+		return nil
+	}
+
+	settings, err := storage.GetSettings(ctx, config)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSettings, err)
+	}
+	values := settings.Protocols.get(service.Protocol)
+	if stored, ok := values[settingCredentials].(string); ok {
+		if credentials, err := ParseCredentials(stored); err == nil && string(credentials.ClientID) == clientID {
+			delete(values, settingCredentials)
+		}
+	}
+	if err := storage.Save(ctx); err != nil {
+		return fmt.Errorf("%w: %v", ErrSettings, err)
+	}
+	return nil
+}
+
+// controllerIdentity is who we are to a device: the name we are listed with,
+// our pairing identifier and our long-term key.
+type controllerIdentity struct {
+	name     string
+	clientID string
+	signer   ed25519.PrivateKey
+}
+
+// resolveIdentity fills in the identity PairOptions leaves out. Unless one is
+// given, the identifier and key of HAP credentials for another protocol of
+// the device are reused, so that we are the same controller everywhere.
+func resolveIdentity(ctx context.Context, config *Config, opts PairOptions) (*controllerIdentity, error) {
+	identity := &controllerIdentity{
+		name:     controllerName(ctx, config, opts.Name, opts.Storage),
+		clientID: opts.ClientID,
+		signer:   opts.PrivateKey,
+	}
+	if identity.signer != nil && len(identity.signer) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%w: expected %d byte private key, got %d", ErrInvalidConfig, ed25519.PrivateKeySize, len(identity.signer))
+	}
+
+	if identity.clientID == "" && identity.signer == nil {
+		for _, service := range config.Services {
+			credentials, err := ParseCredentials(service.Credentials)
+			if err == nil && credentials.Type == CredentialsHAP {
+				identity.clientID = string(credentials.ClientID)
+				identity.signer = ed25519.NewKeyFromSeed(credentials.LTSK)
+				return identity, nil
+			}
+		}
+	}
+
+	if identity.clientID == "" {
+		identity.clientID = newPairingID()
+	}
+	if identity.signer == nil {
+		_, signer, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		identity.signer = signer
+	}
+	return identity, nil
+}
+
+// controllerName returns name, or else the name in the stored settings of a
+// device, or else the default name.
+func controllerName(ctx context.Context, config *Config, name string, storage Storage) string {
+	if name != "" {
+		return name
+	}
+	if storage != nil {
+		if settings, err := storage.GetSettings(ctx, config); err == nil && settings.Info.Name != "" {
+			return settings.Info.Name
+		}
+	}
+	return defaultClientName
+}
+
+// newPairSetup picks the pair-setup procedure a service supports. Legacy
+// AirPlay pairing has an identity of its own.
+func newPairSetup(transport pairingTransport, service *Service, identity *controllerIdentity) (pairSetup, error) {
+	if airplay, ok := transport.(*airPlayPairingTransport); ok && legacyAirPlay(service) {
+		return newLegacyPairSetup(airplay)
+	}
+
+	// MRP gets our name from the DeviceInfoMessage instead
+	name := identity.name
+	if service.Protocol == ProtocolMRP {
+		name = ""
+	}
+	return newHAPPairSetupClient(transport, []byte(identity.clientID), identity.signer, name), nil
+}
+
+// openPairingTransport connects to a service and returns a transport for HAP
+// pairing messages. clientID is our pairing identifier, which MRP wants to
+// know up front along with our name.
+func openPairingTransport(ctx context.Context, config *Config, service *Service, clientID, name string) (pairingTransport, error) {
+	switch service.Protocol {
+	case ProtocolMRP, ProtocolAirPlay, ProtocolCompanion, ProtocolRAOP:
+	default:
+		return nil, fmt.Errorf("%w: HAP pairing over %s", ErrNotSupported, service.Protocol)
+	}
+	if service.Port == 0 {
+		return nil, fmt.Errorf("%w: no port for %s", ErrInvalidConfig, service.Protocol)
+	}
+
+	conn, err := config.dial(ctx, service.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	switch service.Protocol {
+	case ProtocolMRP:
+		transport, err := newMRPPairingTransport(ctx, conn, clientID, name)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return transport, nil
+	case ProtocolAirPlay, ProtocolRAOP:
+		// RAOP pairs like AirPlay on its own port
+		return newAirPlayPairingTransport(conn), nil
+	default:
+		return newCompanionPairingTransport(conn), nil
+	}
+}
+
+// verifyService connects to a service and runs pair-verify with its
+// credentials, introducing us with name where the protocol needs it. AirPlay
+// services without credentials that do not need pairing get transient
+// pair-setup instead. It returns nil if there is nothing to verify. Sessions
+// verified with legacy AirPlay credentials have no shared secret, since the
+// connection is not encrypted.
+func verifyService(ctx context.Context, config *Config, service *Service, name string) (*hapSession, error) {
+	credentials, err := ParseCredentials(service.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	if credentials.Type == CredentialsNone && transientPairing(service) {
+		credentials = &Credentials{Type: CredentialsTransient, LTPK: transientLTPK}
+	}
+
+	clientID := string(credentials.ClientID)
+	switch credentials.Type {
+	case CredentialsHAP:
+	case CredentialsLegacy, CredentialsTransient:
+		if service.Protocol != ProtocolAirPlay {
+			return nil, fmt.Errorf("%w: %s credentials for %s", ErrNotSupported, credentials.Type, service.Protocol)
+		}
+		clientID = newPairingID()
+	default:
+		return nil, nil
+	}
+
+	transport, err := openPairingTransport(ctx, config, service, clientID, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var secret *hapSharedSecret
+	switch credentials.Type {
+	case CredentialsLegacy:
+		err = legacyPairVerify(ctx, transport.(*airPlayPairingTransport), credentials)
+	case CredentialsTransient:
+		secret, err = hapTransientPairSetup(ctx, transport)
+	default:
+		secret, err = hapPairVerify(ctx, transport, credentials)
+	}
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	return &hapSession{transport: transport, secret: secret}, nil
+}
+
+// transientPairing returns true for AirPlay services that support HAP but do
+// not need to be paired, like HomePods.
+func transientPairing(service *Service) bool {
+	if service.Protocol != ProtocolAirPlay {
+		return false
+	}
+	if service.Pairing != PairingRequirementNotNeeded && service.Pairing != PairingRequirementOptional {
+		return false
+	}
+	features := service.Capabilities.Features
+	return features.Has(AirPlayFeatureSystemPairing) || features.Has(AirPlayFeatureCoreUtilsPairingAndEncryption)
+}
@@ -0,0 +1,164 @@
+package pyatv
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/tlv8"
+)
+
+// Pairing is a controller paired with a device.
+type Pairing struct {
+	Identifier string
+	PublicKey  ed25519.PublicKey
+	Admin      bool // Whether the controller may manage pairings
+}
+
+// hapPermissionAdmin is the permission bit of admin controllers.
+const hapPermissionAdmin = 0x01
+
+// hapPairingManager implements PairingManager with the HAP pairing requests
+// sent over a session verified with the credentials of the service.
+type hapPairingManager struct {
+	config      *Config
+	service     *Service
+	opts        PairOptions
+	credentials *Credentials
+
+	transport pairingTransport
+}
+
+func newHAPPairingManager(ctx context.Context, config *Config, service *Service, opts PairOptions) (*hapPairingManager, error) {
+	switch service.Protocol {
+	case ProtocolMRP, ProtocolAirPlay:
+	default:
+		return nil, fmt.Errorf("%w: managing pairings over %s", ErrNotSupported, service.Protocol)
+	}
+	credentials, err := ParseCredentials(service.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	if credentials.Type != CredentialsHAP {
+		return nil, fmt.Errorf("%w: %s needs HAP credentials to manage pairings", ErrNoCredentials, service.Protocol)
+	}
+
+	session, err := verifyService(ctx, config, service, controllerName(ctx, config, opts.Name, opts.Storage))
+	if err != nil {
+		return nil, err
+	}
+	transport, err := session.pairingsTransport(service.Protocol)
+	if err != nil {
+		session.transport.Close()
+		return nil, err
+	}
+	return &hapPairingManager{
+		config:      config,
+		service:     service,
+		opts:        opts,
+		credentials: credentials,
+		transport:   transport,
+	}, nil
+}
+
+// pairingsTransport returns a transport sending pairing requests over the
+// encrypted connection of the session, which must not be used afterwards.
+func (s *hapSession) pairingsTransport(protocol Protocol) (pairingTransport, error) {
+	info, err := sessionKeyInfo(protocol)
+	if err != nil {
+		return nil, err
+	}
+	output, input := s.secret.keys(info)
+	conn, err := newSessionConn(s.transport.stream(), protocol, output, input)
+	if err != nil {
+		return nil, err
+	}
+
+	switch protocol {
+	case ProtocolMRP:
+		// The device already knows who we are from pair-verify
+		return &mrpPairingTransport{conn: conn, reader: bufio.NewReader(conn)}, nil
+	case ProtocolAirPlay:
+		return newAirPlayPairingTransport(conn), nil
+	default:
+		return nil, fmt.Errorf("%w: managing pairings over %s", ErrNotSupported, protocol)
+	}
+}
+
+// Service returns the service pairings are managed on.
+func (m *hapPairingManager) Service() *Service {
+	return m.service
+}
+
+// Close disconnects from the device.
+func (m *hapPairingManager) Close() error {
+	if m.transport == nil {
+		return nil
+	}
+	err := m.transport.Close()
+	m.transport = nil
+	return err
+}
+
+// Pairings lists the controllers paired with the device, which only admin
+// controllers may do.
+func (m *hapPairingManager) Pairings(ctx context.Context) ([]Pairing, error) {
+	if m.transport == nil {
+		return nil, fmt.Errorf("%w: pairing manager closed", ErrInvalidState)
+	}
+	resp, err := exchangePairing(ctx, m.transport, exchangePairings, tlv8.Items{
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M1)),
+		tlv8.Uint(tlv8.TagMethod, uint64(tlv8.MethodListPairings)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups := resp.Split()
+	if _, ok := resp.Get(tlv8.TagIdentifier); !ok && len(groups) == 1 {
+		return nil, nil
+	}
+
+	var pairings []Pairing
+	for _, items := range groups {
+		values, err := requireItems(items, tlv8.TagIdentifier, tlv8.TagPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		permissions, _ := items.Uint(tlv8.TagPermissions)
+		pairings = append(pairings, Pairing{
+			Identifier: string(values[0]),
+			PublicKey:  values[1],
+			Admin:      permissions&hapPermissionAdmin != 0,
+		})
+	}
+	return pairings, nil
+}
+
+// RemovePairing revokes the pairing of a controller. Our credentials are
+// removed from the service and storage if it is our own pairing, after which
+// the device closes the connection.
+func (m *hapPairingManager) RemovePairing(ctx context.Context, identifier string) error {
+	if m.transport == nil {
+		return fmt.Errorf("%w: pairing manager closed", ErrInvalidState)
+	}
+	if _, err := exchangePairing(ctx, m.transport, exchangePairings, tlv8.Items{
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M1)),
+		tlv8.Uint(tlv8.TagMethod, uint64(tlv8.MethodRemovePairing)),
+		tlv8.String(tlv8.TagIdentifier, identifier),
+	}); err != nil {
+		return err
+	}
+
+	if identifier != string(m.credentials.ClientID) {
+		return nil
+	}
+	m.Close()
+	return clearCredentials(ctx, m.config, m.service, identifier, m.opts.Storage)
+}
+
+// Unpair revokes our own pairing.
+func (m *hapPairingManager) Unpair(ctx context.Context) error {
+	return m.RemovePairing(ctx, string(m.credentials.ClientID))
+}
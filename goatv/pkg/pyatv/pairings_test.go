@@ -0,0 +1,197 @@
+package pyatv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alexjsteffen/goatv/pkg/pyatv/mrp"
+	"github.com/alexjsteffen/goatv/pkg/pyatv/tlv8"
+)
+
+// servePairings answers pairings requests from a verified client like a
+// device does.
+func servePairings(server *HAPServer, protocol Protocol) func(net.Conn) {
+	return func(conn net.Conn) {
+		client := conn.(*HAPServerConn).Client()
+		reader := bufio.NewReader(conn)
+		for {
+			var err error
+			switch protocol {
+			case ProtocolMRP:
+				var msg *mrp.ProtocolMessage
+				if msg, err = readMRPMessage(reader); err != nil {
+					return
+				}
+				if msg.Type != mrp.TypeCryptoPairing {
+					continue
+				}
+				items, _ := tlv8.Decode(server.HandlePairings(client, msg.CryptoPairing.PairingData))
+				err = writeMRPMessage(conn, mrpCryptoPairing(items, 0))
+			default:
+				var req *http.Request
+				if req, err = http.ReadRequest(reader); err != nil {
+					return
+				}
+				data, _ := io.ReadAll(req.Body)
+				body := server.HandlePairings(client, data)
+				resp := &http.Response{
+					StatusCode:    http.StatusOK,
+					ProtoMajor:    1,
+					ProtoMinor:    1,
+					ContentLength: int64(len(body)),
+					Body:          io.NopCloser(bytes.NewReader(body)),
+				}
+				err = resp.Write(conn)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestManagePairings(t *testing.T) {
+	for _, protocol := range []Protocol{ProtocolMRP, ProtocolAirPlay} {
+		t.Run(protocol.String(), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			server := newTestHAPServer(t)
+			config := startHAPServer(t, protocol, server, servePairings(server, protocol))
+			storage := NewMemoryStorage()
+			opts := PairOptions{Storage: storage}
+			if err := pairTestAccessory(ctx, config, protocol, "1234", opts); err != nil {
+				t.Fatalf("Pairing failed: %v", err)
+			}
+			credentials, _ := ParseCredentials(config.GetService(protocol).Credentials)
+			other := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+			server.AddClient("other", other)
+
+			manager, err := ManagePairings(ctx, config, protocol, opts)
+			if err != nil {
+				t.Fatalf("ManagePairings() error = %v", err)
+			}
+			defer manager.Close()
+
+			pairings, err := manager.Pairings(ctx)
+			if err != nil {
+				t.Fatalf("Pairings() error = %v", err)
+			}
+			if len(pairings) != 2 {
+				t.Fatalf("Expected 2 pairings, got %v", pairings)
+			}
+			found := false
+			for _, pairing := range pairings {
+				if pairing.Identifier == "other" && (!bytes.Equal(pairing.PublicKey, other) || !pairing.Admin) {
+					t.Errorf("Unexpected pairing %+v", pairing)
+				}
+				found = found || pairing.Identifier == string(credentials.ClientID)
+			}
+			if !found {
+				t.Errorf("Expected our pairing %q in %v", credentials.ClientID, pairings)
+			}
+
+			if err := manager.RemovePairing(ctx, "other"); err != nil {
+				t.Fatalf("RemovePairing() error = %v", err)
+			}
+			if _, ok := server.Clients()["other"]; ok {
+				t.Error("Expected other pairing to be removed")
+			}
+			if config.GetService(protocol).Credentials == "" {
+				t.Error("Expected our credentials to be kept")
+			}
+
+			if err := manager.Unpair(ctx); err != nil {
+				t.Fatalf("Unpair() error = %v", err)
+			}
+			if clients := server.Clients(); len(clients) != 0 {
+				t.Errorf("Expected no pairings left, got %v", clients)
+			}
+			if got := config.GetService(protocol).Credentials; got != "" {
+				t.Errorf("Expected credentials to be removed, got %q", got)
+			}
+			settings, _ := storage.GetSettings(ctx, config)
+			if _, ok := settings.Protocols.get(protocol)[settingCredentials]; ok {
+				t.Error("Expected credentials to be removed from storage")
+			}
+			if _, err := manager.Pairings(ctx); !errors.Is(err, ErrInvalidState) {
+				t.Errorf("Expected ErrInvalidState after unpairing, got %v", err)
+			}
+		})
+	}
+}
+
+func TestManagePairingsNotPaired(t *testing.T) {
+	config := &Config{
+		Address: net.ParseIP("127.0.0.1"),
+		Services: []*Service{
+			{Protocol: ProtocolMRP, Port: 1, Enabled: true},
+			{Protocol: ProtocolCompanion, Port: 1, Enabled: true},
+		},
+	}
+
+	if _, err := ManagePairings(context.Background(), config, ProtocolMRP, PairOptions{}); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Expected ErrNoCredentials, got %v", err)
+	}
+	if _, err := ManagePairings(context.Background(), config, ProtocolCompanion, PairOptions{}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Expected ErrNotSupported, got %v", err)
+	}
+	if _, err := ManagePairings(context.Background(), config, ProtocolAirPlay, PairOptions{}); !errors.Is(err, ErrNoService) {
+		t.Errorf("Expected ErrNoService, got %v", err)
+	}
+}
+
+func TestHAPServerPairingsRequireAdmin(t *testing.T) {
+	server := newTestHAPServer(t)
+	key := func(b byte) ed25519.PublicKey {
+		return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{b}, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+	}
+	server.AddClient("admin", key(1))
+	add := func(client, identifier string, ltpk ed25519.PublicKey, permissions uint64) tlv8.Items {
+		resp, _ := tlv8.Decode(server.HandlePairings(client, tlv8.Encode(
+			tlv8.Uint(tlv8.TagState, uint64(tlv8.M1)),
+			tlv8.Uint(tlv8.TagMethod, uint64(tlv8.MethodAddPairing)),
+			tlv8.String(tlv8.TagIdentifier, identifier),
+			tlv8.Bytes(tlv8.TagPublicKey, ltpk),
+			tlv8.Uint(tlv8.TagPermissions, permissions),
+		)))
+		return resp
+	}
+
+	if resp := add("admin", "user", key(2), 0); len(resp) != 1 {
+		t.Fatalf("Expected admin to add a pairing, got %v", resp)
+	}
+	for _, client := range []string{"user", "", "stranger"} {
+		resp := add(client, client+"-key", key(3), hapPermissionAdmin)
+		if code, _ := resp.Uint(tlv8.TagError); code != uint64(tlv8.ErrorAuthentication) {
+			t.Errorf("Expected %q to be rejected, got %v", client, resp)
+		}
+	}
+	if clients := server.Clients(); len(clients) != 2 {
+		t.Errorf("Expected admin and user to be paired, got %v", clients)
+	}
+
+	resp, _ := tlv8.Decode(server.HandlePairings("admin", tlv8.Encode(
+		tlv8.Uint(tlv8.TagState, uint64(tlv8.M1)),
+		tlv8.Uint(tlv8.TagMethod, uint64(tlv8.MethodListPairings)),
+	)))
+	groups := resp.Split()
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 pairings, got %v", resp)
+	}
+	for _, items := range groups {
+		identifier, _ := items.Get(tlv8.TagIdentifier)
+		permissions, _ := items.Uint(tlv8.TagPermissions)
+		if admin := string(identifier) == "admin"; (permissions == hapPermissionAdmin) != admin {
+			t.Errorf("Unexpected permissions %d of %q", permissions, identifier)
+		}
+	}
+}
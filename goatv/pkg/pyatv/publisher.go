@@ -0,0 +1,193 @@
+package pyatv
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Published records are announced twice, one second apart, and answered with
+// the TTL recommended for host records in RFC 6762 section 10.
+const (
+	mdnsAnnouncements    = 2
+	mdnsAnnounceInterval = time.Second
+	mdnsRecordTTL        = 120
+)
+
+// mdnsService is a service instance announced by an mdnsPublisher. The
+// instance name doubles as host name, like python-zeroconf does.
+type mdnsService struct {
+	Type       string // Service type, e.g. "_touch-remote._tcp"
+	Name       string // Instance name
+	Address    net.IP
+	Port       int
+	Properties map[string]string
+}
+
+func (s *mdnsService) typeName() string {
+	return dns.Fqdn(s.Type + ".local")
+}
+
+func (s *mdnsService) instanceName() string {
+	return escapeDNS(s.Name) + "." + s.typeName()
+}
+
+// records returns the PTR, SRV, TXT and A records of the service.
+func (s *mdnsService) records(ttl uint32) []dns.RR {
+	header := func(name string, rrtype uint16, cacheFlush bool) dns.RR_Header {
+		class := uint16(dns.ClassINET)
+		if cacheFlush {
+			class |= 1 << 15
+		}
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: class, Ttl: ttl}
+	}
+
+	instance := s.instanceName()
+	var txt []string
+	for key, value := range s.Properties {
+		txt = append(txt, key+"="+value)
+	}
+	sort.Strings(txt)
+	records := []dns.RR{
+		&dns.PTR{Hdr: header(s.typeName(), dns.TypePTR, false), Ptr: instance},
+		&dns.SRV{Hdr: header(instance, dns.TypeSRV, true), Port: uint16(s.Port), Target: instance},
+		&dns.TXT{Hdr: header(instance, dns.TypeTXT, true), Txt: txt},
+	}
+	if ip := s.Address.To4(); ip != nil {
+		records = append(records, &dns.A{Hdr: header(instance, dns.TypeA, true), A: ip})
+	}
+	return records
+}
+
+// answers returns the records answering a question, or nil if the question
+// is not about this service. All records are needed to resolve the service,
+// so they are always sent together.
+func (s *mdnsService) answers(question dns.Question) []dns.RR {
+	name := strings.ToLower(question.Name)
+	if name != strings.ToLower(s.typeName()) && name != strings.ToLower(s.instanceName()) {
+		return nil
+	}
+	return s.records(mdnsRecordTTL)
+}
+
+// escapeDNS escapes an instance name to the presentation format used by the
+// dns package. It is the opposite of unescapeDNS.
+func escapeDNS(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ".", `\.`).Replace(s)
+}
+
+// mdnsPublisher announces services with mDNS on IPv4 and answers queries
+// for them until it is closed.
+type mdnsPublisher struct {
+	services []*mdnsService
+	ifaces   []net.Interface
+	socket   *mdnsSocket
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// publishMDNS starts announcing services on every interface in ifaces.
+func publishMDNS(services []*mdnsService, ifaces []net.Interface) (*mdnsPublisher, error) {
+	socket, err := listenMDNSv4(ifaces)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &mdnsPublisher{
+		services: services,
+		ifaces:   ifaces,
+		socket:   socket,
+		stop:     make(chan struct{}),
+	}
+	p.wg.Add(2)
+	go p.receive()
+	go p.announce()
+	return p, nil
+}
+
+// Close sends goodbye packets and stops answering queries.
+func (p *mdnsPublisher) Close() error {
+	close(p.stop)
+	p.send(p.response(0))
+	err := p.socket.conn.Close()
+	p.wg.Wait()
+	return err
+}
+
+func (p *mdnsPublisher) announce() {
+	defer p.wg.Done()
+	for i := 0; i < mdnsAnnouncements; i++ {
+		if i > 0 {
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(mdnsAnnounceInterval):
+			}
+		}
+		p.send(p.response(mdnsRecordTTL))
+	}
+}
+
+func (p *mdnsPublisher) receive() {
+	defer p.wg.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, _, _, err := p.socket.read(buf)
+		if err != nil {
+			return
+		}
+
+		query := new(dns.Msg)
+		if err := query.Unpack(buf[:n]); err != nil || query.Response {
+			continue
+		}
+
+		var answers []dns.RR
+		for _, question := range query.Question {
+			for _, service := range p.services {
+				answers = append(answers, service.answers(question)...)
+			}
+		}
+		if len(answers) > 0 {
+			msg := p.newResponse()
+			msg.Answer = dns.Dedup(answers, nil)
+			p.send(msg)
+		}
+	}
+}
+
+func (p *mdnsPublisher) newResponse() *dns.Msg {
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Authoritative = true
+	return msg
+}
+
+// response announces every service, or says goodbye with a zero TTL.
+func (p *mdnsPublisher) response(ttl uint32) *dns.Msg {
+	msg := p.newResponse()
+	for _, service := range p.services {
+		msg.Answer = append(msg.Answer, service.records(ttl)...)
+	}
+	return msg
+}
+
+// send multicasts a message on every interface. Failures are ignored, since
+// mDNS gives no guarantees anyway.
+func (p *mdnsPublisher) send(msg *dns.Msg) {
+	data, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	if len(p.ifaces) == 0 {
+		p.socket.send(data, nil)
+	}
+	for i := range p.ifaces {
+		p.socket.send(data, &p.ifaces[i])
+	}
+}
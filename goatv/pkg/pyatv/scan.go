@@ -2,39 +2,76 @@ package pyatv
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
 	"time"
 )
 
+// defaultScanTimeout is how long a scan and each unicast host query lasts
+// unless ScanOptions.Timeout says otherwise.
+const defaultScanTimeout = 5 * time.Second
+
 // ScanOptions contains options for scanning.
 type ScanOptions struct {
-	Timeout    time.Duration
-	Identifier string
-	Protocol   *Protocol
-	Hosts      []string
-	Storage    Storage
+	Timeout       time.Duration
+	Identifier    string
+	Protocol      *Protocol
+	Hosts         []string
+	Interfaces    []string         // Names of interfaces to scan on, all multicast capable ones if empty
+	AddressFamily AddressFamily    // IP versions to scan with and their order in Config.Addresses
+	Storage       Storage          // Settings are applied to and updated from found devices
+	Backend       DiscoveryBackend // Overrides the backend chosen from Hosts, Interfaces and AddressFamily
+	OnError       func(err error)  // Receives errors that do not stop the scan, e.g. an unreachable host
 }
 
 // DefaultScanOptions returns default scan options.
 func DefaultScanOptions() ScanOptions {
 	return ScanOptions{
-		Timeout: 5 * time.Second,
+		Timeout: defaultScanTimeout,
 	}
 }
 
 // Scan scans for Apple TVs on the network and returns their configurations.
 func Scan(ctx context.Context, opts ScanOptions) ([]*Config, error) {
 	if opts.Timeout == 0 {
-		opts.Timeout = 5 * time.Second
+		opts.Timeout = defaultScanTimeout
 	}
 
 	scanner := NewScanner(opts)
-	return scanner.Discover(ctx)
+	devices, err := scanner.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Storage != nil {
+		if err := applyStorage(ctx, opts.Storage, devices); err != nil {
+			return nil, err
+		}
+	}
+
+	return devices, nil
+}
+
+// applyStorage applies stored settings to devices and writes back whatever was
+// learned about them during the scan.
+func applyStorage(ctx context.Context, storage Storage, devices []*Config) error {
+	for _, config := range devices {
+		settings, err := storage.GetSettings(ctx, config)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrSettings, err)
+		}
+		config.ApplySettings(settings)
+
+		if err := storage.UpdateSettings(ctx, config); err != nil {
+			return fmt.Errorf("%w: %v", ErrSettings, err)
+		}
+	}
+	return nil
 }
 
 // ConnectOptions contains options for connecting.
 type ConnectOptions struct {
-	Protocol *Protocol
+	Protocol *Protocol // Only connect this protocol, also when nothing uses it
 	Storage  Storage
 }
 
@@ -60,6 +97,16 @@ func Connect(ctx context.Context, config *Config, opts ConnectOptions) (AppleTV,
 // PairOptions contains options for pairing.
 type PairOptions struct {
 	Storage Storage
+
+	// Name is the controller name shown on the device. Defaults to
+	// InfoSettings.Name in Storage, or goatv if there is none.
+	Name string
+	// ClientID is our pairing identifier. Defaults to the one we paired other
+	// protocols of the device with, or a new one.
+	ClientID string
+	// PrivateKey is our long-term Ed25519 key. Defaults to the one we paired
+	// other protocols of the device with, or a new one.
+	PrivateKey ed25519.PrivateKey
 }
 
 // Pair initiates pairing with a device for a specific protocol.
@@ -69,6 +116,20 @@ func Pair(ctx context.Context, config *Config, protocol Protocol, opts PairOptio
 		return nil, fmt.Errorf("%w: no service available for %s", ErrNoService, protocol)
 	}
 
+	if protocol == ProtocolDMAP {
+		return newDMAPPairingHandler(ctx, config, service, opts)
+	}
 	handler := NewPairingHandler(config, service, protocol, opts)
 	return handler, nil
 }
+
+// ManagePairings connects to a paired service and returns a manager for the
+// pairings of the device. Credentials removed with it are also removed from
+// PairOptions.Storage.
+func ManagePairings(ctx context.Context, config *Config, protocol Protocol, opts PairOptions) (PairingManager, error) {
+	service := config.GetService(protocol)
+	if service == nil {
+		return nil, fmt.Errorf("%w: no service available for %s", ErrNoService, protocol)
+	}
+	return newHAPPairingManager(ctx, config, service, opts)
+}
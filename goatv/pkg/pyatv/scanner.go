@@ -2,13 +2,10 @@ package pyatv
 
 import (
 	"context"
-	"fmt"
 	"net"
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/hashicorp/mdns"
 )
 
 // ServiceInfo contains information about a discovered service.
@@ -23,16 +20,36 @@ type ServiceInfo struct {
 
 // Scanner discovers Apple TV devices on the network.
 type Scanner struct {
-	opts    ScanOptions
-	devices map[string]*Config
-	mu      sync.Mutex
+	opts       ScanOptions
+	devices    map[string]*Config
+	identities map[string]string // Identity key to device key
+	watched    map[string]*watchedService
+	reported   map[string]*reportedDevice
+	merged     []*Config // Reported devices merged into others, not yet reported as gone
+	mu         sync.Mutex
+}
+
+// watchedService tracks when a service seen by Watch expires.
+type watchedService struct {
+	device   string
+	protocol Protocol
+	expires  time.Time
+}
+
+// WatchEvent describes a change to a device reported by Scanner.Watch.
+type WatchEvent struct {
+	Type   WatchEventType
+	Config *Config
 }
 
 // NewScanner creates a new scanner with the given options.
 func NewScanner(opts ScanOptions) *Scanner {
 	return &Scanner{
-		opts:    opts,
-		devices: make(map[string]*Config),
+		opts:       opts,
+		devices:    make(map[string]*Config),
+		identities: make(map[string]string),
+		watched:    make(map[string]*watchedService),
+		reported:   make(map[string]*reportedDevice),
 	}
 }
 
@@ -47,30 +64,101 @@ const (
 
 // Discover discovers devices on the network.
 func (s *Scanner) Discover(ctx context.Context) ([]*Config, error) {
-	timeout := s.opts.Timeout
-	if timeout == 0 {
-		timeout = 5 * time.Second
-	}
-
 	// Create context with timeout
-	ctx, cancel := context.WithTimeout(ctx, timeout)
+	ctx, cancel := context.WithTimeout(ctx, s.timeout())
 	defer cancel()
 
-	// Channel to receive discovered entries
-	entriesCh := make(chan *mdns.ServiceEntry, 100)
+	services := s.serviceTypes()
+
+	// Stop as soon as the requested device shows up
+	found := func(entry *ServiceEntry) {
+		s.handleEntry(entry)
+		if s.opts.Identifier != "" && s.identifierFound() {
+			cancel()
+		}
+	}
+
+	if err := s.backend(time.Second).Browse(ctx, services, found); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []*Config
+	for _, config := range s.devices {
+		if config.Ready() && s.matchesIdentifier(config) {
+			result = append(result, config)
+		}
+	}
+
+	return result, nil
+}
+
+// backend returns the discovery backend to use. Unless one was given in the
+// scan options, configured hosts are queried with unicast for up to the scan
+// timeout each and everything else uses multicast with queries capped at
+// maxInterval.
+func (s *Scanner) backend(maxInterval time.Duration) DiscoveryBackend {
+	switch {
+	case s.opts.Backend != nil:
+		return s.opts.Backend
+	case len(s.opts.Hosts) > 0:
+		return &UnicastBackend{Hosts: s.opts.Hosts, Timeout: s.timeout(), OnError: s.reportError}
+	default:
+		return &MulticastBackend{
+			Interfaces:       s.opts.Interfaces,
+			AddressFamily:    s.opts.AddressFamily,
+			MaxQueryInterval: maxInterval,
+		}
+	}
+}
+
+// timeout returns ScanOptions.Timeout, or the default if it is not set.
+func (s *Scanner) timeout() time.Duration {
+	if s.opts.Timeout == 0 {
+		return defaultScanTimeout
+	}
+	return s.opts.Timeout
+}
+
+// reportError passes errors that do not stop scanning to ScanOptions.OnError.
+func (s *Scanner) reportError(err error) {
+	if s.opts.OnError != nil {
+		s.opts.OnError(err)
+	}
+}
 
-	var wg sync.WaitGroup
+// identifierFound returns true once the device in ScanOptions.Identifier has
+// been found.
+func (s *Scanner) identifierFound() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Start goroutine to process entries
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for entry := range entriesCh {
-			s.handleEntry(entry)
+	for _, config := range s.devices {
+		if config.Ready() && s.matchesIdentifier(config) {
+			return true
 		}
-	}()
+	}
+	return false
+}
 
-	// Scan for all service types
+// matchesIdentifier returns true if a config matches ScanOptions.Identifier, or
+// if no identifier was requested.
+func (s *Scanner) matchesIdentifier(config *Config) bool {
+	if s.opts.Identifier == "" {
+		return true
+	}
+	for _, id := range config.AllIdentifiers() {
+		if id == s.opts.Identifier {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceTypes returns the service types to scan for.
+func (s *Scanner) serviceTypes() []string {
 	serviceTypes := []struct {
 		Type     string
 		Protocol Protocol
@@ -82,74 +170,32 @@ func (s *Scanner) Discover(ctx context.Context) ([]*Config, error) {
 		{ServiceTypeCompanion, ProtocolCompanion},
 	}
 
+	var services []string
 	for _, st := range serviceTypes {
 		// Skip if a specific protocol is requested and this isn't it
 		if s.opts.Protocol != nil && *s.opts.Protocol != st.Protocol {
 			continue
 		}
-
-		params := mdns.DefaultParams(st.Type)
-		params.Entries = entriesCh
-		params.Timeout = timeout
-		params.WantUnicastResponse = true
-
-		// If specific hosts are requested, do unicast queries
-		if len(s.opts.Hosts) > 0 {
-			for _, host := range s.opts.Hosts {
-				ip := net.ParseIP(host)
-				if ip != nil {
-					// Unicast query to specific host
-					params.WantUnicastResponse = true
-				}
-			}
-		}
-
-		err := mdns.Query(params)
-		if err != nil && !strings.Contains(err.Error(), "no such host") {
-			// Log error but continue scanning other services
-			fmt.Printf("Warning: failed to query %s: %v\n", st.Type, err)
-		}
-	}
-
-	// Close channel and wait for processing to complete
-	close(entriesCh)
-	wg.Wait()
-
-	// Filter by identifier if specified
-	var result []*Config
-	for _, config := range s.devices {
-		if !config.Ready() {
-			continue
-		}
-
-		if s.opts.Identifier != "" {
-			found := false
-			for _, id := range config.AllIdentifiers() {
-				if id == s.opts.Identifier {
-					found = true
-					break
-				}
-			}
-			if !found {
-				continue
-			}
-		}
-
-		result = append(result, config)
+		services = append(services, st.Type)
 	}
-
-	return result, nil
+	return services
 }
 
 // handleEntry processes a discovered mDNS service entry.
-func (s *Scanner) handleEntry(entry *mdns.ServiceEntry) {
+func (s *Scanner) handleEntry(entry *ServiceEntry) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.addEntry(entry)
+}
+
+// addEntry merges an entry into its device config and returns the device key,
+// or an empty string if the entry was ignored. Must be called with s.mu held.
+func (s *Scanner) addEntry(entry *ServiceEntry) string {
 	// Extract protocol from service name
 	protocol := s.getProtocolFromService(entry.Name)
 	if protocol == 0 {
-		return
+		return ""
 	}
 
 	// Parse TXT records
@@ -163,22 +209,33 @@ func (s *Scanner) handleEntry(entry *mdns.ServiceEntry) {
 		}
 	}
 
-	// Get or create device config
-	deviceKey := s.getDeviceKey(entry, txtRecords)
+	// Get or create device config, services of the same device are tied
+	// together by the identifiers they announce
+	ids, identities := entryIdentifiers(protocol, s.extractName(entry.Name), txtRecords)
+	deviceKey := s.findDevice(entry, identities)
 	config, exists := s.devices[deviceKey]
 	if !exists {
 		config = &Config{
-			Address:    entry.AddrV4,
 			Name:       s.extractName(entry.Name),
 			Services:   make([]*Service, 0),
 			Properties: make(map[string]map[string]string),
 			DeviceInfo: &DeviceInfo{},
 		}
-		if entry.AddrV4 == nil && entry.AddrV6 != nil {
-			config.Address = entry.AddrV6
-		}
 		s.devices[deviceKey] = config
 	}
+	for _, ident := range identities {
+		s.identities[ident.key()] = deviceKey
+	}
+	for _, id := range ids {
+		config.setIdentifier(id)
+	}
+
+	// Follow the device if it moves to a new address, but remember the old
+	// ones as fallback
+	config.Addresses = mergeAddresses(s.opts.AddressFamily, entry.Addresses, config.Addresses)
+	if len(config.Addresses) > 0 {
+		config.Address = config.Addresses[0].IP
+	}
 
 	// Update device name if not set
 	if config.Name == "" {
@@ -195,11 +252,25 @@ func (s *Scanner) handleEntry(entry *mdns.ServiceEntry) {
 		Port:       entry.Port,
 		Properties: txtRecords,
 		Enabled:    true,
-		Pairing:    s.getPairingRequirement(txtRecords, protocol),
 	}
 
-	// Add or update service
+	// Add or update service, the port may change between announcements but
+	// sleep proxies announce port 0
 	config.AddService(service)
+	stored := config.GetService(protocol)
+	if entry.Port != 0 {
+		stored.Port = entry.Port
+	}
+
+	// A sleep proxy only answers while the device itself is asleep, which
+	// any of the services of the device may tell
+	stored.deepSleep = entry.DeepSleep
+	config.DeepSleep = false
+	for _, other := range config.Services {
+		config.DeepSleep = config.DeepSleep || other.deepSleep
+	}
+	stored.Capabilities = parseCapabilities(protocol, stored.Properties)
+	updateServiceDetails(config)
 
 	// Update config identifier
 	if config.Identifier == "" && service.Identifier != "" {
@@ -208,6 +279,8 @@ func (s *Scanner) handleEntry(entry *mdns.ServiceEntry) {
 
 	// Store properties for this service type
 	config.Properties[s.getServiceTypeForProtocol(protocol)] = txtRecords
+
+	return deviceKey
 }
 
 func (s *Scanner) getProtocolFromService(name string) Protocol {
@@ -244,26 +317,6 @@ func (s *Scanner) getServiceTypeForProtocol(protocol Protocol) string {
 	}
 }
 
-func (s *Scanner) getDeviceKey(entry *mdns.ServiceEntry, txtRecords map[string]string) string {
-	// Try to use device ID from TXT records
-	if deviceID, ok := txtRecords["deviceid"]; ok {
-		return deviceID
-	}
-	if deviceID, ok := txtRecords["DeviceID"]; ok {
-		return deviceID
-	}
-
-	// Fall back to IP address
-	if entry.AddrV4 != nil {
-		return entry.AddrV4.String()
-	}
-	if entry.AddrV6 != nil {
-		return entry.AddrV6.String()
-	}
-
-	return entry.Name
-}
-
 func (s *Scanner) extractName(serviceName string) string {
 	// Service name format: "DeviceName._servicetype._tcp.local."
 	parts := strings.Split(serviceName, "._")
@@ -310,71 +363,79 @@ func (s *Scanner) extractIdentifier(txtRecords map[string]string, protocol Proto
 }
 
 func (s *Scanner) updateDeviceInfo(config *Config, txtRecords map[string]string, protocol Protocol) {
-	// Extract model info
-	if model, ok := txtRecords["model"]; ok {
-		config.DeviceInfo.RawModel = model
-		config.DeviceInfo.Model = s.parseModel(model)
+	info := config.DeviceInfo
+
+	// Each protocol announces different parts of the device info
+	var modelKey, versionKey string
+	osHint := OperatingSystemUnknown
+	switch protocol {
+	case ProtocolMRP:
+		if build, ok := txtValue(txtRecords, "SystemBuildVersion"); ok {
+			info.BuildNumber = build
+		}
+		if mac, ok := txtValue(txtRecords, "macAddress"); ok {
+			info.MAC = mac
+		}
+
+		// MRP has only been seen on devices running tvOS
+		osHint = OperatingSystemTvOS
+	case ProtocolAirPlay:
+		modelKey, versionKey = "model", "osvers"
+		if mac, ok := txtValue(txtRecords, "deviceid"); ok && strings.Contains(mac, ":") {
+			info.MAC = mac
+		}
+		if id, ok := txtValue(txtRecords, "psi"); ok {
+			info.OutputDeviceID = id
+		} else if id, ok := txtValue(txtRecords, "pi"); ok {
+			info.OutputDeviceID = id
+		}
+	case ProtocolRAOP:
+		modelKey, versionKey = "am", "ov"
+	case ProtocolCompanion:
+		modelKey = "rpMd"
+	case ProtocolDMAP:
+		osHint = OperatingSystemLegacy
 	}
 
-	// Extract OS version
-	if osv, ok := txtRecords["osvers"]; ok {
-		config.DeviceInfo.Version = osv
-		config.DeviceInfo.OperatingSystem = OperatingSystemTvOS
+	if raw, ok := txtValue(txtRecords, modelKey); modelKey != "" && ok {
+		info.RawModel = raw
+		if model := s.parseModel(raw); model != DeviceModelUnknown {
+			info.Model = model
+		}
+		if system := lookupOS(raw); system != OperatingSystemUnknown {
+			osHint = system
+		}
+	}
+	if version, ok := txtValue(txtRecords, versionKey); versionKey != "" && ok {
+		info.Version = version
 	}
 
-	// Extract build number
-	if build, ok := txtRecords["srcvers"]; ok {
-		config.DeviceInfo.BuildNumber = build
+	// The model is the most reliable source for the operating system
+	if system := modelOS(info.Model); system != OperatingSystemUnknown {
+		info.OperatingSystem = system
+	} else if info.OperatingSystem == OperatingSystemUnknown {
+		info.OperatingSystem = osHint
 	}
 
-	// Extract MAC address
-	if mac, ok := txtRecords["deviceid"]; ok {
-		if strings.Contains(mac, ":") {
-			config.DeviceInfo.MAC = mac
-		}
+	if info.Version == "" {
+		info.Version = lookupVersion(info.BuildNumber)
 	}
 }
 
+// parseModel returns the device model for a raw model identifier.
 func (s *Scanner) parseModel(model string) DeviceModel {
-	model = strings.ToLower(model)
-
-	switch {
-	case strings.Contains(model, "appletv3,1"):
-		return DeviceModelGen3
-	case strings.Contains(model, "appletv3,2"):
-		return DeviceModelGen3
-	case strings.Contains(model, "appletv5,3"):
-		return DeviceModelGen4
-	case strings.Contains(model, "appletv6,2"):
-		return DeviceModelGen4K
-	case strings.Contains(model, "appletv11,1"):
-		return DeviceModelAppleTV4KGen2
-	case strings.Contains(model, "appletv14,1"):
-		return DeviceModelAppleTV4KGen3
-	case strings.Contains(model, "homepod"):
-		if strings.Contains(model, "mini") {
-			return DeviceModelHomePodMini
-		}
-		return DeviceModelHomePod
-	case strings.Contains(model, "airport"):
-		return DeviceModelAirPortExpress
-	default:
-		return DeviceModelUnknown
-	}
+	return lookupModel(model)
 }
 
-func (s *Scanner) getPairingRequirement(txtRecords map[string]string, protocol Protocol) PairingRequirement {
-	switch protocol {
-	case ProtocolMRP:
-		return PairingRequirementMandatory
-	case ProtocolAirPlay:
-		if _, ok := txtRecords["sf"]; ok {
-			return PairingRequirementOptional
+// txtValue looks up a TXT key, ignoring case like DNS-SD does.
+func txtValue(txtRecords map[string]string, key string) (string, bool) {
+	if value, ok := txtRecords[key]; ok {
+		return value, true
+	}
+	for k, value := range txtRecords {
+		if strings.EqualFold(k, key) {
+			return value, true
 		}
-		return PairingRequirementNotNeeded
-	case ProtocolCompanion:
-		return PairingRequirementMandatory
-	default:
-		return PairingRequirementNotNeeded
 	}
+	return "", false
 }
@@ -0,0 +1,193 @@
+package pyatv
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Keys used in the per-protocol settings maps.
+const (
+	settingIdentifier  = "identifier"
+	settingCredentials = "credentials"
+	settingPassword    = "password"
+	settingDisabled    = "disabled"
+)
+
+// MemoryStorage is a Storage that keeps settings in memory only. Everything
+// stored in it is forgotten when the program exits.
+type MemoryStorage struct {
+	mu       sync.Mutex
+	settings []*Settings
+}
+
+// NewMemoryStorage creates an empty memory storage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+// Settings returns a copy of all stored settings.
+func (m *MemoryStorage) Settings() []Settings {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]Settings, len(m.settings))
+	for i, settings := range m.settings {
+		result[i] = *settings
+	}
+	return result
+}
+
+// Save does nothing since there is nowhere to save to.
+func (m *MemoryStorage) Save(ctx context.Context) error {
+	return nil
+}
+
+// Load does nothing since there is nowhere to load from.
+func (m *MemoryStorage) Load(ctx context.Context) error {
+	return nil
+}
+
+// GetSettings returns the settings of a device, matched on any of its service
+// identifiers. New settings are created if the device is not known yet. The
+// returned settings are owned by the storage and changes to them are kept.
+func (m *MemoryStorage) GetSettings(ctx context.Context, config *Config) (*Settings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.getSettings(config)
+}
+
+func (m *MemoryStorage) getSettings(config *Config) (*Settings, error) {
+	identifiers := config.AllIdentifiers()
+	if len(identifiers) == 0 {
+		return nil, fmt.Errorf("%w: no identifier for device %s", ErrDeviceIDMissing, config.Name)
+	}
+
+	for _, settings := range m.settings {
+		if settings.matches(identifiers) {
+			return settings, nil
+		}
+	}
+
+	settings := &Settings{}
+	settings.update(config)
+	m.settings = append(m.settings, settings)
+	return settings, nil
+}
+
+// RemoveSettings removes settings previously returned by GetSettings.
+func (m *MemoryStorage) RemoveSettings(ctx context.Context, settings *Settings) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, stored := range m.settings {
+		if stored == settings {
+			m.settings = append(m.settings[:i], m.settings[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// UpdateSettings writes identifiers, credentials, passwords and device info
+// from a config back to its settings.
+func (m *MemoryStorage) UpdateSettings(ctx context.Context, config *Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	settings, err := m.getSettings(config)
+	if err != nil {
+		return err
+	}
+	settings.update(config)
+	return nil
+}
+
+// matches returns true if any protocol in the settings has one of identifiers.
+func (s *Settings) matches(identifiers []string) bool {
+	for _, protocol := range []Protocol{ProtocolAirPlay, ProtocolCompanion, ProtocolDMAP, ProtocolMRP, ProtocolRAOP} {
+		stored, ok := s.Protocols.get(protocol)[settingIdentifier].(string)
+		if !ok || stored == "" {
+			continue
+		}
+		for _, id := range identifiers {
+			if id == stored {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// update copies what is known about a device into its settings. Empty values
+// never overwrite stored ones.
+func (s *Settings) update(config *Config) {
+	if s.Identifier == "" {
+		s.Identifier = config.Identifier
+	}
+	if config.Name != "" {
+		s.Name = config.Name
+	}
+	if config.DeviceInfo != nil && config.DeviceInfo.MAC != "" {
+		s.MAC = config.DeviceInfo.MAC
+	}
+
+	for _, service := range config.Services {
+		values := s.Protocols.get(service.Protocol)
+		if values == nil {
+			continue
+		}
+		if service.Identifier != "" {
+			values[settingIdentifier] = service.Identifier
+		}
+		if service.Credentials != "" {
+			values[settingCredentials] = service.Credentials
+		}
+		if service.Password != "" {
+			values[settingPassword] = service.Password
+		}
+	}
+}
+
+// get returns the settings of a protocol, creating them if needed.
+func (p *ProtocolSettings) get(protocol Protocol) map[string]interface{} {
+	var values *map[string]interface{}
+	switch protocol {
+	case ProtocolAirPlay:
+		values = &p.AirPlay
+	case ProtocolCompanion:
+		values = &p.Companion
+	case ProtocolDMAP:
+		values = &p.DMAP
+	case ProtocolMRP:
+		values = &p.MRP
+	case ProtocolRAOP:
+		values = &p.RAOP
+	default:
+		return nil
+	}
+
+	if *values == nil {
+		*values = make(map[string]interface{})
+	}
+	return *values
+}
+
+// ApplySettings copies stored credentials and passwords onto the services of
+// a config and disables services that are marked as disabled. Settings that
+// are missing leave the services unchanged.
+func (c *Config) ApplySettings(settings *Settings) {
+	for _, service := range c.Services {
+		values := settings.Protocols.get(service.Protocol)
+		if credentials, ok := values[settingCredentials].(string); ok && credentials != "" {
+			service.Credentials = credentials
+		}
+		if password, ok := values[settingPassword].(string); ok && password != "" {
+			service.Password = password
+		}
+		if disabled, ok := values[settingDisabled].(bool); ok {
+			service.Enabled = !disabled
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package pyatv
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func storageTestConfig() *Config {
+	return &Config{
+		Name:       "Living Room",
+		Identifier: "mrpid",
+		DeviceInfo: &DeviceInfo{MAC: "AA:BB:CC:DD:EE:FF"},
+		Services: []*Service{
+			{Identifier: "mrpid", Protocol: ProtocolMRP, Port: 49152, Enabled: true},
+			{Identifier: "AA:BB:CC:DD:EE:FF", Protocol: ProtocolAirPlay, Port: 7000, Enabled: true},
+		},
+	}
+}
+
+func TestApplyStorage(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+
+	settings, err := storage.GetSettings(ctx, storageTestConfig())
+	if err != nil {
+		t.Fatalf("GetSettings() error = %v", err)
+	}
+	settings.Protocols.MRP[settingCredentials] = "creds"
+	settings.Protocols.AirPlay[settingPassword] = "secret"
+	settings.Protocols.AirPlay[settingDisabled] = true
+
+	// A later scan finds the device under a new name
+	config := storageTestConfig()
+	config.Name = "Bedroom"
+	if err := applyStorage(ctx, storage, []*Config{config}); err != nil {
+		t.Fatalf("applyStorage() error = %v", err)
+	}
+
+	mrp, airplay := config.GetService(ProtocolMRP), config.GetService(ProtocolAirPlay)
+	if mrp.Credentials != "creds" {
+		t.Errorf("Expected credentials creds, got %q", mrp.Credentials)
+	}
+	if airplay.Password != "secret" {
+		t.Errorf("Expected password secret, got %q", airplay.Password)
+	}
+	if airplay.Enabled || !mrp.Enabled {
+		t.Errorf("Expected only AirPlay to be disabled, got MRP=%v AirPlay=%v", mrp.Enabled, airplay.Enabled)
+	}
+
+	stored := storage.Settings()
+	if len(stored) != 1 {
+		t.Fatalf("Expected 1 stored device, got %d", len(stored))
+	}
+	if stored[0].Name != "Bedroom" || stored[0].MAC != "AA:BB:CC:DD:EE:FF" {
+		t.Errorf("Expected updated info, got %q and %q", stored[0].Name, stored[0].MAC)
+	}
+	if stored[0].Info != (InfoSettings{}) {
+		t.Errorf("Expected no client info, got %+v", stored[0].Info)
+	}
+	if stored[0].Protocols.AirPlay[settingIdentifier] != "AA:BB:CC:DD:EE:FF" {
+		t.Errorf("Expected AirPlay identifier to be stored, got %v", stored[0].Protocols.AirPlay)
+	}
+}
+
+func TestMemoryStorageRemoveSettings(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+
+	if _, err := storage.GetSettings(ctx, &Config{Name: "Unknown"}); !errors.Is(err, ErrDeviceIDMissing) {
+		t.Errorf("Expected ErrDeviceIDMissing, got %v", err)
+	}
+
+	settings, _ := storage.GetSettings(ctx, storageTestConfig())
+	if removed, _ := storage.RemoveSettings(ctx, settings); !removed {
+		t.Error("Expected settings to be removed")
+	}
+	if removed, _ := storage.RemoveSettings(ctx, settings); removed {
+		t.Error("Expected settings to be gone already")
+	}
+	if len(storage.Settings()) != 0 {
+		t.Errorf("Expected empty storage, got %d", len(storage.Settings()))
+	}
+}
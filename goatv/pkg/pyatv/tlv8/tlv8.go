@@ -0,0 +1,312 @@
+// Package tlv8 encodes and decodes the TLV8 format used by HomeKit pairing.
+//
+// Values longer than 255 bytes are split into fragments with the same tag
+// when encoding and joined again when decoding. Items that repeat, like the
+// pairings in a list pairings response, are separated by TagSeparator.
+package tlv8
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrMalformed is returned when data is not valid TLV8.
+var ErrMalformed = errors.New("malformed TLV8 data")
+
+// maxFragment is the largest value a single item can hold.
+const maxFragment = 255
+
+// Tag identifies the type of an item.
+type Tag byte
+
+// Tags defined by the HomeKit Accessory Protocol.
+const (
+	TagMethod        Tag = 0x00
+	TagIdentifier    Tag = 0x01
+	TagSalt          Tag = 0x02
+	TagPublicKey     Tag = 0x03
+	TagProof         Tag = 0x04
+	TagEncryptedData Tag = 0x05
+	TagState         Tag = 0x06
+	TagError         Tag = 0x07
+	TagBackOff       Tag = 0x08
+	TagCertificate   Tag = 0x09
+	TagSignature     Tag = 0x0A
+	TagPermissions   Tag = 0x0B
+	TagFragmentData  Tag = 0x0C
+	TagFragmentLast  Tag = 0x0D
+
+	// Used by Apple devices but not part of the specification
+	TagName  Tag = 0x11
+	TagFlags Tag = 0x13
+
+	// TagSeparator separates repeated items of the same kind.
+	TagSeparator Tag = 0xFF
+)
+
+// String returns a string representation of the Tag.
+func (t Tag) String() string {
+	switch t {
+	case TagMethod:
+		return "Method"
+	case TagIdentifier:
+		return "Identifier"
+	case TagSalt:
+		return "Salt"
+	case TagPublicKey:
+		return "PublicKey"
+	case TagProof:
+		return "Proof"
+	case TagEncryptedData:
+		return "EncryptedData"
+	case TagState:
+		return "State"
+	case TagError:
+		return "Error"
+	case TagBackOff:
+		return "BackOff"
+	case TagCertificate:
+		return "Certificate"
+	case TagSignature:
+		return "Signature"
+	case TagPermissions:
+		return "Permissions"
+	case TagFragmentData:
+		return "FragmentData"
+	case TagFragmentLast:
+		return "FragmentLast"
+	case TagName:
+		return "Name"
+	case TagFlags:
+		return "Flags"
+	case TagSeparator:
+		return "Separator"
+	default:
+		return fmt.Sprintf("0x%02x", byte(t))
+	}
+}
+
+// Method is the value of TagMethod.
+type Method byte
+
+// Pairing methods.
+const (
+	MethodPairSetup         Method = 0x00
+	MethodPairSetupWithAuth Method = 0x01
+	MethodPairVerify        Method = 0x02
+	MethodAddPairing        Method = 0x03
+	MethodRemovePairing     Method = 0x04
+	MethodListPairings      Method = 0x05
+)
+
+// State is the value of TagState, the step in a pairing exchange.
+type State byte
+
+// Pairing states.
+const (
+	M1 State = 0x01
+	M2 State = 0x02
+	M3 State = 0x03
+	M4 State = 0x04
+	M5 State = 0x05
+	M6 State = 0x06
+)
+
+// ErrorCode is the value of TagError.
+type ErrorCode byte
+
+// Error codes sent by accessories.
+const (
+	ErrorUnknown        ErrorCode = 0x01
+	ErrorAuthentication ErrorCode = 0x02
+	ErrorBackOff        ErrorCode = 0x03
+	ErrorMaxPeers       ErrorCode = 0x04
+	ErrorMaxTries       ErrorCode = 0x05
+	ErrorUnavailable    ErrorCode = 0x06
+	ErrorBusy           ErrorCode = 0x07
+)
+
+// String returns a string representation of the ErrorCode.
+func (e ErrorCode) String() string {
+	switch e {
+	case ErrorUnknown:
+		return "Unknown"
+	case ErrorAuthentication:
+		return "Authentication"
+	case ErrorBackOff:
+		return "BackOff"
+	case ErrorMaxPeers:
+		return "MaxPeers"
+	case ErrorMaxTries:
+		return "MaxTries"
+	case ErrorUnavailable:
+		return "Unavailable"
+	case ErrorBusy:
+		return "Busy"
+	default:
+		return fmt.Sprintf("0x%02x", byte(e))
+	}
+}
+
+// Flag is a bit in the value of TagFlags.
+type Flag uint32
+
+// FlagTransientPairing requests a pairing that is not stored by the device.
+const FlagTransientPairing Flag = 0x10
+
+// Item is a single tag and its value.
+type Item struct {
+	Tag   Tag
+	Value []byte
+}
+
+// Bytes creates an item with a raw value.
+func Bytes(tag Tag, value []byte) Item {
+	return Item{Tag: tag, Value: value}
+}
+
+// String creates an item with a string value.
+func String(tag Tag, value string) Item {
+	return Item{Tag: tag, Value: []byte(value)}
+}
+
+// Uint creates an item with an integer value, encoded little endian in as
+// few bytes as possible.
+func Uint(tag Tag, value uint64) Item {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], value)
+
+	n := 1
+	for i := 7; i > 0; i-- {
+		if buf[i] != 0 {
+			n = i + 1
+			break
+		}
+	}
+	return Item{Tag: tag, Value: buf[:n]}
+}
+
+// Separator creates an item separating repeated items.
+func Separator() Item {
+	return Item{Tag: TagSeparator}
+}
+
+// Items is an ordered list of items.
+type Items []Item
+
+// Encode converts items to TLV8. Values longer than 255 bytes are split into
+// several fragments. Consecutive items with the same tag must be divided by a
+// separator, otherwise they are joined into one when decoded.
+func Encode(items ...Item) []byte {
+	var data []byte
+	for _, item := range items {
+		value := item.Value
+		for {
+			size := min(len(value), maxFragment)
+			data = append(data, byte(item.Tag), byte(size))
+			data = append(data, value[:size]...)
+			value = value[size:]
+			if len(value) == 0 {
+				break
+			}
+		}
+	}
+	return data
+}
+
+// Encode converts items to TLV8, see Encode.
+func (items Items) Encode() []byte {
+	return Encode(items...)
+}
+
+// Decode parses TLV8 data. Fragments of a value longer than 255 bytes are
+// joined into a single item.
+func Decode(data []byte) (Items, error) {
+	var items Items
+	continues := false
+	for pos := 0; pos < len(data); {
+		if pos+2 > len(data) {
+			return nil, fmt.Errorf("%w: truncated header at offset %d", ErrMalformed, pos)
+		}
+
+		tag, size := Tag(data[pos]), int(data[pos+1])
+		pos += 2
+		if pos+size > len(data) {
+			return nil, fmt.Errorf("%w: %s needs %d bytes at offset %d, only %d left",
+				ErrMalformed, tag, size, pos, len(data)-pos)
+		}
+		value := data[pos : pos+size]
+		pos += size
+
+		// A full fragment is continued by the next item if it has the same tag
+		if last := len(items) - 1; continues && items[last].Tag == tag {
+			items[last].Value = append(items[last].Value, value...)
+		} else {
+			items = append(items, Item{Tag: tag, Value: append([]byte{}, value...)})
+		}
+		continues = size == maxFragment
+	}
+	return items, nil
+}
+
+// Get returns the value of the first item with a tag.
+func (items Items) Get(tag Tag) ([]byte, bool) {
+	for _, item := range items {
+		if item.Tag == tag {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Uint returns the value of the first item with a tag as a little endian
+// integer. It returns false if there is no such item or if it does not fit.
+func (items Items) Uint(tag Tag) (uint64, bool) {
+	value, ok := items.Get(tag)
+	if !ok || len(value) == 0 || len(value) > 8 {
+		return 0, false
+	}
+
+	var buf [8]byte
+	copy(buf[:], value)
+	return binary.LittleEndian.Uint64(buf[:]), true
+}
+
+// Split divides items into groups at every separator.
+func (items Items) Split() []Items {
+	var groups []Items
+	var current Items
+	for _, item := range items {
+		if item.Tag == TagSeparator {
+			groups = append(groups, current)
+			current = nil
+			continue
+		}
+		current = append(current, item)
+	}
+	return append(groups, current)
+}
+
+// String summarizes items for logging. State, method, error and backoff are
+// shown with their values, everything else with its length.
+func (items Items) String() string {
+	parts := make([]string, 0, len(items))
+	for _, item := range items {
+		value, _ := Items{item}.Uint(item.Tag)
+		switch item.Tag {
+		case TagMethod:
+			parts = append(parts, fmt.Sprintf("%s=%d", item.Tag, value))
+		case TagState:
+			parts = append(parts, fmt.Sprintf("%s=M%d", item.Tag, value))
+		case TagError:
+			parts = append(parts, fmt.Sprintf("%s=%s", item.Tag, ErrorCode(value)))
+		case TagBackOff:
+			parts = append(parts, fmt.Sprintf("%s=%ds", item.Tag, value))
+		default:
+			parts = append(parts, fmt.Sprintf("%s=%dbytes", item.Tag, len(item.Value)))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
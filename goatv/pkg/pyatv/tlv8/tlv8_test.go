@@ -0,0 +1,113 @@
+package tlv8
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	data := Encode(Uint(TagState, uint64(M1)), Uint(TagMethod, uint64(MethodPairSetup)), String(TagIdentifier, "abc"))
+	expected := []byte{0x06, 0x01, 0x01, 0x00, 0x01, 0x00, 0x01, 0x03, 'a', 'b', 'c'}
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("Expected %x, got %x", expected, data)
+	}
+
+	items, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if state, ok := items.Uint(TagState); !ok || State(state) != M1 {
+		t.Errorf("Expected state M1, got %d", state)
+	}
+	if id, _ := items.Get(TagIdentifier); string(id) != "abc" {
+		t.Errorf("Expected identifier abc, got %q", id)
+	}
+}
+
+func TestFragments(t *testing.T) {
+	key := bytes.Repeat([]byte{0xAB}, 384)
+	data := Encode(Bytes(TagPublicKey, key), Bytes(TagSalt, []byte{1, 2}))
+
+	// 2+255, 2+129 and 2+2 bytes
+	if len(data) != 392 {
+		t.Fatalf("Expected 392 bytes, got %d", len(data))
+	}
+	if data[0] != byte(TagPublicKey) || data[1] != 255 || data[257] != byte(TagPublicKey) || data[258] != 129 {
+		t.Errorf("Unexpected fragment headers")
+	}
+
+	items, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("Expected 2 items, got %d", len(items))
+	}
+	if !bytes.Equal(items[0].Value, key) {
+		t.Errorf("Expected fragments to be joined, got %d bytes", len(items[0].Value))
+	}
+}
+
+func TestExactFragmentSize(t *testing.T) {
+	value := bytes.Repeat([]byte{1}, 255)
+	items, err := Decode(Encode(Bytes(TagProof, value), Bytes(TagSalt, nil)))
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if len(items) != 2 || len(items[0].Value) != 255 || len(items[1].Value) != 0 {
+		t.Errorf("Unexpected items %s", items)
+	}
+}
+
+func TestRepeatedItems(t *testing.T) {
+	data := Items{
+		String(TagIdentifier, "one"), Uint(TagPermissions, 1),
+		Separator(),
+		String(TagIdentifier, "two"), Uint(TagPermissions, 0),
+	}.Encode()
+
+	items, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	groups := items.Split()
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 groups, got %d", len(groups))
+	}
+	if id, _ := groups[1].Get(TagIdentifier); string(id) != "two" {
+		t.Errorf("Expected second identifier two, got %q", id)
+	}
+	if permissions, ok := groups[0].Uint(TagPermissions); !ok || permissions != 1 {
+		t.Errorf("Expected admin permissions, got %d", permissions)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, data := range [][]byte{{0x06}, {0x06, 0x02, 0x01}, {0x01, 0xFF}} {
+		if _, err := Decode(data); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Decode(%x) expected ErrMalformed, got %v", data, err)
+		}
+	}
+}
+
+func TestUint(t *testing.T) {
+	if item := Uint(TagBackOff, 300); !bytes.Equal(item.Value, []byte{0x2C, 0x01}) {
+		t.Errorf("Expected little endian 300, got %x", item.Value)
+	}
+	if item := Uint(TagState, 0); !bytes.Equal(item.Value, []byte{0}) {
+		t.Errorf("Expected single zero byte, got %x", item.Value)
+	}
+	if _, ok := (Items{Bytes(TagBackOff, make([]byte, 9))}).Uint(TagBackOff); ok {
+		t.Error("Expected too large value to be rejected")
+	}
+}
+
+func TestItemsString(t *testing.T) {
+	items := Items{Uint(TagState, 2), Uint(TagError, uint64(ErrorBackOff)), Uint(TagBackOff, 10), Bytes(TagSalt, make([]byte, 16))}
+	expected := "State=M2, Error=BackOff, BackOff=10s, Salt=16bytes"
+	if got := items.String(); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
@@ -0,0 +1,245 @@
+package pyatv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// watchQueryInterval caps how often Watch asks for services again.
+	watchQueryInterval = time.Minute
+
+	// watchSweepInterval is how often Watch looks for expired services.
+	watchSweepInterval = time.Second
+)
+
+// Watch continuously monitors the network and reports devices as they appear,
+// change and disappear. Changes are driven by mDNS announcements, queries that
+// are repeated in the background, record expiry and goodbye packets. If
+// ScanOptions.Hosts is set, those hosts are polled with unicast queries
+// instead. Backends that return are browsed again after a while, and errors
+// they return are passed to ScanOptions.OnError. The returned channel is
+// closed once ctx is done.
+func (s *Scanner) Watch(ctx context.Context) (<-chan WatchEvent, error) {
+	services := s.serviceTypes()
+	backend := s.backend(watchQueryInterval)
+
+	events := make(chan WatchEvent, 16)
+	found := func(entry *ServiceEntry) {
+		s.emit(ctx, events, s.watchEntry(entry, time.Now()))
+	}
+
+	go func() {
+		defer close(events)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if err := backend.Browse(ctx, services, found); err != nil {
+					s.reportError(err)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(watchQueryInterval):
+				}
+			}
+		}()
+
+		ticker := time.NewTicker(watchSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				wg.Wait()
+				return
+			case now := <-ticker.C:
+				s.emit(ctx, events, s.expire(now))
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+func (s *Scanner) emit(ctx context.Context, events chan<- WatchEvent, pending []WatchEvent) {
+	for _, event := range pending {
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchEntry merges an entry and returns the events it caused.
+func (s *Scanner) watchEntry(entry *ServiceEntry, now time.Time) []WatchEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.ToLower(entry.Name)
+	if entry.TTL == 0 {
+		watched, ok := s.watched[key]
+		if !ok {
+			return nil
+		}
+		delete(s.watched, key)
+		return s.removeService(watched)
+	}
+
+	device := s.addEntry(entry)
+	if device == "" {
+		return nil
+	}
+
+	var events []WatchEvent
+	for _, config := range s.merged {
+		events = append(events, WatchEvent{Type: WatchEventDeviceGone, Config: config.clone()})
+	}
+	s.merged = nil
+
+	s.watched[key] = &watchedService{
+		device:   device,
+		protocol: s.getProtocolFromService(entry.Name),
+		expires:  now.Add(entry.TTL),
+	}
+
+	config := s.devices[device]
+	if !config.Ready() {
+		return events
+	}
+
+	reported, ok := s.reported[device]
+	if !ok {
+		s.reported[device] = newReportedDevice(config)
+		return append(events, WatchEvent{Type: WatchEventDeviceAdded, Config: config.clone()})
+	}
+
+	if services := servicesSignature(config); services != reported.services {
+		reported.services = services
+		events = append(events, WatchEvent{Type: WatchEventServicesUpdated, Config: config.clone()})
+	}
+	if !config.Address.Equal(reported.address) {
+		reported.address = config.Address
+		events = append(events, WatchEvent{Type: WatchEventAddressChanged, Config: config.clone()})
+	}
+	return events
+}
+
+// expire removes all services whose records have not been refreshed in time.
+func (s *Scanner) expire(now time.Time) []WatchEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []WatchEvent
+	for key, watched := range s.watched {
+		if now.Before(watched.expires) {
+			continue
+		}
+		delete(s.watched, key)
+		events = append(events, s.removeService(watched)...)
+	}
+	return events
+}
+
+// removeService drops a service from its device, and the device itself once
+// no services remain. Must be called with s.mu held.
+func (s *Scanner) removeService(watched *watchedService) []WatchEvent {
+	config, ok := s.devices[watched.device]
+	if !ok {
+		return nil
+	}
+
+	// Another instance may still provide the same protocol for this device
+	for _, other := range s.watched {
+		if other.device == watched.device && other.protocol == watched.protocol {
+			return nil
+		}
+	}
+
+	for i, service := range config.Services {
+		if service.Protocol == watched.protocol {
+			config.Services = append(config.Services[:i], config.Services[i+1:]...)
+			break
+		}
+	}
+	delete(config.Properties, s.getServiceTypeForProtocol(watched.protocol))
+
+	reported, ok := s.reported[watched.device]
+	if len(config.Services) == 0 {
+		s.forgetDevice(watched.device)
+		if ok {
+			return []WatchEvent{{Type: WatchEventDeviceGone, Config: config.clone()}}
+		}
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	reported.services = servicesSignature(config)
+	return []WatchEvent{{Type: WatchEventServicesUpdated, Config: config.clone()}}
+}
+
+// reportedDevice is the device state last reported by Watch.
+type reportedDevice struct {
+	address  net.IP
+	services string
+}
+
+func newReportedDevice(config *Config) *reportedDevice {
+	return &reportedDevice{
+		address:  config.Address,
+		services: servicesSignature(config),
+	}
+}
+
+// servicesSignature summarizes the services of a config for change detection.
+func servicesSignature(config *Config) string {
+	var b strings.Builder
+	for _, service := range config.Services {
+		fmt.Fprint(&b, service.Protocol, service.Port, service.Properties, ";")
+	}
+	return b.String()
+}
+
+// clone returns a copy of a config that is safe to hand out while the scanner
+// keeps updating the original.
+func (c *Config) clone() *Config {
+	clone := *c
+	clone.Address = append(net.IP(nil), c.Address...)
+	clone.Addresses = append([]net.IPAddr(nil), c.Addresses...)
+	clone.Identifiers = append([]DeviceIdentifier(nil), c.Identifiers...)
+
+	clone.Services = make([]*Service, len(c.Services))
+	for i, service := range c.Services {
+		copied := *service
+		copied.Properties = copyProperties(service.Properties)
+		clone.Services[i] = &copied
+	}
+
+	clone.Properties = make(map[string]map[string]string, len(c.Properties))
+	for serviceType, properties := range c.Properties {
+		clone.Properties[serviceType] = copyProperties(properties)
+	}
+
+	if c.DeviceInfo != nil {
+		info := *c.DeviceInfo
+		clone.DeviceInfo = &info
+	}
+	return &clone
+}
+
+func copyProperties(properties map[string]string) map[string]string {
+	copied := make(map[string]string, len(properties))
+	for k, v := range properties {
+		copied[k] = v
+	}
+	return copied
+}
@@ -0,0 +1,117 @@
+package pyatv
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestScannerWatchEntryLifecycle(t *testing.T) {
+	scanner := NewScanner(ScanOptions{})
+	now := time.Now()
+
+	entry := &ServiceEntry{
+		Name:       "Living Room._airplay._tcp.local.",
+		Addresses:  []net.IPAddr{{IP: net.ParseIP("10.0.0.2")}},
+		Port:       7000,
+		InfoFields: []string{"deviceid=AA:BB:CC:DD:EE:FF"},
+		TTL:        120 * time.Second,
+	}
+
+	events := scanner.watchEntry(entry, now)
+	if len(events) != 1 || events[0].Type != WatchEventDeviceAdded {
+		t.Fatalf("Expected DeviceAdded, got %v", events)
+	}
+
+	// Same announcement again is not a change
+	if events := scanner.watchEntry(entry, now); len(events) != 0 {
+		t.Errorf("Expected no events for repeated announcement, got %v", events)
+	}
+
+	moved := *entry
+	moved.Addresses = []net.IPAddr{{IP: net.ParseIP("10.0.0.3")}}
+	events = scanner.watchEntry(&moved, now)
+	if len(events) != 1 || events[0].Type != WatchEventAddressChanged {
+		t.Fatalf("Expected AddressChanged, got %v", events)
+	}
+	if !events[0].Config.Address.Equal(net.ParseIP("10.0.0.3")) {
+		t.Errorf("Expected new address in event, got %s", events[0].Config.Address)
+	}
+
+	raop := &ServiceEntry{
+		Name:       "AABBCCDDEEFF@Living Room._raop._tcp.local.",
+		Addresses:  []net.IPAddr{{IP: net.ParseIP("10.0.0.3")}},
+		Port:       7000,
+		InfoFields: []string{"deviceid=AA:BB:CC:DD:EE:FF"},
+		TTL:        10 * time.Second,
+	}
+	events = scanner.watchEntry(raop, now)
+	if len(events) != 1 || events[0].Type != WatchEventServicesUpdated {
+		t.Fatalf("Expected ServicesUpdated, got %v", events)
+	}
+
+	// RAOP expires first, then the AirPlay goodbye removes the device
+	events = scanner.expire(now.Add(11 * time.Second))
+	if len(events) != 1 || events[0].Type != WatchEventServicesUpdated {
+		t.Fatalf("Expected ServicesUpdated on expiry, got %v", events)
+	}
+	if len(events[0].Config.Services) != 1 {
+		t.Errorf("Expected 1 remaining service, got %d", len(events[0].Config.Services))
+	}
+
+	goodbye := moved
+	goodbye.TTL = 0
+	events = scanner.watchEntry(&goodbye, now)
+	if len(events) != 1 || events[0].Type != WatchEventDeviceGone {
+		t.Fatalf("Expected DeviceGone, got %v", events)
+	}
+}
+
+func TestScannerBackendHostTimeout(t *testing.T) {
+	backend, ok := NewScanner(ScanOptions{Hosts: []string{"127.0.0.1"}}).backend(watchQueryInterval).(*UnicastBackend)
+	if !ok {
+		t.Fatal("Expected a unicast backend for configured hosts")
+	}
+	if backend.Timeout != defaultScanTimeout {
+		t.Errorf("Expected host timeout %s, got %s", defaultScanTimeout, backend.Timeout)
+	}
+}
+
+func TestWatchStopsQueryingUnresponsiveHost(t *testing.T) {
+	// A host that receives queries but never answers them
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	defer conn.Close()
+
+	timeout := 2 * unicastResend
+	backend := &UnicastBackend{
+		Hosts:   []string{"127.0.0.1"},
+		Port:    conn.LocalAddr().(*net.UDPAddr).Port,
+		Timeout: timeout,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 4*timeout)
+	defer cancel()
+	if _, err := NewScanner(ScanOptions{Backend: backend}).Watch(ctx); err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+
+	// Queries are resent until the host times out, then not for a while
+	buf := make([]byte, 65536)
+	start := time.Now()
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * unicastResend / 2))
+		if _, _, err := conn.ReadFromUDP(buf); err != nil {
+			break
+		}
+		if time.Since(start) > 2*timeout {
+			t.Fatal("Expected queries to stop once the host timed out")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("Expected queries for %s, stopped after %s", timeout, elapsed)
+	}
+}